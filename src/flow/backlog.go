@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// backlogThreshold is the largest backlog sent message by message.
+	backlogThreshold = 5
+	// backlogPageSize is the number of channel and topic groups per page.
+	backlogPageSize = 5
+
+	backlogCallbackPrefix = "backlog:"
+	backlogShowAll        = "all"
+	backlogDiscard        = "discard"
+)
+
+// takeBacklog moves the delayed messages of the user to the backlog. A
+// small backlog is removed and returned to be sent as is; otherwise the
+// whole backlog is returned with paged set and stays stored until the
+// user shows or discards it.
+func takeBacklog(user string) (messages []Message, paged bool, err error) {
+	if err := dataBase.moveToBacklog(user); err != nil {
+		return nil, false, err
+	}
+	if messages, err = dataBase.getBacklog(user); err != nil {
+		return nil, false, err
+	}
+	if len(messages) <= backlogThreshold {
+		messages, err = dataBase.popBacklog(user)
+		return messages, false, err
+	}
+	return messages, true, nil
+}
+
+// renderBacklogPage renders a compact summary of the given page of the
+// backlog and returns it with the number of pages. The page is clamped
+// to the existing ones.
+func renderBacklogPage(messages []Message, page int) (string, int) {
+	groups := groupDigest(messages)
+	pages := (len(groups) + backlogPageSize - 1) / backlogPageSize
+	if pages == 0 {
+		return "Накопившихся обновлений нет", 0
+	}
+	if page >= pages {
+		page = pages - 1
+	}
+	if page < 0 {
+		page = 0
+	}
+
+	str := strings.Builder{}
+	str.WriteString(fmt.Sprintf("Пока обновления были на паузе, накопилось уведомлений: %d, тем: %d\n\n",
+		len(messages), len(groups)))
+	end := (page + 1) * backlogPageSize
+	if end > len(groups) {
+		end = len(groups)
+	}
+	for _, group := range groups[page*backlogPageSize : end] {
+		latest := group.messages[len(group.messages)-1]
+		str.WriteString(fmt.Sprintf("%s %s [%s]: %d\n%s\n%s\n\n",
+			group.application, group.channel, group.topic, len(group.messages), latest.Summary, latest.Link))
+	}
+	str.WriteString(fmt.Sprintf("Страница %d из %d", page+1, pages))
+	return str.String(), pages
+}
+
+// showBacklog sends the whole backlog of the user grouped by channel and
+// topic and removes it once it is sent.
+func showBacklog(user string, send func(user, text string) error) error {
+	return dataBase.inTx(func(s LocalStorage) error {
+		messages, err := s.popBacklog(user)
+		if err != nil {
+			return err
+		}
+		return sendGrouped(s, user, messages, renderDigest(messages), send)
+	})
+}
+
+// discardBacklog removes the backlog of the user and returns its size.
+func discardBacklog(user string) (int, error) {
+	messages, err := dataBase.popBacklog(user)
+	return len(messages), err
+}
+
+// parseBacklogCallback parses the data of a backlog button: a page
+// number or one of backlogShowAll and backlogDiscard.
+func parseBacklogCallback(data string) (action string, page int, ok bool) {
+	action, ok = strings.CutPrefix(data, backlogCallbackPrefix)
+	if !ok {
+		return "", 0, false
+	}
+	if action == backlogShowAll || action == backlogDiscard {
+		return action, 0, true
+	}
+	page, err := strconv.Atoi(action)
+	if err != nil || page < 0 {
+		return "", 0, false
+	}
+	return "", page, true
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestRenderBacklogPage(t *testing.T) {
+	if _, pages := renderBacklogPage(nil, 0); pages != 0 {
+		t.Errorf("Empty backlog has %d pages", pages)
+	}
+
+	var messages []Message
+	for i := 0; i < 2*backlogPageSize+1; i++ {
+		for j := 0; j <= i; j++ {
+			messages = append(messages, Message{
+				Application: Telegram,
+				Channel:     fmt.Sprintf("channel%d", i),
+				Topic:       "x",
+				Summary:     fmt.Sprintf("summary%d-%d", i, j),
+				Link:        fmt.Sprintf("link%d-%d", i, j),
+			})
+		}
+	}
+
+	text, pages := renderBacklogPage(messages, 0)
+	if pages != 3 {
+		t.Fatalf("Got %d pages but answer is 3", pages)
+	}
+	for _, sub := range []string{"channel0 [x]: 1", "channel1 [x]: 2", "summary1-1", "link1-1", "Страница 1 из 3"} {
+		if !strings.Contains(text, sub) {
+			t.Errorf("Didn't find %s in %s", sub, text)
+		}
+	}
+	if strings.Contains(text, "summary1-0") || strings.Contains(text, fmt.Sprintf("channel%d ", backlogPageSize)) {
+		t.Errorf("Page contains more than it should: %s", text)
+	}
+
+	last, _ := renderBacklogPage(messages, 10)
+	for _, sub := range []string{fmt.Sprintf("channel%d ", 2*backlogPageSize), "Страница 3 из 3"} {
+		if !strings.Contains(last, sub) {
+			t.Errorf("Didn't find %s in %s", sub, last)
+		}
+	}
+}
+
+func TestParseBacklogCallback(t *testing.T) {
+	for _, tc := range []struct {
+		given  string
+		action string
+		page   int
+	}{
+		{"backlog:0", "", 0},
+		{"backlog:7", "", 7},
+		{"backlog:all", backlogShowAll, 0},
+		{"backlog:discard", backlogDiscard, 0},
+	} {
+		action, page, ok := parseBacklogCallback(tc.given)
+		if !ok || action != tc.action || page != tc.page {
+			t.Errorf("%q: got %q, %d, %t", tc.given, action, page, ok)
+		}
+	}
+
+	for _, given := range []string{"", "backlog:", "backlog:-1", "backlog:next", "page:1"} {
+		if _, _, ok := parseBacklogCallback(given); ok {
+			t.Errorf("No error in parsing: %q", given)
+		}
+	}
+}
@@ -1,5 +1,8 @@
 package main
 
+import "context"
+
 type UpdatesListener interface {
-	handleUpdates()
+	// handleUpdates handles the updates until ctx is done.
+	handleUpdates(ctx context.Context)
 }
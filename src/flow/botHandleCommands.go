@@ -1,8 +1,13 @@
 package main
 
 import (
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
 	"strconv"
 	"strings"
 
@@ -14,6 +19,18 @@ const (
 	unknownReply = "Я вас не понимаю, используйте /help для справки"
 )
 
+const (
+	forgetConfirmation = "confirm"
+	forgetReply        = "Все данные о вас удалены."
+)
+
+// userDataFileName is the name of the file with the exported user data.
+func userDataFileName(username string) string {
+	return fmt.Sprintf("topic-keeper-%s.json", username)
+}
+
+var subscriptionNotFoundError = errors.New("Подписка не найдена")
+
 func handleStart(username string) {
 	userId, err := dataBase.getID(username)
 	if err != nil {
@@ -37,13 +54,20 @@ func handleView(username string) {
 	for application, topicByChan := range totalInfo {
 		str.WriteString(fmt.Sprintf("%s:\n", application))
 		for ch, topics := range topicByChan {
-			str.WriteString(fmt.Sprintf(" %s:\n", ch))
+			str.WriteString(fmt.Sprintf(" %s:\n", channelName(application, ch)))
 			for _, topic := range topics {
 				str.WriteString(fmt.Sprintf("   - %s\n", topic))
 			}
 			str.WriteString("\n")
 		}
 	}
+	packs, err := dataBase.getPacks(username)
+	if err != nil {
+		log.Println(err.Error())
+		sendMessage(username, err.Error())
+		return
+	}
+	str.WriteString(formatPacks(packs))
 	ans := str.String()
 	if ans == "" {
 		ans = "Ничего не отслеживается"
@@ -58,233 +82,573 @@ func handleAdd(username string, msg string) {
 		sendMessage(username, "Неверное количество аргументов. Используйте /add <название канала> <ссылка/топик> <платформа>")
 		return
 	}
-	platform := elements[2]
-
-	if platform != "VK" && platform != "TG" {
-		sendMessage(username, "Неподдерживаемая платформа. Используйте 'VK' или 'TG'.")
+	channel, application, err := resolveChannel(elements[2], elements[0])
+	if err == nil {
+		err = checkAccess(username, application, channel)
+	}
+	if err != nil {
+		log.Println(err.Error())
+		sendMessage(username, err.Error())
 		return
 	}
-	if platform == "VK" {
-		after = strings.TrimSuffix(after, "VK")
-		handleAddVK(username, after)
-	} else {
-		after = strings.TrimSuffix(after, "TG")
-		handleAddTelegram(username, after)
+	if err := dataBase.addTopic(username, channel, elements[1], application); err != nil {
+		log.Println(err.Error())
+		sendMessage(username, err.Error())
+		return
 	}
+	sendMessage(username, "Топик добавлен!")
 }
 
-func handleAddTelegram(username string, msg string) {
-	concern, err := parseTopic(msg)
-	fmt.Println(concern)
+func handleRemoveTopic(username, msg string) {
+	after, _ := strings.CutPrefix(msg, "/remove")
+	elements := strings.Fields(after)
+
+	if len(elements) != 3 {
+		sendMessage(username, "Неверное количество аргументов. Используйте /remove <название канала> <ссылка/топик> <платформа>")
+		return
+	}
+	channel, application, err := resolveChannel(elements[2], elements[0])
 	if err != nil {
+		log.Println(err.Error())
 		sendMessage(username, err.Error())
 		return
 	}
-	if err := dataBase.addTopic(username, concern.Channel, concern.Topic, Telegram); err != nil {
+	if err := dataBase.removeTopic(username, channel, elements[1], application); err != nil {
+		log.Println(err.Error())
 		sendMessage(username, err.Error())
 		return
 	}
-	sendMessage(username, "Топик добавлен!")
+	sendMessage(username, "Топик удалён!")
 }
-func handleAddVK(username, text string) {
-	after := strings.TrimSpace(text)
-	link, topic, ok := strings.Cut(after, " ")
 
-	if !ok {
-		sendMessage(username, wrongFmtError.Error())
+func handleRemoveChannel(username, msg string) {
+	after, _ := strings.CutPrefix(msg, "/removeChannel")
+	elements := strings.Fields(after)
+
+	if len(elements) != 2 {
+		sendMessage(username, "Неверное количество аргументов. Используйте /removeChannel <название канала> <платформа>")
 		return
 	}
-
-	objectName, objectType, id, err := getVKInfo(link, vkToken)
+	channel, application, err := resolveChannel(elements[1], elements[0])
 	if err != nil {
 		log.Println(err.Error())
+		sendMessage(username, err.Error())
 		return
 	}
-
-	if objectType != "group" {
-		log.Println("Resolved object is not a group")
+	if err := dataBase.removeChannel(username, channel, application); err != nil {
+		log.Println(err.Error())
+		sendMessage(username, err.Error())
 		return
 	}
+	sendMessage(username, "Канал удалён!")
+}
 
-	groupID := fmt.Sprintf("%d", id)
+func handleCooldown(username, msg string) {
+	after, _ := strings.CutPrefix(msg, "/cooldown")
+	elements := strings.Fields(after)
+	if len(elements) != 4 {
+		sendMessage(username, "Неверное количество аргументов. Используйте /cooldown <название канала> <топик> <платформа> <none/минуты/day>")
+		return
+	}
 
-	topic = strings.TrimSpace(topic)
+	cooldown, err := parseCooldown(elements[3])
+	if err != nil {
+		sendMessage(username, err.Error())
+		return
+	}
+	channel, application, err := resolveChannel(elements[2], elements[0])
+	if err != nil {
+		sendMessage(username, err.Error())
+		return
+	}
 
-	if err := dataBase.addTopic(username, groupID, topic, VK); err != nil {
+	err = dataBase.setCooldown(username, channel, elements[1], application, cooldown)
+	if errors.Is(err, sql.ErrNoRows) {
+		sendMessage(username, subscriptionNotFoundError.Error())
+		return
+	}
+	if err != nil {
 		log.Println(err.Error())
+		sendMessage(username, err.Error())
 		return
 	}
+	sendMessage(username, "Задержка обновлена!")
+}
 
-	if err := dataBase.addVKPublic(objectName, groupID, 0); err != nil {
+func handleNotify(username, msg string) {
+	after, _ := strings.CutPrefix(msg, "/notify")
+	elements := strings.Fields(after)
+	if len(elements) < 4 {
+		sendMessage(username, "Неверное количество аргументов. Используйте /notify <название канала> <топик> <платформа> <куда> [куда...]")
+		return
+	}
+	channel, application, err := resolveChannel(elements[2], elements[0])
+	if err != nil {
+		sendMessage(username, err.Error())
+		return
+	}
+	reply, err := changeDestinations(username, Telegram, channel, elements[1], application, elements[3:])
+	if err != nil {
 		log.Println(err.Error())
+		sendMessage(username, err.Error())
 		return
 	}
-
-	sendMessage(username, "Топик добавлен")
+	sendMessage(username, reply)
 }
-func handleRemoveTopic(username, msg string) {
-	after, _ := strings.CutPrefix(msg, "/remove")
-	elements := strings.Fields(after)
 
-	if len(elements) != 3 {
-		sendMessage(username, "Неверное количество аргументов. Используйте /remove <название канала> <ссылка/топик> <платформа>")
+func handleConfirm(username, msg string) {
+	after, _ := strings.CutPrefix(msg, "/confirm")
+	elements := strings.Fields(after)
+	if len(elements) != 2 {
+		sendMessage(username, "Неверное количество аргументов. Используйте /confirm <куда> <код>")
 		return
 	}
-	platform := elements[2]
+	reply, err := confirmDestination(username, Telegram, elements[0], elements[1])
+	if err != nil {
+		log.Println(err.Error())
+		sendMessage(username, err.Error())
+		return
+	}
+	sendMessage(username, reply)
+}
 
-	if platform != "VK" && platform != "TG" {
-		sendMessage(username, "Неподдерживаемая платформа. Используйте 'VK' или 'TG'.")
+func handlePriority(username, msg string) {
+	after, _ := strings.CutPrefix(msg, "/priority")
+	elements := strings.Fields(after)
+	if len(elements) != 4 {
+		sendMessage(username, "Неверное количество аргументов. Используйте /priority <название канала> <топик> <платформа> <high/normal/low>")
 		return
 	}
 
-	if platform == "VK" {
-		after = strings.TrimSuffix(after, "VK")
-		handleRemoveTopicVK(username, after)
-	} else {
-		after = strings.TrimSuffix(after, "TG")
-		handleRemoveTopicTelegram(username, after)
+	priority, err := parsePriority(elements[3])
+	if err != nil {
+		sendMessage(username, err.Error())
+		return
 	}
-}
-func handleRemoveTopicTelegram(username, msg string) {
-	concern, err := parseTopic(msg)
-	fmt.Println(concern)
+	channel, application, err := resolveChannel(elements[2], elements[0])
 	if err != nil {
 		sendMessage(username, err.Error())
 		return
 	}
-	if err := dataBase.removeTopic(username, concern.Channel, concern.Topic, Telegram); err != nil {
+
+	err = dataBase.setPriority(username, channel, elements[1], application, priority)
+	if errors.Is(err, sql.ErrNoRows) {
+		sendMessage(username, subscriptionNotFoundError.Error())
+		return
+	}
+	if err != nil {
+		log.Println(err.Error())
 		sendMessage(username, err.Error())
 		return
 	}
-	sendMessage(username, "Топик удалён!")
+	sendMessage(username, "Приоритет обновлён!")
 }
-func handleRemoveTopicVK(username, text string) {
-	after := strings.TrimSpace(text)
-	link, topic, ok := strings.Cut(after, " ")
 
-	if !ok {
-		sendMessage(username, wrongFmtError.Error())
+func handleDigest(username, msg string) {
+	after, _ := strings.CutPrefix(msg, "/digest")
+	reply, err := changeDigest(username, after)
+	if err != nil {
+		log.Println(err.Error())
+		sendMessage(username, err.Error())
+		return
 	}
+	sendMessage(username, reply)
+}
 
-	_, objectType, id, err := getVKInfo(link, vkToken)
+func handleTimezone(username, msg string) {
+	after, _ := strings.CutPrefix(msg, "/timezone")
+	reply, err := changeTimezone(username, after)
 	if err != nil {
 		log.Println(err.Error())
+		sendMessage(username, err.Error())
 		return
 	}
+	sendMessage(username, reply)
+}
 
-	if objectType != "group" {
-		log.Println("Resolved object is not a group")
+func handleQuiet(username, msg string) {
+	after, _ := strings.CutPrefix(msg, "/quiet")
+	reply, err := changeQuietHours(username, after)
+	if err != nil {
+		log.Println(err.Error())
+		sendMessage(username, err.Error())
 		return
 	}
+	sendMessage(username, reply)
+}
 
-	groupID := fmt.Sprintf("%d", id)
-
-	topic = strings.TrimSpace(topic)
+func handlePublish(username, msg string) {
+	after, _ := strings.CutPrefix(msg, "/publish")
+	name, topics, err := parsePublish(after)
+	if err != nil {
+		sendMessage(username, err.Error())
+		return
+	}
+	count, err := dataBase.publishPack(username, name, topics)
+	if errors.Is(err, packOwnedError) || errors.Is(err, packTopicsError) {
+		sendMessage(username, err.Error())
+		return
+	}
+	if err != nil {
+		log.Println(err.Error())
+		sendMessage(username, err.Error())
+		return
+	}
+	sendMessage(username, publishedReply(name, count, "/subscribe"))
+}
 
-	if err := dataBase.removeTopic(username, groupID, topic, VK); err != nil {
+func handleUnpublish(username, msg string) {
+	after, _ := strings.CutPrefix(msg, "/unpublish")
+	name, err := parsePackName(after)
+	if err != nil {
+		sendMessage(username, err.Error())
+		return
+	}
+	err = dataBase.unpublishPack(username, name)
+	if errors.Is(err, sql.ErrNoRows) {
+		sendMessage(username, packNotFoundError.Error())
+		return
+	}
+	if err != nil {
 		log.Println(err.Error())
+		sendMessage(username, err.Error())
 		return
 	}
+	sendMessage(username, "Набор удалён!")
+}
 
-	sendMessage(username, "Топик удален")
+func handleSubscribe(username, msg string) {
+	after, _ := strings.CutPrefix(msg, "/subscribe")
+	name, err := parsePackName(after)
+	if err != nil {
+		sendMessage(username, err.Error())
+		return
+	}
+	err = dataBase.subscribePack(username, name)
+	if errors.Is(err, sql.ErrNoRows) {
+		sendMessage(username, packNotFoundError.Error())
+		return
+	}
+	if err != nil {
+		log.Println(err.Error())
+		sendMessage(username, err.Error())
+		return
+	}
+	sendMessage(username, "Вы подписались на набор "+name)
 }
-func handleRemoveChannel(username, msg string) {
-	after, _ := strings.CutPrefix(msg, "/removeChannel")
-	elements := strings.Fields(after)
 
-	if len(elements) != 2 {
-		sendMessage(username, "Неверное количество аргументов. Используйте /removeChannel <название канала> <платформа>")
+func handleUnsubscribe(username, msg string) {
+	after, _ := strings.CutPrefix(msg, "/unsubscribe")
+	name, err := parsePackName(after)
+	if err != nil {
+		sendMessage(username, err.Error())
+		return
+	}
+	err = dataBase.unsubscribePack(username, name)
+	if errors.Is(err, sql.ErrNoRows) {
+		sendMessage(username, "Вы не подписаны на этот набор")
 		return
 	}
+	if err != nil {
+		log.Println(err.Error())
+		sendMessage(username, err.Error())
+		return
+	}
+	sendMessage(username, "Вы отписались от набора "+name)
+}
 
-	channel := elements[0]
-	platform := elements[1]
+func handleUnknownCommand(username string) {
+	reply := "Я не понимаю вашей команды. Воспользуйтесь \n /start \n /view \n /add <name>/<link> <topic> <platform> \n /remove <name>/<link> <topic> <platform> \n " +
+		"/pause [длительность/until ЧЧ:ММ] \n /continue \n /history [N] \n /posts <name>/<link> <platform> <N> \n /mailbox <name> <imap-url> [archive] \n /share <mailbox> <user> \n /unshare <mailbox> <user> \n /cooldown <name>/<link> <topic> <platform> <cooldown> \n /priority <name>/<link> <topic> <platform> <high/normal/low> \n /notify <name>/<link> <topic> <platform> <destination>... \n /confirm <destination> <code> \n /removeChannel <name>/<link> <platform> \n /mute <name>/<link> [platform] <duration/off> \n /digest [schedule] \n /timezone [zone] \n /quiet [ЧЧ:ММ-ЧЧ:ММ] \n /publish <pack> [topic, ...] \n /unpublish <pack> \n /subscribe <pack> \n /unsubscribe <pack> \n /export [yaml/json] \n /import \n /export_my_data \n /forget_me \n /help"
+	sendMessage(username, reply)
+}
 
-	if platform != "VK" && platform != "TG" {
-		sendMessage(username, "Неподдерживаемая платформа. Используйте 'VK' или 'TG'.")
+func handlePause(username, msg string) {
+	after, _ := strings.CutPrefix(msg, "/pause")
+	reply, err := pause(username, after)
+	if err != nil {
+		sendMessage(username, err.Error())
 		return
 	}
+	sendMessage(username, reply)
+}
 
-	if platform == "VK" {
-		handleRemoveChannelVK(username, channel)
-	} else {
-		handleRemoveChannelTelegram(username, channel)
+func handleMute(username, msg string) {
+	after, _ := strings.CutPrefix(msg, "/mute")
+	elements := strings.Fields(after)
+	if len(elements) < 2 {
+		sendMessage(username, "Неверное количество аргументов. Используйте /mute <название канала> [платформа] <длительность/until ЧЧ:ММ/off>")
+		return
 	}
-}
-func handleRemoveChannelTelegram(username, channel string) {
-	var err error
-	if channel, err = parseChannelName(channel); err != nil {
+	platform, arg := TelegramCode, elements[1:]
+	if _, found := sources[elements[1]]; len(elements) > 2 && found {
+		platform, arg = elements[1], elements[2:]
+	}
+	channel, application, err := resolveChannel(platform, elements[0])
+	if err != nil {
 		sendMessage(username, err.Error())
 		return
 	}
-	if err := dataBase.removeChannel(username, channel, Telegram); err != nil {
+	reply, err := changeMute(username, channel, application, strings.Join(arg, " "))
+	if err != nil {
+		log.Println(err.Error())
 		sendMessage(username, err.Error())
 		return
 	}
-	sendMessage(username, "Канал удалён!")
+	sendMessage(username, reply)
 }
 
-func handleRemoveChannelVK(username, text string) {
-	after := strings.TrimSpace(text)
-	link, _, ok := strings.Cut(after, " ")
-
-	if !ok {
-		sendMessage(username, wrongFmtError.Error())
+func handleContinue(username string) {
+	if err := dataBase.unpauseUser(username); err != nil {
+		sendMessage(username, err.Error())
+		return
 	}
 
-	_, objectType, id, err := getVKInfo(link, vkToken)
+	sendMessage(username, "Обновления сняты с паузы!")
+	flushBacklog(username)
+}
+
+// flushBacklog delivers the delayed messages of the user, as a paged
+// summary with buttons if there are many of them.
+func flushBacklog(username string) {
+	messages, paged, err := takeBacklog(username)
 	if err != nil {
 		log.Println(err.Error())
 		return
 	}
+	if !paged {
+		for _, msg := range messages {
+			if err := sendNews(msg); err != nil {
+				retryNotification(msg, err)
+			}
+		}
+		return
+	}
 
-	if objectType != "group" {
-		log.Println("Resolved object is not a group")
+	userId, err := dataBase.getID(username)
+	if err != nil {
+		log.Println(err.Error())
 		return
 	}
+	text, pages := renderBacklogPage(messages, 0)
+	msg := tgbotapi.NewMessage(userId, text)
+	msg.ReplyMarkup = backlogKeyboard(0, pages)
+	if _, err := bot.Send(msg); err != nil {
+		log.Println(err.Error())
+	}
+}
 
-	groupID := fmt.Sprintf("%d", id)
+func backlogKeyboard(page, pages int) tgbotapi.InlineKeyboardMarkup {
+	var navigation []tgbotapi.InlineKeyboardButton
+	if page > 0 {
+		navigation = append(navigation, tgbotapi.NewInlineKeyboardButtonData("◀", backlogCallbackPrefix+strconv.Itoa(page-1)))
+	}
+	if page < pages-1 {
+		navigation = append(navigation, tgbotapi.NewInlineKeyboardButtonData("▶", backlogCallbackPrefix+strconv.Itoa(page+1)))
+	}
+	actions := tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("Показать все", backlogCallbackPrefix+backlogShowAll),
+		tgbotapi.NewInlineKeyboardButtonData("Удалить", backlogCallbackPrefix+backlogDiscard),
+	)
+	if len(navigation) == 0 {
+		return tgbotapi.NewInlineKeyboardMarkup(actions)
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(navigation, actions)
+}
 
-	if err := dataBase.removeChannel(username, groupID, VK); err != nil {
+// handleBacklogCallback handles a press of a backlog button by editing
+// the summary message in place.
+func handleBacklogCallback(query *tgbotapi.CallbackQuery) {
+	if _, err := bot.Request(tgbotapi.NewCallback(query.ID, "")); err != nil {
 		log.Println(err.Error())
+	}
+	action, page, ok := parseBacklogCallback(query.Data)
+	if !ok || query.Message == nil {
 		return
 	}
+	username := query.From.UserName
+	chatID, messageID := query.Message.Chat.ID, query.Message.MessageID
 
-	sendMessage(username, "Канал удален")
+	var edit tgbotapi.Chattable
+	switch action {
+	case backlogShowAll:
+		if err := showBacklog(username, sendText); err != nil {
+			log.Println(err.Error())
+			return
+		}
+		edit = tgbotapi.NewEditMessageText(chatID, messageID, "Все накопившиеся уведомления показаны")
+	case backlogDiscard:
+		n, err := discardBacklog(username)
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		edit = tgbotapi.NewEditMessageText(chatID, messageID, fmt.Sprintf("Удалено уведомлений: %d", n))
+	default:
+		messages, err := dataBase.getBacklog(username)
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		text, pages := renderBacklogPage(messages, page)
+		if pages == 0 {
+			edit = tgbotapi.NewEditMessageText(chatID, messageID, text)
+		} else {
+			if page >= pages {
+				page = pages - 1
+			}
+			edit = tgbotapi.NewEditMessageTextAndMarkup(chatID, messageID, text, backlogKeyboard(page, pages))
+		}
+	}
+	if _, err := bot.Send(edit); err != nil {
+		log.Println(err.Error())
+	}
 }
 
-func handleUnknownCommand(username string) {
-	reply := "Я не понимаю вашей команды. Воспользуйтесь \n /start \n /view \n /add <name>/<link> <topic> <platform> \n /remove <name>/<link> <topic> <platform> \n " +
-		"/pause \n /continue \n /removeChannel <name>/<link> <platform> \n /help"
+func handleDeadLetters(username, msg string) {
+	if !isAdmin(username) {
+		handleUnknownCommand(username)
+		return
+	}
+	after, _ := strings.CutPrefix(msg, "/deadletters")
+	reply, err := showDeadLetters(after)
+	if err != nil {
+		log.Println(err.Error())
+		sendMessage(username, err.Error())
+		return
+	}
 	sendMessage(username, reply)
 }
 
-func handlePause(username string) {
-	if err := dataBase.pauseUser(username); err != nil {
+func handleReplay(username, msg string) {
+	if !isAdmin(username) {
+		handleUnknownCommand(username)
+		return
+	}
+	after, _ := strings.CutPrefix(msg, "/replay")
+	reply, err := replay(after)
+	if err != nil {
+		log.Println(err.Error())
 		sendMessage(username, err.Error())
 		return
 	}
-	sendMessage(username, "Обновления поставлены на паузу!")
+	sendMessage(username, reply)
 }
 
-func handleContinue(username string) {
-	var err error
-	var messages []Message
-	if err = dataBase.unpauseUser(username); err != nil {
+func handleHistory(username, msg string) {
+	after, _ := strings.CutPrefix(msg, "/history")
+	limit, err := parseHistoryLimit(after)
+	if err != nil {
 		sendMessage(username, err.Error())
 		return
 	}
+	deliveries, err := dataBase.getDeliveries(username, limit)
+	if err != nil {
+		log.Println(err.Error())
+		sendMessage(username, err.Error())
+		return
+	}
+	sendMessage(username, formatHistory(deliveries))
+}
 
-	if messages, err = dataBase.getDelayedMessages(username); err != nil {
+func handleExport(username, msg string) {
+	after, _ := strings.CutPrefix(msg, "/export")
+	format := strings.ToLower(strings.TrimSpace(after))
+	doc, err := dataBase.getSubscriptions(username)
+	if err != nil {
+		log.Println(err.Error())
+		sendMessage(username, err.Error())
+		return
+	}
+	raw, err := encodeSubscriptions(doc, format)
+	if err != nil {
+		sendMessage(username, err.Error())
+		return
+	}
+	if err := sendDocument(username, subscriptionsFileName(format), raw); err != nil {
+		log.Println(err.Error())
+		sendMessage(username, err.Error())
+	}
+}
+
+func handleImport(username string, doc *tgbotapi.Document) {
+	if doc == nil {
+		sendMessage(username, "Отправьте YAML или JSON файл, полученный через /export, с подписью /import")
+		return
+	}
+	if doc.FileSize > maxImportSize {
+		sendMessage(username, importTooLargeError.Error())
+		return
+	}
+	url, err := bot.GetFileDirectURL(doc.FileID)
+	if err != nil {
+		log.Println(err.Error())
+		sendMessage(username, err.Error())
+		return
+	}
+	resp, err := http.Get(url)
+	if err != nil {
+		log.Println(err.Error())
+		sendMessage(username, err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxImportSize+1))
+	if err != nil {
+		log.Println(err.Error())
 		sendMessage(username, err.Error())
 		return
 	}
 
-	for _, msg := range messages {
-		sendNews(msg)
+	summary, err := importSubscriptions(username, data)
+	if err != nil {
+		sendMessage(username, err.Error())
+		return
 	}
+	sendMessage(username, summary)
+}
 
-	sendMessage(username, "Обновления сняты с паузы!")
+func handleExportMyData(username string) {
+	data, err := dataBase.getUserData(username)
+	if err != nil {
+		log.Println(err.Error())
+		sendMessage(username, err.Error())
+		return
+	}
+	raw, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		log.Println(err.Error())
+		sendMessage(username, err.Error())
+		return
+	}
+	if err := sendDocument(username, userDataFileName(username), raw); err != nil {
+		log.Println(err.Error())
+		sendMessage(username, err.Error())
+	}
+}
+
+func handleForgetMe(username, msg string) {
+	after, _ := strings.CutPrefix(msg, "/forget_me")
+	if strings.TrimSpace(after) != forgetConfirmation {
+		sendMessage(username, "Все ваши подписки, отложенные сообщения и история уведомлений будут удалены. "+
+			"Для подтверждения отправьте /forget_me "+forgetConfirmation)
+		return
+	}
+
+	userId, err := dataBase.getID(username)
+	if err != nil {
+		log.Println(err.Error())
+		sendMessage(username, err.Error())
+		return
+	}
+	if err := dataBase.forgetUser(username); err != nil {
+		log.Println(err.Error())
+		sendMessage(username, err.Error())
+		return
+	}
+	if _, err := bot.Send(tgbotapi.NewMessage(userId, forgetReply)); err != nil {
+		log.Println(err.Error())
+	}
 }
 
 func handleHelp(username string) {
@@ -292,10 +656,36 @@ func handleHelp(username string) {
 		"/view - для просмотра доступных каналов и связанных с ними тем. \n \n" +
 		"/add <@название канала>/<ссылка на канал> <слово> <платформа> - добавляет указанное слово в список для поиска в конкретном канале. \n \n" +
 		"/remove <@название канала>/<ссылка на канал> <слово> <платформа> - удаляет указанное слово из списка для поиска в конкретном канале.\n \n" +
-		"/pause - приостанавливает обновления в боте. \n \n" +
-		"/continue - возобновляет поток обновлений в боте после приостановки. \n \n" +
-		"/removeChannel <@название канала>/<ссылка на канал> <платформа> - удаляет список для поиска в конкретном канале. \n" +
-		"В качестве платформы нужно указывать либо VK, либо TG.\n \n" +
+		"/pause [длительность/until ЧЧ:ММ] - приостанавливает обновления в боте, например /pause 2h или /pause until 18:00. \n \n" +
+		"/mute <@название канала>/<ссылка на канал> [платформа] <длительность/until ЧЧ:ММ/off> - приостанавливает обновления из одного канала, например /mute @channel 1d. \n \n" +
+		"/continue - возобновляет поток обновлений в боте после приостановки. Если накопилось много уведомлений, присылает их сводку с кнопками. \n \n" +
+		"/history [N] - показывает последние N отправленных уведомлений. \n \n" +
+		"/posts <@название канала>/<ссылка на канал> <платформа> <N> - ищет слова в последних N постах канала, если платформа это позволяет. \n \n" +
+		"/mailbox <имя> <imaps://логин:пароль@сервер/папка> [ссылка на архив с {id}] - подключает почтовый ящик рассылки под именем, слова в нём добавляются командой /add <имя> <слово> MAIL. Сообщение с паролем бот удалит. Ящик читает только тот, кто его подключил. \n \n" +
+		"/share <имя ящика> <@пользователь> - разрешает пользователю подписываться на ваш ящик, /unshare <имя ящика> <@пользователь> - запрещает. \n \n" +
+		"/cooldown <@название канала>/<ссылка на канал> <слово> <платформа> <none/минуты/day> - задаёт минимальный интервал между уведомлениями по слову, day - 24 часа с последнего уведомления. \n \n" +
+		"/priority <@название канала>/<ссылка на канал> <слово> <платформа> <high/normal/low> - задаёт приоритет слова: high приходит всегда, даже на паузе и в тихие часы, normal следует вашим настройкам, low приходит только в дайджесте. \n \n" +
+		"/notify <@название канала>/<ссылка на канал> <слово> <платформа> <куда> [куда...] - задаёт, куда присылать уведомления по слову: home (сюда), mm:@имя в Mattermost, slack:@имя в Slack, mx:@имя:сервер в Matrix, webhook:<url> или email:<адрес>. Каждый адрес, кроме home, нужно сначала подтвердить. \n \n" +
+		"/confirm <куда> <код> - подтверждает адрес доставки кодом, который бот отправил туда. \n \n" +
+		"/removeChannel <@название канала>/<ссылка на канал> <платформа> - удаляет список для поиска в конкретном канале. \n \n" +
+		"/digest [off/hourly/daily ЧЧ:ММ/weekly <mon-sun> ЧЧ:ММ] - собирает уведомления в дайджест по расписанию. \n \n" +
+		"/timezone [часовой пояс] - задаёт часовой пояс для расписаний, например Europe/Moscow. \n \n" +
+		"/quiet [off/ЧЧ:ММ-ЧЧ:ММ] - задаёт тихие часы, уведомления за это время придут после их окончания. \n \n" +
+		"/publish <набор> [топик, ...] - публикует ваши подписки на перечисленные топики, или все, как набор, на который могут подписаться другие. Повторная публикация обновляет набор у всех подписчиков. \n \n" +
+		"/unpublish <набор> - удаляет опубликованный набор. \n \n" +
+		"/subscribe <набор> - подписывает на набор топиков. \n \n" +
+		"/unsubscribe <набор> - отписывает от набора топиков. \n \n" +
+		"/export [yaml/json] - присылает файл со всеми подписками. \n \n" +
+		"/import - заменяет подписки на подписки из файла, отправленного с этой подписью. \n \n" +
+		"/export_my_data - присылает файл со всеми данными, которые бот хранит о вас. \n \n" +
+		"/forget_me - удаляет все данные о вас. \n \n" +
+		"В качестве платформы нужно указывать " + strings.Join(sourceCodes(), ", ") + ".\n \n" +
+		"Для RSS вместо канала укажите ссылку на ленту, например /add https://spbu.ru/rss экзамен RSS.\n \n" +
+		"Для Discord (DS) укажите ссылку на канал или приглашение на сервер, где есть бот.\n \n" +
+		"Для Matrix (MX) укажите комнату #комната:сервер или ссылку matrix.to, бот войдёт в неё сам.\n \n" +
+		"Для Slack (SL) укажите #канал рабочего пространства, в закрытые каналы бота нужно пригласить.\n \n" +
+		"Для вебхуков (HOOK) укажите <источник>/<канал>, например /add ci/course-project дедлайн HOOK.\n \n" +
+		"Для репозиториев GitHub и GitLab (GIT) укажите ссылку на репозиторий, бот пришлёт новые issues, pull requests и комментарии.\n \n" +
 		"Эти команды помогут вам управлять списком тем и слов для поиска, чтобы быстро находить нужную информацию в чатах."
 	sendMessage(username, reply)
 }
@@ -322,14 +712,98 @@ func setBotCommands(bot *tgbotapi.BotAPI) {
 			Command:     "pause",
 			Description: "Приостановка получения обновлений",
 		},
+		{
+			Command:     "mute",
+			Description: "Приостановить обновления из канала",
+		},
 		{
 			Command:     "continue",
 			Description: "Возобновление получений обновлений",
 		},
+		{
+			Command:     "history",
+			Description: "Последние отправленные уведомления",
+		},
+		{
+			Command:     "posts",
+			Description: "Поискать слова в последних постах канала",
+		},
+		{
+			Command:     "mailbox",
+			Description: "Подключить почтовый ящик рассылки",
+		},
+		{
+			Command:     "share",
+			Description: "Поделиться почтовым ящиком",
+		},
+		{
+			Command:     "unshare",
+			Description: "Перестать делиться почтовым ящиком",
+		},
+		{
+			Command:     "cooldown",
+			Description: "Задать интервал между уведомлениями",
+		},
+		{
+			Command:     "priority",
+			Description: "Задать приоритет слова",
+		},
+		{
+			Command:     "notify",
+			Description: "Выбрать, куда присылать уведомления по слову",
+		},
+		{
+			Command:     "confirm",
+			Description: "Подтвердить адрес доставки кодом",
+		},
 		{
 			Command:     "removeChannel",
 			Description: "Удалить канал с его историей поиска",
 		},
+		{
+			Command:     "digest",
+			Description: "Настроить дайджест уведомлений",
+		},
+		{
+			Command:     "timezone",
+			Description: "Задать часовой пояс",
+		},
+		{
+			Command:     "quiet",
+			Description: "Задать тихие часы",
+		},
+		{
+			Command:     "publish",
+			Description: "Опубликовать подписки как набор",
+		},
+		{
+			Command:     "unpublish",
+			Description: "Удалить опубликованный набор",
+		},
+		{
+			Command:     "subscribe",
+			Description: "Подписаться на набор топиков",
+		},
+		{
+			Command:     "unsubscribe",
+			Description: "Отписаться от набора топиков",
+		},
+		{
+			Command:     "export",
+			Description: "Выгрузить подписки в YAML или JSON",
+		},
+		{
+			Command:     "import",
+			Description: "Загрузить подписки из файла",
+		},
+		{
+			Command:     "export_my_data",
+			Description: "Выгрузить все данные о себе",
+		},
+		{
+			Command:     "forget_me",
+			Description: "Удалить все данные о себе",
+		},
 		{
 			Command:     "help",
 			Description: "Получить помощь",
@@ -366,31 +840,73 @@ func HandlegetHistoryVK(username, msg string) {
 		sendMessage(username, wrongFmtError.Error())
 		return
 	}
-	link := txt[0]
-	count, err := strconv.Atoi(txt[1])
-	if err != nil || count < 0 {
-		sendMessage(username, "Incorrect count of posts")
+	requestPosts(username, VKCode, txt[0], txt[1])
+}
+
+func handleMailbox(username, msg string) {
+	after, _ := strings.CutPrefix(msg, "/mailbox")
+	reply, err := attachMailbox(username, strings.Fields(after))
+	if errors.Is(err, wrongFmtError) {
+		sendMessage(username, "Неверное количество аргументов. Используйте /mailbox <имя> <imaps://логин:пароль@сервер/папка> [ссылка на архив с {id}]")
 		return
 	}
-
-	publicName, objectType, objectID, err := getVKInfo(link, vkToken)
 	if err != nil {
+		log.Println(err.Error())
 		sendMessage(username, err.Error())
 		return
 	}
-	if objectType != "group" {
-		sendMessage(username, "Resolved object is not a group")
+	sendMessage(username, reply)
+}
+
+func handleShareMailbox(username, msg string, share bool) {
+	command := "/share"
+	if !share {
+		command = "/unshare"
+	}
+	after, _ := strings.CutPrefix(msg, command)
+	reply, err := shareMailbox(username, strings.Fields(after), share)
+	if errors.Is(err, wrongFmtError) {
+		sendMessage(username, "Неверное количество аргументов. Используйте "+command+" <имя ящика> <@пользователь>")
+		return
+	}
+	if err != nil {
+		log.Println(err.Error())
+		sendMessage(username, err.Error())
 		return
 	}
+	sendMessage(username, reply)
+}
 
-	ID := fmt.Sprintf("%d", objectID)
+func handlePosts(username, msg string) {
+	after, _ := strings.CutPrefix(msg, "/posts")
+	elements := strings.Fields(after)
+	if len(elements) != 3 {
+		sendMessage(username, "Неверное количество аргументов. Используйте /posts <название канала> <платформа> <количество>")
+		return
+	}
+	requestPosts(username, elements[1], elements[0], elements[2])
+}
 
-	hsh := getHash(publicName) % VKNHistoryWorkers
-	VKHistoryChans[hsh] <- UserHistory{
-		user:       username,
-		link:       link,
-		publicID:   ID,
-		postsCount: count,
-		publicName: publicName,
+// requestPosts passes the latest posts of the channel on platform to the
+// user as a history request.
+func requestPosts(username, platform, link, count string) {
+	n, err := strconv.Atoi(count)
+	if err != nil || n <= 0 {
+		sendMessage(username, "Количество постов должно быть положительным числом")
+		return
+	}
+	source, err := getSource(platform)
+	if err != nil {
+		sendMessage(username, err.Error())
+		return
+	}
+	channel, err := source.resolveChannel(link)
+	if err != nil {
+		sendMessage(username, err.Error())
+		return
+	}
+	if err := source.history(username, channel, n); err != nil {
+		log.Println(err.Error())
+		sendMessage(username, err.Error())
 	}
 }
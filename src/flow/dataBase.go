@@ -5,6 +5,7 @@ import (
 	_ "embed"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	_ "github.com/jackc/pgx/v4/stdlib"
@@ -13,15 +14,20 @@ import (
 type Application = string
 
 const (
-	// TODO: extract Delay to config
-	Delay                  = 10 * time.Second
 	Telegram   Application = "telegram"
 	VK         Application = "vk"
 	MatterMost Application = "mattermost"
+	RSS        Application = "rss"
+	Mail       Application = "mail"
+	Discord    Application = "discord"
+	Matrix     Application = "matrix"
+	Slack      Application = "slack"
+	Hook       Application = "hook"
+	Git        Application = "git"
 )
 
 func getUsingApplications() []Application {
-	return []Application{VK, Telegram, MatterMost}
+	return []Application{VK, Telegram, MatterMost, RSS, Mail, Discord, Matrix, Slack, Hook, Git}
 }
 
 type Message struct {
@@ -29,39 +35,201 @@ type Message struct {
 	User        string      `json:"user"`
 	Link        string      `json:"link"`
 	Channel     string      `json:"channel"`
+	// ChannelID is the channel as stored in the subscriptions, Channel
+	// is its name to show.
+	ChannelID string `json:"channel_id,omitempty"`
+	Topic     string `json:"topic"`
+	Summary   string `json:"summary"`
+	// Suppressed is the number of matches skipped due to the cooldown
+	// since the previous notification.
+	Suppressed int `json:"suppressed"`
+	// Priority is the highest priority of the matched topics.
+	Priority Priority `json:"priority,omitempty"`
+	// Destinations are where the message is delivered, home if empty.
+	Destinations []string `json:"destinations,omitempty"`
+	// Text is the whole text of a notification which groups several
+	// messages, such as a part of a digest, and Grouped are those
+	// messages.
+	Text    string    `json:"text,omitempty"`
+	Grouped []Message `json:"grouped,omitempty"`
+}
+
+// Subscriber is a user to be notified about a message.
+type Subscriber struct {
+	Topics []string
+	// Suppressed is the total number of suppressed matches of Topics.
+	Suppressed int
+	// Priority is the highest priority of Topics.
+	Priority Priority
+	// Destinations are the destinations of all Topics.
+	Destinations []string
+}
+
+type DeliveryStatus = string
+
+const (
+	DeliverySent   DeliveryStatus = "sent"
+	DeliveryFailed DeliveryStatus = "failed"
+)
+
+// Delivery is an entry of the notification history.
+type Delivery struct {
+	Message
+	SentAt time.Time      `json:"sent_at"`
+	Status DeliveryStatus `json:"status"`
+}
+
+type Subscription struct {
+	Application Application `json:"application"`
+	Channel     string      `json:"channel"`
 	Topic       string      `json:"topic"`
-	Summary     string      `json:"summary"`
+	// Cooldown is in seconds.
+	Cooldown int       `json:"cooldown"`
+	Priority Priority  `json:"priority"`
+	LastTime time.Time `json:"last_time"`
+	// Destinations are space-separated, empty for home.
+	Destinations string `json:"destinations,omitempty"`
+}
+
+// UserData is everything stored about a user.
+type UserData struct {
+	User          string         `json:"user"`
+	ID            int64          `json:"id"`
+	Paused        bool           `json:"paused"`
+	PausedUntil   *time.Time     `json:"paused_until,omitempty"`
+	Digest        string         `json:"digest,omitempty"`
+	Timezone      string         `json:"timezone,omitempty"`
+	QuietHours    string         `json:"quiet_hours,omitempty"`
+	Subscriptions []Subscription `json:"subscriptions"`
+	Mutes         []Mute         `json:"mutes"`
+	Packs         []string       `json:"packs"`
+	OwnedPacks    []string       `json:"owned_packs"`
+	Queued        []Message      `json:"queued_messages"`
+	Digested      []Message      `json:"digest_messages"`
+	Delivered     []Delivery     `json:"delivered_messages"`
+}
+
+// Mute is a channel paused for a user until the given time.
+type Mute struct {
+	Application Application `json:"application"`
+	Channel     string      `json:"channel"`
+	Until       time.Time   `json:"until"`
+}
+
+// UserSettings are the delivery preferences of a user.
+type UserSettings struct {
+	Paused bool
+	// PausedUntil is when the pause ends, nil for a pause until /continue.
+	PausedUntil *time.Time
+	// Digest is the digest schedule, empty for instant delivery.
+	Digest string
+	// Timezone is an IANA name, empty for the server timezone.
+	Timezone string
+	// QuietHours are in the HH:MM-HH:MM format, empty for none.
+	QuietHours string
 }
 
 type LocalStorage interface {
+	inTx(fn func(s LocalStorage) error) error
+
 	addMmChan(id string, name string) error
 	getMmChan(id string) (string, error)
 
-	addUser(user string, id int64) error
+	addUser(user string, id int64, application Application) error
 	addTopic(user, channel, topic string, application Application) error
 	removeTopic(user, channel, topic string, application Application) error
 	removeChannel(user, channel string, application Application) error
 	getTopics(channel string, application Application) ([]string, error)
 	getUserInfo(user string) (map[Application]map[string][]string, error)
-	getUsers(channel string, topics []string, application Application) (map[string][]string, error)
-	setTime(user, channel, topic string, application Application) error
+	getSubscriptions(user string) (SubscriptionsDocument, error)
+	publishPack(owner, name string, topics []string) (int64, error)
+	unpublishPack(owner, name string) error
+	subscribePack(user, name string) error
+	unsubscribePack(user, name string) error
+	getPacks(user string) ([]string, error)
+	getUsers(channel string, topics []string, application Application) (map[string]Subscriber, error)
+	setTimes(channel string, users map[string]Subscriber, application Application) error
+	getCoolingUsers(channel string, topics []string, application Application) (map[string]Subscriber, error)
+	suppress(channel string, users map[string]Subscriber, application Application) error
+	setCooldown(user, channel, topic string, application Application, cooldown time.Duration) error
+	setPriority(user, channel, topic string, application Application, priority Priority) error
+	setDestinations(user, channel, topic string, application Application, destinations []string) error
+	requestConfirmation(user, destination, code string, resendBefore time.Time) (bool, error)
+	confirmDestination(user, destination, code string) (bool, error)
+	getConfirmedDestinations(user string) ([]string, error)
+	markNotified(application Application, channelID, messageID string, topics map[string][]string) (map[string][]string, error)
 	containsChannel(channel string, application Application) (bool, error)
 	addDelayedMessage(messages Message) error
 	getDelayedMessages(user string) ([]Message, error)
-	pauseUser(user string) error
+	moveToBacklog(user string) error
+	getBacklog(user string) ([]Message, error)
+	popBacklog(user string) ([]Message, error)
+	pauseUser(user string, until *time.Time) error
 	unpauseUser(user string) error
+	expirePauses(application Application, now time.Time) ([]string, error)
+	muteChannel(user, channel string, application Application, until time.Time) error
+	unmuteChannel(user, channel string, application Application) error
+	isMuted(user, channel string, application Application) (bool, error)
+	expireMutes(now time.Time) error
 	isPaused(user string) (bool, error)
+	getUserSettings(user string) (UserSettings, error)
+	setDigest(user string, schedule string, next time.Time) error
+	addDigestMessage(message Message) error
+	getDueDigests(application Application, now time.Time) (map[string]UserSettings, error)
+	popDigestMessages(user string) ([]Message, error)
+	setDigestNext(user string, next *time.Time) error
+	ensureDigestNext(user string, next time.Time) error
+	setTimezone(user, timezone string) error
+	setQuietHours(user, quiet string) error
+	getQueuedUsers(application Application) (map[string]UserSettings, error)
+	logDelivery(message Message, status DeliveryStatus) error
+	getDeliveries(user string, limit int) ([]Delivery, error)
 	getID(user string) (int64, error)
+	getApplication(user string) (Application, error)
+	getUserData(user string) (UserData, error)
+	forgetUser(user string) error
+	prune(before time.Time) (int64, error)
 	getVKPublicNameByID(groupID string) (string, error)
 	addVKPublic(groupName, groupId string, postID int) error
 	getVKPublic() ([]string, error)
+	getSubscribedChannels(application Application) ([]string, error)
+	getFeed(url string) (FeedState, error)
+	saveFeed(state FeedState) error
+	addMailbox(mailbox Mailbox) error
+	getMailbox(name string) (Mailbox, error)
+	setMailboxUID(name string, uidValidity, lastUID uint32) error
+	getSyncToken(account string) (string, error)
+	saveSyncToken(account, token string) error
+	shareMailbox(name, owner, user string) error
+	unshareMailbox(name, owner, user string) error
+	canReadMailbox(name, user string) (bool, error)
+	getRepo(repo string) (RepoState, error)
+	saveRepo(state RepoState) error
 	updateVKLastPostID(groupID string, postID int) error
 	getVKLastPostID(groupID string) (int, error)
+
+	enqueueJob(job Job, at time.Time) (int64, error)
+	claimJobs(limit int, lease time.Duration, destinations []DestinationKind) ([]Job, error)
+	completeJob(id int64) error
+	retryJob(id int64, attempts int, at time.Time, lastErr string) error
+	buryJob(job Job, class FailureClass, text string) error
+	getDeadLetters(limit int) ([]DeadLetter, error)
+	replayDeadLetter(id int64) error
+	replayDeadLetters() (int64, error)
 }
 
 type DataBase struct {
 	DB    *sql.DB
 	Names TablesNames
+	// q is used instead of DB when set, e.g. inside a transaction.
+	q querier
+}
+
+// querier is the subset of methods shared by *sql.DB and *sql.Tx.
+type querier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
 }
 
 type DBConfig struct {
@@ -73,10 +241,37 @@ type DBConfig struct {
 }
 
 type TablesNames struct {
-	Channels string
-	Users    string
-	Messages string
-	VKPostID string
+	Channels   string
+	Users      string
+	Messages   string
+	VKPostID   string
+	Deliveries string
+	Notified   string
+	// Packs, PackTopics and PackSubscribers store shared topic packs.
+	Packs           string
+	PackTopics      string
+	PackSubscribers string
+	Digests         string
+	Mutes           string
+	// WorkQueue stores pending jobs, DeadLetters the failed ones.
+	WorkQueue   string
+	DeadLetters string
+	// Feeds stores the state of the polled RSS and Atom feeds.
+	Feeds string
+	// Mailboxes stores the attached IMAP mailboxes.
+	Mailboxes string
+	// MailboxReaders stores the users the owners share their mailboxes
+	// with.
+	MailboxReaders string
+	// SyncTokens stores the token of the next Matrix sync of every
+	// account.
+	SyncTokens string
+	// Repos stores the state of the polled GitHub and GitLab
+	// repositories.
+	Repos string
+	// Confirmations stores the confirmation codes of the destinations
+	// of every user.
+	Confirmations string
 }
 
 //go:embed migrations/init.sql
@@ -92,18 +287,55 @@ func NewDatabase(cfg DBConfig, names TablesNames) (*DataBase, error) {
 	if _, err := db.Exec(initScript); err != nil {
 		return nil, err
 	}
-	return &DataBase{db, names}, nil
+	d := &DataBase{DB: db, Names: names}
+	if err := d.sealMailboxes(); err != nil {
+		log.Printf("can't encrypt the credentials of mailboxes: %s", err.Error())
+	}
+	return d, nil
+}
+
+func (d *DataBase) conn() querier {
+	if d.q != nil {
+		return d.q
+	}
+	return d.DB
+}
+
+// inTx runs fn against a storage bound to a single transaction. The
+// transaction is committed if fn succeeds and rolled back otherwise.
+// Nested calls reuse the outer transaction.
+func (d *DataBase) inTx(fn func(s LocalStorage) error) error {
+	return d.withTx(func(tx *DataBase) error {
+		return fn(tx)
+	})
+}
+
+func (d *DataBase) withTx(fn func(tx *DataBase) error) error {
+	if _, ok := d.q.(*sql.Tx); ok {
+		return fn(d)
+	}
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(&DataBase{DB: d.DB, Names: d.Names, q: tx}); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			log.Println(rbErr.Error())
+		}
+		return err
+	}
+	return tx.Commit()
 }
 
 func (d *DataBase) addMmChan(id, name string) error {
 	query := "INSERT INTO mm_chans(id, name) VALUES ($1, $2)"
-	_, err := d.DB.Exec(query, id, name)
+	_, err := d.conn().Exec(query, id, name)
 	return err
 }
 
 func (d *DataBase) getMmChan(id string) (string, error) {
 	query := "SELECT name FROM mm_chans WHERE id=$1"
-	row := d.DB.QueryRow(query, id)
+	row := d.conn().QueryRow(query, id)
 	var name string
 	err := row.Scan(&name)
 	if err != nil {
@@ -114,7 +346,7 @@ func (d *DataBase) getMmChan(id string) (string, error) {
 
 func (d *DataBase) addTopic(user, channel, topic string, application Application) error {
 	query := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE nickname=$1 AND channel=$2 AND topic=$3 AND application=$4", d.Names.Channels)
-	row := d.DB.QueryRow(query,
+	row := d.conn().QueryRow(query,
 		user, channel, topic, application)
 
 	var count int64
@@ -128,12 +360,12 @@ func (d *DataBase) addTopic(user, channel, topic string, application Application
 	}
 
 	query = fmt.Sprintf("INSERT INTO %s (nickname, channel, topic, last_time, application) VALUES ($1,$2,$3,$4,$5)", d.Names.Channels)
-	_, err = d.DB.Exec(
+	_, err = d.conn().Exec(
 		query,
 		user,
 		channel,
 		topic,
-		time.Now().Add(-Delay),
+		time.Unix(0, 0),
 		application,
 	)
 
@@ -142,7 +374,7 @@ func (d *DataBase) addTopic(user, channel, topic string, application Application
 
 func (d *DataBase) removeTopic(user, channel, topic string, application Application) error {
 	query := fmt.Sprintf("DELETE FROM %s WHERE nickname = $1 AND channel = $2 AND topic = $3 AND application = $4", d.Names.Channels)
-	_, err := d.DB.Exec(
+	_, err := d.conn().Exec(
 		query,
 		user,
 		channel,
@@ -157,7 +389,7 @@ func (d *DataBase) removeTopic(user, channel, topic string, application Applicat
 
 func (d *DataBase) removeChannel(user, channel string, application Application) error {
 	query := fmt.Sprintf("DELETE FROM %s WHERE nickname = $1 AND channel = $2 AND application = $3", d.Names.Channels)
-	_, err := d.DB.Exec(
+	_, err := d.conn().Exec(
 		query,
 		user,
 		channel,
@@ -169,9 +401,16 @@ func (d *DataBase) removeChannel(user, channel string, application Application)
 	return nil
 }
 
+// getTopics returns the topics tracked in channel either directly or
+// through a pack with subscribers.
 func (d *DataBase) getTopics(channel string, application Application) ([]string, error) {
-	query := fmt.Sprintf("SELECT topic FROM %s WHERE channel = $1 AND application = $2", d.Names.Channels)
-	rows, err := d.DB.Query(
+	query := fmt.Sprintf(
+		`SELECT topic FROM %s WHERE channel = $1 AND application = $2
+				UNION
+				SELECT t.topic FROM %s t WHERE t.channel = $1 AND t.application = $2
+				AND EXISTS (SELECT 1 FROM %s s WHERE s.pack = t.pack)`,
+		d.Names.Channels, d.Names.PackTopics, d.Names.PackSubscribers)
+	rows, err := d.conn().Query(
 		query,
 		channel,
 		application,
@@ -179,6 +418,7 @@ func (d *DataBase) getTopics(channel string, application Application) ([]string,
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 	var topics []string
 	for rows.Next() {
 		var topic string
@@ -188,33 +428,48 @@ func (d *DataBase) getTopics(channel string, application Application) ([]string,
 		}
 		topics = append(topics, topic)
 	}
-	return topics, nil
+	return topics, rows.Err()
 }
 
-func (d *DataBase) getUserInfo(user string) (map[Application]map[string][]string, error) {
-	queryVK := fmt.Sprintf("SELECT groupid, public_name FROM %s", d.Names.VKPostID)
-	rows, err := d.DB.Query(queryVK)
+// getSubscriptions returns the topics of the user by application and
+// channel identifier.
+func (d *DataBase) getSubscriptions(user string) (SubscriptionsDocument, error) {
+	query := fmt.Sprintf("SELECT application, channel, topic FROM %s WHERE nickname = $1", d.Names.Channels)
+	rows, err := d.conn().Query(
+		query,
+		user,
+	)
 	if err != nil {
 		return nil, err
 	}
-	vkMap := make(map[string]string)
+	defer rows.Close()
+
+	answer := make(SubscriptionsDocument)
 	for rows.Next() {
-		var id int
-		var publicName string
-		err = rows.Scan(&id, &publicName)
-		sID := fmt.Sprintf("%d", id)
-		vkMap[sID] = publicName
-		log.Println(publicName, id)
+		var application Application
+		var channel, topic string
+		if err := rows.Scan(&application, &channel, &topic); err != nil {
+			return nil, err
+		}
+		if answer[application] == nil {
+			answer[application] = make(map[string][]string)
+		}
+		answer[application][channel] = append(answer[application][channel], topic)
 	}
 
+	return answer, rows.Err()
+}
+
+func (d *DataBase) getUserInfo(user string) (map[Application]map[string][]string, error) {
 	query := fmt.Sprintf("SELECT channel, topic, application FROM %s WHERE nickname = $1", d.Names.Channels)
-	rows, err = d.DB.Query(
+	rows, err := d.conn().Query(
 		query,
 		user,
 	)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
 	answer := make(map[Application]map[string][]string)
 	for _, application := range getUsingApplications() {
@@ -229,86 +484,445 @@ func (d *DataBase) getUserInfo(user string) (map[Application]map[string][]string
 		if err != nil {
 			return nil, err
 		}
-		switch application {
-		case VK:
-			channel = vkMap[channel]
-			curTopics := answer[VK][channel]
-			curTopics = append(curTopics, topic)
-			answer[VK][channel] = curTopics
-		case Telegram:
-			curTopics := answer[Telegram][channel]
-			curTopics = append(curTopics, topic)
-			answer[Telegram][channel] = curTopics
-		case MatterMost:
-			curTopics := answer[MatterMost][channel]
-			curTopics = append(curTopics, topic)
-			answer[MatterMost][channel] = curTopics
+		if answer[application] == nil {
+			answer[application] = make(map[string][]string)
 		}
+		answer[application][channel] = append(answer[application][channel], topic)
 	}
 
 	return answer, nil
 }
 
-func (d *DataBase) getUsers(channel string, topics []string, application Application) (map[string][]string, error) {
-	answer := make(map[string][]string)
-	for _, topic := range topics {
-		query := fmt.Sprintf("SELECT nickname FROM %s WHERE channel = $1 AND topic = $2 AND last_time < $3 AND application = $4 ", d.Names.Channels)
-		rows, err := d.DB.Query(
-			query,
-			channel,
-			topic,
-			time.Now().Add(-Delay),
-			application,
-		)
+// notifiedPackSubscriptions restricts an update of pack_subscribers s
+// joined with pack_topics t to the pairs of nicknames and topics $3 and
+// $4 in channel $1 of application $2 which come from packs.
+const notifiedPackSubscriptions = `s.pack = t.pack AND t.channel = $1 AND t.application = $2
+		AND (s.nickname, t.topic) IN (SELECT * FROM unnest($3::text[], $4::text[]))
+		AND NOT EXISTS (SELECT 1 FROM %[1]s c WHERE c.nickname = s.nickname
+			AND c.channel = t.channel AND c.topic = t.topic AND c.application = t.application)`
+
+// packSubscriptions selects the pack subscriptions to the topics $2 in
+// channel $1 of application $3 as the columns of pack_topics t and
+// pack_subscribers s. A direct subscription to a topic takes precedence
+// over a pack.
+const packSubscriptions = `%[2]s t JOIN %[3]s s ON s.pack = t.pack
+		WHERE t.channel = $1 AND t.topic = ANY($2) AND t.application = $3
+		AND NOT EXISTS (SELECT 1 FROM %[1]s c WHERE c.nickname = s.nickname
+			AND c.channel = t.channel AND c.topic = t.topic AND c.application = t.application)`
+
+// getUsers returns the subscribers of topics in channel whose cooldown
+// has passed. The settings of a pack subscription apply to all the
+// topics of the pack, whose suppressed matches are counted once.
+func (d *DataBase) getUsers(channel string, topics []string, application Application) (map[string]Subscriber, error) {
+	query := fmt.Sprintf(
+		`SELECT nickname, topic, suppressed, priority, destinations FROM %[1]s
+				WHERE channel = $1 AND topic = ANY($2) AND application = $3
+				AND last_time <= $4::timestamptz - cooldown * interval '1 second'
+				UNION
+				SELECT s.nickname, t.topic,
+					CASE WHEN row_number() OVER (PARTITION BY s.nickname, s.pack ORDER BY t.topic) = 1
+						THEN s.suppressed ELSE 0 END,
+					s.priority, s.destinations
+				FROM `+packSubscriptions+`
+				AND s.last_time <= $4::timestamptz - s.cooldown * interval '1 second'`,
+		d.Names.Channels, d.Names.PackTopics, d.Names.PackSubscribers)
+	rows, err := d.conn().Query(
+		query,
+		channel,
+		topics,
+		application,
+		time.Now(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	answer := make(map[string]Subscriber)
+	for rows.Next() {
+		var user, topic string
+		var suppressed int
+		var priority Priority
+		var destinations string
+		err = rows.Scan(&user, &topic, &suppressed, &priority, &destinations)
 		if err != nil {
 			return nil, err
 		}
+		subscriber, found := answer[user]
+		if found {
+			subscriber.Priority = maxPriority(subscriber.Priority, priority)
+		} else {
+			subscriber.Priority = priority
+		}
+		if !containsString(subscriber.Topics, topic) {
+			subscriber.Topics = append(subscriber.Topics, topic)
+		}
+		subscriber.Suppressed += suppressed
+		subscriber.Destinations = mergeDestinations(subscriber.Destinations, destinations)
+		answer[user] = subscriber
+	}
 
-		for rows.Next() {
-			var user string
-			err = rows.Scan(&user)
-			if err != nil {
-				return nil, err
-			}
-			answer[user] = append(answer[user], topic)
+	return answer, rows.Err()
+}
+
+// setTimes marks every topic of every user in users as just notified.
+func (d *DataBase) setTimes(channel string, users map[string]Subscriber, application Application) error {
+	var nicknames, topics []string
+	for user, subscriber := range users {
+		for _, topic := range subscriber.Topics {
+			nicknames = append(nicknames, user)
+			topics = append(topics, topic)
 		}
 	}
+	if len(nicknames) == 0 {
+		return nil
+	}
 
-	return answer, nil
+	query := fmt.Sprintf(
+		`UPDATE %s SET last_time = $1, suppressed = 0 WHERE channel = $2 AND application = $3
+				AND (nickname, topic) IN (SELECT * FROM unnest($4::text[], $5::text[]))`,
+		d.Names.Channels)
+	_, err := d.conn().Exec(
+		query,
+		time.Now(),
+		channel,
+		application,
+		nicknames,
+		topics,
+	)
+	if err != nil {
+		return err
+	}
+	query = fmt.Sprintf(
+		`UPDATE %[3]s s SET last_time = $5, suppressed = 0 FROM %[2]s t WHERE `+notifiedPackSubscriptions,
+		d.Names.Channels, d.Names.PackTopics, d.Names.PackSubscribers)
+	_, err = d.conn().Exec(query, channel, application, nicknames, topics, time.Now())
+	return err
 }
 
-func (d *DataBase) setTime(user, channel, topic string, application Application) error {
-	query := fmt.Sprintf("UPDATE %s SET last_time = $1 WHERE  nickname = $2 AND channel = $3 AND topic = $4 AND application = $5", d.Names.Channels)
-	_, err := d.DB.Exec(
+// getCoolingUsers returns the subscribers of topics in channel who are
+// still cooling down.
+func (d *DataBase) getCoolingUsers(channel string, topics []string, application Application) (map[string]Subscriber, error) {
+	query := fmt.Sprintf(
+		`SELECT nickname, topic FROM %[1]s
+				WHERE channel = $1 AND topic = ANY($2) AND application = $3
+				AND last_time > $4::timestamptz - cooldown * interval '1 second'
+				UNION
+				SELECT s.nickname, t.topic FROM `+packSubscriptions+`
+				AND s.last_time > $4::timestamptz - s.cooldown * interval '1 second'`,
+		d.Names.Channels, d.Names.PackTopics, d.Names.PackSubscribers)
+	rows, err := d.conn().Query(
 		query,
+		channel,
+		topics,
+		application,
 		time.Now(),
-		user,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	answer := make(map[string]Subscriber)
+	for rows.Next() {
+		var user, topic string
+		if err := rows.Scan(&user, &topic); err != nil {
+			return nil, err
+		}
+		subscriber := answer[user]
+		subscriber.Topics = append(subscriber.Topics, topic)
+		answer[user] = subscriber
+	}
+	return answer, rows.Err()
+}
+
+// suppress counts a match for every topic of every user in users, who
+// are cooling down.
+func (d *DataBase) suppress(channel string, users map[string]Subscriber, application Application) error {
+	var nicknames, topics []string
+	for user, subscriber := range users {
+		for _, topic := range subscriber.Topics {
+			nicknames = append(nicknames, user)
+			topics = append(topics, topic)
+		}
+	}
+	if len(nicknames) == 0 {
+		return nil
+	}
+
+	query := fmt.Sprintf(
+		`UPDATE %s SET suppressed = suppressed + 1 WHERE channel = $1 AND application = $2
+				AND (nickname, topic) IN (SELECT * FROM unnest($3::text[], $4::text[]))`,
+		d.Names.Channels)
+	_, err := d.conn().Exec(
+		query,
 		channel,
-		topic,
 		application,
+		nicknames,
+		topics,
 	)
+	if err != nil {
+		return err
+	}
+	// A pack subscription counts a match once however many of its
+	// topics are matched.
+	query = fmt.Sprintf(
+		`UPDATE %[3]s s SET suppressed = s.suppressed + 1 FROM %[2]s t WHERE `+notifiedPackSubscriptions,
+		d.Names.Channels, d.Names.PackTopics, d.Names.PackSubscribers)
+	_, err = d.conn().Exec(query, channel, application, nicknames, topics)
 	return err
 }
 
+// requestConfirmation stores a new confirmation code of the destination
+// of the user unless the destination is confirmed or its code was sent
+// after resendBefore. It reports whether the code is to be sent.
+func (d *DataBase) requestConfirmation(user, destination, code string, resendBefore time.Time) (bool, error) {
+	query := fmt.Sprintf(
+		`INSERT INTO %[1]s AS c (nickname, destination, code) VALUES ($1, $2, $3)
+				ON CONFLICT (nickname, destination) DO UPDATE
+				SET code = EXCLUDED.code, attempts = 0, sent_at = now()
+				WHERE NOT c.confirmed AND c.sent_at < $4
+				RETURNING nickname`,
+		d.Names.Confirmations)
+	var nickname string
+	err := d.conn().QueryRow(query, user, destination, code, resendBefore).Scan(&nickname)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// confirmDestination confirms the destination of the user if the code
+// is right. Every code allows a few attempts only.
+func (d *DataBase) confirmDestination(user, destination, code string) (bool, error) {
+	query := fmt.Sprintf(
+		`UPDATE %s SET confirmed = (code = $3), attempts = attempts + 1
+				WHERE nickname = $1 AND destination = $2 AND NOT confirmed AND attempts < $4
+				RETURNING confirmed`,
+		d.Names.Confirmations)
+	var confirmed bool
+	err := d.conn().QueryRow(query, user, destination, code, maxConfirmationAttempts).Scan(&confirmed)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return confirmed, err
+}
+
+// getConfirmedDestinations returns the confirmed destinations of the
+// user.
+func (d *DataBase) getConfirmedDestinations(user string) ([]string, error) {
+	query := fmt.Sprintf("SELECT destination FROM %s WHERE nickname = $1 AND confirmed", d.Names.Confirmations)
+	rows, err := d.conn().Query(query, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var destinations []string
+	for rows.Next() {
+		var destination string
+		if err := rows.Scan(&destination); err != nil {
+			return nil, err
+		}
+		destinations = append(destinations, destination)
+	}
+	return destinations, rows.Err()
+}
+
+// setPriority returns sql.ErrNoRows when the user has no such
+// subscription.
+func (d *DataBase) setPriority(user, channel, topic string, application Application, priority Priority) error {
+	return d.setSubscription("priority", priority, user, channel, topic, application)
+}
+
+// setDestinations sets where the notifications of a subscription are
+// delivered, nil for home. It returns sql.ErrNoRows if there is no such
+// subscription.
+func (d *DataBase) setDestinations(user, channel, topic string, application Application, destinations []string) error {
+	return d.setSubscription("destinations", strings.Join(destinations, " "), user, channel, topic, application)
+}
+
+// setSubscription sets a column of the subscription of the user to the
+// topic. For a topic the user has through packs it is set for the whole
+// subscriptions to those packs. It returns sql.ErrNoRows if there is no such
+// subscription.
+func (d *DataBase) setSubscription(column string, value any, user, channel, topic string, application Application) error {
+	query := fmt.Sprintf(
+		"UPDATE %s SET %s = $1 WHERE nickname = $2 AND channel = $3 AND topic = $4 AND application = $5",
+		d.Names.Channels, column)
+	res, err := d.conn().Exec(query, value, user, channel, topic, application)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil || affected != 0 {
+		return err
+	}
+
+	query = fmt.Sprintf(
+		`UPDATE %s SET %s = $1 WHERE nickname = $2 AND pack IN (
+				SELECT pack FROM %s WHERE channel = $3 AND topic = $4 AND application = $5)`,
+		d.Names.PackSubscribers, column, d.Names.PackTopics)
+	res, err = d.conn().Exec(query, value, user, channel, topic, application)
+	if err != nil {
+		return err
+	}
+	affected, err = res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// mergeDestinations adds the space-separated destinations of a topic to
+// the ones of the other topics, an empty list standing for home.
+func mergeDestinations(merged []string, destinations string) []string {
+	fields := strings.Fields(destinations)
+	if len(fields) == 0 {
+		fields = []string{DestinationHome}
+	}
+	for _, destination := range fields {
+		if !containsString(merged, destination) {
+			merged = append(merged, destination)
+		}
+	}
+	return merged
+}
+
+func (d *DataBase) setCooldown(user, channel, topic string, application Application, cooldown time.Duration) error {
+	return d.setSubscription("cooldown", int64(cooldown/time.Second), user, channel, topic, application)
+}
+
+// markNotified records that the users are notified about the topics of
+// the message and returns the topics each of them has not been notified
+// about before. Users without such topics are left out.
+func (d *DataBase) markNotified(application Application, channelID, messageID string, topics map[string][]string) (map[string][]string, error) {
+	if len(topics) == 0 {
+		return nil, nil
+	}
+	var fresh map[string][]string
+	err := d.withTx(func(tx *DataBase) error {
+		// A message and its edits may be handled by several processes at
+		// once, so the notifications about it are serialized.
+		_, err := tx.conn().Exec(`SELECT pg_advisory_xact_lock(hashtext($1))`,
+			strings.Join([]string{application, channelID, messageID}, "/"))
+		if err != nil {
+			return err
+		}
+		notified, err := tx.notifiedTopics(application, channelID, messageID, topics)
+		if err != nil {
+			return err
+		}
+
+		fresh = make(map[string][]string)
+		var freshUsers, recorded []string
+		for user, userTopics := range topics {
+			known, found := notified[user]
+			if found && known == nil {
+				continue
+			}
+			var newTopics []string
+			for _, topic := range userTopics {
+				if !containsString(known, topic) {
+					newTopics = append(newTopics, topic)
+				}
+			}
+			if len(newTopics) == 0 {
+				continue
+			}
+			fresh[user] = newTopics
+			freshUsers = append(freshUsers, user)
+			recorded = append(recorded, strings.Join(append(known, newTopics...), "\n"))
+		}
+		if len(freshUsers) == 0 {
+			return nil
+		}
+
+		query := fmt.Sprintf(
+			`INSERT INTO %s (application, channel_id, message_id, nickname, topics)
+					SELECT $1, $2, $3, nickname, topics FROM unnest($4::text[], $5::text[]) AS n(nickname, topics)
+					ON CONFLICT (application, channel_id, message_id, nickname) DO UPDATE SET topics = EXCLUDED.topics`,
+			tx.Names.Notified)
+		_, err = tx.conn().Exec(
+			query,
+			application,
+			channelID,
+			messageID,
+			freshUsers,
+			recorded,
+		)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fresh, nil
+}
+
+// notifiedTopics returns the topics of the message the users have been
+// notified about. A user notified before the topics were recorded has
+// nil topics, which cover them all.
+func (d *DataBase) notifiedTopics(application Application, channelID, messageID string, topics map[string][]string) (map[string][]string, error) {
+	users := make([]string, 0, len(topics))
+	for user := range topics {
+		users = append(users, user)
+	}
+	query := fmt.Sprintf(
+		`SELECT nickname, topics FROM %s
+				WHERE application = $1 AND channel_id = $2 AND message_id = $3 AND nickname = ANY($4)`,
+		d.Names.Notified)
+	rows, err := d.conn().Query(
+		query,
+		application,
+		channelID,
+		messageID,
+		users,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notified := make(map[string][]string)
+	for rows.Next() {
+		var user, userTopics string
+		if err := rows.Scan(&user, &userTopics); err != nil {
+			return nil, err
+		}
+		notified[user] = nil
+		if userTopics != "" {
+			notified[user] = strings.Split(userTopics, "\n")
+		}
+	}
+	return notified, rows.Err()
+}
+
 func (d *DataBase) containsChannel(channel string, application Application) (bool, error) {
-	query := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE channel=$1 AND application = $2", d.Names.Channels)
-	row := d.DB.QueryRow(
+	query := fmt.Sprintf(
+		`SELECT EXISTS (SELECT 1 FROM %s WHERE channel = $1 AND application = $2)
+				OR EXISTS (SELECT 1 FROM %s t WHERE t.channel = $1 AND t.application = $2
+					AND EXISTS (SELECT 1 FROM %s s WHERE s.pack = t.pack))`,
+		d.Names.Channels, d.Names.PackTopics, d.Names.PackSubscribers)
+	row := d.conn().QueryRow(
 		query,
 		channel,
 		application,
 	)
-	var count int64
-	err := row.Scan(&count)
+	var found bool
+	err := row.Scan(&found)
 	if err != nil {
 		return false, err
 	}
 
-	return count != 0, nil
+	return found, nil
 }
 
 func (d *DataBase) addDelayedMessage(message Message) error {
-	query := fmt.Sprintf("INSERT INTO %s (nickname, link, channel, topic, summary, application) VALUES ($1,$2,$3,$4,$5,$6)", d.Names.Messages)
-	_, err := d.DB.Exec(
+	query := fmt.Sprintf("INSERT INTO %s (nickname, link, channel, topic, summary, application, suppressed, channel_id, destinations) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9)", d.Names.Messages)
+	_, err := d.conn().Exec(
 		query,
 		message.User,
 		message.Link,
@@ -316,45 +930,146 @@ func (d *DataBase) addDelayedMessage(message Message) error {
 		message.Topic,
 		message.Summary,
 		message.Application,
+		message.Suppressed,
+		message.ChannelID,
+		strings.Join(message.Destinations, " "),
 	)
 
 	return err
 }
 
+// notMutedCondition selects the delayed messages m which are not from a
+// channel currently muted by their user.
+const notMutedCondition = `NOT EXISTS (SELECT 1 FROM %s mu
+		WHERE mu.nickname = m.nickname AND mu.channel = m.channel_id
+		AND mu.application = m.application AND mu.until > now())`
+
+// getDelayedMessages removes and returns the delayed messages of the
+// user except the ones from the channels muted by them and the ones
+// waiting in the backlog.
 func (d *DataBase) getDelayedMessages(user string) ([]Message, error) {
-	query := fmt.Sprintf("SELECT * FROM %s WHERE nickname = $1", d.Names.Messages)
-	rows, err := d.DB.Query(
+	query := fmt.Sprintf(
+		`DELETE FROM %s m WHERE nickname = $1 AND NOT backlog AND `+notMutedCondition+`
+				RETURNING nickname, link, channel, topic, summary, application, suppressed, COALESCE(channel_id, ''), destinations`,
+		d.Names.Messages, d.Names.Mutes)
+	rows, err := d.conn().Query(
 		query,
 		user,
 	)
 	if err != nil {
 		return nil, err
 	}
+	return scanMessages(rows)
+}
+
+// moveToBacklog moves the delayed messages which getDelayedMessages
+// would return to the backlog, where they wait for the user to show or
+// discard them.
+func (d *DataBase) moveToBacklog(user string) error {
+	query := fmt.Sprintf(
+		`UPDATE %s m SET backlog = true WHERE nickname = $1 AND NOT backlog AND `+notMutedCondition,
+		d.Names.Messages, d.Names.Mutes)
+	_, err := d.conn().Exec(query, user)
+	return err
+}
+
+// getBacklog returns the backlog of the user, oldest first.
+func (d *DataBase) getBacklog(user string) ([]Message, error) {
+	query := fmt.Sprintf(
+		`SELECT nickname, link, channel, topic, summary, application, suppressed, COALESCE(channel_id, ''), destinations
+				FROM %s WHERE nickname = $1 AND backlog ORDER BY created_at`,
+		d.Names.Messages)
+	rows, err := d.conn().Query(query, user)
+	if err != nil {
+		return nil, err
+	}
+	return scanMessages(rows)
+}
+
+// popBacklog removes and returns the backlog of the user, oldest first.
+func (d *DataBase) popBacklog(user string) ([]Message, error) {
+	query := fmt.Sprintf(
+		`WITH deleted AS (DELETE FROM %s WHERE nickname = $1 AND backlog RETURNING *)
+				SELECT nickname, link, channel, topic, summary, application, suppressed, COALESCE(channel_id, ''), destinations
+				FROM deleted ORDER BY created_at`,
+		d.Names.Messages)
+	rows, err := d.conn().Query(query, user)
+	if err != nil {
+		return nil, err
+	}
+	return scanMessages(rows)
+}
+
+// scanMessages reads and closes rows of delayed messages.
+func scanMessages(rows *sql.Rows) ([]Message, error) {
+	defer rows.Close()
 	var messages []Message
 	for rows.Next() {
 		var message Message
-		err = rows.Scan(&message.User, &message.Link, &message.Channel, &message.Topic, &message.Summary, &message.Application)
+		var destinations string
+		err := rows.Scan(&message.User, &message.Link, &message.Channel, &message.Topic, &message.Summary,
+			&message.Application, &message.Suppressed, &message.ChannelID, &destinations)
 		if err != nil {
 			return nil, err
 		}
+		message.Destinations = strings.Fields(destinations)
 		messages = append(messages, message)
 	}
+	return messages, rows.Err()
+}
+
+func (d *DataBase) logDelivery(message Message, status DeliveryStatus) error {
+	query := fmt.Sprintf(
+		`INSERT INTO %s (nickname, application, channel, topic, link, summary, sent_at, status)
+				VALUES ($1,$2,$3,$4,$5,$6,$7,$8)`,
+		d.Names.Deliveries)
+	_, err := d.conn().Exec(
+		query,
+		message.User,
+		message.Application,
+		message.Channel,
+		message.Topic,
+		message.Link,
+		message.Summary,
+		time.Now(),
+		status,
+	)
+	return err
+}
 
-	query = fmt.Sprintf("DELETE FROM %s WHERE nickname = $1", d.Names.Messages)
-	_, err = d.DB.Exec(
+// getDeliveries returns at most limit latest deliveries, newest first.
+func (d *DataBase) getDeliveries(user string, limit int) ([]Delivery, error) {
+	query := fmt.Sprintf(
+		`SELECT nickname, application, channel, topic, link, summary, sent_at, status
+				FROM %s WHERE nickname = $1 ORDER BY sent_at DESC LIMIT $2`,
+		d.Names.Deliveries)
+	rows, err := d.conn().Query(
 		query,
 		user,
+		limit,
 	)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
+
+	var deliveries []Delivery
+	for rows.Next() {
+		var delivery Delivery
+		err = rows.Scan(&delivery.User, &delivery.Application, &delivery.Channel, &delivery.Topic,
+			&delivery.Link, &delivery.Summary, &delivery.SentAt, &delivery.Status)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
 
-	return messages, nil
+	return deliveries, rows.Err()
 }
 
 func (d *DataBase) isPaused(user string) (bool, error) {
 	query := fmt.Sprintf("SELECT paused FROM %s WHERE nickname = $1", d.Names.Users)
-	row := d.DB.QueryRow(
+	row := d.conn().QueryRow(
 		query,
 		user,
 	)
@@ -367,20 +1082,162 @@ func (d *DataBase) isPaused(user string) (bool, error) {
 	return isPaused, nil
 }
 
-func (d *DataBase) pauseUser(user string) error {
-	isPaused, err := d.isPaused(user)
-	if err != nil {
+// userSettingsColumns are scanned by scanUserSettings.
+const userSettingsColumns = "paused, paused_until, COALESCE(digest, ''), COALESCE(timezone, ''), COALESCE(quiet_hours, '')"
+
+func scanUserSettings(row interface{ Scan(...any) error }, settings *UserSettings, dest ...any) error {
+	var pausedUntil sql.NullTime
+	dest = append(dest, &settings.Paused, &pausedUntil, &settings.Digest, &settings.Timezone, &settings.QuietHours)
+	if err := row.Scan(dest...); err != nil {
 		return err
 	}
-	if isPaused {
-		return nil
+	if pausedUntil.Valid {
+		settings.PausedUntil = &pausedUntil.Time
 	}
-	query := fmt.Sprintf("UPDATE %s SET paused = $1 WHERE nickname = $2 ", d.Names.Users)
-	_, err = d.DB.Exec(
-		query,
-		true,
-		user,
-	)
+	return nil
+}
+
+func (d *DataBase) getUserSettings(user string) (UserSettings, error) {
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE nickname = $1", userSettingsColumns, d.Names.Users)
+	var settings UserSettings
+	err := scanUserSettings(d.conn().QueryRow(query, user), &settings)
+	return settings, err
+}
+
+// setDigest changes the digest schedule of the user. An empty schedule
+// switches back to instant delivery; matches accumulated so far are
+// then delivered at next.
+func (d *DataBase) setDigest(user string, schedule string, next time.Time) error {
+	query := fmt.Sprintf("UPDATE %s SET digest = NULLIF($1, ''), digest_next = $2 WHERE nickname = $3", d.Names.Users)
+	_, err := d.conn().Exec(query, schedule, next, user)
+	return err
+}
+
+func (d *DataBase) addDigestMessage(message Message) error {
+	query := fmt.Sprintf(
+		`INSERT INTO %s (nickname, link, channel, topic, summary, application, suppressed)
+				VALUES ($1,$2,$3,$4,$5,$6,$7)`,
+		d.Names.Digests)
+	_, err := d.conn().Exec(
+		query,
+		message.User,
+		message.Link,
+		message.Channel,
+		message.Topic,
+		message.Summary,
+		message.Application,
+		message.Suppressed,
+	)
+	return err
+}
+
+// getDueDigests returns the settings of the users of application whose
+// digest is due by now.
+func (d *DataBase) getDueDigests(application Application, now time.Time) (map[string]UserSettings, error) {
+	query := fmt.Sprintf(
+		`SELECT nickname, %s FROM %s
+				WHERE application = $1 AND digest_next <= $2`,
+		userSettingsColumns, d.Names.Users)
+	return d.queryUserSettings(query, application, now)
+}
+
+// getQueuedUsers returns the settings of the users of application who
+// are not paused but have delayed messages outside muted channels and
+// the backlog.
+func (d *DataBase) getQueuedUsers(application Application) (map[string]UserSettings, error) {
+	query := fmt.Sprintf(
+		`SELECT nickname, %s FROM %s u
+				WHERE application = $1 AND NOT paused
+				AND EXISTS (SELECT 1 FROM %s m WHERE m.nickname = u.nickname AND NOT m.backlog
+					AND `+notMutedCondition+`)`,
+		userSettingsColumns, d.Names.Users, d.Names.Messages, d.Names.Mutes)
+	return d.queryUserSettings(query, application)
+}
+
+func (d *DataBase) queryUserSettings(query string, args ...any) (map[string]UserSettings, error) {
+	rows, err := d.conn().Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	answer := make(map[string]UserSettings)
+	for rows.Next() {
+		var user string
+		var settings UserSettings
+		if err := scanUserSettings(rows, &settings, &user); err != nil {
+			return nil, err
+		}
+		answer[user] = settings
+	}
+	return answer, rows.Err()
+}
+
+// setTimezone sets the IANA timezone of the user.
+func (d *DataBase) setTimezone(user, timezone string) error {
+	query := fmt.Sprintf("UPDATE %s SET timezone = NULLIF($1, '') WHERE nickname = $2", d.Names.Users)
+	_, err := d.conn().Exec(query, timezone, user)
+	return err
+}
+
+// setQuietHours sets the quiet hours of the user; empty means none.
+func (d *DataBase) setQuietHours(user, quiet string) error {
+	query := fmt.Sprintf("UPDATE %s SET quiet_hours = NULLIF($1, '') WHERE nickname = $2", d.Names.Users)
+	_, err := d.conn().Exec(query, quiet, user)
+	return err
+}
+
+// popDigestMessages removes and returns the accumulated matches of the
+// user, oldest first.
+func (d *DataBase) popDigestMessages(user string) ([]Message, error) {
+	query := fmt.Sprintf(
+		`WITH deleted AS (DELETE FROM %s WHERE nickname = $1 RETURNING *)
+				SELECT nickname, link, channel, topic, summary, application, suppressed
+				FROM deleted ORDER BY created_at`,
+		d.Names.Digests)
+	rows, err := d.conn().Query(query, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []Message
+	for rows.Next() {
+		var message Message
+		err = rows.Scan(&message.User, &message.Link, &message.Channel, &message.Topic, &message.Summary,
+			&message.Application, &message.Suppressed)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+	return messages, rows.Err()
+}
+
+// ensureDigestNext schedules a digest at next unless one is scheduled.
+func (d *DataBase) ensureDigestNext(user string, next time.Time) error {
+	query := fmt.Sprintf("UPDATE %s SET digest_next = $1 WHERE nickname = $2 AND digest_next IS NULL", d.Names.Users)
+	_, err := d.conn().Exec(query, next, user)
+	return err
+}
+
+// setDigestNext sets the time of the next digest; nil means none.
+func (d *DataBase) setDigestNext(user string, next *time.Time) error {
+	query := fmt.Sprintf("UPDATE %s SET digest_next = $1 WHERE nickname = $2", d.Names.Users)
+	_, err := d.conn().Exec(query, next, user)
+	return err
+}
+
+// pauseUser pauses the user until the given time, nil means until the
+// user continues.
+func (d *DataBase) pauseUser(user string, until *time.Time) error {
+	query := fmt.Sprintf("UPDATE %s SET paused = $1, paused_until = $2 WHERE nickname = $3", d.Names.Users)
+	_, err := d.conn().Exec(
+		query,
+		true,
+		until,
+		user,
+	)
 	return err
 }
 
@@ -392,8 +1249,8 @@ func (d *DataBase) unpauseUser(user string) error {
 	if !isPaused {
 		return nil
 	}
-	query := fmt.Sprintf("UPDATE %s SET paused = $1 WHERE  nickname = $2 ", d.Names.Users)
-	_, err = d.DB.Exec(
+	query := fmt.Sprintf("UPDATE %s SET paused = $1, paused_until = NULL WHERE  nickname = $2 ", d.Names.Users)
+	_, err = d.conn().Exec(
 		query,
 		false,
 		user,
@@ -402,9 +1259,77 @@ func (d *DataBase) unpauseUser(user string) error {
 	return err
 }
 
+// expirePauses unpauses the users of application whose pause is over by
+// now and returns them.
+func (d *DataBase) expirePauses(application Application, now time.Time) ([]string, error) {
+	query := fmt.Sprintf(
+		`UPDATE %s SET paused = false, paused_until = NULL
+				WHERE application = $1 AND paused AND paused_until <= $2
+				RETURNING nickname`,
+		d.Names.Users)
+	rows, err := d.conn().Query(query, application, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []string
+	for rows.Next() {
+		var user string
+		if err := rows.Scan(&user); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (d *DataBase) muteChannel(user, channel string, application Application, until time.Time) error {
+	query := fmt.Sprintf(
+		`INSERT INTO %s (nickname, channel, application, until) VALUES ($1,$2,$3,$4)
+				ON CONFLICT (nickname, channel, application) DO UPDATE SET until = EXCLUDED.until`,
+		d.Names.Mutes)
+	_, err := d.conn().Exec(query, user, channel, application, until)
+	return err
+}
+
+// unmuteChannel returns sql.ErrNoRows if the channel is not muted.
+func (d *DataBase) unmuteChannel(user, channel string, application Application) error {
+	query := fmt.Sprintf(
+		"DELETE FROM %s WHERE nickname = $1 AND channel = $2 AND application = $3 AND until > now()",
+		d.Names.Mutes)
+	res, err := d.conn().Exec(query, user, channel, application)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (d *DataBase) isMuted(user, channel string, application Application) (bool, error) {
+	query := fmt.Sprintf(
+		`SELECT EXISTS (SELECT 1 FROM %s
+				WHERE nickname = $1 AND channel = $2 AND application = $3 AND until > now())`,
+		d.Names.Mutes)
+	var muted bool
+	err := d.conn().QueryRow(query, user, channel, application).Scan(&muted)
+	return muted, err
+}
+
+// expireMutes deletes the mutes which are over by now.
+func (d *DataBase) expireMutes(now time.Time) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE until <= $1", d.Names.Mutes)
+	_, err := d.conn().Exec(query, now)
+	return err
+}
+
 func (d *DataBase) getID(user string) (int64, error) {
 	query := fmt.Sprintf("SELECT id FROM %s WHERE nickname=$1", d.Names.Users)
-	row := d.DB.QueryRow(
+	row := d.conn().QueryRow(
 		query,
 		user,
 	)
@@ -417,9 +1342,17 @@ func (d *DataBase) getID(user string) (int64, error) {
 	return id, nil
 }
 
-func (d *DataBase) addUser(user string, id int64) error {
+// getApplication returns the platform the user talks to the bot on.
+func (d *DataBase) getApplication(user string) (Application, error) {
+	query := fmt.Sprintf("SELECT application FROM %s WHERE nickname = $1", d.Names.Users)
+	var application Application
+	err := d.conn().QueryRow(query, user).Scan(&application)
+	return application, err
+}
+
+func (d *DataBase) addUser(user string, id int64, application Application) error {
 	query := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE nickname=$1", d.Names.Users)
-	row := d.DB.QueryRow(
+	row := d.conn().QueryRow(
 		query,
 		user,
 	)
@@ -428,27 +1361,40 @@ func (d *DataBase) addUser(user string, id int64) error {
 		return err
 	}
 
-	query = fmt.Sprintf("INSERT INTO %s (id, nickname, paused) VALUES ($1,$2,$3)", d.Names.Users)
-	_, err := d.DB.Exec(
+	query = fmt.Sprintf("INSERT INTO %s (id, nickname, paused, application) VALUES ($1,$2,$3,$4)", d.Names.Users)
+	_, err := d.conn().Exec(
 		query,
 		id,
 		user,
 		false,
+		application,
 	)
 
 	return err
 }
 
 func (d *DataBase) getVKPublic() ([]string, error) {
-	query := fmt.Sprintf("SELECT channel FROM %s WHERE application=$1 GROUP BY channel", d.Names.Channels)
-	rows, err := d.DB.Query(
+	return d.getSubscribedChannels(VK)
+}
+
+// getSubscribedChannels returns the channels of application someone is
+// subscribed to directly or through a pack.
+func (d *DataBase) getSubscribedChannels(application Application) ([]string, error) {
+	query := fmt.Sprintf(
+		`SELECT channel FROM %s WHERE application=$1
+				UNION
+				SELECT t.channel FROM %s t WHERE t.application = $1
+				AND EXISTS (SELECT 1 FROM %s s WHERE s.pack = t.pack)`,
+		d.Names.Channels, d.Names.PackTopics, d.Names.PackSubscribers)
+	rows, err := d.conn().Query(
 		query,
-		VK,
+		application,
 	)
 
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
 	var ansRows []string
 
@@ -464,12 +1410,238 @@ func (d *DataBase) getVKPublic() ([]string, error) {
 	return ansRows, nil
 }
 
+// getFeed returns the state of the feed at url, sql.ErrNoRows if it has
+// never been fetched.
+func (d *DataBase) getFeed(url string) (FeedState, error) {
+	query := fmt.Sprintf("SELECT title, etag, last_modified, seen FROM %s WHERE url = $1", d.Names.Feeds)
+	state := FeedState{URL: url}
+	var seen string
+	err := d.conn().QueryRow(query, url).Scan(&state.Title, &state.ETag, &state.LastModified, &seen)
+	if err != nil {
+		return FeedState{}, err
+	}
+	if seen != "" {
+		state.Seen = strings.Split(seen, "\n")
+	}
+	return state, nil
+}
+
+func (d *DataBase) saveFeed(state FeedState) error {
+	query := fmt.Sprintf(
+		`INSERT INTO %s (url, title, etag, last_modified, seen) VALUES ($1, $2, $3, $4, $5)
+				ON CONFLICT (url) DO UPDATE SET title = $2, etag = $3, last_modified = $4, seen = $5`,
+		d.Names.Feeds)
+	_, err := d.conn().Exec(query, state.URL, state.Title, state.ETag, state.LastModified,
+		strings.Join(state.Seen, "\n"))
+	return err
+}
+
+// addMailbox attaches a mailbox or changes one attached by the same
+// owner. The credentials are stored encrypted.
+func (d *DataBase) addMailbox(mailbox Mailbox) error {
+	credentials, err := sealSecret(mailbox.credentials())
+	if err != nil {
+		return err
+	}
+	query := fmt.Sprintf(
+		`INSERT INTO %s (name, owner, url, archive, uid_validity, last_uid, credentials)
+				VALUES ($1, $2, $3, $4, $5, $6, $7)
+				ON CONFLICT (name) DO UPDATE SET url = $3, archive = $4, uid_validity = $5, last_uid = $6,
+					credentials = $7
+				WHERE %s.owner = $2`,
+		d.Names.Mailboxes, d.Names.Mailboxes)
+	res, err := d.conn().Exec(query, mailbox.Name, mailbox.Owner, mailbox.URL, mailbox.Archive,
+		int64(mailbox.UIDValidity), int64(mailbox.LastUID), credentials)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return mailboxTakenError
+	}
+	return nil
+}
+
+func (d *DataBase) getMailbox(name string) (Mailbox, error) {
+	query := fmt.Sprintf(
+		"SELECT owner, url, archive, uid_validity, last_uid, credentials FROM %s WHERE name = $1", d.Names.Mailboxes)
+	mailbox := Mailbox{Name: name}
+	var uidValidity, lastUID int64
+	var credentials []byte
+	err := d.conn().QueryRow(query, name).Scan(&mailbox.Owner, &mailbox.URL, &mailbox.Archive, &uidValidity, &lastUID,
+		&credentials)
+	if err != nil {
+		return Mailbox{}, err
+	}
+	mailbox.UIDValidity, mailbox.LastUID = uint32(uidValidity), uint32(lastUID)
+	if credentials == nil {
+		// The mailbox has not been sealed yet, its URL holds the
+		// credentials.
+		mailbox.URL, mailbox.Login, mailbox.Password, err = splitMailboxURL(mailbox.URL)
+		return mailbox, err
+	}
+	plain, err := openSecret(credentials)
+	if err != nil {
+		return Mailbox{}, err
+	}
+	mailbox.setCredentials(plain)
+	return mailbox, nil
+}
+
+// sealMailboxes moves the credentials of the mailboxes attached before
+// they were encrypted out of their URLs.
+func (d *DataBase) sealMailboxes() error {
+	query := fmt.Sprintf("SELECT name, url FROM %s WHERE credentials IS NULL", d.Names.Mailboxes)
+	rows, err := d.conn().Query(query)
+	if err != nil {
+		return err
+	}
+	var mailboxes []Mailbox
+	for rows.Next() {
+		var mailbox Mailbox
+		if err := rows.Scan(&mailbox.Name, &mailbox.URL); err != nil {
+			rows.Close()
+			return err
+		}
+		mailboxes = append(mailboxes, mailbox)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	query = fmt.Sprintf("UPDATE %s SET url = $2, credentials = $3 WHERE name = $1", d.Names.Mailboxes)
+	for _, mailbox := range mailboxes {
+		var err error
+		if mailbox.URL, mailbox.Login, mailbox.Password, err = splitMailboxURL(mailbox.URL); err != nil {
+			return fmt.Errorf("mailbox %s: %w", mailbox.Name, err)
+		}
+		credentials, err := sealSecret(mailbox.credentials())
+		if err != nil {
+			return err
+		}
+		if _, err := d.conn().Exec(query, mailbox.Name, mailbox.URL, credentials); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setMailboxUID saves the UID of the last seen message of a mailbox.
+func (d *DataBase) setMailboxUID(name string, uidValidity, lastUID uint32) error {
+	query := fmt.Sprintf("UPDATE %s SET uid_validity = $2, last_uid = $3 WHERE name = $1", d.Names.Mailboxes)
+	_, err := d.conn().Exec(query, name, int64(uidValidity), int64(lastUID))
+	return err
+}
+
+// getSyncToken returns the token of the next sync of the Matrix account,
+// sql.ErrNoRows if it has never synced.
+func (d *DataBase) getSyncToken(account string) (string, error) {
+	query := fmt.Sprintf("SELECT next_batch FROM %s WHERE account = $1", d.Names.SyncTokens)
+	var token string
+	err := d.conn().QueryRow(query, account).Scan(&token)
+	return token, err
+}
+
+func (d *DataBase) saveSyncToken(account, token string) error {
+	query := fmt.Sprintf(
+		`INSERT INTO %s (account, next_batch) VALUES ($1, $2)
+				ON CONFLICT (account) DO UPDATE SET next_batch = $2`,
+		d.Names.SyncTokens)
+	_, err := d.conn().Exec(query, account, token)
+	return err
+}
+
+// shareMailbox lets the user read the mailbox of the owner.
+func (d *DataBase) shareMailbox(name, owner, user string) error {
+	query := fmt.Sprintf(
+		`INSERT INTO %s (name, nickname) SELECT name, $3 FROM %s WHERE name = $1 AND owner = $2
+				ON CONFLICT DO NOTHING`,
+		d.Names.MailboxReaders, d.Names.Mailboxes)
+	return d.withTx(func(tx *DataBase) error {
+		if err := tx.checkMailboxOwner(name, owner); err != nil {
+			return err
+		}
+		_, err := tx.conn().Exec(query, name, owner, user)
+		return err
+	})
+}
+
+// unshareMailbox stops sharing the mailbox of the owner with the user.
+func (d *DataBase) unshareMailbox(name, owner, user string) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE name = $1 AND nickname = $2", d.Names.MailboxReaders)
+	return d.withTx(func(tx *DataBase) error {
+		if err := tx.checkMailboxOwner(name, owner); err != nil {
+			return err
+		}
+		_, err := tx.conn().Exec(query, name, user)
+		return err
+	})
+}
+
+// checkMailboxOwner fails with mailboxNotFoundError unless the mailbox
+// is attached by the owner.
+func (d *DataBase) checkMailboxOwner(name, owner string) error {
+	query := fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %s WHERE name = $1 AND owner = $2)", d.Names.Mailboxes)
+	var owned bool
+	if err := d.conn().QueryRow(query, name, owner).Scan(&owned); err != nil {
+		return err
+	}
+	if !owned {
+		return mailboxNotFoundError
+	}
+	return nil
+}
+
+// canReadMailbox tells whether the user is the owner of the mailbox or
+// one it is shared with.
+func (d *DataBase) canReadMailbox(name, user string) (bool, error) {
+	query := fmt.Sprintf(
+		`SELECT EXISTS (SELECT 1 FROM %s WHERE name = $1 AND owner = $2)
+				OR EXISTS (SELECT 1 FROM %s WHERE name = $1 AND nickname = $2)`,
+		d.Names.Mailboxes, d.Names.MailboxReaders)
+	var allowed bool
+	err := d.conn().QueryRow(query, name, user).Scan(&allowed)
+	return allowed, err
+}
+
+// getRepo returns the state of a repository, sql.ErrNoRows if it has
+// never been polled.
+func (d *DataBase) getRepo(repo string) (RepoState, error) {
+	query := fmt.Sprintf("SELECT since, etags FROM %s WHERE repo = $1", d.Names.Repos)
+	state := RepoState{Repo: repo, ETags: make(map[string]string)}
+	var etags string
+	if err := d.conn().QueryRow(query, repo).Scan(&state.Since, &etags); err != nil {
+		return RepoState{}, err
+	}
+	// Every line is a kind of items and its etag.
+	for _, line := range strings.Split(etags, "\n") {
+		if kind, etag, found := strings.Cut(line, " "); found {
+			state.ETags[kind] = etag
+		}
+	}
+	return state, nil
+}
+
+func (d *DataBase) saveRepo(state RepoState) error {
+	query := fmt.Sprintf(
+		`INSERT INTO %s (repo, since, etags) VALUES ($1, $2, $3)
+				ON CONFLICT (repo) DO UPDATE SET since = $2, etags = $3`,
+		d.Names.Repos)
+	var etags []string
+	for kind, etag := range state.ETags {
+		if etag != "" {
+			etags = append(etags, kind+" "+etag)
+		}
+	}
+	_, err := d.conn().Exec(query, state.Repo, state.Since, strings.Join(etags, "\n"))
+	return err
+}
+
 func (d *DataBase) updateVKLastPostID(groupID string, postID int) error {
 	query := fmt.Sprintf(
 		`INSERT INTO %s (groupid, last_post) VALUES ($1, $2)
 				ON CONFLICT (groupid) DO UPDATE SET last_post =  $3`,
 		d.Names.VKPostID)
-	_, err := d.DB.Exec(
+	_, err := d.conn().Exec(
 		query,
 		groupID,
 		postID,
@@ -480,7 +1652,7 @@ func (d *DataBase) updateVKLastPostID(groupID string, postID int) error {
 
 func (d *DataBase) getVKLastPostID(groupID string) (int, error) {
 	query := fmt.Sprintf("SELECT last_post FROM %s WHERE groupID=$1", d.Names.VKPostID)
-	row := d.DB.QueryRow(
+	row := d.conn().QueryRow(
 		query,
 		groupID,
 	)
@@ -498,7 +1670,7 @@ func (d *DataBase) addVKPublic(groupName, groupID string, postID int) error {
 		`INSERT INTO %s (groupid, last_post, public_name) VALUES ($1, $2, $3)
 				ON CONFLICT (groupid) DO UPDATE SET public_name =  $4`,
 		d.Names.VKPostID)
-	_, err := d.DB.Exec(
+	_, err := d.conn().Exec(
 		query,
 		groupID,
 		postID,
@@ -510,7 +1682,7 @@ func (d *DataBase) addVKPublic(groupName, groupID string, postID int) error {
 
 func (d *DataBase) getVKPublicNameByID(groupID string) (string, error) {
 	query := fmt.Sprintf("SELECT public_name FROM %s WHERE groupid = $1", d.Names.VKPostID)
-	row := d.DB.QueryRow(query, groupID)
+	row := d.conn().QueryRow(query, groupID)
 
 	var name string
 	err := row.Scan(&name)
@@ -521,3 +1693,517 @@ func (d *DataBase) getVKPublicNameByID(groupID string) (string, error) {
 	return name, nil
 
 }
+
+func (d *DataBase) getUserData(user string) (UserData, error) {
+	data := UserData{User: user}
+	err := d.withTx(func(tx *DataBase) error {
+
+		query := fmt.Sprintf("SELECT id, %s FROM %s WHERE nickname = $1", userSettingsColumns, d.Names.Users)
+		var settings UserSettings
+		err := scanUserSettings(tx.conn().QueryRow(query, user), &settings, &data.ID)
+		data.Paused, data.PausedUntil, data.Digest = settings.Paused, settings.PausedUntil, settings.Digest
+		data.Timezone, data.QuietHours = settings.Timezone, settings.QuietHours
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+
+		query = fmt.Sprintf(
+			`SELECT application, channel, topic, cooldown, priority, last_time, destinations FROM %s
+					WHERE nickname = $1 ORDER BY application, channel, topic`,
+			d.Names.Channels)
+		rows, err := tx.conn().Query(query, user)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var sub Subscription
+			err = rows.Scan(&sub.Application, &sub.Channel, &sub.Topic, &sub.Cooldown, &sub.Priority, &sub.LastTime,
+				&sub.Destinations)
+			if err != nil {
+				return err
+			}
+			data.Subscriptions = append(data.Subscriptions, sub)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		if data.Packs, err = tx.getPacks(user); err != nil {
+			return err
+		}
+		query = fmt.Sprintf("SELECT name FROM %s WHERE owner = $1 ORDER BY name", d.Names.Packs)
+		rows, err = tx.conn().Query(query, user)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				return err
+			}
+			data.OwnedPacks = append(data.OwnedPacks, name)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		query = fmt.Sprintf(
+			`SELECT nickname, link, channel, topic, summary, application, suppressed
+					FROM %s WHERE nickname = $1 ORDER BY created_at`,
+			d.Names.Messages)
+		rows, err = tx.conn().Query(query, user)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var message Message
+			err = rows.Scan(&message.User, &message.Link, &message.Channel, &message.Topic, &message.Summary,
+				&message.Application, &message.Suppressed)
+			if err != nil {
+				return err
+			}
+			data.Queued = append(data.Queued, message)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		query = fmt.Sprintf(
+			`SELECT nickname, link, channel, topic, summary, application, suppressed
+					FROM %s WHERE nickname = $1 ORDER BY created_at`,
+			d.Names.Digests)
+		rows, err = tx.conn().Query(query, user)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var message Message
+			err = rows.Scan(&message.User, &message.Link, &message.Channel, &message.Topic, &message.Summary,
+				&message.Application, &message.Suppressed)
+			if err != nil {
+				return err
+			}
+			data.Digested = append(data.Digested, message)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		query = fmt.Sprintf(
+			`SELECT application, channel, until FROM %s
+					WHERE nickname = $1 ORDER BY application, channel`,
+			d.Names.Mutes)
+		rows, err = tx.conn().Query(query, user)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var mute Mute
+			if err := rows.Scan(&mute.Application, &mute.Channel, &mute.Until); err != nil {
+				return err
+			}
+			data.Mutes = append(data.Mutes, mute)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		query = fmt.Sprintf(
+			`SELECT nickname, application, channel, topic, link, summary, sent_at, status
+					FROM %s WHERE nickname = $1 ORDER BY sent_at`,
+			d.Names.Deliveries)
+		rows, err = tx.conn().Query(query, user)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var delivery Delivery
+			err = rows.Scan(&delivery.User, &delivery.Application, &delivery.Channel, &delivery.Topic,
+				&delivery.Link, &delivery.Summary, &delivery.SentAt, &delivery.Status)
+			if err != nil {
+				return err
+			}
+			data.Delivered = append(data.Delivered, delivery)
+		}
+		return rows.Err()
+	})
+	return data, err
+}
+
+// forgetUser deletes every row stored about the user.
+func (d *DataBase) forgetUser(user string) error {
+	return d.withTx(func(tx *DataBase) error {
+		query := fmt.Sprintf(
+			`DELETE FROM %s WHERE pack IN (SELECT name FROM %s WHERE owner = $1)`,
+			d.Names.PackSubscribers, d.Names.Packs)
+		if _, err := tx.conn().Exec(query, user); err != nil {
+			return err
+		}
+		query = fmt.Sprintf(
+			`DELETE FROM %s WHERE pack IN (SELECT name FROM %s WHERE owner = $1)`,
+			d.Names.PackTopics, d.Names.Packs)
+		if _, err := tx.conn().Exec(query, user); err != nil {
+			return err
+		}
+		query = fmt.Sprintf("DELETE FROM %s WHERE owner = $1", d.Names.Packs)
+		if _, err := tx.conn().Exec(query, user); err != nil {
+			return err
+		}
+		// Mailboxes hold the credentials of their owner.
+		query = fmt.Sprintf(
+			`DELETE FROM %s WHERE nickname = $1 OR name IN (SELECT name FROM %s WHERE owner = $1)`,
+			d.Names.MailboxReaders, d.Names.Mailboxes)
+		if _, err := tx.conn().Exec(query, user); err != nil {
+			return err
+		}
+		query = fmt.Sprintf("DELETE FROM %s WHERE owner = $1", d.Names.Mailboxes)
+		if _, err := tx.conn().Exec(query, user); err != nil {
+			return err
+		}
+
+		for _, table := range []string{
+			d.Names.Channels,
+			d.Names.Messages,
+			d.Names.Digests,
+			d.Names.Mutes,
+			d.Names.Deliveries,
+			d.Names.Notified,
+			d.Names.Confirmations,
+			d.Names.PackSubscribers,
+			d.Names.Users,
+		} {
+			query := fmt.Sprintf("DELETE FROM %s WHERE nickname = $1", table)
+			if _, err := tx.conn().Exec(query, user); err != nil {
+				return err
+			}
+		}
+		// The history requests of the user are event jobs naming them.
+		for _, table := range []string{d.Names.WorkQueue, d.Names.DeadLetters} {
+			query := fmt.Sprintf(
+				`DELETE FROM %s WHERE (kind = $1 AND payload->>'user' = $3)
+						OR (kind = $2 AND payload->>'history_user' = $3)`,
+				table)
+			if _, err := tx.conn().Exec(query, JobNotification, JobEvent, user); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// prune deletes delayed messages, delivery logs, deduplication keys and
+// dead letters created before the given time and returns the number of deleted rows.
+func (d *DataBase) prune(before time.Time) (int64, error) {
+	var total int64
+	err := d.withTx(func(tx *DataBase) error {
+		// The delayed messages of paused users are kept however long the
+		// pause is.
+		notPaused := fmt.Sprintf(
+			" AND NOT EXISTS (SELECT 1 FROM %s u WHERE u.nickname = m.nickname AND u.paused)", d.Names.Users)
+		for _, table := range []struct {
+			name      string
+			column    string
+			condition string
+		}{
+			{d.Names.Messages, "created_at", notPaused},
+			{d.Names.Digests, "created_at", ""},
+			{d.Names.Deliveries, "sent_at", ""},
+			{d.Names.Notified, "notified_at", ""},
+			{d.Names.DeadLetters, "failed_at", ""},
+		} {
+			query := fmt.Sprintf("DELETE FROM %s m WHERE %s < $1%s", table.name, table.column, table.condition)
+			res, err := tx.conn().Exec(query, before)
+			if err != nil {
+				return err
+			}
+			affected, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			total += affected
+		}
+		return nil
+	})
+	return total, err
+}
+
+// publishPack creates or replaces the pack name with a snapshot of the
+// owner's subscriptions to topics, all of them if topics is empty, and
+// returns the number of topics in it. It returns packTopicsError if the
+// owner has none of topics.
+func (d *DataBase) publishPack(owner, name string, topics []string) (int64, error) {
+	var count int64
+	err := d.withTx(func(tx *DataBase) error {
+		query := fmt.Sprintf(
+			`INSERT INTO %s (name, owner) VALUES ($1, $2)
+					ON CONFLICT (name) DO UPDATE SET owner = %[1]s.owner
+					RETURNING owner`,
+			d.Names.Packs)
+		var current string
+		if err := tx.conn().QueryRow(query, name, owner).Scan(&current); err != nil {
+			return err
+		}
+		if current != owner {
+			return packOwnedError
+		}
+
+		query = fmt.Sprintf("DELETE FROM %s WHERE pack = $1", d.Names.PackTopics)
+		if _, err := tx.conn().Exec(query, name); err != nil {
+			return err
+		}
+		query = fmt.Sprintf(
+			`INSERT INTO %s (pack, channel, topic, application)
+					SELECT DISTINCT $1, channel, topic, application FROM %s WHERE nickname = $2`,
+			d.Names.PackTopics, d.Names.Channels)
+		args := []any{name, owner}
+		if len(topics) > 0 {
+			query += " AND topic = ANY($3)"
+			args = append(args, topics)
+		}
+		res, err := tx.conn().Exec(query, args...)
+		if err != nil {
+			return err
+		}
+		if count, err = res.RowsAffected(); err == nil && count == 0 && len(topics) > 0 {
+			return packTopicsError
+		}
+		return err
+	})
+	return count, err
+}
+
+func (d *DataBase) unpublishPack(owner, name string) error {
+	return d.withTx(func(tx *DataBase) error {
+		query := fmt.Sprintf("DELETE FROM %s WHERE name = $1 AND owner = $2", d.Names.Packs)
+		res, err := tx.conn().Exec(query, name, owner)
+		if err != nil {
+			return err
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected == 0 {
+			return sql.ErrNoRows
+		}
+		for _, table := range []string{d.Names.PackTopics, d.Names.PackSubscribers} {
+			query = fmt.Sprintf("DELETE FROM %s WHERE pack = $1", table)
+			if _, err := tx.conn().Exec(query, name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (d *DataBase) subscribePack(user, name string) error {
+	query := fmt.Sprintf(
+		`INSERT INTO %s (pack, nickname) SELECT name, $2 FROM %s WHERE name = $1
+				ON CONFLICT DO NOTHING`,
+		d.Names.PackSubscribers, d.Names.Packs)
+	res, err := d.conn().Exec(query, name, user)
+	if err != nil {
+		return err
+	}
+	if affected, err := res.RowsAffected(); err != nil {
+		return err
+	} else if affected != 0 {
+		return nil
+	}
+
+	var exists bool
+	query = fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %s WHERE name = $1)", d.Names.Packs)
+	if err := d.conn().QueryRow(query, name).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (d *DataBase) unsubscribePack(user, name string) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE pack = $1 AND nickname = $2", d.Names.PackSubscribers)
+	res, err := d.conn().Exec(query, name, user)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// getPacks returns the names of the packs the user is subscribed to.
+func (d *DataBase) getPacks(user string) ([]string, error) {
+	query := fmt.Sprintf("SELECT pack FROM %s WHERE nickname = $1 ORDER BY pack", d.Names.PackSubscribers)
+	rows, err := d.conn().Query(query, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var packs []string
+	for rows.Next() {
+		var pack string
+		if err := rows.Scan(&pack); err != nil {
+			return nil, err
+		}
+		packs = append(packs, pack)
+	}
+	return packs, rows.Err()
+}
+
+// enqueueJob stores a job to be run at the given time and returns its id.
+func (d *DataBase) enqueueJob(job Job, at time.Time) (int64, error) {
+	query := fmt.Sprintf(
+		`INSERT INTO %s (kind, payload, attempts, next_attempt, destination)
+				VALUES ($1, $2, $3, $4, NULLIF($5, '')) RETURNING id`,
+		d.Names.WorkQueue)
+	var id int64
+	err := d.conn().QueryRow(query, job.Kind, string(job.Payload), job.Attempts, at, job.Destination).Scan(&id)
+	return id, err
+}
+
+// claimJobs returns up to limit due jobs and locks them for lease, so
+// that they are claimed again only if they are neither completed nor
+// rescheduled in time. Only the jobs routed to one of destinations or
+// to none are claimed.
+func (d *DataBase) claimJobs(limit int, lease time.Duration, destinations []DestinationKind) ([]Job, error) {
+	query := fmt.Sprintf(
+		`UPDATE %s SET locked_until = $1 WHERE id IN (
+				SELECT id FROM %[1]s
+				WHERE next_attempt <= $2 AND (locked_until IS NULL OR locked_until <= $2)
+					AND (destination IS NULL OR destination = ANY($4))
+				ORDER BY next_attempt LIMIT $3 FOR UPDATE SKIP LOCKED)
+				RETURNING id, kind, payload, attempts, COALESCE(destination, '')`,
+		d.Names.WorkQueue)
+	now := time.Now()
+	rows, err := d.conn().Query(query, now.Add(lease), now, limit, destinations)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []Job
+	for rows.Next() {
+		var job Job
+		var payload string
+		if err := rows.Scan(&job.ID, &job.Kind, &payload, &job.Attempts, &job.Destination); err != nil {
+			return nil, err
+		}
+		job.Payload = []byte(payload)
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+func (d *DataBase) completeJob(id int64) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE id = $1", d.Names.WorkQueue)
+	_, err := d.conn().Exec(query, id)
+	return err
+}
+
+// retryJob unlocks the job and schedules its next attempt.
+func (d *DataBase) retryJob(id int64, attempts int, at time.Time, lastErr string) error {
+	query := fmt.Sprintf(
+		`UPDATE %s SET attempts = $1, next_attempt = $2, locked_until = NULL, last_error = $3
+				WHERE id = $4`,
+		d.Names.WorkQueue)
+	_, err := d.conn().Exec(query, attempts, at, lastErr, id)
+	return err
+}
+
+// buryJob moves the job to the dead letters.
+func (d *DataBase) buryJob(job Job, class FailureClass, text string) error {
+	return d.withTx(func(tx *DataBase) error {
+		query := fmt.Sprintf(
+			`INSERT INTO %s (kind, payload, attempts, failure_class, error, destination)
+					VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''))`,
+			d.Names.DeadLetters)
+		_, err := tx.conn().Exec(query, job.Kind, string(job.Payload), job.Attempts, class, text, job.Destination)
+		if err != nil {
+			return err
+		}
+		if job.ID == 0 {
+			return nil
+		}
+		return tx.completeJob(job.ID)
+	})
+}
+
+// getDeadLetters returns up to limit latest dead letters.
+func (d *DataBase) getDeadLetters(limit int) ([]DeadLetter, error) {
+	query := fmt.Sprintf(
+		`SELECT id, kind, payload, attempts, failure_class, error, failed_at FROM %s
+				ORDER BY failed_at DESC, id DESC LIMIT $1`,
+		d.Names.DeadLetters)
+	rows, err := d.conn().Query(query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var letters []DeadLetter
+	for rows.Next() {
+		var letter DeadLetter
+		var payload string
+		err := rows.Scan(&letter.ID, &letter.Kind, &payload, &letter.Attempts, &letter.Class, &letter.Error,
+			&letter.FailedAt)
+		if err != nil {
+			return nil, err
+		}
+		letter.Payload = []byte(payload)
+		letters = append(letters, letter)
+	}
+	return letters, rows.Err()
+}
+
+// replayDeadLetter moves the dead letter back to the work queue with its
+// attempts reset. It returns sql.ErrNoRows if there is no such letter.
+func (d *DataBase) replayDeadLetter(id int64) error {
+	return d.withTx(func(tx *DataBase) error {
+		query := fmt.Sprintf(
+			`WITH replayed AS (DELETE FROM %s WHERE id = $1 RETURNING kind, payload, destination)
+					INSERT INTO %s (kind, payload, attempts, next_attempt, destination)
+					SELECT kind, payload, 0, now(), destination FROM replayed`,
+			d.Names.DeadLetters, d.Names.WorkQueue)
+		res, err := tx.conn().Exec(query, id)
+		if err != nil {
+			return err
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected == 0 {
+			return sql.ErrNoRows
+		}
+		return nil
+	})
+}
+
+// replayDeadLetters moves every dead letter back to the work queue and
+// returns their number.
+func (d *DataBase) replayDeadLetters() (int64, error) {
+	query := fmt.Sprintf(
+		`WITH replayed AS (DELETE FROM %s RETURNING kind, payload, destination)
+				INSERT INTO %s (kind, payload, attempts, next_attempt, destination)
+				SELECT kind, payload, 0, now(), destination FROM replayed`,
+		d.Names.DeadLetters, d.Names.WorkQueue)
+	res, err := d.conn().Exec(query)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -5,14 +5,33 @@ import (
 	_ "embed"
 	"fmt"
 	"gopkg.in/yaml.v2"
+	"reflect"
 	_ "runtime/debug"
+	"sort"
+	"sync"
 	"testing"
+	"time"
 )
 
 var names = TablesNames{
-	Channels: "channels_test",
-	Users:    "users_test",
-	Messages: "message_test",
+	Channels:        "channels_test",
+	Users:           "users_test",
+	Messages:        "message_test",
+	Deliveries:      "deliveries_test",
+	Notified:        "notified_test",
+	Packs:           "packs_test",
+	PackTopics:      "pack_topics_test",
+	PackSubscribers: "pack_subscribers_test",
+	Digests:         "digest_messages_test",
+	Mutes:           "mutes_test",
+	WorkQueue:       "work_queue_test",
+	DeadLetters:     "dead_letters_test",
+	Feeds:           "feeds_test",
+	Mailboxes:       "mailboxes_test",
+	MailboxReaders:  "mailbox_readers_test",
+	SyncTokens:      "sync_tokens_test",
+	Repos:           "repos_test",
+	Confirmations:   "confirmations_test",
 }
 
 //go:embed migrations/init_test.sql
@@ -28,7 +47,7 @@ func NewTestDatabase(cfg DBConfig, names TablesNames) (*DataBase, error) {
 	if _, err := db.Exec(initScriptTest); err != nil {
 		return nil, err
 	}
-	return &DataBase{db, names}, nil
+	return &DataBase{DB: db, Names: names}, nil
 }
 
 func TestAddUser(t *testing.T) {
@@ -61,7 +80,7 @@ func TestAddUser(t *testing.T) {
 		{"user5", 4, fmt.Sprintf("SELECT COUNT(*) FROM %s", names.Users)},
 		{"user6", 5, fmt.Sprintf("SELECT COUNT(*) FROM %s", names.Users)},
 	} {
-		err = testBase.addUser(tc.user, tc.id)
+		err = testBase.addUser(tc.user, tc.id, Telegram)
 		if err != nil {
 			t.Errorf("error in adding User :[%s] \n", err.Error())
 		}
@@ -75,3 +94,169 @@ func TestAddUser(t *testing.T) {
 		}
 	}
 }
+
+// TestMarkNotifiedConcurrent notifies about a message and its edit at
+// once, as two processes sharing the work queue do.
+func TestMarkNotifiedConcurrent(t *testing.T) {
+	var dbConfig DBConfig
+	if err := yaml.Unmarshal(rawDBConfig, &dbConfig); err != nil {
+		t.Fatal(err)
+	}
+	testBase, err := NewTestDatabase(dbConfig, names)
+	if err != nil {
+		t.Skipf("database is not available: %s", err.Error())
+	}
+	if _, err := testBase.DB.Exec(fmt.Sprintf("DELETE FROM %s", names.Notified)); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := []map[string][]string{
+		{"alice": {"exam"}, "bob": {"exam"}},
+		{"alice": {"exam", "deadline"}, "bob": {"exam"}},
+	}
+	for i := 0; i < 20; i++ {
+		messageID := fmt.Sprint(i)
+		results := make([]map[string][]string, len(calls))
+		errs := make([]error, len(calls))
+		var wg sync.WaitGroup
+		for j, topics := range calls {
+			wg.Add(1)
+			go func(j int, topics map[string][]string) {
+				defer wg.Done()
+				results[j], errs[j] = testBase.markNotified(Telegram, "-100", messageID, topics)
+			}(j, topics)
+		}
+		wg.Wait()
+
+		notified := map[string][]string{}
+		for j, result := range results {
+			if errs[j] != nil {
+				t.Fatal(errs[j])
+			}
+			for user, topics := range result {
+				notified[user] = append(notified[user], topics...)
+			}
+		}
+		for _, topics := range notified {
+			sort.Strings(topics)
+		}
+		want := map[string][]string{"alice": {"deadline", "exam"}, "bob": {"exam"}}
+		if !reflect.DeepEqual(notified, want) {
+			t.Errorf("message %s: notified about %v, want each of %v once", messageID, notified, want)
+		}
+	}
+}
+
+// countingQuerier counts the statements sent to the database.
+type countingQuerier struct {
+	querier
+	n int
+}
+
+func (c *countingQuerier) Exec(query string, args ...any) (sql.Result, error) {
+	c.n++
+	return c.querier.Exec(query, args...)
+}
+
+func (c *countingQuerier) Query(query string, args ...any) (*sql.Rows, error) {
+	c.n++
+	return c.querier.Query(query, args...)
+}
+
+func (c *countingQuerier) QueryRow(query string, args ...any) *sql.Row {
+	c.n++
+	return c.querier.QueryRow(query, args...)
+}
+
+const (
+	benchChannel     = "bench_channel"
+	benchUsers       = 20
+	benchTopicsCount = 5
+)
+
+func newBenchDatabase(b *testing.B) (*DataBase, *countingQuerier, []string) {
+	var dbConfig DBConfig
+	if err := yaml.Unmarshal(rawDBConfig, &dbConfig); err != nil {
+		b.Fatal(err)
+	}
+	testBase, err := NewTestDatabase(dbConfig, names)
+	if err != nil {
+		b.Fatalf("error in creating data base with error :[%s] \n", err.Error())
+	}
+
+	_, err = testBase.DB.Exec(fmt.Sprintf("DELETE FROM %s;", names.Channels))
+	if err != nil {
+		b.Fatalf("error in delete from data base with :[%s] \n", err.Error())
+	}
+
+	var topics []string
+	for i := 0; i < benchTopicsCount; i++ {
+		topics = append(topics, fmt.Sprintf("topic%d", i))
+	}
+	for i := 0; i < benchUsers; i++ {
+		for _, topic := range topics {
+			user := fmt.Sprintf("user%d", i)
+			if err := testBase.addTopic(user, benchChannel, topic, Telegram); err != nil {
+				b.Fatalf("error in adding topic :[%s] \n", err.Error())
+			}
+		}
+	}
+
+	counter := &countingQuerier{querier: testBase.DB}
+	testBase.q = counter
+	return testBase, counter, topics
+}
+
+// BenchmarkMatchPerTopic reproduces the former access pattern: one
+// getUsers query per topic and one setTime statement per user and topic.
+func BenchmarkMatchPerTopic(b *testing.B) {
+	testBase, counter, topics := newBenchDatabase(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, topic := range topics {
+			users, err := testBase.getUsers(benchChannel, []string{topic}, Telegram)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for user := range users {
+				single := map[string]Subscriber{user: {Topics: []string{topic}}}
+				if err := testBase.setTimes(benchChannel, single, Telegram); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+		resetLastTime(b, testBase)
+	}
+	b.ReportMetric(float64(counter.n)/float64(b.N), "queries/op")
+}
+
+// BenchmarkMatchBatched uses one getUsers query and one bulk setTimes
+// statement per matched message.
+func BenchmarkMatchBatched(b *testing.B) {
+	testBase, counter, topics := newBenchDatabase(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		users, err := testBase.getUsers(benchChannel, topics, Telegram)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := testBase.setTimes(benchChannel, users, Telegram); err != nil {
+			b.Fatal(err)
+		}
+		resetLastTime(b, testBase)
+	}
+	b.ReportMetric(float64(counter.n)/float64(b.N), "queries/op")
+}
+
+// resetLastTime makes every subscription eligible again without being
+// counted as a round-trip of the measured code.
+func resetLastTime(b *testing.B, testBase *DataBase) {
+	b.StopTimer()
+	query := fmt.Sprintf("UPDATE %s SET last_time = $1", names.Channels)
+	if _, err := testBase.DB.Exec(query, time.Unix(0, 0)); err != nil {
+		b.Fatal(err)
+	}
+	b.StartTimer()
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	DigestHourly = "hourly"
+	DigestDaily  = "daily"
+	DigestWeekly = "weekly"
+
+	// maxDigestLength keeps a digest message under the Telegram limit.
+	maxDigestLength = 4000
+)
+
+var wrongDigestError = errors.New(
+	"Неправильное расписание. Используйте off, hourly, daily ЧЧ:ММ или weekly <mon-sun> ЧЧ:ММ")
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// DigestSchedule tells when accumulated matches are delivered.
+type DigestSchedule struct {
+	Kind    string
+	Weekday time.Weekday
+	Hour    int
+	Minute  int
+}
+
+// parseDigestSchedule parses "hourly", "daily HH:MM" or
+// "weekly <day> HH:MM".
+func parseDigestSchedule(s string) (DigestSchedule, error) {
+	fields := strings.Fields(strings.ToLower(s))
+	if len(fields) == 0 {
+		return DigestSchedule{}, wrongDigestError
+	}
+	schedule := DigestSchedule{Kind: fields[0]}
+	var err error
+	switch {
+	case schedule.Kind == DigestHourly && len(fields) == 1:
+		return schedule, nil
+	case schedule.Kind == DigestDaily && len(fields) == 2:
+		schedule.Hour, schedule.Minute, err = parseClock(fields[1])
+	case schedule.Kind == DigestWeekly && len(fields) == 3:
+		var found bool
+		if schedule.Weekday, found = weekdays[fields[1]]; !found {
+			return DigestSchedule{}, wrongDigestError
+		}
+		schedule.Hour, schedule.Minute, err = parseClock(fields[2])
+	default:
+		return DigestSchedule{}, wrongDigestError
+	}
+	if err != nil {
+		return DigestSchedule{}, wrongDigestError
+	}
+	return schedule, nil
+}
+
+// parseClock parses a wall clock time in the HH:MM format.
+func parseClock(s string) (int, int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, 0, err
+	}
+	return t.Hour(), t.Minute(), nil
+}
+
+func (d DigestSchedule) String() string {
+	switch d.Kind {
+	case DigestDaily:
+		return fmt.Sprintf("%s %02d:%02d", d.Kind, d.Hour, d.Minute)
+	case DigestWeekly:
+		return fmt.Sprintf("%s %s %02d:%02d", d.Kind,
+			strings.ToLower(d.Weekday.String()[:3]), d.Hour, d.Minute)
+	}
+	return d.Kind
+}
+
+// next returns the first delivery time strictly after the given one, in
+// its location.
+func (d DigestSchedule) next(after time.Time) time.Time {
+	if d.Kind == DigestHourly {
+		return after.Truncate(time.Hour).Add(time.Hour)
+	}
+	y, m, day := after.Date()
+	candidate := time.Date(y, m, day, d.Hour, d.Minute, 0, 0, after.Location())
+	if d.Kind == DigestWeekly {
+		shift := (int(d.Weekday) - int(candidate.Weekday()) + 7) % 7
+		candidate = time.Date(y, m, day+shift, d.Hour, d.Minute, 0, 0, after.Location())
+	}
+	for !candidate.After(after) {
+		step := 1
+		if d.Kind == DigestWeekly {
+			step = 7
+		}
+		y, m, day = candidate.Date()
+		candidate = time.Date(y, m, day+step, d.Hour, d.Minute, 0, 0, after.Location())
+	}
+	return candidate
+}
+
+type digestGroup struct {
+	application Application
+	channel     string
+	topic       string
+	messages    []Message
+}
+
+// groupDigest groups messages by channel and topic keeping the order of
+// the first message of every group.
+func groupDigest(messages []Message) []*digestGroup {
+	var groups []*digestGroup
+	byKey := make(map[[3]string]*digestGroup)
+	for _, message := range messages {
+		key := [3]string{message.Application, message.Channel, message.Topic}
+		group, found := byKey[key]
+		if !found {
+			group = &digestGroup{
+				application: message.Application,
+				channel:     message.Channel,
+				topic:       message.Topic,
+			}
+			byKey[key] = group
+			groups = append(groups, group)
+		}
+		group.messages = append(group.messages, message)
+	}
+	return groups
+}
+
+// digestPart is a text of a digest with the messages it shows.
+type digestPart struct {
+	text     string
+	messages []Message
+}
+
+// splitDigest renders one part per channel and topic. Groups which do
+// not fit into a single message are split.
+func splitDigest(messages []Message) []digestPart {
+	var parts []digestPart
+	for _, group := range groupDigest(messages) {
+		header := fmt.Sprintf("Digest: %s %s [%s], messages: %d\n",
+			group.application, group.channel, group.topic, len(group.messages))
+		str := strings.Builder{}
+		str.WriteString(header)
+		var shown []Message
+		for _, message := range group.messages {
+			item := fmt.Sprintf("\n• %s\n%s\n", message.Summary, message.Link)
+			if message.Suppressed > 0 {
+				item += fmt.Sprintf(suppressedFormat, message.Suppressed)
+			}
+			if str.Len()+len(item) > maxDigestLength && str.Len() > len(header) {
+				parts = append(parts, digestPart{text: str.String(), messages: shown})
+				str.Reset()
+				str.WriteString(header)
+				shown = nil
+			}
+			str.WriteString(item)
+			shown = append(shown, message)
+		}
+		parts = append(parts, digestPart{text: str.String(), messages: shown})
+	}
+	return parts
+}
+
+// renderDigest renders the texts of the digest.
+func renderDigest(messages []Message) []string {
+	parts := splitDigest(messages)
+	texts := make([]string, 0, len(parts))
+	for _, part := range parts {
+		texts = append(texts, part.text)
+	}
+	return texts
+}
+
+// digestOverview asks the summarizer for an overview of the digest. It
+// returns an empty string if the summarizer is not configured.
+func digestOverview(messages []Message) string {
+	if openAIkey == "" || len(messages) < 2 {
+		return ""
+	}
+	summaries := make([]string, 0, len(messages))
+	for _, message := range messages {
+		summaries = append(summaries, message.Summary)
+	}
+	overview, err := api.summarize(strings.Join(summaries, "\n"), openAIkey)
+	if err != nil {
+		log.Printf("error in OpenAI uisng with error: %s \n", err.Error())
+		return ""
+	}
+	return "Overview: " + overview
+}
+
+// changeDigest shows or changes the digest schedule of the user
+// according to the command argument and returns the reply.
+func changeDigest(user, arg string) (string, error) {
+	arg = strings.TrimSpace(arg)
+	now := time.Now()
+	switch strings.ToLower(arg) {
+	case "":
+		settings, err := dataBase.getUserSettings(user)
+		if err != nil {
+			return "", err
+		}
+		if settings.Digest == "" {
+			return "Дайджест выключен, уведомления приходят сразу", nil
+		}
+		return fmt.Sprintf("Дайджест: %s (%s)", settings.Digest, settings.location()), nil
+	case "off":
+		if err := dataBase.setDigest(user, "", now); err != nil {
+			return "", err
+		}
+		return "Дайджест выключен, уведомления будут приходить сразу", nil
+	}
+
+	schedule, err := parseDigestSchedule(arg)
+	if err != nil {
+		return "", err
+	}
+	settings, err := dataBase.getUserSettings(user)
+	if err != nil {
+		return "", err
+	}
+	next := schedule.next(now.In(settings.location()))
+	if err := dataBase.setDigest(user, schedule.String(), next); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Дайджест: %s, следующий будет %s", schedule, next.Format(historyTimeFormat)), nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDigestSchedule(t *testing.T) {
+	for _, tc := range []struct {
+		given  string
+		answer DigestSchedule
+	}{
+		{"hourly", DigestSchedule{Kind: DigestHourly}},
+		{"daily 09:00", DigestSchedule{Kind: DigestDaily, Hour: 9}},
+		{"Daily 21:30", DigestSchedule{Kind: DigestDaily, Hour: 21, Minute: 30}},
+		{"weekly mon 08:15", DigestSchedule{Kind: DigestWeekly, Weekday: time.Monday, Hour: 8, Minute: 15}},
+	} {
+		res, err := parseDigestSchedule(tc.given)
+		if err != nil {
+			t.Errorf("Error (%s) in parsing: %s", err.Error(), tc.given)
+		}
+		if res != tc.answer {
+			t.Errorf("Got %v but answer is %v", res, tc.answer)
+		}
+		again, err := parseDigestSchedule(res.String())
+		if err != nil || again != res {
+			t.Errorf("%v does not survive String: %s", res, res.String())
+		}
+	}
+
+	for _, given := range []string{"", "daily", "daily 25:00", "weekly 09:00", "weekly xyz 09:00", "hourly 09:00", "monthly"} {
+		if _, err := parseDigestSchedule(given); err == nil {
+			t.Errorf("No error in parsing: %q", given)
+		}
+	}
+}
+
+func TestDigestScheduleNext(t *testing.T) {
+	loc := time.UTC
+	// 2026-10-14 is a Wednesday.
+	now := time.Date(2026, 10, 14, 10, 20, 0, 0, loc)
+	for _, tc := range []struct {
+		schedule DigestSchedule
+		answer   time.Time
+	}{
+		{DigestSchedule{Kind: DigestHourly}, time.Date(2026, 10, 14, 11, 0, 0, 0, loc)},
+		{DigestSchedule{Kind: DigestDaily, Hour: 12}, time.Date(2026, 10, 14, 12, 0, 0, 0, loc)},
+		{DigestSchedule{Kind: DigestDaily, Hour: 9}, time.Date(2026, 10, 15, 9, 0, 0, 0, loc)},
+		{DigestSchedule{Kind: DigestDaily, Hour: 10, Minute: 20}, time.Date(2026, 10, 15, 10, 20, 0, 0, loc)},
+		{DigestSchedule{Kind: DigestWeekly, Weekday: time.Friday, Hour: 9}, time.Date(2026, 10, 16, 9, 0, 0, 0, loc)},
+		{DigestSchedule{Kind: DigestWeekly, Weekday: time.Monday, Hour: 9}, time.Date(2026, 10, 19, 9, 0, 0, 0, loc)},
+		{DigestSchedule{Kind: DigestWeekly, Weekday: time.Wednesday, Hour: 9}, time.Date(2026, 10, 21, 9, 0, 0, 0, loc)},
+		{DigestSchedule{Kind: DigestWeekly, Weekday: time.Wednesday, Hour: 11}, time.Date(2026, 10, 14, 11, 0, 0, 0, loc)},
+	} {
+		if res := tc.schedule.next(now); !res.Equal(tc.answer) {
+			t.Errorf("%s: got %s but answer is %s", tc.schedule, res, tc.answer)
+		}
+	}
+}
+
+func TestRenderDigest(t *testing.T) {
+	messages := []Message{
+		{Application: Telegram, Channel: "a", Topic: "x", Summary: "first", Link: "l1"},
+		{Application: Telegram, Channel: "b", Topic: "x", Summary: "second", Link: "l2"},
+		{Application: Telegram, Channel: "a", Topic: "x", Summary: "third", Link: "l3", Suppressed: 2},
+	}
+	texts := renderDigest(messages)
+	if len(texts) != 2 {
+		t.Fatalf("Got %d texts but answer is 2: %v", len(texts), texts)
+	}
+	for _, sub := range []string{"messages: 2", "first", "third", "and 2 more"} {
+		if !strings.Contains(texts[0], sub) {
+			t.Errorf("Didn't find %s in %s", sub, texts[0])
+		}
+	}
+	if !strings.Contains(texts[1], "second") {
+		t.Errorf("Didn't find second in %s", texts[1])
+	}
+
+	var long []Message
+	for i := 0; i < 100; i++ {
+		long = append(long, Message{Channel: "a", Topic: "x", Summary: strings.Repeat("s", 100)})
+	}
+	texts = renderDigest(long)
+	if len(texts) < 2 {
+		t.Errorf("Long digest is not split")
+	}
+	for _, text := range texts {
+		if len(text) > maxDigestLength {
+			t.Errorf("Digest message is %d bytes long", len(text))
+		}
+	}
+}
+
+// digestStorage keeps the digest messages of one user and restores them
+// if the transaction fails.
+type digestStorage struct {
+	LocalStorage
+	messages []Message
+	jobs     []Job
+}
+
+func (s *digestStorage) inTx(fn func(s LocalStorage) error) error {
+	messages, jobs := s.messages, s.jobs
+	if err := fn(s); err != nil {
+		s.messages, s.jobs = messages, jobs
+		return err
+	}
+	return nil
+}
+
+func (s *digestStorage) popDigestMessages(string) ([]Message, error) {
+	messages := s.messages
+	s.messages = nil
+	return messages, nil
+}
+
+func (s *digestStorage) getApplication(string) (Application, error) {
+	return Telegram, nil
+}
+
+func (s *digestStorage) enqueueJob(job Job, at time.Time) (int64, error) {
+	job.ID = int64(len(s.jobs) + 1)
+	s.jobs = append(s.jobs, job)
+	return job.ID, nil
+}
+
+func TestReleaseDigest(t *testing.T) {
+	saved, savedNotifier := dataBase, notifiers[DestinationTelegram]
+	t.Cleanup(func() { dataBase, notifiers[DestinationTelegram] = saved, savedNotifier })
+	notifiers[DestinationTelegram] = recordingNotifier{}
+	storage := &digestStorage{messages: []Message{{Channel: "a", Topic: "x"}, {Channel: "b", Topic: "x"}}}
+	dataBase = storage
+
+	var queued []notification
+	err := releaseDigest(context.Background(), "alice", func(user, text string) error {
+		t.Errorf("sent %q, want the parts queued", text)
+		return nil
+	}, func(_ context.Context, n notification) { queued = append(queued, n) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(storage.messages) != 0 || len(storage.jobs) != 2 {
+		t.Fatalf("kept %d messages, enqueued %d jobs, want 0, 2", len(storage.messages), len(storage.jobs))
+	}
+	for i, n := range queued {
+		if n.job == nil || n.job.ID != storage.jobs[i].ID || len(n.message.Grouped) != 1 {
+			t.Errorf("queued %+v, want a part with its job", n)
+		}
+	}
+	if len(queued) != 2 {
+		t.Errorf("queued %d parts, want 2", len(queued))
+	}
+}
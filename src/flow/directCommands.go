@@ -0,0 +1,579 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// directPlatform is a chat whose users send the bot text commands in
+// direct messages, e.g. Mattermost and Slack. Users are known by their
+// direct channel with the bot.
+type directPlatform interface {
+	// code is the code of the platform's source, the platform of the
+	// channels in commands unless another one is given.
+	code() string
+	// application is the platform as stored for the users.
+	application() Application
+	// help lists the commands of the platform.
+	help() string
+	sendMsg(id, text string) error
+}
+
+// fileTransfer is a directPlatform which sends and receives files, for
+// EXPORT, IMPORT and EXPORT_MY_DATA.
+type fileTransfer interface {
+	sendFile(id, name string, data []byte) error
+	getFile(fileID string) ([]byte, error)
+}
+
+// messageDeleter is a directPlatform which deletes the messages of the
+// users. MAILBOX is only taken where its password can be deleted.
+type messageDeleter interface {
+	deleteMessage(messageID string) error
+}
+
+// userFinder is a directPlatform which finds the direct channel with a
+// user by @username, for SHARE and UNSHARE.
+type userFinder interface {
+	directChannel(username string) (string, error)
+}
+
+// directCommand is a command sent to the bot in a direct message.
+type directCommand struct {
+	// user is the direct channel the command came from.
+	user string
+	text string
+	// message is the id of the message with the command.
+	message string
+	// files are the ids of the files attached to the message.
+	files []string
+}
+
+const (
+	unknownDirectReply = "Я вас не понимаю, используйте HELP для справки"
+	errReply           = "Упс, произошла ошибка..."
+	backlogHint        = "\n\nBACKLOG <номер> - другая страница, BACKLOG ALL - показать все, BACKLOG DISCARD - удалить"
+)
+
+// userErrors are the errors of commands shown to the user as is.
+var userErrors = []error{
+	wrongPauseError,
+	channelNotMutedError,
+	wrongDigestError,
+	wrongTimezoneError,
+	wrongQuietHoursError,
+	wrongCooldownError,
+	wrongPriorityError,
+	wrongPackNameError,
+	packOwnedError,
+	packNotFoundError,
+	packTopicsError,
+	subscriptionNotFoundError,
+	wrongDestinationError,
+	destinationAddressError,
+	privateWebhookError,
+	confirmationSendError,
+	confirmationCodeError,
+	wrongHistoryLimitError,
+	historyUnsupportedError,
+	unsupportedFormatError,
+}
+
+func isUserError(err error) bool {
+	if isChannelError(err) {
+		return true
+	}
+	for _, target := range userErrors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleDirectCommand runs the command and replies to it, with the
+// error if it is meant for the user.
+func handleDirectCommand(p directPlatform, c directCommand) {
+	if err := dataBase.addUser(c.user, 0, p.application()); err != nil {
+		log.Printf("can't add %s user %s: %s", p.application(), c.user, err.Error())
+		return
+	}
+	reply, err := runDirectCommand(p, c)
+	if err != nil {
+		reply = errReply
+		if isUserError(err) {
+			reply = err.Error()
+		} else {
+			log.Printf("%s command of %s failed: %s", p.application(), c.user, err.Error())
+		}
+	}
+	if reply != "" {
+		p.sendMsg(c.user, reply)
+	}
+}
+
+// runDirectCommand runs the command and returns the reply to it. The
+// commands the platform can't take are not understood.
+func runDirectCommand(p directPlatform, c directCommand) (string, error) {
+	cmd, body, _ := strings.Cut(strings.TrimSpace(c.text), " ")
+	cmd = strings.ToUpper(cmd)
+	body = strings.TrimSpace(body)
+	id := c.user
+	files, _ := p.(fileTransfer)
+	switch cmd {
+	case "ADD":
+		return directAdd(p, id, body)
+	case "REMOVE":
+		return directRemove(p, id, body)
+	case "VIEW":
+		return directView(p, id)
+	case "PAUSE":
+		return pause(id, body)
+	case "MUTE":
+		return directMute(p, id, body)
+	case "CONTINUE":
+		if err := dataBase.unpauseUser(id); err != nil {
+			return "", err
+		}
+		p.sendMsg(id, "Обновления сняты с паузы!")
+		flushDirectBacklog(p, id)
+		return "", nil
+	case "BACKLOG":
+		return directBacklog(p, id, body)
+	case "HISTORY":
+		return directHistory(id, body)
+	case "POSTS":
+		return directPosts(p, id, body)
+	case "COOLDOWN":
+		return directCooldown(p, id, body)
+	case "PRIORITY":
+		return directPriority(p, id, body)
+	case "NOTIFY":
+		return directNotify(p, id, body)
+	case "CONFIRM":
+		elements := strings.Fields(body)
+		if len(elements) != 2 {
+			return "Неверное количество аргументов. Используйте CONFIRM <куда> <код>", nil
+		}
+		return confirmDestination(id, p.application(), elements[0], elements[1])
+	case "DIGEST":
+		return changeDigest(id, body)
+	case "TIMEZONE":
+		return changeTimezone(id, body)
+	case "QUIET":
+		return changeQuietHours(id, body)
+	case "PUBLISH":
+		return directPublish(id, body)
+	case "UNPUBLISH":
+		return directUnpublish(id, body)
+	case "SUBSCRIBE":
+		return directSubscribe(id, body)
+	case "UNSUBSCRIBE":
+		return directUnsubscribe(id, body)
+	case "FORGET_ME":
+		return directForgetMe(id, body)
+	case "HELP":
+		return p.help(), nil
+	case "MAILBOX":
+		if deleter, ok := p.(messageDeleter); ok {
+			reply, err := directMailbox(id, body)
+			// The command holds the password of the mailbox.
+			if err := deleter.deleteMessage(c.message); err != nil {
+				log.Printf("can't delete the mailbox password of %s: %s", id, err.Error())
+			}
+			return reply, err
+		}
+	case "SHARE", "UNSHARE":
+		if finder, ok := p.(userFinder); ok {
+			return directShareMailbox(finder, id, body, cmd == "SHARE")
+		}
+	case "EXPORT":
+		if files != nil {
+			return directExport(files, id, body)
+		}
+	case "IMPORT":
+		if files != nil {
+			return directImport(files, id, c.files)
+		}
+	case "EXPORT_MY_DATA":
+		if files != nil {
+			return directExportMyData(files, id)
+		}
+	}
+	return unknownDirectReply, nil
+}
+
+// flushDirectBacklog delivers the delayed messages of the user, as a
+// paged summary if there are many of them.
+func flushDirectBacklog(p directPlatform, id string) {
+	messages, paged, err := takeBacklog(id)
+	if err != nil {
+		log.Printf("can't flush the backlog of %s: %s", id, err.Error())
+		return
+	}
+	if !paged {
+		for _, msg := range messages {
+			if err := sendNews(msg); err != nil {
+				log.Printf("can't send news to %s: %s", id, err.Error())
+			}
+		}
+		return
+	}
+	text, _ := renderBacklogPage(messages, 0)
+	p.sendMsg(id, text+backlogHint)
+}
+
+// resolveDirectChannel returns the subscription key of a channel on
+// platform, a channel of p if it is empty.
+func resolveDirectChannel(p directPlatform, name, platform string) (string, Application, error) {
+	if platform == "" {
+		platform = p.code()
+	}
+	return resolveChannel(platform, name)
+}
+
+func directAdd(p directPlatform, id, body string) (string, error) {
+	elements := strings.Fields(body)
+	if len(elements) != 2 && len(elements) != 3 {
+		return "Неверное количество аргументов. Используйте ADD <канал> <топик> [платформа]", nil
+	}
+	platform := ""
+	if len(elements) == 3 {
+		platform = elements[2]
+	}
+	channel, application, err := resolveDirectChannel(p, elements[0], platform)
+	if err != nil {
+		return "", err
+	}
+	if err := checkAccess(id, application, channel); err != nil {
+		return "", err
+	}
+	if err := dataBase.addTopic(id, channel, elements[1], application); err != nil {
+		return "", err
+	}
+	return "Топик добавлен!", nil
+}
+
+func directRemove(p directPlatform, id, body string) (string, error) {
+	elements := strings.Fields(body)
+	if len(elements) != 2 && len(elements) != 3 {
+		return "Неверное количество аргументов. Используйте REMOVE <канал> <топик> [платформа]", nil
+	}
+	platform := ""
+	if len(elements) == 3 {
+		platform = elements[2]
+	}
+	channel, application, err := resolveDirectChannel(p, elements[0], platform)
+	if err != nil {
+		return "", err
+	}
+	if err := dataBase.removeTopic(id, channel, elements[1], application); err != nil {
+		return "", err
+	}
+	return "Топик удалён!", nil
+}
+
+// directView lists the subscriptions, the channels of other platforms
+// than p go with the platform.
+func directView(p directPlatform, id string) (string, error) {
+	totalInfo, err := dataBase.getUserInfo(id)
+	if err != nil {
+		return "", err
+	}
+	str := strings.Builder{}
+	for application, topicByChan := range totalInfo {
+		for ch, topics := range topicByChan {
+			chName := channelName(application, ch)
+			if application != p.application() {
+				chName = fmt.Sprintf("%s %s", application, chName)
+			}
+			str.WriteString(fmt.Sprintf("%s:\n", chName))
+			for _, topic := range topics {
+				str.WriteString(fmt.Sprintf("   - %s\n", topic))
+			}
+			str.WriteString("\n\n")
+		}
+	}
+	packs, err := dataBase.getPacks(id)
+	if err != nil {
+		return "", err
+	}
+	str.WriteString(formatPacks(packs))
+	if str.Len() == 0 {
+		return "Ничего не отслеживается", nil
+	}
+	return str.String(), nil
+}
+
+func directMute(p directPlatform, id, body string) (string, error) {
+	name, arg, found := strings.Cut(body, " ")
+	if !found {
+		return "Неверное количество аргументов. Используйте MUTE <канал> <длительность/until ЧЧ:ММ/off>", nil
+	}
+	channel, application, err := resolveDirectChannel(p, name, "")
+	if err != nil {
+		return "", err
+	}
+	return changeMute(id, channel, application, arg)
+}
+
+func directBacklog(p directPlatform, id, body string) (string, error) {
+	switch strings.ToUpper(body) {
+	case "ALL":
+		return "", showBacklog(id, p.sendMsg)
+	case "DISCARD":
+		n, err := discardBacklog(id)
+		return fmt.Sprintf("Удалено уведомлений: %d", n), err
+	}
+	page := 1
+	if body != "" {
+		var err error
+		if page, err = strconv.Atoi(body); err != nil || page < 1 {
+			return "Неверный номер страницы", nil
+		}
+	}
+	messages, err := dataBase.getBacklog(id)
+	if err != nil {
+		return "", err
+	}
+	text, pages := renderBacklogPage(messages, page-1)
+	if pages > 0 {
+		text += backlogHint
+	}
+	return text, nil
+}
+
+func directHistory(id, body string) (string, error) {
+	limit, err := parseHistoryLimit(body)
+	if err != nil {
+		return "", err
+	}
+	deliveries, err := dataBase.getDeliveries(id, limit)
+	if err != nil {
+		return "", err
+	}
+	return formatHistory(deliveries), nil
+}
+
+func directPosts(p directPlatform, id, body string) (string, error) {
+	elements := strings.Fields(body)
+	if len(elements) != 2 && len(elements) != 3 {
+		return "Неверное количество аргументов. Используйте POSTS <канал> [платформа] <N>", nil
+	}
+	count, err := strconv.Atoi(elements[len(elements)-1])
+	if err != nil || count <= 0 {
+		return "Количество постов должно быть положительным числом", nil
+	}
+	platform := p.code()
+	if len(elements) == 3 {
+		platform = elements[1]
+	}
+	source, err := getSource(platform)
+	if err != nil {
+		return "", err
+	}
+	channel, err := source.resolveChannel(elements[0])
+	if err != nil {
+		return "", err
+	}
+	// The matching posts come as notifications.
+	return "", source.history(id, channel, count)
+}
+
+func directCooldown(p directPlatform, id, body string) (string, error) {
+	elements := strings.Fields(body)
+	if len(elements) != 3 {
+		return "Неверное количество аргументов. Используйте COOLDOWN <канал> <топик> <none/минуты/day>", nil
+	}
+	cooldown, err := parseCooldown(elements[2])
+	if err != nil {
+		return "", err
+	}
+	channel, application, err := resolveDirectChannel(p, elements[0], "")
+	if err != nil {
+		return "", err
+	}
+	err = dataBase.setCooldown(id, channel, elements[1], application, cooldown)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", subscriptionNotFoundError
+	}
+	return "Задержка обновлена!", err
+}
+
+func directPriority(p directPlatform, id, body string) (string, error) {
+	elements := strings.Fields(body)
+	if len(elements) != 3 {
+		return "Неверное количество аргументов. Используйте PRIORITY <канал> <топик> <high/normal/low>", nil
+	}
+	priority, err := parsePriority(elements[2])
+	if err != nil {
+		return "", err
+	}
+	channel, application, err := resolveDirectChannel(p, elements[0], "")
+	if err != nil {
+		return "", err
+	}
+	err = dataBase.setPriority(id, channel, elements[1], application, priority)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", subscriptionNotFoundError
+	}
+	return "Приоритет обновлён!", err
+}
+
+func directNotify(p directPlatform, id, body string) (string, error) {
+	elements := strings.Fields(body)
+	platform := ""
+	if len(elements) > 3 && containsString(sourceCodes(), strings.ToUpper(elements[2])) {
+		platform = elements[2]
+		elements = append(elements[:2], elements[3:]...)
+	}
+	if len(elements) < 3 {
+		return "Неверное количество аргументов. Используйте NOTIFY <канал> <топик> [платформа] <куда> [куда...]", nil
+	}
+	channel, application, err := resolveDirectChannel(p, elements[0], platform)
+	if err != nil {
+		return "", err
+	}
+	return changeDestinations(id, p.application(), channel, elements[1], application, elements[2:])
+}
+
+func directPublish(id, body string) (string, error) {
+	name, topics, err := parsePublish(body)
+	if err != nil {
+		return "", err
+	}
+	count, err := dataBase.publishPack(id, name, topics)
+	if err != nil {
+		return "", err
+	}
+	return publishedReply(name, count, "SUBSCRIBE"), nil
+}
+
+func directUnpublish(id, body string) (string, error) {
+	name, err := parsePackName(body)
+	if err != nil {
+		return "", err
+	}
+	err = dataBase.unpublishPack(id, name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", packNotFoundError
+	}
+	return "Набор удалён!", err
+}
+
+func directSubscribe(id, body string) (string, error) {
+	name, err := parsePackName(body)
+	if err != nil {
+		return "", err
+	}
+	err = dataBase.subscribePack(id, name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", packNotFoundError
+	}
+	return "Вы подписались на набор " + name, err
+}
+
+func directUnsubscribe(id, body string) (string, error) {
+	name, err := parsePackName(body)
+	if err != nil {
+		return "", err
+	}
+	err = dataBase.unsubscribePack(id, name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "Вы не подписаны на этот набор", nil
+	}
+	return "Вы отписались от набора " + name, err
+}
+
+func directForgetMe(id, body string) (string, error) {
+	if body != forgetConfirmation {
+		return "Все ваши подписки, отложенные сообщения и история уведомлений будут удалены. " +
+			"Для подтверждения отправьте FORGET_ME " + forgetConfirmation, nil
+	}
+	if err := dataBase.forgetUser(id); err != nil {
+		return "", err
+	}
+	return forgetReply, nil
+}
+
+func directMailbox(id, body string) (string, error) {
+	reply, err := attachMailbox(id, strings.Fields(body))
+	if errors.Is(err, wrongFmtError) {
+		return "Неверное количество аргументов. Используйте MAILBOX <имя> <imaps://логин:пароль@сервер/папка> [ссылка на архив с {id}]", nil
+	}
+	if err != nil {
+		// The mailbox can't be reached or is wrong, the user is to fix it.
+		log.Printf("can't attach a mailbox of %s: %s", id, err.Error())
+		return err.Error(), nil
+	}
+	return reply, nil
+}
+
+// directShareMailbox shares a mailbox with a user given by @username,
+// who is known by the id of the direct channel with the bot.
+func directShareMailbox(finder userFinder, id, body string, share bool) (string, error) {
+	command := "SHARE"
+	if !share {
+		command = "UNSHARE"
+	}
+	elements := strings.Fields(body)
+	if len(elements) != 2 {
+		return "Неверное количество аргументов. Используйте " + command + " <имя ящика> <@пользователь>", nil
+	}
+	direct, err := finder.directChannel(strings.TrimPrefix(elements[1], "@"))
+	if err != nil {
+		return "Пользователь " + elements[1] + " не найден", nil
+	}
+	reply, err := shareMailbox(id, []string{elements[0], direct}, share)
+	if err != nil {
+		return "", err
+	}
+	// The reply names the user rather than the channel.
+	return strings.Replace(reply, direct, elements[1], 1), nil
+}
+
+func directExport(files fileTransfer, id, body string) (string, error) {
+	format := strings.ToLower(body)
+	doc, err := dataBase.getSubscriptions(id)
+	if err != nil {
+		return "", err
+	}
+	raw, err := encodeSubscriptions(doc, format)
+	if err != nil {
+		return "", err
+	}
+	return "", files.sendFile(id, subscriptionsFileName(format), raw)
+}
+
+func directImport(files fileTransfer, id string, fileIDs []string) (string, error) {
+	if len(fileIDs) != 1 {
+		return "Приложите к IMPORT один YAML или JSON файл, полученный через EXPORT", nil
+	}
+	data, err := files.getFile(fileIDs[0])
+	if err != nil {
+		return "", err
+	}
+	summary, err := importSubscriptions(id, data)
+	if err != nil {
+		// The problems of the file are for the user to fix.
+		return err.Error(), nil
+	}
+	return summary, nil
+}
+
+func directExportMyData(files fileTransfer, id string) (string, error) {
+	data, err := dataBase.getUserData(id)
+	if err != nil {
+		return "", err
+	}
+	raw, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return "", files.sendFile(id, userDataFileName(id), raw)
+}
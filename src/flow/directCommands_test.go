@@ -0,0 +1,53 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// textPlatform takes the commands with no files, deletions or users.
+type textPlatform struct {
+	sent []string
+}
+
+func (*textPlatform) code() string             { return SlackCode }
+func (*textPlatform) application() Application { return Slack }
+func (*textPlatform) help() string             { return "help" }
+
+func (p *textPlatform) sendMsg(id, text string) error {
+	p.sent = append(p.sent, text)
+	return nil
+}
+
+// deletingPlatform also deletes the messages of the users.
+type deletingPlatform struct {
+	textPlatform
+	deleted []string
+}
+
+func (p *deletingPlatform) deleteMessage(messageID string) error {
+	p.deleted = append(p.deleted, messageID)
+	return nil
+}
+
+func TestRunDirectCommand(t *testing.T) {
+	text := &textPlatform{}
+	for _, command := range []string{"poke", "EXPORT", "IMPORT", "MAILBOX box", "SHARE box @ivan"} {
+		reply, err := runDirectCommand(text, directCommand{user: "D0IVAN", text: command})
+		if err != nil || reply != unknownDirectReply {
+			t.Errorf("%s = %q, %v, want it not understood", command, reply, err)
+		}
+	}
+	if reply, _ := runDirectCommand(text, directCommand{user: "D0IVAN", text: " help "}); reply != "help" {
+		t.Errorf("HELP = %q", reply)
+	}
+
+	deleting := &deletingPlatform{}
+	reply, err := runDirectCommand(deleting, directCommand{user: "D0IVAN", text: "mailbox box", message: "P1"})
+	if err != nil || reply == unknownDirectReply {
+		t.Errorf("MAILBOX = %q, %v", reply, err)
+	}
+	if want := []string{"P1"}; !reflect.DeepEqual(deleting.deleted, want) {
+		t.Errorf("deleted = %v, want %v", deleting.deleted, want)
+	}
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	DiscordCode      = "DS"
+	discordAPI       = "https://discord.com/api/v10"
+	discordLink      = "https://discord.com/channels/%s/%s"
+	discordTimeout   = 30 * time.Second
+	discordReconnect = 5 * time.Second
+	// maxDiscordReconnect limits the delay of reconnecting after failed
+	// sessions.
+	maxDiscordReconnect = 5 * time.Minute
+	// discordIntents are GUILDS, GUILD_MESSAGES and MESSAGE_CONTENT. The
+	// last one must be enabled for the bot in the developer portal.
+	discordIntents = 1<<0 | 1<<9 | 1<<15
+	// maxDiscordHistory is the largest page of messages Discord returns.
+	maxDiscordHistory = 100
+)
+
+// Gateway opcodes.
+const (
+	discordDispatch       = 0
+	discordHeartbeat      = 1
+	discordIdentify       = 2
+	discordResume         = 6
+	discordReconnectOp    = 7
+	discordInvalidSession = 9
+	discordHello          = 10
+	discordHeartbeatAck   = 11
+)
+
+var (
+	discordLinkError = errors.New(
+		"Неправильная ссылка на канал Discord. Используйте https://discord.com/channels/<сервер>/<канал> или приглашение")
+	discordChannelError = errors.New("Бот не видит этот канал Discord. Добавьте его на сервер")
+
+	discordInvalidSessionError = errors.New("gateway invalidated the session")
+	discordMissedAckError      = errors.New("gateway did not acknowledge a heartbeat")
+)
+
+var (
+	discordChannelLink = regexp.MustCompile(`^(?:https?://)?(?:(?:www|ptb|canary)\.)?discord(?:app)?\.com/channels/(\d+)/(\d+)`)
+	discordInviteLink  = regexp.MustCompile(`^(?:https?://)?(?:(?:www\.)?discord\.gg|(?:www\.)?discord(?:app)?\.com/invite)/([\w-]+)`)
+	discordID          = regexp.MustCompile(`^\d+$`)
+)
+
+// discordSource listens to the guild text channels the bot is in. The
+// channels are subscribed to by id; the channelID of events is
+// guild/channel, which makes message links.
+type discordSource struct {
+	token  string
+	api    string
+	client *http.Client
+	// enqueue passes an event to the pipeline.
+	enqueue func(workEvent)
+
+	// session is the gateway session to resume, used by listen only.
+	session discordSession
+
+	mu       sync.Mutex
+	channels map[string]discordChannel
+}
+
+// discordSession is what resumes a gateway session after a reconnect.
+type discordSession struct {
+	id        string
+	resumeURL string
+	// seq is the sequence number of the last event received.
+	seq int64
+}
+
+type discordChannel struct {
+	ID      string `json:"id"`
+	GuildID string `json:"guild_id"`
+	Name    string `json:"name"`
+}
+
+type discordMessage struct {
+	ID        string `json:"id"`
+	ChannelID string `json:"channel_id"`
+	GuildID   string `json:"guild_id"`
+	Content   string `json:"content"`
+	Author    struct {
+		Bot bool `json:"bot"`
+	} `json:"author"`
+}
+
+type discordPayload struct {
+	Op int             `json:"op"`
+	D  json.RawMessage `json:"d"`
+	S  *int64          `json:"s,omitempty"`
+	T  string          `json:"t,omitempty"`
+}
+
+func newDiscordSource(token string) *discordSource {
+	return &discordSource{
+		token:    token,
+		api:      discordAPI,
+		client:   &http.Client{Timeout: discordTimeout},
+		enqueue:  enqueueEvent,
+		channels: make(map[string]discordChannel),
+	}
+}
+
+// get requests a path of the REST API into v.
+func (s *discordSource) get(ctx context.Context, path string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.api+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bot "+s.token)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusNotFound:
+		return discordChannelError
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("discord responded with %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (s *discordSource) handleUpdates(ctx context.Context) {
+	delay := discordReconnect
+	for {
+		ready, err := s.listen(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		delay = nextDiscordDelay(delay, ready)
+		// The jitter keeps the reconnects of a failing gateway apart.
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+		log.Printf("discord gateway disconnected, reconnecting in %s: %s", wait.Round(time.Second), err.Error())
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// nextDiscordDelay returns the delay of the next reconnect: it starts
+// over after a session which has been ready and doubles after one which
+// has failed, e.g. when Discord keeps invalidating the sessions.
+func nextDiscordDelay(delay time.Duration, ready bool) time.Duration {
+	if ready {
+		return discordReconnect
+	}
+	if delay *= 2; delay > maxDiscordReconnect {
+		delay = maxDiscordReconnect
+	}
+	return delay
+}
+
+// listen handles the events of one gateway connection until ctx is done
+// or the connection fails. The session of the previous connection is
+// resumed if there is one, so no event is missed. It tells whether the
+// session has become ready.
+func (s *discordSource) listen(ctx context.Context) (bool, error) {
+	gatewayURL := s.session.resumeURL
+	if s.session.id == "" || gatewayURL == "" {
+		var gateway struct {
+			URL string `json:"url"`
+		}
+		if err := s.get(ctx, "/gateway/bot", &gateway); err != nil {
+			return false, err
+		}
+		gatewayURL = gateway.URL
+	}
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, gatewayURL+"/?v=10&encoding=json", nil)
+	if err != nil {
+		return false, err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		// Closing the connection stops the reads below.
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	var writeMu sync.Mutex
+	send := func(op int, d any) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return conn.WriteJSON(map[string]any{"op": op, "d": d})
+	}
+	var seq atomic.Int64
+	seq.Store(s.session.seq)
+	defer func() { s.session.seq = seq.Load() }()
+	// acked is false from a heartbeat until its acknowledgement.
+	var acked, missed atomic.Bool
+	acked.Store(true)
+	heartbeat := func() error {
+		acked.Store(false)
+		if n := seq.Load(); n > 0 {
+			return send(discordHeartbeat, n)
+		}
+		return send(discordHeartbeat, nil)
+	}
+
+	var hello struct {
+		Op int `json:"op"`
+		D  struct {
+			HeartbeatInterval int `json:"heartbeat_interval"`
+		} `json:"d"`
+	}
+	if err := conn.ReadJSON(&hello); err != nil {
+		return false, err
+	}
+	if hello.Op != discordHello || hello.D.HeartbeatInterval <= 0 {
+		return false, fmt.Errorf("unexpected gateway greeting with op %d", hello.Op)
+	}
+	if s.session.id != "" {
+		err = send(discordResume, map[string]any{
+			"token":      s.token,
+			"session_id": s.session.id,
+			"seq":        s.session.seq,
+		})
+	} else {
+		err = send(discordIdentify, map[string]any{
+			"token":   s.token,
+			"intents": discordIntents,
+			"properties": map[string]string{
+				"os":      "linux",
+				"browser": "topic-keeper",
+				"device":  "topic-keeper",
+			},
+		})
+	}
+	if err != nil {
+		return false, err
+	}
+	go func() {
+		ticker := time.NewTicker(time.Duration(hello.D.HeartbeatInterval) * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				// A connection which does not acknowledge heartbeats
+				// is dead; closing it makes listen reconnect.
+				if !acked.Load() {
+					missed.Store(true)
+					conn.Close()
+					return
+				}
+				if err := heartbeat(); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	ready := false
+	for {
+		var payload discordPayload
+		if err := conn.ReadJSON(&payload); err != nil {
+			if missed.Load() {
+				return ready, discordMissedAckError
+			}
+			return ready, err
+		}
+		if payload.S != nil {
+			seq.Store(*payload.S)
+		}
+		switch payload.Op {
+		case discordDispatch:
+			switch payload.T {
+			case "READY":
+				var session struct {
+					SessionID        string `json:"session_id"`
+					ResumeGatewayURL string `json:"resume_gateway_url"`
+				}
+				if err := json.Unmarshal(payload.D, &session); err != nil {
+					return ready, err
+				}
+				s.session.id, s.session.resumeURL = session.SessionID, session.ResumeGatewayURL
+				ready = true
+			case "RESUMED":
+				ready = true
+			}
+			s.dispatch(payload.T, payload.D)
+		case discordHeartbeat:
+			if err := heartbeat(); err != nil {
+				return ready, err
+			}
+		case discordHeartbeatAck:
+			acked.Store(true)
+		case discordReconnectOp:
+			return ready, errors.New("gateway asked to reconnect")
+		case discordInvalidSession:
+			// The data tells whether the session may be resumed.
+			var resumable bool
+			json.Unmarshal(payload.D, &resumable)
+			if !resumable {
+				s.session = discordSession{}
+				seq.Store(0)
+			}
+			return ready, discordInvalidSessionError
+		}
+	}
+}
+
+// dispatch handles a gateway event: remembers the names of channels and
+// passes guild messages to the pipeline.
+func (s *discordSource) dispatch(event string, data json.RawMessage) {
+	switch event {
+	case "GUILD_CREATE":
+		var guild struct {
+			ID       string           `json:"id"`
+			Channels []discordChannel `json:"channels"`
+		}
+		if err := json.Unmarshal(data, &guild); err != nil {
+			log.Println(err.Error())
+			return
+		}
+		for _, ch := range guild.Channels {
+			ch.GuildID = guild.ID
+			s.remember(ch)
+		}
+	case "CHANNEL_CREATE", "CHANNEL_UPDATE":
+		var ch discordChannel
+		if err := json.Unmarshal(data, &ch); err != nil {
+			log.Println(err.Error())
+			return
+		}
+		s.remember(ch)
+	case "MESSAGE_CREATE":
+		var message discordMessage
+		if err := json.Unmarshal(data, &message); err != nil {
+			log.Println(err.Error())
+			return
+		}
+		// Direct messages have no guild.
+		if message.GuildID == "" || message.Author.Bot || message.Content == "" {
+			return
+		}
+		s.enqueue(s.event(message, nil))
+	}
+}
+
+func (s *discordSource) remember(ch discordChannel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.channels[ch.ID] = ch
+}
+
+func (s *discordSource) event(message discordMessage, request *historyRequest) workEvent {
+	event := workEvent{
+		application:    Discord,
+		channel:        s.channelName(message.ChannelID),
+		channelID:      message.GuildID + "/" + message.ChannelID,
+		key:            message.ChannelID,
+		text:           message.Content,
+		messageID:      message.ID,
+		historyRequest: request,
+	}
+	event.link = s.link(event)
+	return event
+}
+
+func (*discordSource) application() Application {
+	return Discord
+}
+
+// resolveChannel returns the id of the channel of a channel link, an
+// invite or an id, if the bot can read the channel.
+func (s *discordSource) resolveChannel(link string) (string, error) {
+	ctx := context.Background()
+	id := link
+	if match := discordChannelLink.FindStringSubmatch(link); match != nil {
+		id = match[2]
+	} else if match := discordInviteLink.FindStringSubmatch(link); match != nil {
+		var invite struct {
+			Channel discordChannel `json:"channel"`
+		}
+		if err := s.get(ctx, "/invites/"+url.PathEscape(match[1]), &invite); err != nil {
+			return "", err
+		}
+		id = invite.Channel.ID
+	}
+	if !discordID.MatchString(id) {
+		return "", discordLinkError
+	}
+	ch, err := s.getChannel(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	return ch.ID, nil
+}
+
+// getChannel returns the channel with the id, asking Discord if it is
+// not known yet.
+func (s *discordSource) getChannel(ctx context.Context, id string) (discordChannel, error) {
+	s.mu.Lock()
+	ch, found := s.channels[id]
+	s.mu.Unlock()
+	if found {
+		return ch, nil
+	}
+	if err := s.get(ctx, "/channels/"+id, &ch); err != nil {
+		return discordChannel{}, err
+	}
+	s.remember(ch)
+	return ch, nil
+}
+
+func (s *discordSource) channelName(channel string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ch, found := s.channels[channel]; found && ch.Name != "" {
+		return "#" + ch.Name
+	}
+	return channel
+}
+
+func (*discordSource) link(event workEvent) string {
+	return fmt.Sprintf(discordLink, event.channelID, event.messageID)
+}
+
+func (s *discordSource) history(user, channel string, count int) error {
+	ctx := context.Background()
+	ch, err := s.getChannel(ctx, channel)
+	if err != nil {
+		return err
+	}
+	if count > maxDiscordHistory {
+		count = maxDiscordHistory
+	}
+	var messages []discordMessage
+	if err := s.get(ctx, fmt.Sprintf("/channels/%s/messages?limit=%d", channel, count), &messages); err != nil {
+		return err
+	}
+	// Discord returns the newest message first.
+	for i := len(messages) - 1; i >= 0; i-- {
+		message := messages[i]
+		if message.Author.Bot || message.Content == "" {
+			continue
+		}
+		message.GuildID = ch.GuildID
+		s.enqueue(s.event(message, &historyRequest{user}))
+	}
+	return nil
+}
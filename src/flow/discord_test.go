@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// discordServer fakes the REST API and the gateway of Discord. A new
+// session gets READY and a message, a resumed one gets RESUMED and a
+// message sent meanwhile. Heartbeats are acknowledged if ack is set.
+func discordServer(t *testing.T, heartbeatInterval int, ack bool) *discordSource {
+	upgrader := websocket.Upgrader{}
+	mux := http.NewServeMux()
+	var server *httptest.Server
+	reply := func(w http.ResponseWriter, v any) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+	mux.HandleFunc("/gateway/bot", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, map[string]string{"url": "ws" + strings.TrimPrefix(server.URL, "http")})
+	})
+	mux.HandleFunc("/channels/10", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, discordChannel{ID: "10", GuildID: "1", Name: "general"})
+	})
+	mux.HandleFunc("/invites/study", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, map[string]any{"channel": discordChannel{ID: "10", Name: "general"}})
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		conn.WriteJSON(map[string]any{"op": discordHello, "d": map[string]int{"heartbeat_interval": heartbeatInterval}})
+		var first struct {
+			Op int `json:"op"`
+			D  struct {
+				SessionID string `json:"session_id"`
+				Seq       int64  `json:"seq"`
+			} `json:"d"`
+		}
+		if err := conn.ReadJSON(&first); err != nil {
+			t.Error(err)
+			return
+		}
+		seq := int(first.D.Seq)
+		dispatch := func(event string, d any) {
+			seq++
+			conn.WriteJSON(map[string]any{"op": discordDispatch, "s": seq, "t": event, "d": d})
+		}
+		if first.Op == discordResume {
+			if strings.TrimSuffix(r.URL.Path, "/") != "/resume" || first.D.SessionID != "session" {
+				t.Errorf("resume to %s = %+v", r.URL.Path, first)
+			}
+			dispatch("RESUMED", map[string]any{})
+			dispatch("MESSAGE_CREATE", map[string]any{"id": "203", "channel_id": "10", "guild_id": "1",
+				"content": "дедлайн завтра"})
+		} else {
+			resume := "ws" + strings.TrimPrefix(server.URL, "http") + "/resume"
+			dispatch("READY", map[string]any{"session_id": "session", "resume_gateway_url": resume})
+			dispatch("MESSAGE_CREATE", map[string]any{"id": "202", "channel_id": "10", "guild_id": "1",
+				"content": "экзамен перенесли"})
+		}
+		for {
+			var payload discordPayload
+			if err := conn.ReadJSON(&payload); err != nil {
+				return
+			}
+			if payload.Op == discordHeartbeat && ack {
+				conn.WriteJSON(map[string]any{"op": discordHeartbeatAck})
+			}
+		}
+	})
+	server = httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	s := newDiscordSource("secret")
+	s.api = server.URL
+	s.client = server.Client()
+	return s
+}
+
+// listenDiscord runs listen until the first event and returns it.
+func listenDiscord(t *testing.T, s *discordSource) workEvent {
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan workEvent, 1)
+	s.enqueue = func(event workEvent) { events <- event }
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.listen(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event from the gateway")
+	}
+	return workEvent{}
+}
+
+func TestDiscordResume(t *testing.T) {
+	s := discordServer(t, 45000, true)
+	if event := listenDiscord(t, s); event.link != "https://discord.com/channels/1/10/202" {
+		t.Fatalf("first session event = %+v", event)
+	}
+	if s.session.id != "session" || s.session.seq != 2 {
+		t.Fatalf("session = %+v", s.session)
+	}
+	if event := listenDiscord(t, s); event.messageID != "203" || s.session.seq != 4 {
+		t.Errorf("resumed session: event %+v, seq %d", event, s.session.seq)
+	}
+}
+
+func TestDiscordMissedAck(t *testing.T) {
+	s := discordServer(t, 20, false)
+	s.enqueue = func(workEvent) {}
+	ready, err := s.listen(context.Background())
+	if err != discordMissedAckError || !ready {
+		t.Errorf("listen = %t, %v, want a missed ack", ready, err)
+	}
+}
+
+func TestDiscordResolveChannel(t *testing.T) {
+	s := discordServer(t, 45000, true)
+	for _, link := range []string{"https://discord.com/channels/1/10/202", "https://discord.gg/study"} {
+		if channel, err := s.resolveChannel(link); channel != "10" || err != nil {
+			t.Errorf("resolveChannel(%q) = %q, %v", link, channel, err)
+		}
+	}
+	if _, err := s.resolveChannel("https://t.me/spbu"); err != discordLinkError {
+		t.Errorf("resolveChannel of a Telegram link error = %v", err)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const maxImportSize = 1 << 20
+
+var (
+	unsupportedFormatError = errors.New("Неподдерживаемый формат. Используйте yaml или json")
+	importTooLargeError    = errors.New("Файл слишком большой")
+)
+
+// SubscriptionsDocument holds topics by application and channel
+// identifier. It is the format of /export and /import.
+type SubscriptionsDocument map[Application]map[string][]string
+
+// encodeSubscriptions renders doc as "yaml" or "json".
+func encodeSubscriptions(doc SubscriptionsDocument, format string) ([]byte, error) {
+	switch format {
+	case "", "yaml", "yml":
+		return yaml.Marshal(doc)
+	case "json":
+		return json.MarshalIndent(doc, "", "  ")
+	}
+	return nil, unsupportedFormatError
+}
+
+// subscriptionsFileName is the name of the exported file in format.
+func subscriptionsFileName(format string) string {
+	if format == "" {
+		format = "yaml"
+	}
+	return "subscriptions." + format
+}
+
+// decodeSubscriptions parses and validates a YAML or JSON document.
+func decodeSubscriptions(data []byte) (SubscriptionsDocument, error) {
+	if len(data) > maxImportSize {
+		return nil, importTooLargeError
+	}
+	var doc SubscriptionsDocument
+	// JSON documents are valid YAML as well.
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("Не удалось разобрать файл: %s", err.Error())
+	}
+	if err := validateSubscriptions(doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func validateSubscriptions(doc SubscriptionsDocument) error {
+	var problems []string
+	for application, channels := range doc {
+		if !isUsingApplication(application) {
+			problems = append(problems, fmt.Sprintf("неизвестная платформа %q", application))
+			continue
+		}
+		for channel, topics := range channels {
+			if channel == "" || strings.ContainsAny(channel, " \t\n") {
+				problems = append(problems, fmt.Sprintf("%s: неправильный канал %q", application, channel))
+				continue
+			}
+			if application == VK {
+				if _, err := strconv.Atoi(channel); err != nil {
+					problems = append(problems, fmt.Sprintf("%s: канал %q должен быть числовым ID", application, channel))
+					continue
+				}
+			}
+			for _, topic := range topics {
+				if topic == "" || strings.ContainsAny(topic, " \t\n") {
+					problems = append(problems, fmt.Sprintf("%s/%s: неправильный топик %q", application, channel, topic))
+				}
+			}
+		}
+	}
+	if len(problems) != 0 {
+		sort.Strings(problems)
+		return errors.New("Ошибки в файле:\n" + strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+func isUsingApplication(application Application) bool {
+	for _, using := range getUsingApplications() {
+		if using == application {
+			return true
+		}
+	}
+	return false
+}
+
+// subscriptionSet flattens doc into a set of subscriptions.
+func subscriptionSet(doc SubscriptionsDocument) map[Subscription]bool {
+	set := make(map[Subscription]bool)
+	for application, channels := range doc {
+		for channel, topics := range channels {
+			for _, topic := range topics {
+				set[Subscription{Application: application, Channel: channel, Topic: topic}] = true
+			}
+		}
+	}
+	return set
+}
+
+// diffSubscriptions returns the subscriptions to add and to remove to
+// turn from into to, both sorted.
+func diffSubscriptions(from, to SubscriptionsDocument) (added, removed []Subscription) {
+	oldSet, newSet := subscriptionSet(from), subscriptionSet(to)
+	for sub := range newSet {
+		if !oldSet[sub] {
+			added = append(added, sub)
+		}
+	}
+	for sub := range oldSet {
+		if !newSet[sub] {
+			removed = append(removed, sub)
+		}
+	}
+	sortSubscriptions(added)
+	sortSubscriptions(removed)
+	return added, removed
+}
+
+func sortSubscriptions(subs []Subscription) {
+	sort.Slice(subs, func(i, j int) bool {
+		if subs[i].Application != subs[j].Application {
+			return subs[i].Application < subs[j].Application
+		}
+		if subs[i].Channel != subs[j].Channel {
+			return subs[i].Channel < subs[j].Channel
+		}
+		return subs[i].Topic < subs[j].Topic
+	})
+}
+
+func formatDiff(added, removed []Subscription) string {
+	if len(added) == 0 && len(removed) == 0 {
+		return "Подписки не изменились"
+	}
+	str := strings.Builder{}
+	str.WriteString(fmt.Sprintf("Подписки обновлены: +%d, -%d\n", len(added), len(removed)))
+	for _, sub := range added {
+		str.WriteString(fmt.Sprintf("+ %s %s: %s\n", sub.Application, sub.Channel, sub.Topic))
+	}
+	for _, sub := range removed {
+		str.WriteString(fmt.Sprintf("- %s %s: %s\n", sub.Application, sub.Channel, sub.Topic))
+	}
+	return str.String()
+}
+
+// importSubscriptions replaces the subscriptions of the user with the
+// ones from data atomically and returns a summary of the changes.
+func importSubscriptions(user string, data []byte) (string, error) {
+	doc, err := decodeSubscriptions(data)
+	if err != nil {
+		return "", err
+	}
+	current, err := dataBase.getSubscriptions(user)
+	if err != nil {
+		return "", err
+	}
+	added, removed := diffSubscriptions(current, doc)
+	for _, sub := range added {
+		if err := checkAccess(user, sub.Application, sub.Channel); err != nil {
+			return "", err
+		}
+	}
+
+	vkNames := make(map[string]string)
+	for _, sub := range added {
+		if sub.Application != VK || vkNames[sub.Channel] != "" {
+			continue
+		}
+		name, err := dataBase.getVKPublicNameByID(sub.Channel)
+		if errors.Is(err, sql.ErrNoRows) {
+			id, _ := strconv.Atoi(sub.Channel)
+			name, err = getGroupName(id, vkToken)
+		}
+		if err != nil {
+			return "", err
+		}
+		vkNames[sub.Channel] = name
+	}
+
+	err = dataBase.inTx(func(s LocalStorage) error {
+		for _, sub := range removed {
+			if err := s.removeTopic(user, sub.Channel, sub.Topic, sub.Application); err != nil {
+				return err
+			}
+		}
+		for _, sub := range added {
+			if err := s.addTopic(user, sub.Channel, sub.Topic, sub.Application); err != nil {
+				return err
+			}
+		}
+		for id, name := range vkNames {
+			if err := s.addVKPublic(name, id, 0); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return formatDiff(added, removed), nil
+}
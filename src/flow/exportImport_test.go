@@ -0,0 +1,88 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSubscriptionsRoundTrip(t *testing.T) {
+	doc := SubscriptionsDocument{
+		Telegram: {"channel": {"дедлайн", "экзамен"}},
+		VK:       {"12345": {"стипендия"}},
+	}
+	for _, format := range []string{"", "yaml", "json"} {
+		raw, err := encodeSubscriptions(doc, format)
+		if err != nil {
+			t.Fatalf("Error (%s) in encoding %q", err.Error(), format)
+		}
+		res, err := decodeSubscriptions(raw)
+		if err != nil {
+			t.Fatalf("Error (%s) in decoding %q: %s", err.Error(), format, raw)
+		}
+		if !reflect.DeepEqual(res, doc) {
+			t.Errorf("Got %v but answer is %v", res, doc)
+		}
+	}
+
+	if _, err := encodeSubscriptions(doc, "xml"); err == nil {
+		t.Errorf("No error in encoding xml")
+	}
+}
+
+func TestDecodeSubscriptions(t *testing.T) {
+	res, err := decodeSubscriptions([]byte("vk:\n  12345: [стипендия]\n"))
+	if err != nil {
+		t.Fatalf("Error (%s) in decoding numeric channel", err.Error())
+	}
+	if topics := res[VK]["12345"]; len(topics) != 1 || topics[0] != "стипендия" {
+		t.Errorf("Got %v", res)
+	}
+
+	for _, given := range []string{
+		"telegram: [channel]",
+		"icq:\n  channel: [topic]\n",
+		"vk:\n  public_name: [topic]\n",
+		"telegram:\n  channel: [two words]\n",
+		"telegram:\n  \"\": [topic]\n",
+		`{"telegram": {"channel": [""]}}`,
+	} {
+		if _, err := decodeSubscriptions([]byte(given)); err == nil {
+			t.Errorf("No error in decoding: %s", given)
+		}
+	}
+}
+
+func TestDiffSubscriptions(t *testing.T) {
+	old := SubscriptionsDocument{
+		Telegram: {"channel": {"a", "b"}},
+		VK:       {"1": {"c"}},
+	}
+	updated := SubscriptionsDocument{
+		Telegram:   {"channel": {"b", "d"}},
+		MatterMost: {"town-square": {"e"}},
+	}
+	added, removed := diffSubscriptions(old, updated)
+
+	wantAdded := []Subscription{
+		{Application: MatterMost, Channel: "town-square", Topic: "e"},
+		{Application: Telegram, Channel: "channel", Topic: "d"},
+	}
+	wantRemoved := []Subscription{
+		{Application: Telegram, Channel: "channel", Topic: "a"},
+		{Application: VK, Channel: "1", Topic: "c"},
+	}
+	if !reflect.DeepEqual(added, wantAdded) {
+		t.Errorf("Got added %v but answer is %v", added, wantAdded)
+	}
+	if !reflect.DeepEqual(removed, wantRemoved) {
+		t.Errorf("Got removed %v but answer is %v", removed, wantRemoved)
+	}
+
+	summary := formatDiff(added, removed)
+	for _, sub := range []string{"+2, -2", "+ telegram channel: d", "- vk 1: c"} {
+		if !strings.Contains(summary, sub) {
+			t.Errorf("Didn't find %s in %s", sub, summary)
+		}
+	}
+}
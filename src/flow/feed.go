@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	FeedCode    = "RSS"
+	feedPeriod  = 5 * time.Minute
+	feedTimeout = 30 * time.Second
+	// maxFeedSize limits the size of a downloaded feed.
+	maxFeedSize = 5 << 20
+)
+
+var (
+	wrongFeedError   = errors.New("Неправильная ссылка на ленту")
+	notFeedError     = errors.New("По ссылке нет RSS или Atom ленты")
+	privateFeedError = errors.New("Лента должна быть на публичном адресе")
+)
+
+// FeedState is what is known about a polled feed.
+type FeedState struct {
+	URL   string
+	Title string
+	// ETag and LastModified make the next fetch conditional.
+	ETag         string
+	LastModified string
+	// Seen are the ids of the items of the latest fetch.
+	Seen []string
+}
+
+type feed struct {
+	title string
+	// items are in the order of the feed, usually the newest first.
+	items []feedItem
+}
+
+type feedItem struct {
+	id   string
+	link string
+	text string
+}
+
+// xmlFeed covers RSS 2.0, RSS 1.0 and Atom.
+type xmlFeed struct {
+	XMLName xml.Name
+	Channel struct {
+		Title string    `xml:"title"`
+		Items []rssItem `xml:"item"`
+	} `xml:"channel"`
+	// Items of RSS 1.0 are outside of the channel.
+	Items   []rssItem   `xml:"item"`
+	Title   string      `xml:"title"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type rssItem struct {
+	Title string `xml:"title"`
+	// Links may include an empty atom:link.
+	Links       []string `xml:"link"`
+	GUID        string   `xml:"guid"`
+	Description string   `xml:"description"`
+}
+
+type atomEntry struct {
+	ID    string `xml:"id"`
+	Title string `xml:"title"`
+	Links []struct {
+		Href string `xml:"href,attr"`
+		Rel  string `xml:"rel,attr"`
+	} `xml:"link"`
+	Summary string `xml:"summary"`
+	Content string `xml:"content"`
+}
+
+func parseFeed(data []byte) (feed, error) {
+	var doc xmlFeed
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return feed{}, fmt.Errorf("%w: %s", notFeedError, err.Error())
+	}
+	var f feed
+	switch doc.XMLName.Local {
+	case "rss", "RDF":
+		f.title = doc.Channel.Title
+		for _, item := range append(doc.Channel.Items, doc.Items...) {
+			link := ""
+			for _, l := range item.Links {
+				if l = strings.TrimSpace(l); l != "" {
+					link = l
+					break
+				}
+			}
+			f.items = append(f.items, newFeedItem(item.GUID, link, item.Title, item.Description))
+		}
+	case "feed":
+		f.title = doc.Title
+		for _, entry := range doc.Entries {
+			link := ""
+			for _, l := range entry.Links {
+				if l.Rel == "" || l.Rel == "alternate" {
+					link = l.Href
+					break
+				}
+			}
+			text := entry.Summary
+			if text == "" {
+				text = entry.Content
+			}
+			f.items = append(f.items, newFeedItem(entry.ID, link, entry.Title, text))
+		}
+	default:
+		return feed{}, notFeedError
+	}
+	f.title = strings.TrimSpace(f.title)
+	return f, nil
+}
+
+// newFeedItem identifies an item by its id, its link or its title,
+// whichever the feed has.
+func newFeedItem(id, link, title, description string) feedItem {
+	item := feedItem{id: strings.TrimSpace(id), link: strings.TrimSpace(link)}
+	title = plainText(title)
+	item.text = strings.TrimSpace(title + "\n" + plainText(description))
+	if item.id == "" {
+		item.id = item.link
+	}
+	if item.id == "" {
+		item.id = title
+	}
+	return item
+}
+
+var htmlTag = regexp.MustCompile(`<[^>]*>`)
+
+// plainText strips the HTML of a description so that tags are not
+// matched against the topics.
+func plainText(s string) string {
+	return strings.TrimSpace(html.UnescapeString(htmlTag.ReplaceAllString(s, " ")))
+}
+
+// feedSource polls the subscribed RSS and Atom feeds.
+type feedSource struct {
+	// client connects to public addresses only, since the feeds are
+	// given by the users.
+	client  *http.Client
+	storage LocalStorage
+	// enqueue passes an event to the pipeline.
+	enqueue func(workEvent)
+}
+
+func newFeedSource(storage LocalStorage) *feedSource {
+	return &feedSource{
+		client:  publicClient(feedTimeout),
+		storage: storage,
+		enqueue: enqueueEvent,
+	}
+}
+
+func (s *feedSource) handleUpdates(ctx context.Context) {
+	pollLoop(ctx, s.storage, RSS, feedPeriod, s.poll)
+}
+
+// poll passes the items of the feed at u which have not been seen to the
+// pipeline. The items of a feed fetched for the first time are only
+// remembered.
+func (s *feedSource) poll(ctx context.Context, u string) error {
+	state, err := s.storage.getFeed(u)
+	known := err == nil
+	if errors.Is(err, sql.ErrNoRows) {
+		state = FeedState{URL: u}
+	} else if err != nil {
+		return err
+	}
+	f, next, modified, err := s.fetch(ctx, state)
+	if err != nil || !modified {
+		return err
+	}
+	if known {
+		seen := make(map[string]bool, len(state.Seen))
+		for _, id := range state.Seen {
+			seen[id] = true
+		}
+		for i := len(f.items) - 1; i >= 0; i-- {
+			if !seen[f.items[i].id] {
+				s.enqueue(feedEvent(next, f.items[i], nil))
+			}
+		}
+	}
+	return s.storage.saveFeed(next)
+}
+
+// fetch gets the feed of state unless it has not changed since state was
+// saved, in which case modified is false. The returned state describes
+// the fetched feed.
+func (s *feedSource) fetch(ctx context.Context, state FeedState) (f feed, next FeedState, modified bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, state.URL, nil)
+	if err != nil {
+		return feed{}, state, false, err
+	}
+	if state.ETag != "" {
+		req.Header.Set("If-None-Match", state.ETag)
+	}
+	if state.LastModified != "" {
+		req.Header.Set("If-Modified-Since", state.LastModified)
+	}
+	resp, err := s.client.Do(req)
+	if errors.Is(err, privateAddressError) {
+		return feed{}, state, false, privateFeedError
+	}
+	if err != nil {
+		return feed{}, state, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return feed{}, state, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return feed{}, state, false, fmt.Errorf("feed responded with %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxFeedSize))
+	if err != nil {
+		return feed{}, state, false, err
+	}
+	if f, err = parseFeed(data); err != nil {
+		return feed{}, state, false, err
+	}
+	next = FeedState{
+		URL:          state.URL,
+		Title:        f.title,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+	for _, item := range f.items {
+		next.Seen = append(next.Seen, item.id)
+	}
+	return f, next, true, nil
+}
+
+func feedEvent(state FeedState, item feedItem, request *historyRequest) workEvent {
+	name := state.Title
+	if name == "" {
+		name = state.URL
+	}
+	return workEvent{
+		application:    RSS,
+		channel:        name,
+		channelID:      state.URL,
+		key:            state.URL,
+		text:           item.text,
+		link:           item.link,
+		messageID:      item.id,
+		historyRequest: request,
+	}
+}
+
+func (*feedSource) application() Application {
+	return RSS
+}
+
+// resolveChannel returns the normalized URL of a feed. A new feed is
+// fetched to check it and to remember its current items.
+func (s *feedSource) resolveChannel(link string) (string, error) {
+	u, err := url.Parse(link)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", wrongFeedError
+	}
+	link = u.String()
+	_, err = s.storage.getFeed(link)
+	if !errors.Is(err, sql.ErrNoRows) {
+		return link, err
+	}
+	return link, s.poll(context.Background(), link)
+}
+
+func (s *feedSource) channelName(channel string) string {
+	if state, err := s.storage.getFeed(channel); err == nil && state.Title != "" {
+		return state.Title
+	}
+	return channel
+}
+
+// link returns the link of the feed item, which can't be built from its
+// id.
+func (*feedSource) link(event workEvent) string {
+	return event.link
+}
+
+func (s *feedSource) history(user, channel string, count int) error {
+	f, state, _, err := s.fetch(context.Background(), FeedState{URL: channel})
+	if err != nil {
+		return err
+	}
+	items := f.items
+	if len(items) > count {
+		items = items[:count]
+	}
+	for i := len(items) - 1; i >= 0; i-- {
+		s.enqueue(feedEvent(state, items[i], &historyRequest{user}))
+	}
+	return nil
+}
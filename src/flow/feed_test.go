@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+const rssFeed = `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0" xmlns:atom="http://www.w3.org/2005/Atom">
+<channel>
+  <title>Новости СПбГУ</title>
+  <atom:link href="https://spbu.ru/rss" rel="self"/>
+  <item>
+    <title>Перенос экзамена</title>
+    <link>https://spbu.ru/news/2</link>
+    <guid>news-2</guid>
+    <description>&lt;p&gt;Экзамен по &lt;b&gt;матанализу&lt;/b&gt; перенесён&lt;/p&gt;</description>
+  </item>
+  <item>
+    <title>День открытых дверей</title>
+    <link>https://spbu.ru/news/1</link>
+  </item>
+</channel>
+</rss>`
+
+const atomFeed = `<?xml version="1.0" encoding="utf-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+  <title>Блог курса</title>
+  <entry>
+    <id>tag:blog,2024:1</id>
+    <title>Дедлайн по домашке</title>
+    <link rel="alternate" href="https://blog.example.com/1"/>
+    <summary>Сдать до пятницы</summary>
+  </entry>
+</feed>`
+
+func TestParseFeed(t *testing.T) {
+	f, err := parseFeed([]byte(rssFeed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := feed{title: "Новости СПбГУ", items: []feedItem{
+		{id: "news-2", link: "https://spbu.ru/news/2", text: "Перенос экзамена\nЭкзамен по  матанализу  перенесён"},
+		{id: "https://spbu.ru/news/1", link: "https://spbu.ru/news/1", text: "День открытых дверей"},
+	}}
+	if !reflect.DeepEqual(f, want) {
+		t.Errorf("parseFeed(rss) = %+v, want %+v", f, want)
+	}
+
+	f, err = parseFeed([]byte(atomFeed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = feed{title: "Блог курса", items: []feedItem{
+		{id: "tag:blog,2024:1", link: "https://blog.example.com/1", text: "Дедлайн по домашке\nСдать до пятницы"},
+	}}
+	if !reflect.DeepEqual(f, want) {
+		t.Errorf("parseFeed(atom) = %+v, want %+v", f, want)
+	}
+
+	for _, data := range []string{"<html><body>news</body></html>", "not xml"} {
+		if _, err := parseFeed([]byte(data)); !errors.Is(err, notFeedError) {
+			t.Errorf("parseFeed(%q) error = %v, want %v", data, err, notFeedError)
+		}
+	}
+}
+
+// feedStorage keeps the feed states in memory.
+type feedStorage struct {
+	memoryStore[FeedState]
+}
+
+func (s *feedStorage) getFeed(url string) (FeedState, error) {
+	return s.get(url)
+}
+
+func (s *feedStorage) saveFeed(state FeedState) error {
+	return s.save(state.URL, state)
+}
+
+// feedServer serves body with an ETag and answers 304 to a request
+// with the same ETag.
+type feedServer struct {
+	mu   sync.Mutex
+	body string
+	etag string
+	// requests counts all requests, notModified the 304 responses.
+	requests    int
+	notModified int
+}
+
+func (f *feedServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests++
+	if r.Header.Get("If-None-Match") == f.etag {
+		f.notModified++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", f.etag)
+	w.Header().Set("Content-Type", "application/rss+xml")
+	w.Write([]byte(f.body))
+}
+
+func (f *feedServer) set(body, etag string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.body, f.etag = body, etag
+}
+
+func newTestFeedSource(t *testing.T, handler http.Handler) (*feedSource, *httptest.Server, *[]workEvent) {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	enqueue, events := recordEvents()
+	s := &feedSource{
+		client:  server.Client(),
+		storage: &feedStorage{newMemoryStore[FeedState]()},
+		enqueue: enqueue,
+	}
+	return s, server, events
+}
+
+func TestFeedPoll(t *testing.T) {
+	server := &feedServer{}
+	server.set(atomFeed, `"v1"`)
+	s, ts, events := newTestFeedSource(t, server)
+
+	channel, err := s.resolveChannel(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*events) != 0 {
+		t.Fatalf("a new feed produced events %+v", *events)
+	}
+	if name := s.channelName(channel); name != "Блог курса" {
+		t.Errorf("channelName = %q", name)
+	}
+
+	// Nothing has changed: the server answers 304.
+	if err := s.poll(context.Background(), channel); err != nil {
+		t.Fatal(err)
+	}
+	if server.notModified != 1 || len(*events) != 0 {
+		t.Fatalf("unchanged feed: %d not modified responses, events %+v", server.notModified, *events)
+	}
+
+	server.set(`<feed xmlns="http://www.w3.org/2005/Atom"><title>Блог курса</title>
+  <entry><id>tag:blog,2024:2</id><title>Экзамен</title><link href="https://blog.example.com/2"/></entry>
+  <entry><id>tag:blog,2024:1</id><title>Дедлайн по домашке</title></entry>
+</feed>`, `"v2"`)
+	pollSubscribed(context.Background(), s.storage, RSS, s.poll)
+	want := []workEvent{{
+		application: RSS,
+		channel:     "Блог курса",
+		channelID:   channel,
+		key:         channel,
+		text:        "Экзамен",
+		link:        "https://blog.example.com/2",
+		messageID:   "tag:blog,2024:2",
+	}}
+	if !reflect.DeepEqual(*events, want) {
+		t.Errorf("events = %+v, want %+v", *events, want)
+	}
+	if state, _ := s.storage.getFeed(channel); state.ETag != `"v2"` {
+		t.Errorf("saved ETag = %q", state.ETag)
+	}
+}
+
+func TestFeedHistory(t *testing.T) {
+	server := &feedServer{}
+	server.set(rssFeed, `"v1"`)
+	s, ts, events := newTestFeedSource(t, server)
+
+	if err := s.history("alice", ts.URL, 1); err != nil {
+		t.Fatal(err)
+	}
+	if len(*events) != 1 || (*events)[0].messageID != "news-2" || (*events)[0].historyRequest == nil ||
+		(*events)[0].historyRequest.user != "alice" {
+		t.Errorf("history events = %+v", *events)
+	}
+}
+
+func TestResolveFeed(t *testing.T) {
+	s, ts, _ := newTestFeedSource(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html></html>"))
+	}))
+	if _, err := s.resolveChannel("ftp://example.com/rss"); err != wrongFeedError {
+		t.Errorf("resolveChannel(ftp) error = %v", err)
+	}
+	if _, err := s.resolveChannel(ts.URL); !errors.Is(err, notFeedError) {
+		t.Errorf("resolveChannel(html) error = %v", err)
+	}
+}
+
+func TestFeedPrivateAddress(t *testing.T) {
+	server := &feedServer{}
+	server.set(rssFeed, `"v1"`)
+	s, ts, events := newTestFeedSource(t, server)
+	s.client = publicClient(feedTimeout)
+
+	if _, err := s.resolveChannel(ts.URL); err != privateFeedError {
+		t.Errorf("resolveChannel(%s) error = %v, want %v", ts.URL, err, privateFeedError)
+	}
+	if err := s.history("alice", ts.URL, 1); err != privateFeedError {
+		t.Errorf("history(%s) error = %v, want %v", ts.URL, err, privateFeedError)
+	}
+	if server.requests != 0 || len(*events) != 0 {
+		t.Errorf("a feed on a loopback address was fetched: events %+v", *events)
+	}
+}
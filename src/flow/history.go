@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultHistoryLimit = 10
+	maxHistoryLimit     = 50
+	historyTimeFormat   = "02.01 15:04"
+)
+
+var wrongHistoryLimitError = fmt.Errorf(
+	"Количество уведомлений должно быть числом от 1 до %d", maxHistoryLimit)
+
+// parseHistoryLimit parses the optional argument of the history command.
+func parseHistoryLimit(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return defaultHistoryLimit, nil
+	}
+	limit, err := strconv.Atoi(s)
+	if err != nil || limit < 1 || limit > maxHistoryLimit {
+		return 0, wrongHistoryLimitError
+	}
+	return limit, nil
+}
+
+// formatHistory renders deliveries as a single text message.
+func formatHistory(deliveries []Delivery) string {
+	if len(deliveries) == 0 {
+		return "История уведомлений пуста"
+	}
+	str := strings.Builder{}
+	for _, delivery := range deliveries {
+		str.WriteString(fmt.Sprintf("%s %s [%s]",
+			delivery.SentAt.Local().Format(historyTimeFormat), delivery.Application, delivery.Topic))
+		if delivery.Channel != "" {
+			str.WriteString(fmt.Sprintf(" в %s", delivery.Channel))
+		}
+		if delivery.Status != DeliverySent {
+			str.WriteString(" (не доставлено)")
+		}
+		str.WriteString(fmt.Sprintf("\n%s\n%s\n\n", delivery.Summary, delivery.Link))
+	}
+	return str.String()
+}
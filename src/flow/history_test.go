@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseHistoryLimit(t *testing.T) {
+	for _, tc := range []struct {
+		given  string
+		answer int
+	}{
+		{"", defaultHistoryLimit},
+		{"  ", defaultHistoryLimit},
+		{"1", 1},
+		{" 25 ", 25},
+		{"50", 50},
+	} {
+		res, err := parseHistoryLimit(tc.given)
+		if err != nil {
+			t.Errorf("Error (%s) in parsing: %q", err.Error(), tc.given)
+		}
+		if res != tc.answer {
+			t.Errorf("Got %d but answer is %d", res, tc.answer)
+		}
+	}
+
+	for _, given := range []string{"0", "-3", "51", "ten", "1 2"} {
+		if _, err := parseHistoryLimit(given); err == nil {
+			t.Errorf("No error in parsing: %q", given)
+		}
+	}
+}
+
+func TestFormatHistory(t *testing.T) {
+	if res := formatHistory(nil); res == "" {
+		t.Errorf("Empty history is rendered as empty text")
+	}
+
+	res := formatHistory([]Delivery{
+		{
+			Message: Message{
+				Application: Telegram,
+				Channel:     "channel",
+				Topic:       "дедлайн",
+				Summary:     "summary",
+				Link:        "https://t.me/channel/1",
+			},
+			SentAt: time.Now(),
+			Status: DeliverySent,
+		},
+		{
+			Message: Message{Application: VK, Topic: "экзамен"},
+			SentAt:  time.Now(),
+			Status:  DeliveryFailed,
+		},
+	})
+	for _, sub := range []string{"дедлайн", "https://t.me/channel/1", "экзамен", "не доставлено"} {
+		if !strings.Contains(res, sub) {
+			t.Errorf("Didn't find %s in %s", sub, res)
+		}
+	}
+	if strings.Count(res, "не доставлено") != 1 {
+		t.Errorf("Only failed deliveries must be marked: %s", res)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	HookCode = "HOOK"
+	hookPath = "/hook"
+	// defaultHookAddr is where the endpoint listens if no address is
+	// given.
+	defaultHookAddr = ":8080"
+	// maxHookSize limits the body of a hook request.
+	maxHookSize     = 1 << 20
+	hookReadTimeout = 10 * time.Second
+	hookStopTimeout = 5 * time.Second
+)
+
+var hookChannelError = errors.New(
+	"Неправильный канал вебхука. Используйте <источник>/<канал>, где источник настроен у бота")
+
+// hookPost is the body of a request to the webhook endpoint.
+type hookPost struct {
+	Source  string `json:"source"`
+	Channel string `json:"channel"`
+	Text    string `json:"text"`
+	Link    string `json:"link"`
+	ID      string `json:"id"`
+}
+
+// hookSource receives posts from any system, e.g. a CI or an LMS, over
+// HTTP. Every system is a source with its own secret, sent as a bearer
+// token; its channels are subscribed to as source/channel.
+type hookSource struct {
+	addr    string
+	secrets map[string]string
+	// enqueue passes an event to the pipeline.
+	enqueue func(workEvent)
+}
+
+// newHookSource configures the endpoint from TOPIC_KEEPER_HOOK_ADDR and
+// the sources from TOPIC_KEEPER_HOOK_SECRETS, e.g. "ci:s1,lms:s2". It
+// returns nil if no source is configured.
+func newHookSource() *hookSource {
+	secrets := parseHookSecrets(os.Getenv("TOPIC_KEEPER_HOOK_SECRETS"))
+	if len(secrets) == 0 {
+		return nil
+	}
+	addr := os.Getenv("TOPIC_KEEPER_HOOK_ADDR")
+	if addr == "" {
+		addr = defaultHookAddr
+	}
+	return &hookSource{addr: addr, secrets: secrets, enqueue: enqueueEvent}
+}
+
+// parseHookSecrets parses a comma separated list of source:secret.
+func parseHookSecrets(s string) map[string]string {
+	secrets := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		source, secret, found := strings.Cut(pair, ":")
+		if !found || source == "" || secret == "" || strings.Contains(source, "/") {
+			if pair != "" {
+				log.Printf("invalid hook source %q is skipped", pair)
+			}
+			continue
+		}
+		secrets[source] = secret
+	}
+	return secrets
+}
+
+// handleUpdates serves the endpoint until ctx is done.
+func (s *hookSource) handleUpdates(ctx context.Context) {
+	mux := http.NewServeMux()
+	mux.Handle(hookPath, s)
+	server := &http.Server{Addr: s.addr, Handler: mux, ReadTimeout: hookReadTimeout}
+	go func() {
+		<-ctx.Done()
+		stopCtx, cancel := context.WithTimeout(context.Background(), hookStopTimeout)
+		defer cancel()
+		server.Shutdown(stopCtx)
+	}()
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("hook endpoint failed: %s", err.Error())
+	}
+}
+
+// ServeHTTP passes a post of a source to the pipeline.
+func (s *hookSource) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var post hookPost
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxHookSize)).Decode(&post); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	secret, found := s.secrets[post.Source]
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+		http.Error(w, "unknown source or wrong secret", http.StatusUnauthorized)
+		return
+	}
+	if post.Channel == "" || post.Text == "" {
+		http.Error(w, "channel and text are required", http.StatusBadRequest)
+		return
+	}
+	channel := post.Source + "/" + post.Channel
+	s.enqueue(workEvent{
+		application: Hook,
+		channel:     channel,
+		channelID:   channel,
+		key:         channel,
+		text:        post.Text,
+		link:        post.Link,
+		// Posts without an id are not deduplicated.
+		messageID: post.ID,
+	})
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (*hookSource) application() Application {
+	return Hook
+}
+
+// resolveChannel checks that the channel is source/channel of a
+// configured source.
+func (s *hookSource) resolveChannel(link string) (string, error) {
+	source, channel, found := strings.Cut(link, "/")
+	if _, known := s.secrets[source]; !found || !known || channel == "" {
+		return "", hookChannelError
+	}
+	return link, nil
+}
+
+func (*hookSource) channelName(channel string) string {
+	return channel
+}
+
+func (*hookSource) link(event workEvent) string {
+	return event.link
+}
+
+func (*hookSource) history(user, channel string, count int) error {
+	return historyUnsupportedError
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseHookSecrets(t *testing.T) {
+	got := parseHookSecrets(" ci:s1, lms:s:2,bad, a/b:s3,,empty:")
+	want := map[string]string{"ci": "s1", "lms": "s:2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseHookSecrets = %v, want %v", got, want)
+	}
+}
+
+func TestHookEndpoint(t *testing.T) {
+	var events []workEvent
+	s := &hookSource{
+		secrets: map[string]string{"ci": "s1", "lms": "s2"},
+		enqueue: func(event workEvent) { events = append(events, event) },
+	}
+	for _, tt := range []struct {
+		method, secret, body string
+		status               int
+	}{
+		{http.MethodPost, "s1", `{"source":"ci","channel":"course","text":"дедлайн сборки","link":"https://ci/1","id":"1"}`,
+			http.StatusAccepted},
+		{http.MethodPost, "s1", `{"source":"lms","channel":"course","text":"чужой секрет"}`, http.StatusUnauthorized},
+		{http.MethodPost, "", `{"source":"ci","channel":"course","text":"без секрета"}`, http.StatusUnauthorized},
+		{http.MethodPost, "s1", `{"source":"forms","channel":"course","text":"нет источника"}`, http.StatusUnauthorized},
+		{http.MethodPost, "s2", `{"source":"lms","channel":"","text":"без канала"}`, http.StatusBadRequest},
+		{http.MethodPost, "s2", `{"source":`, http.StatusBadRequest},
+		{http.MethodGet, "s1", "", http.StatusMethodNotAllowed},
+	} {
+		req := httptest.NewRequest(tt.method, hookPath, strings.NewReader(tt.body))
+		if tt.secret != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.secret)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		if w.Code != tt.status {
+			t.Errorf("%s %s = %d, want %d", tt.method, tt.body, w.Code, tt.status)
+		}
+	}
+	want := []workEvent{{
+		application: Hook,
+		channel:     "ci/course",
+		channelID:   "ci/course",
+		key:         "ci/course",
+		text:        "дедлайн сборки",
+		link:        "https://ci/1",
+		messageID:   "1",
+	}}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("events = %+v, want %+v", events, want)
+	}
+}
+
+func TestHookResolveChannel(t *testing.T) {
+	s := &hookSource{secrets: map[string]string{"ci": "s1"}}
+	if channel, err := s.resolveChannel("ci/course-project"); channel != "ci/course-project" || err != nil {
+		t.Errorf("resolveChannel = %q, %v", channel, err)
+	}
+	for _, link := range []string{"ci", "ci/", "lms/course", "@channel"} {
+		if _, err := s.resolveChannel(link); err != hookChannelError {
+			t.Errorf("resolveChannel(%q) error = %v", link, err)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// imapTimeout limits a whole IMAP session.
+	imapTimeout = time.Minute
+	// maxMailSize limits the size of a fetched message.
+	maxMailSize = 10 << 20
+)
+
+// imapClient is the small part of an IMAP4rev1 client needed to read a
+// mailbox.
+type imapClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+	tag  int
+}
+
+// imapResponse is an untagged response with its literals.
+type imapResponse struct {
+	text     string
+	literals [][]byte
+}
+
+type imapMessage struct {
+	uid uint32
+	raw []byte
+}
+
+var (
+	imapLiteral     = regexp.MustCompile(`\{(\d+)\}$`)
+	imapUIDValidity = regexp.MustCompile(`\[UIDVALIDITY (\d+)\]`)
+	imapUIDNext     = regexp.MustCompile(`\[UIDNEXT (\d+)\]`)
+	imapExists      = regexp.MustCompile(`^\* (\d+) EXISTS`)
+	imapFetchUID    = regexp.MustCompile(`\bUID (\d+)`)
+)
+
+// dialIMAP connects to the server of an imap:// or imaps:// URL and logs
+// in with its user.
+func dialIMAP(ctx context.Context, u *url.URL) (*imapClient, error) {
+	dialer := &net.Dialer{Timeout: imapTimeout}
+	var conn net.Conn
+	var err error
+	switch u.Scheme {
+	case "imaps":
+		addr := u.Host
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), "993")
+		}
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: u.Hostname()}}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", addr)
+	case "imap":
+		addr := u.Host
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), "143")
+		}
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	default:
+		return nil, wrongMailboxError
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Now().Add(imapTimeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c := &imapClient{conn: conn, r: bufio.NewReader(conn)}
+	greeting, err := c.readResponse()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(greeting.text, "* OK") {
+		conn.Close()
+		return nil, fmt.Errorf("imap: unexpected greeting %q", greeting.text)
+	}
+	password, _ := u.User.Password()
+	if _, err := c.command("LOGIN %s %s", imapQuote(u.User.Username()), imapQuote(password)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// command sends a command and returns its untagged responses if it
+// succeeds.
+func (c *imapClient) command(format string, args ...any) ([]imapResponse, error) {
+	c.tag++
+	tag := fmt.Sprintf("A%d", c.tag)
+	if _, err := fmt.Fprintf(c.conn, "%s %s\r\n", tag, fmt.Sprintf(format, args...)); err != nil {
+		return nil, err
+	}
+	var responses []imapResponse
+	for {
+		resp, err := c.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		if status, ok := strings.CutPrefix(resp.text, tag+" "); ok {
+			if strings.HasPrefix(status, "OK") {
+				return responses, nil
+			}
+			return nil, fmt.Errorf("imap: %s", status)
+		}
+		responses = append(responses, resp)
+	}
+}
+
+// readResponse reads a response line together with the literals it
+// contains.
+func (c *imapClient) readResponse() (imapResponse, error) {
+	var resp imapResponse
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return imapResponse{}, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		resp.text += line
+		match := imapLiteral.FindStringSubmatch(line)
+		if match == nil {
+			return resp, nil
+		}
+		size, err := strconv.Atoi(match[1])
+		if err != nil || size > maxMailSize {
+			return imapResponse{}, fmt.Errorf("imap: literal of %s bytes", match[1])
+		}
+		literal := make([]byte, size)
+		if _, err := io.ReadFull(c.r, literal); err != nil {
+			return imapResponse{}, err
+		}
+		resp.literals = append(resp.literals, literal)
+	}
+}
+
+// examine opens the folder read-only.
+func (c *imapClient) examine(folder string) (uidValidity, uidNext, exists uint32, err error) {
+	responses, err := c.command("EXAMINE %s", imapQuote(folder))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	for _, resp := range responses {
+		if match := imapUIDValidity.FindStringSubmatch(resp.text); match != nil {
+			uidValidity = parseUint32(match[1])
+		}
+		if match := imapUIDNext.FindStringSubmatch(resp.text); match != nil {
+			uidNext = parseUint32(match[1])
+		}
+		if match := imapExists.FindStringSubmatch(resp.text); match != nil {
+			exists = parseUint32(match[1])
+		}
+	}
+	return uidValidity, uidNext, exists, nil
+}
+
+// fetch returns the messages of the set, which is of UIDs if byUID and
+// of sequence numbers otherwise. The messages are not marked as seen.
+func (c *imapClient) fetch(set string, byUID bool) ([]imapMessage, error) {
+	cmd := "FETCH"
+	if byUID {
+		cmd = "UID FETCH"
+	}
+	responses, err := c.command("%s %s (UID BODY.PEEK[])", cmd, set)
+	if err != nil {
+		return nil, err
+	}
+	var messages []imapMessage
+	for _, resp := range responses {
+		match := imapFetchUID.FindStringSubmatch(resp.text)
+		if !strings.Contains(resp.text, " FETCH ") || match == nil || len(resp.literals) == 0 {
+			continue
+		}
+		messages = append(messages, imapMessage{uid: parseUint32(match[1]), raw: resp.literals[0]})
+	}
+	return messages, nil
+}
+
+func (c *imapClient) logout() {
+	c.command("LOGOUT")
+	c.conn.Close()
+}
+
+// imapQuote makes s an IMAP quoted string.
+func imapQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
+
+func parseUint32(s string) uint32 {
+	n, _ := strconv.ParseUint(s, 10, 32)
+	return uint32(n)
+}
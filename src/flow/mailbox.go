@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+const (
+	MailCode   = "MAIL"
+	mailPeriod = 2 * time.Minute
+	// maxMailFetch limits the number of messages fetched at once.
+	maxMailFetch = 50
+	// archiveMessageID is replaced by the Message-ID in archive links.
+	archiveMessageID = "{id}"
+)
+
+var (
+	wrongMailboxError = errors.New(
+		"Неправильный адрес ящика. Используйте imaps://логин:пароль@сервер/папка")
+	mailboxNotFoundError = errors.New("Почтовый ящик не найден. Подключите его командой /mailbox")
+	mailboxTakenError    = errors.New("Ящик с таким именем уже подключён другим пользователем")
+	mailboxAccessError   = fmt.Errorf("%w. Владелец ящика может поделиться им с вами", channelAccessError)
+)
+
+// Mailbox is an IMAP folder, usually of a mailing list, attached by its
+// owner. Its messages are matched like the posts of a channel named
+// after the mailbox.
+type Mailbox struct {
+	Name  string
+	Owner string
+	// URL is imap[s]://host[:port]/folder.
+	URL string
+	// Login and Password are stored encrypted.
+	Login    string
+	Password string
+	// Archive is the link to the messages, with {id} replaced by the
+	// Message-ID.
+	Archive string
+	// UIDValidity and LastUID mark the last seen message.
+	UIDValidity uint32
+	LastUID     uint32
+}
+
+// mailMessage is the text of an email.
+type mailMessage struct {
+	id      string
+	subject string
+	text    string
+}
+
+// mailboxSource polls the subscribed mailboxes.
+type mailboxSource struct {
+	storage LocalStorage
+	// enqueue passes an event to the pipeline.
+	enqueue func(workEvent)
+}
+
+func newMailboxSource(storage LocalStorage) *mailboxSource {
+	return &mailboxSource{storage: storage, enqueue: enqueueEvent}
+}
+
+// parseMailboxURL checks the URL of a mailbox. The folder defaults to
+// INBOX.
+func parseMailboxURL(s string) (*url.URL, string, error) {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "imap" && u.Scheme != "imaps") || u.Host == "" || u.User == nil {
+		return nil, "", wrongMailboxError
+	}
+	folder := strings.TrimPrefix(u.Path, "/")
+	if folder == "" {
+		folder = "INBOX"
+	}
+	return u, folder, nil
+}
+
+// splitMailboxURL takes the login and the password out of the URL of a
+// mailbox.
+func splitMailboxURL(s string) (address, login, password string, err error) {
+	u, _, err := parseMailboxURL(s)
+	if err != nil {
+		return "", "", "", err
+	}
+	login = u.User.Username()
+	password, _ = u.User.Password()
+	u.User = nil
+	return u.String(), login, password, nil
+}
+
+// dialURL returns the URL of the mailbox with its credentials and its
+// folder.
+func (m Mailbox) dialURL() (*url.URL, string, error) {
+	u, err := url.Parse(m.URL)
+	if err != nil {
+		return nil, "", wrongMailboxError
+	}
+	u.User = url.UserPassword(m.Login, m.Password)
+	return parseMailboxURL(u.String())
+}
+
+// credentials returns the login and the password of the mailbox as
+// they are stored.
+func (m Mailbox) credentials() string {
+	return m.Login + "\n" + m.Password
+}
+
+func (m *Mailbox) setCredentials(credentials string) {
+	m.Login, m.Password, _ = strings.Cut(credentials, "\n")
+}
+
+// attachMailbox attaches the mailbox of the owner given by args: a name,
+// an IMAP URL and optionally an archive link. Only messages arriving
+// later are matched.
+func attachMailbox(owner string, args []string) (string, error) {
+	if len(args) != 2 && len(args) != 3 {
+		return "", wrongFmtError
+	}
+	mailbox := Mailbox{Name: args[0], Owner: owner}
+	if len(args) == 3 {
+		mailbox.Archive = args[2]
+	}
+	var err error
+	if mailbox.URL, mailbox.Login, mailbox.Password, err = splitMailboxURL(args[1]); err != nil {
+		return "", err
+	}
+	u, folder, err := mailbox.dialURL()
+	if err != nil {
+		return "", err
+	}
+	c, err := dialIMAP(context.Background(), u)
+	if err != nil {
+		return "", fmt.Errorf("Не удалось подключиться к ящику: %w", err)
+	}
+	defer c.logout()
+	uidValidity, uidNext, _, err := c.examine(folder)
+	if err != nil {
+		return "", fmt.Errorf("Не удалось открыть папку %s: %w", folder, err)
+	}
+	mailbox.UIDValidity = uidValidity
+	if uidNext > 0 {
+		mailbox.LastUID = uidNext - 1
+	}
+	if err := dataBase.addMailbox(mailbox); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Ящик %s подключён. Добавьте слова командой /add %s <слово> %s",
+		mailbox.Name, mailbox.Name, MailCode), nil
+}
+
+// shareMailbox shares the mailbox of the owner given by args, its name
+// and a user, with the user, or stops sharing it.
+func shareMailbox(owner string, args []string, share bool) (string, error) {
+	if len(args) != 2 {
+		return "", wrongFmtError
+	}
+	name, user := args[0], strings.TrimPrefix(args[1], "@")
+	if !share {
+		return fmt.Sprintf("Ящик %s больше не доступен %s", name, user), dataBase.unshareMailbox(name, owner, user)
+	}
+	return fmt.Sprintf("Ящик %s доступен %s", name, user), dataBase.shareMailbox(name, owner, user)
+}
+
+func (s *mailboxSource) handleUpdates(ctx context.Context) {
+	pollLoop(ctx, s.storage, Mail, mailPeriod, s.poll)
+}
+
+// poll passes the messages which arrived to the mailbox since the last
+// poll to the pipeline.
+func (s *mailboxSource) poll(ctx context.Context, name string) error {
+	mailbox, err := s.storage.getMailbox(name)
+	if err != nil {
+		return err
+	}
+	u, folder, err := mailbox.dialURL()
+	if err != nil {
+		return err
+	}
+	c, err := dialIMAP(ctx, u)
+	if err != nil {
+		return err
+	}
+	defer c.logout()
+	uidValidity, uidNext, _, err := c.examine(folder)
+	if err != nil {
+		return err
+	}
+	if uidValidity != mailbox.UIDValidity {
+		// The UIDs have been reassigned, start over from the next one.
+		last := uint32(0)
+		if uidNext > 0 {
+			last = uidNext - 1
+		}
+		return s.storage.setMailboxUID(name, uidValidity, last)
+	}
+	if uidNext > 0 && uidNext-1 <= mailbox.LastUID {
+		return nil
+	}
+	first := mailbox.LastUID + 1
+	messages, err := c.fetch(fmt.Sprintf("%d:%d", first, first+maxMailFetch-1), true)
+	if err != nil {
+		return err
+	}
+	last := mailbox.LastUID
+	for _, message := range messages {
+		// The range of UIDs may include the last message already seen.
+		if message.uid <= mailbox.LastUID {
+			continue
+		}
+		if event, err := mailEvent(mailbox, message, nil); err != nil {
+			log.Printf("can't parse message %d of %s: %s", message.uid, name, err.Error())
+		} else {
+			s.enqueue(event)
+		}
+		if message.uid > last {
+			last = message.uid
+		}
+	}
+	// Every UID of the fetched range is seen, even of deleted messages.
+	if seen := first + maxMailFetch - 1; uidNext > 0 {
+		if seen > uidNext-1 {
+			seen = uidNext - 1
+		}
+		if seen > last {
+			last = seen
+		}
+	}
+	if last == mailbox.LastUID {
+		return nil
+	}
+	return s.storage.setMailboxUID(name, uidValidity, last)
+}
+
+func mailEvent(mailbox Mailbox, message imapMessage, request *historyRequest) (workEvent, error) {
+	m, err := parseMail(message.raw)
+	if err != nil {
+		return workEvent{}, err
+	}
+	id := m.id
+	if id == "" {
+		id = strconv.FormatUint(uint64(message.uid), 10)
+	}
+	return workEvent{
+		application:    Mail,
+		channel:        mailbox.Name,
+		channelID:      mailbox.Name,
+		key:            mailbox.Name,
+		text:           strings.TrimSpace(m.subject + "\n" + m.text),
+		link:           mailLink(mailbox.Archive, m.id),
+		messageID:      id,
+		historyRequest: request,
+	}, nil
+}
+
+// mailLink returns the link to a message in the archive, or its mid: URL
+// if there is no archive.
+func mailLink(archive, messageID string) string {
+	switch {
+	case strings.Contains(archive, archiveMessageID):
+		return strings.ReplaceAll(archive, archiveMessageID, url.PathEscape(messageID))
+	case archive != "":
+		return archive
+	case messageID != "":
+		return "mid:" + url.PathEscape(messageID)
+	}
+	return ""
+}
+
+func (*mailboxSource) application() Application {
+	return Mail
+}
+
+func (s *mailboxSource) resolveChannel(name string) (string, error) {
+	_, err := s.storage.getMailbox(name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", mailboxNotFoundError
+	}
+	return name, err
+}
+
+// checkAccess lets only the owner of the mailbox and the users it is
+// shared with read it.
+func (s *mailboxSource) checkAccess(user, channel string) error {
+	allowed, err := s.storage.canReadMailbox(channel, user)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return mailboxAccessError
+	}
+	return nil
+}
+
+func (*mailboxSource) channelName(channel string) string {
+	return channel
+}
+
+func (*mailboxSource) link(event workEvent) string {
+	return event.link
+}
+
+func (s *mailboxSource) history(user, channel string, count int) error {
+	if err := s.checkAccess(user, channel); err != nil {
+		return err
+	}
+	mailbox, err := s.storage.getMailbox(channel)
+	if err != nil {
+		return err
+	}
+	u, folder, err := mailbox.dialURL()
+	if err != nil {
+		return err
+	}
+	c, err := dialIMAP(context.Background(), u)
+	if err != nil {
+		return err
+	}
+	defer c.logout()
+	_, _, exists, err := c.examine(folder)
+	if err != nil || exists == 0 {
+		return err
+	}
+	first := uint32(1)
+	if exists > uint32(count) {
+		first = exists - uint32(count) + 1
+	}
+	messages, err := c.fetch(fmt.Sprintf("%d:%d", first, exists), false)
+	if err != nil {
+		return err
+	}
+	for _, message := range messages {
+		event, err := mailEvent(mailbox, message, &historyRequest{user})
+		if err != nil {
+			log.Printf("can't parse message %d of %s: %s", message.uid, channel, err.Error())
+			continue
+		}
+		s.enqueue(event)
+	}
+	return nil
+}
+
+// parseMail extracts the plain text of an email.
+func parseMail(raw []byte) (mailMessage, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return mailMessage{}, err
+	}
+	m := mailMessage{id: strings.Trim(msg.Header.Get("Message-Id"), "<> ")}
+	decoder := mime.WordDecoder{CharsetReader: charsetReader}
+	if m.subject, err = decoder.DecodeHeader(msg.Header.Get("Subject")); err != nil {
+		m.subject = msg.Header.Get("Subject")
+	}
+	m.text, err = partText(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), msg.Body)
+	return m, err
+}
+
+// partText returns the text of a MIME part. Plain text is preferred to
+// HTML and attachments are skipped.
+func partText(contentType, encoding string, body io.Reader) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType, params = "text/plain", nil
+	}
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		parts := multipart.NewReader(body, params["boundary"])
+		var plain, html string
+		for {
+			part, err := parts.NextRawPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return "", err
+			}
+			if disposition, _, _ := mime.ParseMediaType(part.Header.Get("Content-Disposition")); disposition == "attachment" {
+				continue
+			}
+			partType := part.Header.Get("Content-Type")
+			text, err := partText(partType, part.Header.Get("Content-Transfer-Encoding"), part)
+			if err != nil || text == "" {
+				continue
+			}
+			if strings.HasPrefix(strings.ToLower(partType), "text/html") {
+				html = text
+			} else if plain == "" {
+				plain = text
+			}
+		}
+		if plain != "" {
+			return plain, nil
+		}
+		return html, nil
+	}
+	if !strings.HasPrefix(mediaType, "text/") {
+		return "", nil
+	}
+	if charset := strings.ToLower(params["charset"]); charset != "" && charset != "utf-8" && charset != "us-ascii" {
+		if body, err = charsetReader(charset, body); err != nil {
+			return "", err
+		}
+	}
+	data, err := io.ReadAll(io.LimitReader(body, maxMailSize))
+	if err != nil {
+		return "", err
+	}
+	if mediaType == "text/html" {
+		return plainText(string(data)), nil
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// charsetReader decodes input in charset, e.g. KOI8-R or Windows-1251,
+// to UTF-8.
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	encoding, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, err
+	}
+	return encoding.NewDecoder().Reader(input), nil
+}
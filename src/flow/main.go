@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	_ "embed"
 	"errors"
 	"flag"
@@ -8,7 +9,9 @@ import (
 	"hash/fnv"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	"gopkg.in/yaml.v2"
 
@@ -31,25 +34,33 @@ type historyRequest struct {
 }
 
 type workEvent struct {
-	application    Application
-	channel        string
-	channelID      string
+	application Application
+	channel     string
+	channelID   string
+	// key is the channel as stored in the subscriptions.
+	key            string
 	text           string
 	link           string
 	messageID      string
 	historyRequest *historyRequest
+	// edited is set if the event is an edit of a message that may have
+	// been matched already.
+	edited bool
+	// forwardedFrom is the origin of a forwarded message.
+	forwardedFrom string
+	// job is the work queue entry of the event, nil if it is not stored.
+	job *Job
 }
 
 var (
-	vkToken          string
-	api              API
-	bot              *tgbotapi.BotAPI
-	dataBase         LocalStorage
-	sendChan         chan Message
-	openAIkey        string
-	workChans        []chan workEvent
-	telegramListener UpdatesListener
-	vkListener       VKHandler
+	vkToken    string
+	api        API
+	bot        *tgbotapi.BotAPI
+	dataBase   LocalStorage
+	sendChan   chan notification
+	openAIkey  string
+	workChans  []chan workEvent
+	vkListener VKHandler
 )
 
 func parseTopic(s string) (Concern, error) {
@@ -93,96 +104,65 @@ Summary: %s
 link: %s
 `
 
-func worker(workChan chan workEvent) {
-	for update := range workChan {
-		channel := update.channel
-		msg := update.text
-		application := update.application
+const suppressedFormat = "and %d more\n"
 
-		if update.application == VK {
-			channel = update.channelID
-		}
-
-		if found, err := dataBase.containsChannel(channel, application); !found || err != nil {
-			if err != nil {
-				log.Printf(err.Error())
-			}
-			continue
-		}
-
-		possibleTopics, err := dataBase.getTopics(channel, application)
-		if err != nil {
-			log.Printf(err.Error())
-			continue
-		}
-
-		var foundTopics []string
-		if foundTopics, err = api.analyze(msg, possibleTopics); err != nil || len(foundTopics) == 0 {
-			if err != nil {
-				log.Println(err.Error())
-			}
-			continue
-		}
-
-		var summary string
-		if openAIkey != "" && len(msg) > summaryLength {
-			if summary, err = api.summarize(msg, openAIkey); err != nil {
-				log.Printf("error in OpenAI uisng with error: %s \n", err.Error())
-				summary = summarize(msg)
-			}
-		} else {
-			summary = summarize(msg)
-		}
+func newsText(msg Message) string {
+	if msg.Text != "" {
+		return msg.Text
+	}
+	text := fmt.Sprintf(format, msg.Application, msg.Topic, msg.Channel, msg.Summary, msg.Link)
+	if msg.Priority == PriorityHigh {
+		text = highPriorityMark + text
+	}
+	if msg.Suppressed > 0 {
+		text += fmt.Sprintf(suppressedFormat, msg.Suppressed)
+	}
+	return text
+}
 
-		sendUsers := make(map[string][]string)
-		if update.historyRequest == nil {
-			sendUsers, err = dataBase.getUsers(channel, foundTopics, application)
-		} else {
-			sendUsers[update.historyRequest.user] = foundTopics
-		}
+// notification is a message for the sender with its work queue entry,
+// nil if it is not stored.
+type notification struct {
+	message Message
+	job     *Job
+}
 
-		for user, userTopics := range sendUsers {
-			isPaused := false
-			if update.historyRequest == nil {
-				isPaused, err = dataBase.isPaused(user)
-				if err != nil {
-					log.Printf(err.Error())
-					continue
-				}
-				for _, topic := range userTopics {
-					if err := dataBase.setTime(user, channel, topic, application); err != nil {
-						log.Printf(err.Error())
-						continue
-					}
-				}
-			}
+func queueNotification(ctx context.Context, n notification) {
+	select {
+	case sendChan <- n:
+	case <-ctx.Done():
+		log.Printf("notification for %s is dropped: %s", n.message.User, ctx.Err())
+	}
+}
 
-			finalTopics := strings.Join(userTopics, ", ")
-			message := Message{
-				Application: update.application,
-				User:        user,
-				Link:        update.link,
-				Channel:     update.channel,
-				Topic:       finalTopics,
-				Summary:     summary,
+// sender sends the notifications of sendChan until it is closed or ctx
+// is done.
+func sender(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case n, ok := <-sendChan:
+			if !ok {
+				return
 			}
-			if isPaused {
-				if err := dataBase.addDelayedMessage(message); err != nil {
-					log.Printf(err.Error())
-					continue
-				}
-			} else {
-				sendChan <- message
+			err := sendNews(n.message)
+			if n.job != nil {
+				finishJob(*n.job, err)
+			} else if err != nil {
+				retryNotification(n.message, err)
 			}
-
 		}
 	}
 }
 
-func sender() {
-	for msg := range sendChan {
-		sendNews(msg)
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
 	}
+	return false
 }
 
 func getHash(s string) uint32 {
@@ -191,18 +171,20 @@ func getHash(s string) uint32 {
 	return h.Sum32()
 }
 
-var mt = flag.Bool("mt", false, "run with mattermost")
+var (
+	mt = flag.Bool("mt", false, "run with mattermost")
+	sl = flag.Bool("slack", false, "run with slack")
+)
 
 func main() {
 	flag.Parse()
 
-	workChans = make([]chan workEvent, NWorkers)
-	sendChan = make(chan Message, BaseCap)
+	// ctx is done on a signal, hardCtx a grace period later.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	hardCtx, cancel := withGracePeriod(ctx, drainTimeout)
 
-	for i := 0; i < NWorkers; i++ {
-		workChans[i] = make(chan workEvent)
-		go worker(workChans[i])
-	}
+	sendChan = make(chan notification, BaseCap)
+	startWorkers(hardCtx)
 
 	var dbConfig DBConfig
 	var err error
@@ -211,28 +193,70 @@ func main() {
 	}
 	dataBase, err = NewDatabase(dbConfig,
 		TablesNames{
-			Messages: "messages",
-			Users:    "users",
-			Channels: "channels",
-			VKPostID: "vk_last_post_by_public",
+			Messages:        "messages",
+			Users:           "users",
+			Channels:        "channels",
+			VKPostID:        "vk_last_post_by_public",
+			Deliveries:      "deliveries",
+			Notified:        "notified",
+			Packs:           "packs",
+			PackTopics:      "pack_topics",
+			PackSubscribers: "pack_subscribers",
+			Digests:         "digest_messages",
+			Mutes:           "mutes",
+			WorkQueue:       "work_queue",
+			DeadLetters:     "dead_letters",
+			Feeds:           "feeds",
+			Mailboxes:       "mailboxes",
+			MailboxReaders:  "mailbox_readers",
+			SyncTokens:      "sync_tokens",
+			Repos:           "repos",
+			Confirmations:   "confirmations",
 		},
 	)
 	if err != nil {
 		panic(err)
 	}
 
+	if retention := loadRetention(); retention > 0 {
+		go retentionJob(ctx, retention, retentionPeriod)
+	}
+
 	api = &basicAPI{}
+	openAIkey = os.Getenv("TOPIC_KEEPER_OPENAI_TOKEN")
+	if openAIkey != "" {
+		log.Printf("using openAI summarizer with key: %s", openAIkey)
+	}
+	events = newPipeline(dataBase, api, openAIkey)
+	var code int
 	if *mt {
-		os.Exit(mattermostMain())
+		code = mattermostMain(ctx, hardCtx)
+	} else if *sl {
+		code = slackMain(ctx, hardCtx)
 	} else {
-		os.Exit(tgMain())
+		code = tgMain(ctx, hardCtx)
 	}
+	stop()
+	cancel()
+	os.Exit(code)
+}
+
+func sendText(username string, text string) error {
+	userId, err := dataBase.getID(username)
+	if err != nil {
+		return err
+	}
+	if _, err = bot.Send(tgbotapi.NewMessage(userId, text)); err != nil {
+		return failure(sendFailureClass(err), err)
+	}
+	return nil
 }
 
 func sendMessage(username string, text string) {
 	userId, err := dataBase.getID(username)
 	if err != nil {
-		panic(err.Error())
+		log.Printf("can't send a message to %s: %s", username, err.Error())
+		return
 	}
 	msg := tgbotapi.NewMessage(userId, text)
 	_, err = bot.Send(msg)
@@ -241,17 +265,59 @@ func sendMessage(username string, text string) {
 	}
 }
 
-func sendNews(msg Message) {
-	userId, err := dataBase.getID(msg.User)
+func sendDocument(username, name string, data []byte) error {
+	userId, err := dataBase.getID(username)
 	if err != nil {
-		panic(err.Error())
+		return err
+	}
+	doc := tgbotapi.NewDocument(userId, tgbotapi.FileBytes{Name: name, Bytes: data})
+	_, err = bot.Send(doc)
+	return err
+}
+
+// sendNews delivers the notification to the destinations of its
+// subscription and logs the delivery. The failed deliveries to one of
+// several destinations are retried on their own, and the ones this
+// process has no notifier for are handed over to another one.
+func sendNews(msg Message) error {
+	if len(msg.Destinations) > 1 {
+		for _, destination := range msg.Destinations {
+			single := msg
+			single.Destinations = []string{destination}
+			if kind, err := messageDestination(dataBase, single); err == nil && !hasNotifier(kind) {
+				handOverNotification(single)
+				continue
+			}
+			if err := sendNews(single); err != nil {
+				retryNotification(single, err)
+			}
+		}
+		return nil
+	}
+
+	destination := DestinationHome
+	if len(msg.Destinations) == 1 {
+		destination = msg.Destinations[0]
+	}
+	status := DeliverySent
+	notifier, address, err := resolveDestination(msg.User, destination)
+	if err == nil {
+		err = notifier.notify(address, msg)
 	}
-	text := fmt.Sprintf(format, msg.Application, msg.Topic, msg.Channel, msg.Summary, msg.Link)
-	ans := tgbotapi.NewMessage(userId, text)
-	_, err = bot.Send(ans)
 	if err != nil {
-		log.Println(err.Error())
+		log.Printf("can't send a notification to %s via %s: %s", msg.User, destination, err.Error())
+		status = DeliveryFailed
+	}
+	logged := []Message{msg}
+	if len(msg.Grouped) > 0 {
+		logged = msg.Grouped
+	}
+	for _, message := range logged {
+		if err := dataBase.logDelivery(message, status); err != nil {
+			log.Println(err.Error())
+		}
 	}
+	return err
 }
 
 func summarize(text string) string {
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	MatrixCode = "MX"
+	// matrixSyncTimeout is how long the homeserver holds a sync request.
+	matrixSyncTimeout = 30 * time.Second
+	matrixRetry       = 5 * time.Second
+	matrixPermalink   = "https://matrix.to/#/%s/%s"
+	// maxMatrixHistory limits the page of messages asked for.
+	maxMatrixHistory = 100
+)
+
+// matrixSyncFilter leaves in a sync only the messages of the joined
+// rooms and the invites: the bot needs neither the state of the rooms
+// nor presence, receipts and typing.
+const matrixSyncFilter = `{"presence":{"types":[]},"account_data":{"types":[]},` +
+	`"room":{"timeline":{"types":["m.room.message"]},"state":{"types":[]},` +
+	`"ephemeral":{"types":[]},"account_data":{"types":[]}}}`
+
+var (
+	matrixRoomError = errors.New(
+		"Неправильная комната Matrix. Используйте #комната:сервер, !id:сервер или ссылку matrix.to")
+	matrixForbiddenError = errors.New("Бот не может войти в эту комнату Matrix. Пригласите его")
+)
+
+// matrixClient is the small part of the Matrix client-server API the bot
+// needs.
+type matrixClient struct {
+	homeserver string
+	token      string
+	client     *http.Client
+	// userID is the user of the bot.
+	userID string
+	txn    atomic.Int64
+}
+
+// matrixError is an error response of the homeserver.
+type matrixError struct {
+	Status  int
+	Code    string `json:"errcode"`
+	Message string `json:"error"`
+}
+
+func (e *matrixError) Error() string {
+	return fmt.Sprintf("matrix: %d %s %s", e.Status, e.Code, e.Message)
+}
+
+// connectMatrix logs in to the homeserver with an access token,
+// configured by MATRIX_HOMESERVER and MATRIX_TOKEN. It returns nil if
+// Matrix is not configured.
+func connectMatrix() (*matrixClient, error) {
+	homeserver := os.Getenv("MATRIX_HOMESERVER")
+	if homeserver == "" {
+		return nil, nil
+	}
+	return newMatrixClient(context.Background(), homeserver, os.Getenv("MATRIX_TOKEN"), http.DefaultClient)
+}
+
+// registerMatrix registers the Matrix source and notifier if Matrix is
+// configured and returns the source, nil otherwise.
+func registerMatrix() *matrixSource {
+	c, err := connectMatrix()
+	if err != nil {
+		log.Printf("can't connect to matrix: %s", err.Error())
+		return nil
+	}
+	if c == nil {
+		return nil
+	}
+	source := newMatrixSource(c, dataBase)
+	registerSource(MatrixCode, source)
+	notifiers[DestinationMatrix] = &matrixNotifier{c: c}
+	return source
+}
+
+func newMatrixClient(ctx context.Context, homeserver, token string, client *http.Client) (*matrixClient, error) {
+	c := &matrixClient{homeserver: strings.TrimSuffix(homeserver, "/"), token: token, client: client}
+	var whoami struct {
+		UserID string `json:"user_id"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/account/whoami", nil, &whoami); err != nil {
+		return nil, err
+	}
+	c.userID = whoami.UserID
+	return c, nil
+}
+
+// do calls the endpoint at path of the client-server API with body as
+// JSON and decodes the response into v.
+func (c *matrixClient) do(ctx context.Context, method, path string, body, v any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.homeserver+"/_matrix/client/v3"+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		e := &matrixError{Status: resp.StatusCode}
+		json.NewDecoder(resp.Body).Decode(e)
+		return e
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// sendText posts a text message to the room.
+func (c *matrixClient) sendText(ctx context.Context, room, text string) error {
+	txn := strconv.FormatInt(time.Now().UnixNano(), 36) + "." + strconv.FormatInt(c.txn.Add(1), 10)
+	path := fmt.Sprintf("/rooms/%s/send/m.room.message/%s", url.PathEscape(room), txn)
+	return c.do(ctx, http.MethodPut, path, map[string]string{"msgtype": "m.text", "body": text}, nil)
+}
+
+type matrixEvent struct {
+	Type    string `json:"type"`
+	EventID string `json:"event_id"`
+	Sender  string `json:"sender"`
+	Content struct {
+		MsgType string `json:"msgtype"`
+		Body    string `json:"body"`
+		// NewContent marks an edit.
+		NewContent json.RawMessage `json:"m.new_content"`
+	} `json:"content"`
+}
+
+type matrixSync struct {
+	NextBatch string `json:"next_batch"`
+	Rooms     struct {
+		Join map[string]struct {
+			Timeline struct {
+				Events []matrixEvent `json:"events"`
+			} `json:"timeline"`
+		} `json:"join"`
+		Invite map[string]json.RawMessage `json:"invite"`
+	} `json:"rooms"`
+}
+
+// matrixSource reads the rooms the bot has joined. The bot joins the
+// rooms it is invited to.
+type matrixSource struct {
+	c *matrixClient
+	// storage keeps the sync token, so no message is missed over a
+	// restart.
+	storage LocalStorage
+	// enqueue passes an event to the pipeline.
+	enqueue func(workEvent)
+
+	mu    sync.Mutex
+	names map[string]string
+}
+
+func newMatrixSource(c *matrixClient, storage LocalStorage) *matrixSource {
+	return &matrixSource{c: c, storage: storage, enqueue: enqueueEvent, names: make(map[string]string)}
+}
+
+// handleUpdates runs the sync loop until ctx is done. The events before
+// the first sync of the account are skipped.
+func (s *matrixSource) handleUpdates(ctx context.Context) {
+	for {
+		err := s.syncNext(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("matrix sync failed: %s", err.Error())
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(matrixRetry):
+			}
+		}
+	}
+}
+
+// syncNext syncs from the stored token and stores the next one. The
+// events are queued before the token is stored, so a failure repeats
+// them rather than loses them; the pipeline skips the repeated ones.
+func (s *matrixSource) syncNext(ctx context.Context) error {
+	since, err := s.storage.getSyncToken(s.c.userID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	next, err := s.sync(ctx, since)
+	if err != nil {
+		return err
+	}
+	return s.storage.saveSyncToken(s.c.userID, next)
+}
+
+// sync handles one sync response and returns the token of the next one.
+func (s *matrixSource) sync(ctx context.Context, since string) (string, error) {
+	query := url.Values{"filter": {matrixSyncFilter}}
+	if since != "" {
+		query.Set("since", since)
+		query.Set("timeout", strconv.Itoa(int(matrixSyncTimeout/time.Millisecond)))
+	}
+	var resp matrixSync
+	if err := s.c.do(ctx, http.MethodGet, "/sync?"+query.Encode(), nil, &resp); err != nil {
+		return "", err
+	}
+	for room := range resp.Rooms.Invite {
+		if _, err := s.joinRoom(ctx, room); err != nil {
+			log.Printf("can't join matrix room %s: %s", room, err.Error())
+		}
+	}
+	if since == "" {
+		return resp.NextBatch, nil
+	}
+	for room, joined := range resp.Rooms.Join {
+		for _, event := range joined.Timeline.Events {
+			if s.skip(event) {
+				continue
+			}
+			s.enqueue(s.event(ctx, room, event, nil))
+		}
+	}
+	return resp.NextBatch, nil
+}
+
+// skip tells whether an event is not a new text message of a person.
+func (s *matrixSource) skip(event matrixEvent) bool {
+	return event.Type != "m.room.message" || event.Sender == s.c.userID || event.Content.NewContent != nil ||
+		(event.Content.MsgType != "m.text" && event.Content.MsgType != "m.notice") || event.Content.Body == ""
+}
+
+func (s *matrixSource) event(ctx context.Context, room string, event matrixEvent, request *historyRequest) workEvent {
+	w := workEvent{
+		application:    Matrix,
+		channel:        s.roomName(ctx, room),
+		channelID:      room,
+		key:            room,
+		text:           event.Content.Body,
+		messageID:      event.EventID,
+		historyRequest: request,
+	}
+	w.link = s.link(w)
+	return w
+}
+
+// joinRoom joins a room by id or alias and returns its id.
+func (s *matrixSource) joinRoom(ctx context.Context, room string) (string, error) {
+	var resp struct {
+		RoomID string `json:"room_id"`
+	}
+	err := s.c.do(ctx, http.MethodPost, "/join/"+url.PathEscape(room), struct{}{}, &resp)
+	var e *matrixError
+	if errors.As(err, &e) && (e.Status == http.StatusForbidden || e.Status == http.StatusNotFound) {
+		return "", matrixForbiddenError
+	}
+	return resp.RoomID, err
+}
+
+// roomName returns the name of the room, its id if it has none.
+func (s *matrixSource) roomName(ctx context.Context, room string) string {
+	s.mu.Lock()
+	name, found := s.names[room]
+	s.mu.Unlock()
+	if found {
+		return name
+	}
+	var state struct {
+		Name string `json:"name"`
+	}
+	name = room
+	path := fmt.Sprintf("/rooms/%s/state/m.room.name/", url.PathEscape(room))
+	if err := s.c.do(ctx, http.MethodGet, path, nil, &state); err == nil && state.Name != "" {
+		name = state.Name
+	}
+	s.mu.Lock()
+	s.names[room] = name
+	s.mu.Unlock()
+	return name
+}
+
+func (*matrixSource) application() Application {
+	return Matrix
+}
+
+// resolveChannel joins the room of an alias, a room id or a matrix.to
+// link and returns its id.
+func (s *matrixSource) resolveChannel(link string) (string, error) {
+	room := link
+	if rest, ok := strings.CutPrefix(link, "https://matrix.to/#/"); ok {
+		room, _, _ = strings.Cut(rest, "?")
+		room, _, _ = strings.Cut(room, "/")
+		if unescaped, err := url.PathUnescape(room); err == nil {
+			room = unescaped
+		}
+	}
+	if len(room) < 4 || (room[0] != '#' && room[0] != '!') || !strings.Contains(room, ":") {
+		return "", matrixRoomError
+	}
+	return s.joinRoom(context.Background(), room)
+}
+
+func (s *matrixSource) channelName(channel string) string {
+	return s.roomName(context.Background(), channel)
+}
+
+func (*matrixSource) link(event workEvent) string {
+	return fmt.Sprintf(matrixPermalink, url.PathEscape(event.channelID), url.PathEscape(event.messageID))
+}
+
+func (s *matrixSource) history(user, channel string, count int) error {
+	if count > maxMatrixHistory {
+		count = maxMatrixHistory
+	}
+	ctx := context.Background()
+	var resp struct {
+		Chunk []matrixEvent `json:"chunk"`
+	}
+	path := fmt.Sprintf("/rooms/%s/messages?dir=b&limit=%d", url.PathEscape(channel), count)
+	if err := s.c.do(ctx, http.MethodGet, path, nil, &resp); err != nil {
+		return err
+	}
+	// The messages go backwards in time.
+	for i := len(resp.Chunk) - 1; i >= 0; i-- {
+		if !s.skip(resp.Chunk[i]) {
+			s.enqueue(s.event(ctx, channel, resp.Chunk[i], &historyRequest{user}))
+		}
+	}
+	return nil
+}
+
+// matrixNotifier sends notifications to direct rooms with Matrix users.
+// The rooms are kept in the m.direct account data of the bot, like
+// clients do.
+type matrixNotifier struct {
+	c  *matrixClient
+	mu sync.Mutex
+}
+
+// notify sends msg to the user with the address as Matrix id.
+func (m *matrixNotifier) notify(address string, msg Message) error {
+	ctx := context.Background()
+	room, err := m.directRoom(ctx, address)
+	if err != nil {
+		return err
+	}
+	if err := m.c.sendText(ctx, room, newsText(msg)); err != nil {
+		return failure(matrixFailureClass(err), err)
+	}
+	return nil
+}
+
+// directRoom returns the direct room with the user, creating it if
+// there is none.
+func (m *matrixNotifier) directRoom(ctx context.Context, user string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	path := fmt.Sprintf("/user/%s/account_data/m.direct", url.PathEscape(m.c.userID))
+	direct := map[string][]string{}
+	err := m.c.do(ctx, http.MethodGet, path, nil, &direct)
+	var e *matrixError
+	if err != nil && !(errors.As(err, &e) && e.Status == http.StatusNotFound) {
+		return "", failure(FailureDelivery, err)
+	}
+	if rooms := direct[user]; len(rooms) > 0 {
+		return rooms[len(rooms)-1], nil
+	}
+	var created struct {
+		RoomID string `json:"room_id"`
+	}
+	err = m.c.do(ctx, http.MethodPost, "/createRoom", map[string]any{
+		"is_direct": true,
+		"invite":    []string{user},
+		"preset":    "trusted_private_chat",
+	}, &created)
+	if err != nil {
+		return "", failure(matrixFailureClass(err), err)
+	}
+	direct[user] = append(direct[user], created.RoomID)
+	if err := m.c.do(ctx, http.MethodPut, path, direct, nil); err != nil {
+		log.Printf("can't save the matrix direct room of %s: %s", user, err.Error())
+	}
+	return created.RoomID, nil
+}
+
+// matrixFailureClass tells whether a failed request may succeed later.
+func matrixFailureClass(err error) FailureClass {
+	var e *matrixError
+	if errors.As(err, &e) && e.Status >= 400 && e.Status < 500 && e.Status != http.StatusTooManyRequests {
+		return FailurePermanent
+	}
+	return FailureDelivery
+}
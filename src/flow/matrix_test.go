@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// syncStorage keeps the sync tokens in memory.
+type syncStorage struct {
+	LocalStorage
+	tokens map[string]string
+}
+
+func (s *syncStorage) getSyncToken(account string) (string, error) {
+	token, found := s.tokens[account]
+	if !found {
+		return "", sql.ErrNoRows
+	}
+	return token, nil
+}
+
+func (s *syncStorage) saveSyncToken(account, token string) error {
+	s.tokens[account] = token
+	return nil
+}
+
+// matrixSyncServer fakes the sync of a homeserver: the initial one
+// holds an old message, the next one a new message, the bot's own one
+// and a membership change.
+func matrixSyncServer(t *testing.T) *httptest.Server {
+	message := func(id, sender, body string) map[string]any {
+		return map[string]any{"type": "m.room.message", "event_id": id, "sender": sender,
+			"content": map[string]string{"msgtype": "m.text", "body": body}}
+	}
+	timeline := func(events ...any) map[string]any {
+		return map[string]any{"join": map[string]any{"!study:example.org": map[string]any{
+			"timeline": map[string]any{"events": events}}}}
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		path := strings.TrimPrefix(r.URL.Path, "/_matrix/client/v3")
+		var resp any
+		switch since := r.URL.Query().Get("since"); {
+		case path == "/account/whoami":
+			resp = map[string]string{"user_id": "@keeper:example.org"}
+		case path != "/sync":
+			resp = map[string]string{"name": "Учёба"}
+		case r.URL.Query().Get("filter") != matrixSyncFilter:
+			t.Errorf("sync filter = %q", r.URL.Query().Get("filter"))
+		case since == "":
+			resp = map[string]any{"next_batch": "s1", "rooms": timeline(message("$old", "@ivan:example.org", "экзамен вчера"))}
+		case since == "s1":
+			resp = map[string]any{"next_batch": "s2", "rooms": timeline(
+				message("$own", "@keeper:example.org", "экзамен от бота"),
+				map[string]any{"type": "m.room.member", "event_id": "$join", "sender": "@ivan:example.org"},
+				message("$new", "@ivan:example.org", "экзамен перенесли"),
+			)}
+		default:
+			resp = map[string]any{"next_batch": "s3"}
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestMatrixSyncToken(t *testing.T) {
+	server := matrixSyncServer(t)
+	ctx := context.Background()
+	c, err := newMatrixClient(ctx, server.URL, "secret", server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := &syncStorage{tokens: map[string]string{}}
+	enqueue, events := recordEvents()
+	s := newMatrixSource(c, storage)
+	s.enqueue = enqueue
+	if err := s.syncNext(ctx); err != nil || storage.tokens["@keeper:example.org"] != "s1" || len(*events) != 0 {
+		t.Fatalf("first sync = %v, tokens %v, events %+v", err, storage.tokens, *events)
+	}
+
+	// The bot restarts: the new source goes on from the stored token.
+	restarted := newMatrixSource(c, storage)
+	restarted.enqueue = enqueue
+	if err := restarted.syncNext(ctx); err != nil || storage.tokens["@keeper:example.org"] != "s2" {
+		t.Fatalf("sync after a restart = %v, tokens %v", err, storage.tokens)
+	}
+	if len(*events) != 1 || (*events)[0].link != "https://matrix.to/#/%21study:example.org/$new" {
+		t.Errorf("events after a restart = %+v", *events)
+	}
+}
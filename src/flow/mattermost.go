@@ -1,12 +1,13 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/url"
 	"os"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/mattermost/mattermost-server/v6/model"
@@ -48,331 +49,307 @@ type application struct {
 	team   *model.Team
 }
 
-func mattermostMain() int {
-	app := &application{
+// newApplication returns the bot of the Mattermost team mm is logged in
+// to.
+func newApplication(cfg config, mm *mattermostNotifier) *application {
+	return &application{
+		config: cfg,
 		logger: zerolog.New(
 			zerolog.ConsoleWriter{
 				Out:        os.Stdout,
 				TimeFormat: time.RFC822,
 			},
 		).With().Timestamp().Logger(),
+		client: mm.client,
+		user:   mm.user,
+		team:   mm.team,
 	}
+}
 
-	app.config = loadConfig()
+// mattermostMain runs the Mattermost bot until ctx is done or the
+// websocket is closed and then drains the pipeline until hardCtx is.
+func mattermostMain(ctx, hardCtx context.Context) int {
+	cfg := loadConfig()
+	mm, err := connectMattermost(cfg)
+	if err != nil {
+		log.Fatalf("Could not connect to mattermost: %s", err.Error())
+	}
+	app := newApplication(cfg, mm)
 	app.logger.Info().Str("config", fmt.Sprint(app.config)).Msg("")
+	app.logger.Info().Msg("Logged in to mattermost")
+
+	// Notifications may also go to the other platforms, and their
+	// channels may be subscribed to, if they are configured.
+	notifiers[DestinationMattermost] = mm
+	registerNotifiers()
+	registerSource(MattermostCode, mattermostSource{app})
+	registerRemoteSources()
+	registerSlack()
+
+	ctx, stopSources := context.WithCancel(ctx)
+	defer stopSources()
+	go scheduler(ctx, MatterMost, app.sendMsg, func(id string) { flushDirectBacklog(app, id) }, schedulerPeriod)
+
+	var poller sync.WaitGroup
+	poller.Add(1)
+	go func() {
+		defer poller.Done()
+		queuePoller(ctx)
+	}()
+	senderDone := startSender(hardCtx)
+
+	sources[MattermostCode].handleUpdates(ctx)
+	stopSources()
+	return drain(hardCtx, senderDone, poller.Wait)
+}
 
-	app.client = model.NewAPIv4Client(app.config.server.String())
-	app.client.SetToken(app.config.token)
+// mattermostSource reads the channels of the team the bot is in.
+type mattermostSource struct {
+	app *application
+}
 
-	if user, resp, err := app.client.GetUser("me", ""); err != nil {
-		app.logger.Fatal().Err(err).Msg("Could not log in")
-	} else {
-		app.logger.Debug().Interface("user", user).Interface("resp", resp).Msg("")
-		app.logger.Info().Msg("Logged in to mattermost")
-		app.user = user
+func (s mattermostSource) handleUpdates(ctx context.Context) {
+	s.app.listen(ctx)
+}
+
+func (mattermostSource) application() Application {
+	return MatterMost
+}
+
+// resolveChannel returns the id of the team channel name.
+func (s mattermostSource) resolveChannel(name string) (string, error) {
+	ch, _, err := s.app.client.GetChannelByName(name, s.app.team.Id, "")
+	if err != nil {
+		return "", err
+	}
+	if err := dataBase.addMmChan(ch.Id, name); err != nil {
+		return "", err
 	}
+	return ch.Id, nil
+}
 
-	// Find and save the bot's team to app struct.
-	if team, resp, err := app.client.GetTeamByName(app.config.teamName, ""); err != nil {
-		app.logger.Fatal().Err(err).Msg("Could not find team. Is this bot a member ?")
-	} else {
-		app.logger.Debug().Interface("team", team).Interface("resp", resp).Msg("")
-		app.team = team
+func (mattermostSource) channelName(channel string) string {
+	if name, err := dataBase.getMmChan(channel); err == nil {
+		return name
 	}
+	return channel
+}
 
+func (s mattermostSource) link(event workEvent) string {
+	return fmt.Sprintf("%s/%s/pl/%s", s.app.config.server, s.app.config.teamName, event.messageID)
+}
+
+func (s mattermostSource) history(user, channel string, count int) error {
+	posts, _, err := s.app.client.GetPostsForChannel(channel, 0, count, "", false)
+	if err != nil {
+		return err
+	}
+	name := s.channelName(channel)
+	// The order lists the newest post first.
+	for i := len(posts.Order) - 1; i >= 0; i-- {
+		post := posts.Posts[posts.Order[i]]
+		if post == nil || post.UserId == s.app.user.Id {
+			continue
+		}
+		event := workEvent{
+			application:    MatterMost,
+			channel:        name,
+			channelID:      channel,
+			key:            channel,
+			text:           post.Message,
+			messageID:      post.Id,
+			historyRequest: &historyRequest{user},
+		}
+		event.link = s.link(event)
+		enqueueEvent(event)
+	}
+	return nil
+}
+
+// listen handles the websocket events until ctx is done or the websocket
+// is closed.
+func (a *application) listen(ctx context.Context) {
 	var wsClient *model.WebSocketClient
 	var err error
 	fails := 0
 	for {
 		wsClient, err = model.NewWebSocketClient4(
-			fmt.Sprintf("ws://%s", app.config.server.Host+app.config.server.Path),
-			app.client.AuthToken,
+			fmt.Sprintf("ws://%s", a.config.server.Host+a.config.server.Path),
+			a.client.AuthToken,
 		)
 		if err != nil {
-			app.logger.Warn().Err(err).Msg("Mattermost websocket disconnected, retrying")
+			a.logger.Warn().Err(err).Msg("Mattermost websocket disconnected, retrying")
 			fails += 1
-			time.Sleep(time.Second)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
 			continue
 		}
 		break
 	}
 	wsClient.Listen()
-	for event := range wsClient.EventChannel {
-		// Consider only posts for now.
-		if event.EventType() != model.WebsocketEventPosted {
-			continue
-		}
-		post := &model.Post{}
-		err := json.Unmarshal([]byte(event.GetData()["post"].(string)), &post)
-		if err != nil {
-			app.logger.Error().Err(err).Msg("Could not cast event to *model.Post")
-			continue
-		}
-		// Ignore messages sent by this bot itself.
-		if post.UserId == app.user.Id {
-			continue
-		}
-
-		chanType := event.GetData()["channel_type"]
-		id := post.ChannelId
-		if chanType == "D" {
-			// Direct.
-			err = dataBase.addUser(id, 0)
-			if err != nil {
-				app.logger.Error().Err(err).Msg("addUser error")
-				continue
-			}
-
-			cmd, body, _ := strings.Cut(post.Message, " ")
-			cmd = strings.ToUpper(cmd)
-			body = strings.TrimSpace(body)
-			switch cmd {
-			case "ADD":
-				app.handleAdd(id, body)
-			case "REMOVE":
-				app.handleRemove(id, body)
-			case "VIEW":
-				app.handleView(id, body)
-			case "PAUSE":
-				app.handlePause(id)
-			case "CONTINUE":
-				app.handleContinue(id)
-			case "HELP":
-				app.handleHelp(id)
-			default:
-				app.handleUnknown(id)
+	for {
+		select {
+		case <-ctx.Done():
+			wsClient.Close()
+			return
+		case event, ok := <-wsClient.EventChannel:
+			if !ok {
+				return
 			}
-		} else {
-			app.handleUpdate(id, post.Message, post.Id)
+			a.handleEvent(event)
 		}
 	}
-
-	return 0
-}
-
-func MmMessageToText(msg Message) string {
-	format := `Topic was detected: [%s]
-	Summary: %s
-	Link: %s
-	`
-	text := fmt.Sprintf(
-		format, msg.Topic, msg.Summary, msg.Link)
-	return text
 }
 
-func (a *application) handleUpdate(id, msg, msgId string) {
-	if found, err := dataBase.containsChannel(id, MatterMost); !found || err != nil {
-		if err != nil {
-			a.logger.Error().Err(err).Msg("handleUpdate error")
-		}
+func (a *application) handleEvent(event *model.WebSocketEvent) {
+	// Consider only posts for now.
+	if event.EventType() != model.WebsocketEventPosted {
 		return
 	}
-	possibleTopics, err := dataBase.getTopics(id, MatterMost)
+	post := &model.Post{}
+	err := json.Unmarshal([]byte(event.GetData()["post"].(string)), &post)
 	if err != nil {
-		a.logger.Error().Err(err).Msg("handleUpdate error")
+		a.logger.Error().Err(err).Msg("Could not cast event to *model.Post")
 		return
 	}
-	if len(possibleTopics) == 0 {
-		return
-	}
-	var foundTopics []string
-	if foundTopics, err = api.analyze(msg, possibleTopics); err != nil || len(foundTopics) == 0 {
-		if err != nil {
-			a.logger.Error().Err(err).Msg("handleUpdate error")
-		}
+	// Ignore messages sent by this bot itself.
+	if post.UserId == a.user.Id {
 		return
 	}
 
-	var summary string
-	if openAIkey != "" && len(msg) > summaryLength {
-		if summary, err = api.summarize(msg, openAIkey); err != nil {
-			err := fmt.Errorf("error in OpenAI uisng with error: %s \n", err.Error())
-			a.logger.Error().Err(err).Msg("handleUpdate error")
-			summary = summarize(msg)
-		}
+	id := post.ChannelId
+	if event.GetData()["channel_type"] == "D" {
+		// Direct.
+		handleDirectCommand(a, directCommand{user: id, text: post.Message, message: post.Id, files: post.FileIds})
 	} else {
-		summary = summarize(msg)
+		a.handleUpdate(id, post.Message, post.Id)
 	}
+}
 
-	sendUsers, err := dataBase.getUsers(id, foundTopics, MatterMost)
-	for userId, userTopics := range sendUsers {
-		isPaused, err := dataBase.isPaused(userId)
-		if err != nil {
-			a.logger.Error().Err(err)
-			continue
-		}
-		for _, topic := range userTopics {
-			if err := dataBase.setTime(userId, id, topic, MatterMost); err != nil {
-				a.logger.Error().Err(err).Msg("handleUpdate error")
-				continue
-			}
-		}
-
-		finalTopics := strings.Join(userTopics, ", ")
-		msg := Message{
-			User: userId,
-			Link: fmt.Sprintf("%s/%s/pl/%s",
-				a.config.server, a.config.teamName, msgId),
-			Topic:       finalTopics,
-			Summary:     summary,
-			Application: MatterMost,
-		}
-		if isPaused {
-			if err := dataBase.addDelayedMessage(msg); err != nil {
-				a.logger.Error().Err(err).Msg("handleUpdate error")
-				continue
-			}
-		} else {
-			if isPaused {
-				if err := dataBase.addDelayedMessage(msg); err != nil {
-					log.Printf(err.Error())
-					continue
-				}
-			} else {
-				a.sendMsg(msg.User, MmMessageToText(msg))
-			}
-		}
+func MmMessageToText(msg Message) string {
+	format := `Topic was detected: [%s]
+	Summary: %s
+	Link: %s
+	`
+	text := fmt.Sprintf(
+		format, msg.Topic, msg.Summary, msg.Link)
+	if msg.Priority == PriorityHigh {
+		text = highPriorityMark + text
+	}
+	if msg.Suppressed > 0 {
+		text += fmt.Sprintf(suppressedFormat, msg.Suppressed)
 	}
+	return text
 }
 
-func (a *application) handleUnknown(id string) {
-	reply := "Я вас не понимаю, используйте HELP для справки"
-	a.sendMsg(id, reply)
+// handleUpdate passes a channel post to the pipeline.
+func (a *application) handleUpdate(id, msg, msgId string) {
+	source := mattermostSource{a}
+	event := workEvent{
+		application: MatterMost,
+		channel:     source.channelName(id),
+		channelID:   id,
+		key:         id,
+		text:        msg,
+		messageID:   msgId,
+	}
+	event.link = source.link(event)
+	enqueueEvent(event)
 }
 
-func (a *application) handleHelp(id string) {
-	reply := "\n Мой набор команд включает в себя следующие опции: \n \n" +
-		"VIEW - для просмотра доступных каналов и связанных с ними тем. \n \n" +
-		"ADD <название канала> <слово>- добавляет указанное слово в список для поиска в конкретном канале. \n \n" +
-		"REMOVE <название канала> <слово> - удаляет указанное слово из списка для поиска в конкретном канале.\n \n" +
-		"PAUSE- приостанавливает обновления в боте. \n \n" +
-		"CONTINUE - возобновляет поток обновлений в боте после приостановки. \n \n" +
-		"Эти команды помогут вам управлять списком тем и слов для поиска, чтобы быстро находить нужную информацию в чатах."
-	a.sendMsg(id, reply)
+func (*application) code() string {
+	return MattermostCode
 }
 
-const errReply = "Упс, произошла ошибка..."
-
-func (a *application) handleContinue(id string) {
-	var err error
-	var messages []Message
-	if err = dataBase.unpauseUser(id); err != nil {
-		a.logger.Error().Err(err).Msg("Failed to add topic")
-		a.sendMsg(id, errReply)
-		return
-	}
-
-	if messages, err = dataBase.getDelayedMessages(id); err != nil {
-		a.logger.Error().Err(err).Msg("Failed to add topic")
-		a.sendMsg(id, errReply)
-		return
-	}
+func (*application) application() Application {
+	return MatterMost
+}
 
-	a.sendMsg(id, "Обновления сняты с паузы!")
-	for _, msg := range messages {
-		a.sendMsg(msg.User, MmMessageToText(msg))
-	}
+func (*application) help() string {
+	return mattermostHelp
 }
 
-func (a *application) handlePause(id string) {
-	if err := dataBase.pauseUser(id); err != nil {
-		a.logger.Error().Err(err).Msg("Failed to add topic")
-		a.sendMsg(id, errReply)
-		return
-	}
-	a.sendMsg(id, "Обновления поставлены на паузу!")
+const mattermostHelp = "\n Мой набор команд включает в себя следующие опции: \n \n" +
+	"VIEW - для просмотра доступных каналов и связанных с ними тем. \n \n" +
+	"ADD <название канала> <слово> [VK/TG/RSS/MAIL/DS/MX/SL/HOOK/GIT] - добавляет указанное слово в список для поиска в конкретном канале, по умолчанию в Mattermost. \n \n" +
+	"REMOVE <название канала> <слово> [VK/TG/RSS/MAIL/DS/MX/SL/HOOK/GIT] - удаляет указанное слово из списка для поиска в конкретном канале.\n \n" +
+	"PAUSE [длительность/until ЧЧ:ММ] - приостанавливает обновления в боте, например PAUSE 2h или PAUSE until 18:00. \n \n" +
+	"MUTE <название канала> <длительность/until ЧЧ:ММ/off> - приостанавливает обновления из одного канала, например MUTE town-square 1d. \n \n" +
+	"CONTINUE - возобновляет поток обновлений в боте после приостановки. Если накопилось много уведомлений, присылает их сводку. \n \n" +
+	"BACKLOG [номер/ALL/DISCARD] - показывает страницу сводки накопившихся уведомлений, все уведомления сразу или удаляет их. \n \n" +
+	"HISTORY [N] - показывает последние N отправленных уведомлений. \n \n" +
+	"MAILBOX <имя> <imaps://логин:пароль@сервер/папка> [ссылка на архив с {id}] - подключает почтовый ящик рассылки под именем, слова в нём добавляются командой ADD <имя> <слово> MAIL. Ящик читает только тот, кто его подключил. \n \n" +
+	"SHARE <имя ящика> <@пользователь> - разрешает пользователю подписываться на ваш ящик, UNSHARE <имя ящика> <@пользователь> - запрещает. \n \n" +
+	"POSTS <название канала> [VK/TG/RSS/MAIL/DS/MX/SL/HOOK/GIT] <N> - ищет слова в последних N постах канала, если платформа это позволяет. \n \n" +
+	"COOLDOWN <название канала> <слово> <none/минуты/day> - задаёт минимальный интервал между уведомлениями по слову, day - 24 часа с последнего уведомления. \n \n" +
+	"NOTIFY <название канала> <слово> [VK/TG/RSS/MAIL/DS/MX/SL/HOOK/GIT] <куда> [куда...] - задаёт, куда присылать уведомления по слову: home (сюда), tg:@имя в Telegram, slack:@имя в Slack, mx:@имя:сервер в Matrix, webhook:<url> или email:<адрес>. Каждый адрес, кроме home, нужно сначала подтвердить. \n \n" +
+	"CONFIRM <куда> <код> - подтверждает адрес доставки кодом, который бот отправил туда. \n \n" +
+	"PRIORITY <название канала> <слово> <high/normal/low> - задаёт приоритет слова: high приходит всегда, даже на паузе и в тихие часы, normal следует вашим настройкам, low приходит только в дайджесте. \n \n" +
+	"DIGEST [off/hourly/daily ЧЧ:ММ/weekly <mon-sun> ЧЧ:ММ] - собирает уведомления в дайджест по расписанию. \n \n" +
+	"TIMEZONE [часовой пояс] - задаёт часовой пояс для расписаний, например Europe/Moscow. \n \n" +
+	"QUIET [off/ЧЧ:ММ-ЧЧ:ММ] - задаёт тихие часы, уведомления за это время придут после их окончания. \n \n" +
+	"PUBLISH <набор> [топик, ...] - публикует ваши подписки на перечисленные топики, или все, как набор, на который могут подписаться другие. Повторная публикация обновляет набор у всех подписчиков. \n \n" +
+	"UNPUBLISH <набор> - удаляет опубликованный набор. \n \n" +
+	"SUBSCRIBE <набор> - подписывает на набор топиков. \n \n" +
+	"UNSUBSCRIBE <набор> - отписывает от набора топиков. \n \n" +
+	"EXPORT [yaml/json] - присылает файл со всеми подписками. \n \n" +
+	"IMPORT - заменяет подписки на подписки из приложенного файла. \n \n" +
+	"EXPORT_MY_DATA - присылает файл со всеми данными, которые бот хранит о вас. \n \n" +
+	"FORGET_ME - удаляет все данные о вас. \n \n" +
+	"Эти команды помогут вам управлять списком тем и слов для поиска, чтобы быстро находить нужную информацию в чатах."
+
+// deleteMessage deletes a post, the one with the password of MAILBOX.
+func (a *application) deleteMessage(messageID string) error {
+	_, err := a.client.DeletePost(messageID)
+	return err
 }
 
-func (a *application) handleView(id, body string) {
-	totalInfo, err := dataBase.getUserInfo(id)
+// directChannel returns the direct channel of the bot with the user.
+func (a *application) directChannel(username string) (string, error) {
+	user, _, err := a.client.GetUserByUsername(username, "")
 	if err != nil {
-		a.logger.Error().Err(err).Msg("Failed to view topics")
-		a.sendMsg(id, errReply)
-		return
-	}
-	str := strings.Builder{}
-	for _, topicByChan := range totalInfo {
-		for ch, topics := range topicByChan {
-			chName, err := dataBase.getMmChan(ch)
-			if err != nil {
-				a.logger.Error().Err(err).Msg("Failed to view topics")
-				a.sendMsg(id, errReply)
-				return
-			}
-			str.WriteString(fmt.Sprintf("%s:\n", chName))
-			for _, topic := range topics {
-				str.WriteString(fmt.Sprintf("   - %s\n", topic))
-			}
-			str.WriteString("\n")
-			str.WriteString("\n")
-		}
+		return "", err
 	}
-	ans := str.String()
-	if ans == "" {
-		ans = "Ничего не отслеживается"
+	direct, _, err := a.client.CreateDirectChannel(a.user.Id, user.Id)
+	if err != nil {
+		return "", err
 	}
-	a.sendMsg(id, ans)
+	return direct.Id, nil
 }
 
-func (a *application) handleRemove(id, body string) {
-	elements := strings.Fields(body)
-	if len(elements) != 2 {
-		a.sendMsg(id, "Неверное количество аргументов. Используйте REMOVE <канал> <топик>")
-		return
-	}
-	channel := elements[0]
-	// Determine channel ID.
-	ch, _, err := a.client.GetChannelByName(channel, a.team.Id, "")
-	if err != nil {
-		a.logger.Error().Err(err).Msg("Failed to add topic")
-		a.sendMsg(id, errReply)
-		return
-	}
-	dataBase.addMmChan(ch.Id, channel)
-	concern := Concern{
-		Channel: ch.Id,
-		Topic:   elements[1],
-	}
-	if err := dataBase.removeTopic(id, concern.Channel, concern.Topic, MatterMost); err != nil {
-		a.logger.Error().Err(err).Msg("Failed to remove topic")
-		a.sendMsg(id, errReply)
-		return
-	}
-	a.sendMsg(id, "Топик удалён!")
+func (a *application) getFile(fileID string) ([]byte, error) {
+	data, _, err := a.client.GetFile(fileID)
+	return data, err
 }
 
-func (a *application) handleAdd(id, body string) {
-	elements := strings.Fields(body)
-	if len(elements) != 2 {
-		a.sendMsg(id, "Неверное количество аргументов. Используйте ADD <название канала> <топик>")
-		return
-	}
-	channel := elements[0]
-	// Determine channel ID.
-	ch, _, err := a.client.GetChannelByName(channel, a.team.Id, "")
+func (a *application) sendMsg(id, msg string) error {
+	post := &model.Post{}
+	post.ChannelId = id
+	post.Message = msg
+	_, _, err := a.client.CreatePost(post)
 	if err != nil {
-		a.logger.Error().Err(err).Msg("Failed to add topic")
-		a.sendMsg(id, errReply)
-		return
-	}
-	dataBase.addMmChan(ch.Id, channel)
-	concern := Concern{
-		Channel: ch.Id,
-		Topic:   elements[1],
-	}
-	if err := dataBase.addTopic(id, concern.Channel, concern.Topic, MatterMost); err != nil {
-		a.logger.Error().Err(err).Msg("Failed to add topic")
-		a.sendMsg(id, errReply)
-		return
+		a.logger.Error().Err(err).Msg("Failed to create post")
 	}
-	a.sendMsg(id, "Топик добавлен!")
+	return err
 }
 
-func (a *application) sendMsg(id, msg string) {
+func (a *application) sendFile(id, name string, data []byte) error {
+	upload, _, err := a.client.UploadFile(data, id, name)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Failed to upload file")
+		return err
+	}
 	post := &model.Post{}
 	post.ChannelId = id
-	post.Message = msg
+	for _, info := range upload.FileInfos {
+		post.FileIds = append(post.FileIds, info.Id)
+	}
 	if _, _, err := a.client.CreatePost(post); err != nil {
 		a.logger.Error().Err(err).Msg("Failed to create post")
+		return err
 	}
+	return nil
 }
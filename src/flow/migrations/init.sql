@@ -31,5 +31,169 @@ CREATE TABLE IF NOT EXISTS  vk_last_post_by_public (
     groupid TEXT PRIMARY KEY,
     last_post INT,
     public_name TEXT
-)
+);
+
+CREATE TABLE IF NOT EXISTS deliveries (
+    nickname TEXT,
+    application TEXT,
+    channel TEXT,
+    topic TEXT,
+    link TEXT,
+    summary TEXT,
+    sent_at TIMESTAMP WITH TIME ZONE,
+    status TEXT
+);
+
+CREATE INDEX IF NOT EXISTS deliveries_nickname_sent_at
+    ON deliveries (nickname, sent_at);
+
+CREATE TABLE IF NOT EXISTS notified (
+    application TEXT,
+    channel_id TEXT,
+    message_id TEXT,
+    nickname TEXT,
+    notified_at TIMESTAMP WITH TIME ZONE DEFAULT now(),
+    PRIMARY KEY (application, channel_id, message_id, nickname)
+);
+
+ALTER TABLE notified ADD COLUMN IF NOT EXISTS topics TEXT NOT NULL DEFAULT '';
+
+ALTER TABLE channels ADD COLUMN IF NOT EXISTS cooldown INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE channels ADD COLUMN IF NOT EXISTS suppressed INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS suppressed INTEGER NOT NULL DEFAULT 0;
+
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS created_at TIMESTAMP WITH TIME ZONE DEFAULT now();
+
+CREATE TABLE IF NOT EXISTS packs (
+    name TEXT PRIMARY KEY,
+    owner TEXT
+);
+
+CREATE TABLE IF NOT EXISTS pack_topics (
+    pack TEXT,
+    channel TEXT,
+    topic TEXT,
+    application TEXT
+);
+
+CREATE TABLE IF NOT EXISTS pack_subscribers (
+    pack TEXT,
+    nickname TEXT,
+    PRIMARY KEY (pack, nickname)
+);
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS application TEXT;
+UPDATE users SET application = CASE WHEN id = 0 THEN 'mattermost' ELSE 'telegram' END
+    WHERE application IS NULL;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS digest TEXT;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS digest_next TIMESTAMP WITH TIME ZONE;
+
+CREATE TABLE IF NOT EXISTS digest_messages (
+    nickname TEXT,
+    link TEXT,
+    channel TEXT,
+    topic TEXT,
+    summary TEXT,
+    application TEXT,
+    suppressed INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT now()
+);
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS timezone TEXT;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS quiet_hours TEXT;
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS paused_until TIMESTAMP WITH TIME ZONE;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS channel_id TEXT;
+
+CREATE TABLE IF NOT EXISTS mutes (
+    nickname TEXT,
+    channel TEXT,
+    application TEXT,
+    until TIMESTAMP WITH TIME ZONE,
+    PRIMARY KEY (nickname, channel, application)
+);
+
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS backlog BOOLEAN NOT NULL DEFAULT false;
+
+ALTER TABLE channels ADD COLUMN IF NOT EXISTS priority TEXT NOT NULL DEFAULT 'normal';
+
+CREATE TABLE IF NOT EXISTS work_queue (
+    id BIGSERIAL PRIMARY KEY,
+    kind TEXT NOT NULL,
+    payload JSONB NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    locked_until TIMESTAMP WITH TIME ZONE,
+    last_error TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS work_queue_next_attempt ON work_queue (next_attempt);
+
+CREATE TABLE IF NOT EXISTS dead_letters (
+    id BIGSERIAL PRIMARY KEY,
+    kind TEXT NOT NULL,
+    payload JSONB NOT NULL,
+    attempts INTEGER NOT NULL,
+    failure_class TEXT NOT NULL,
+    error TEXT,
+    failed_at TIMESTAMP WITH TIME ZONE DEFAULT now()
+);
+
+ALTER TABLE channels ADD COLUMN IF NOT EXISTS destinations TEXT NOT NULL DEFAULT '';
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS destinations TEXT NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS feeds (
+    url TEXT PRIMARY KEY,
+    title TEXT NOT NULL DEFAULT '',
+    etag TEXT NOT NULL DEFAULT '',
+    last_modified TEXT NOT NULL DEFAULT '',
+    seen TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS mailboxes (
+    name TEXT PRIMARY KEY,
+    owner TEXT NOT NULL,
+    url TEXT NOT NULL,
+    archive TEXT NOT NULL DEFAULT '',
+    uid_validity BIGINT NOT NULL DEFAULT 0,
+    last_uid BIGINT NOT NULL DEFAULT 0
+);
+
+ALTER TABLE mailboxes ADD COLUMN IF NOT EXISTS credentials BYTEA;
+
+CREATE TABLE IF NOT EXISTS mailbox_readers (
+    name TEXT NOT NULL,
+    nickname TEXT NOT NULL,
+    PRIMARY KEY (name, nickname)
+);
+
+CREATE TABLE IF NOT EXISTS sync_tokens (
+    account TEXT PRIMARY KEY,
+    next_batch TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS repos (
+    repo TEXT PRIMARY KEY,
+    since TIMESTAMPTZ NOT NULL,
+    etags TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS confirmations (
+    nickname TEXT NOT NULL,
+    destination TEXT NOT NULL,
+    code TEXT NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    confirmed BOOLEAN NOT NULL DEFAULT false,
+    sent_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (nickname, destination)
+);
+
+ALTER TABLE work_queue ADD COLUMN IF NOT EXISTS destination TEXT;
+ALTER TABLE dead_letters ADD COLUMN IF NOT EXISTS destination TEXT;
 
+ALTER TABLE pack_subscribers ADD COLUMN IF NOT EXISTS cooldown INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE pack_subscribers ADD COLUMN IF NOT EXISTS suppressed INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE pack_subscribers ADD COLUMN IF NOT EXISTS last_time TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT 'epoch';
+ALTER TABLE pack_subscribers ADD COLUMN IF NOT EXISTS priority TEXT NOT NULL DEFAULT 'normal';
+ALTER TABLE pack_subscribers ADD COLUMN IF NOT EXISTS destinations TEXT NOT NULL DEFAULT '';
@@ -8,9 +8,14 @@ CREATE TABLE IF NOT EXISTS channels_test (
                                         nickname TEXT,
                                         channel TEXT,
                                         topic TEXT,
-                                        last_time TIMESTAMP WITH TIME ZONE
+                                        last_time TIMESTAMP WITH TIME ZONE,
+                                        application TEXT
 );
 
+ALTER TABLE channels_test ADD COLUMN IF NOT EXISTS application TEXT;
+ALTER TABLE channels_test ADD COLUMN IF NOT EXISTS cooldown INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE channels_test ADD COLUMN IF NOT EXISTS suppressed INTEGER NOT NULL DEFAULT 0;
+
 CREATE TABLE IF NOT EXISTS messages_test (
                                         nickname TEXT,
                                         link TEXT,
@@ -18,3 +23,144 @@ CREATE TABLE IF NOT EXISTS messages_test (
                                         topic TEXT,
                                         summary TEXT
 );
+
+ALTER TABLE users_test ADD COLUMN IF NOT EXISTS application TEXT;
+ALTER TABLE users_test ADD COLUMN IF NOT EXISTS digest TEXT;
+ALTER TABLE users_test ADD COLUMN IF NOT EXISTS digest_next TIMESTAMP WITH TIME ZONE;
+ALTER TABLE users_test ADD COLUMN IF NOT EXISTS timezone TEXT;
+ALTER TABLE users_test ADD COLUMN IF NOT EXISTS quiet_hours TEXT;
+ALTER TABLE users_test ADD COLUMN IF NOT EXISTS paused_until TIMESTAMP WITH TIME ZONE;
+ALTER TABLE channels_test ADD COLUMN IF NOT EXISTS priority TEXT NOT NULL DEFAULT 'normal';
+ALTER TABLE channels_test ADD COLUMN IF NOT EXISTS destinations TEXT NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS notified_test (
+                                        application TEXT,
+                                        channel_id TEXT,
+                                        message_id TEXT,
+                                        nickname TEXT,
+                                        notified_at TIMESTAMP WITH TIME ZONE DEFAULT now(),
+                                        topics TEXT NOT NULL DEFAULT '',
+                                        PRIMARY KEY (application, channel_id, message_id, nickname)
+);
+
+CREATE TABLE IF NOT EXISTS deliveries_test (
+                                        nickname TEXT,
+                                        application TEXT,
+                                        channel TEXT,
+                                        topic TEXT,
+                                        link TEXT,
+                                        summary TEXT,
+                                        sent_at TIMESTAMP WITH TIME ZONE,
+                                        status TEXT
+);
+
+CREATE TABLE IF NOT EXISTS packs_test (
+                                        name TEXT PRIMARY KEY,
+                                        owner TEXT
+);
+
+CREATE TABLE IF NOT EXISTS pack_topics_test (
+                                        pack TEXT,
+                                        channel TEXT,
+                                        topic TEXT,
+                                        application TEXT
+);
+
+CREATE TABLE IF NOT EXISTS pack_subscribers_test (
+                                        pack TEXT,
+                                        nickname TEXT,
+                                        PRIMARY KEY (pack, nickname)
+);
+
+ALTER TABLE pack_subscribers_test ADD COLUMN IF NOT EXISTS cooldown INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE pack_subscribers_test ADD COLUMN IF NOT EXISTS suppressed INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE pack_subscribers_test ADD COLUMN IF NOT EXISTS last_time TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT 'epoch';
+ALTER TABLE pack_subscribers_test ADD COLUMN IF NOT EXISTS priority TEXT NOT NULL DEFAULT 'normal';
+ALTER TABLE pack_subscribers_test ADD COLUMN IF NOT EXISTS destinations TEXT NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS digest_messages_test (
+                                        nickname TEXT,
+                                        link TEXT,
+                                        channel TEXT,
+                                        topic TEXT,
+                                        summary TEXT,
+                                        application TEXT,
+                                        suppressed INTEGER NOT NULL DEFAULT 0,
+                                        created_at TIMESTAMP WITH TIME ZONE DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS mutes_test (
+                                        nickname TEXT,
+                                        channel TEXT,
+                                        application TEXT,
+                                        until TIMESTAMP WITH TIME ZONE,
+                                        PRIMARY KEY (nickname, channel, application)
+);
+
+CREATE TABLE IF NOT EXISTS work_queue_test (
+                                        id BIGSERIAL PRIMARY KEY,
+                                        kind TEXT NOT NULL,
+                                        payload JSONB NOT NULL,
+                                        attempts INTEGER NOT NULL DEFAULT 0,
+                                        next_attempt TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+                                        locked_until TIMESTAMP WITH TIME ZONE,
+                                        last_error TEXT,
+                                        created_at TIMESTAMP WITH TIME ZONE DEFAULT now(),
+                                        destination TEXT
+);
+
+CREATE TABLE IF NOT EXISTS dead_letters_test (
+                                        id BIGSERIAL PRIMARY KEY,
+                                        kind TEXT NOT NULL,
+                                        payload JSONB NOT NULL,
+                                        attempts INTEGER NOT NULL,
+                                        failure_class TEXT NOT NULL,
+                                        error TEXT,
+                                        failed_at TIMESTAMP WITH TIME ZONE DEFAULT now(),
+                                        destination TEXT
+);
+
+CREATE TABLE IF NOT EXISTS feeds_test (
+                                        url TEXT PRIMARY KEY,
+                                        title TEXT NOT NULL DEFAULT '',
+                                        etag TEXT NOT NULL DEFAULT '',
+                                        last_modified TEXT NOT NULL DEFAULT '',
+                                        seen TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS mailboxes_test (
+                                        name TEXT PRIMARY KEY,
+                                        owner TEXT NOT NULL,
+                                        url TEXT NOT NULL,
+                                        archive TEXT NOT NULL DEFAULT '',
+                                        uid_validity BIGINT NOT NULL DEFAULT 0,
+                                        last_uid BIGINT NOT NULL DEFAULT 0,
+                                        credentials BYTEA
+);
+
+CREATE TABLE IF NOT EXISTS mailbox_readers_test (
+                                        name TEXT NOT NULL,
+                                        nickname TEXT NOT NULL,
+                                        PRIMARY KEY (name, nickname)
+);
+
+CREATE TABLE IF NOT EXISTS sync_tokens_test (
+                                        account TEXT PRIMARY KEY,
+                                        next_batch TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS repos_test (
+                                        repo TEXT PRIMARY KEY,
+                                        since TIMESTAMPTZ NOT NULL,
+                                        etags TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS confirmations_test (
+                                        nickname TEXT NOT NULL,
+                                        destination TEXT NOT NULL,
+                                        code TEXT NOT NULL,
+                                        attempts INTEGER NOT NULL DEFAULT 0,
+                                        confirmed BOOLEAN NOT NULL DEFAULT false,
+                                        sent_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+                                        PRIMARY KEY (nickname, destination)
+);
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/mattermost/mattermost-server/v6/model"
+)
+
+// Notifier delivers notifications to one kind of destination.
+type Notifier interface {
+	// notify delivers msg to the address, whose meaning depends on the
+	// notifier: a user, a URL or an email address.
+	notify(address string, msg Message) error
+}
+
+type DestinationKind = string
+
+const (
+	// DestinationHome is the platform the user talks to the bot on.
+	DestinationHome       DestinationKind = "home"
+	DestinationTelegram   DestinationKind = "tg"
+	DestinationMattermost DestinationKind = "mm"
+	DestinationWebhook    DestinationKind = "webhook"
+	DestinationEmail      DestinationKind = "email"
+	DestinationMatrix     DestinationKind = "mx"
+	DestinationSlack      DestinationKind = "slack"
+)
+
+// notifiers are the configured notifiers by destination kind.
+var notifiers = map[DestinationKind]Notifier{}
+
+var (
+	wrongDestinationError = errors.New(
+		"Неправильный адрес доставки. Используйте home, tg:@имя, mm:@имя, slack:@имя, mx:@имя:сервер, webhook:<url> или email:<адрес>")
+	destinationAddressError = errors.New(
+		"Для доставки на другую платформу укажите имя пользователя, например mm:@name")
+	privateWebhookError   = errors.New("Вебхук должен вести на публичный адрес")
+	confirmationSendError = errors.New("Не удалось отправить код подтверждения")
+	confirmationCodeError = errors.New(
+		"Неверный код подтверждения. Если попытки закончились, повторите команду notify, чтобы получить новый код")
+)
+
+const (
+	// maxConfirmationAttempts is how many times one confirmation code
+	// may be entered.
+	maxConfirmationAttempts = 5
+	// confirmationResendPeriod is how often a confirmation code may be
+	// sent to one destination.
+	confirmationResendPeriod = time.Hour
+)
+
+// parseDestination checks a destination of the form kind[:address] and
+// returns it normalized. Telegram, Mattermost and Slack destinations
+// without an address mean the user on that platform, which must be home.
+func parseDestination(s string, home Application) (string, error) {
+	kind, address, _ := strings.Cut(strings.TrimSpace(s), ":")
+	kind = strings.ToLower(kind)
+	address = strings.TrimSpace(address)
+	switch kind {
+	case DestinationHome:
+		if address != "" {
+			return "", wrongDestinationError
+		}
+		return kind, nil
+	case DestinationTelegram, DestinationMattermost, DestinationSlack:
+		if address == "" {
+			if homeDestination(home) != kind {
+				return "", destinationAddressError
+			}
+			return DestinationHome, nil
+		}
+		if !strings.HasPrefix(address, "@") || len(address) == 1 {
+			return "", wrongDestinationError
+		}
+	case DestinationMatrix:
+		// Matrix ids contain the server: @name:example.org.
+		name, server, _ := strings.Cut(address, ":")
+		if !strings.HasPrefix(name, "@") || len(name) == 1 || server == "" {
+			return "", wrongDestinationError
+		}
+	case DestinationWebhook:
+		u, err := url.Parse(address)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return "", wrongDestinationError
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+		defer cancel()
+		if err := checkPublicHost(ctx, u.Hostname()); err != nil {
+			return "", privateWebhookError
+		}
+	case DestinationEmail:
+		addr, err := mail.ParseAddress(address)
+		if err != nil {
+			return "", wrongDestinationError
+		}
+		address = addr.Address
+	default:
+		return "", wrongDestinationError
+	}
+	return kind + ":" + address, nil
+}
+
+// parseDestinations parses the destinations of a subscription. An empty
+// list means home.
+func parseDestinations(args []string, home Application) ([]string, error) {
+	var destinations []string
+	for _, arg := range args {
+		destination, err := parseDestination(arg, home)
+		if err != nil {
+			return nil, err
+		}
+		if !containsString(destinations, destination) {
+			destinations = append(destinations, destination)
+		}
+	}
+	if len(destinations) == 1 && destinations[0] == DestinationHome {
+		return nil, nil
+	}
+	return destinations, nil
+}
+
+// homeDestination returns the destination kind of a home platform.
+func homeDestination(home Application) DestinationKind {
+	switch home {
+	case MatterMost:
+		return DestinationMattermost
+	case Slack:
+		return DestinationSlack
+	}
+	return DestinationTelegram
+}
+
+// messageDestination returns the kind of the destination message is
+// delivered to. It is empty for several destinations, which any process
+// splits, and for an unknown user, whom any process fails to notify.
+func messageDestination(s LocalStorage, message Message) (DestinationKind, error) {
+	if len(message.Destinations) > 1 {
+		return "", nil
+	}
+	kind := DestinationHome
+	if len(message.Destinations) == 1 {
+		kind, _, _ = strings.Cut(message.Destinations[0], ":")
+	}
+	if kind != DestinationHome {
+		return kind, nil
+	}
+	home, err := s.getApplication(message.User)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return homeDestination(home), nil
+}
+
+// hasNotifier reports whether this process delivers to the destination
+// kind. Jobs without a kind are delivered by any process.
+func hasNotifier(kind DestinationKind) bool {
+	_, found := notifiers[kind]
+	return kind == "" || found
+}
+
+// notifierKinds returns the destination kinds this process delivers to.
+func notifierKinds() []DestinationKind {
+	kinds := make([]DestinationKind, 0, len(notifiers))
+	for kind := range notifiers {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// resolveDestination returns the notifier and the address of a
+// destination of the user.
+func resolveDestination(user, destination string) (Notifier, string, error) {
+	kind, address, _ := strings.Cut(destination, ":")
+	if kind == DestinationHome || kind == "" {
+		home, err := dataBase.getApplication(user)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, "", failure(FailurePermanent, err)
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		kind, address = homeDestination(home), user
+	}
+	notifier, found := notifiers[kind]
+	if !found {
+		return nil, "", failure(FailurePermanent, fmt.Errorf("destination %s is not configured", kind))
+	}
+	return notifier, address, nil
+}
+
+// changeDestinations sets where the notifications of a subscription are
+// delivered. Every destination except home has to be confirmed first:
+// a code is sent to the unconfirmed ones instead.
+func changeDestinations(user string, home Application, channel, topic string, application Application,
+	args []string) (string, error) {
+	destinations, err := parseDestinations(args, home)
+	if err != nil {
+		return "", err
+	}
+	unconfirmed, err := unconfirmedDestinations(user, destinations)
+	if err != nil {
+		return "", err
+	}
+	if len(unconfirmed) > 0 {
+		return requestConfirmations(user, unconfirmed)
+	}
+	err = dataBase.setDestinations(user, channel, topic, application, destinations)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", subscriptionNotFoundError
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(destinations) == 0 {
+		return "Уведомления будут приходить сюда", nil
+	}
+	return "Уведомления будут приходить в " + strings.Join(destinations, ", "), nil
+}
+
+// unconfirmedDestinations returns the destinations the user has not
+// confirmed.
+func unconfirmedDestinations(user string, destinations []string) ([]string, error) {
+	confirmed, err := dataBase.getConfirmedDestinations(user)
+	if err != nil {
+		return nil, err
+	}
+	var unconfirmed []string
+	for _, destination := range destinations {
+		if destination != DestinationHome && !containsString(confirmed, destination) {
+			unconfirmed = append(unconfirmed, destination)
+		}
+	}
+	return unconfirmed, nil
+}
+
+// requestConfirmations sends a confirmation code to every destination
+// unless one has been sent recently.
+func requestConfirmations(user string, destinations []string) (string, error) {
+	for _, destination := range destinations {
+		code, err := confirmationCode()
+		if err != nil {
+			return "", err
+		}
+		send, err := dataBase.requestConfirmation(user, destination, code, time.Now().Add(-confirmationResendPeriod))
+		if err != nil {
+			return "", err
+		}
+		if !send {
+			continue
+		}
+		notifier, address, err := resolveDestination(user, destination)
+		if err == nil {
+			err = notifier.notify(address, confirmationMessage(user, code))
+		}
+		if err != nil {
+			log.Printf("can't send a confirmation code to %s: %s", destination, err.Error())
+			return "", fmt.Errorf("%w в %s", confirmationSendError, destination)
+		}
+	}
+	return fmt.Sprintf("Сначала подтвердите, что адреса %s ваши: туда отправлен код. "+
+		"Введите его командой confirm <куда> <код> и повторите команду", strings.Join(destinations, ", ")), nil
+}
+
+// confirmationCode returns a random six digit code.
+func confirmationCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// confirmationMessage is the notification carrying a confirmation code.
+func confirmationMessage(user, code string) Message {
+	return Message{
+		User:    user,
+		Channel: "Topic Keeper",
+		Topic:   "confirmation",
+		Summary: fmt.Sprintf("%s wants notifications delivered here. The confirmation code is %s", user, code),
+	}
+}
+
+// confirmDestination confirms a destination of the user with the code
+// sent to it.
+func confirmDestination(user string, home Application, destination, code string) (string, error) {
+	destination, err := parseDestination(destination, home)
+	if err != nil {
+		return "", err
+	}
+	confirmed, err := dataBase.confirmDestination(user, destination, strings.TrimSpace(code))
+	if err != nil {
+		return "", err
+	}
+	if !confirmed {
+		return "", confirmationCodeError
+	}
+	return fmt.Sprintf("Адрес %s подтверждён", destination), nil
+}
+
+type telegramNotifier struct {
+	bot *tgbotapi.BotAPI
+}
+
+// notify sends msg to the Telegram user with the address as nickname.
+func (t telegramNotifier) notify(address string, msg Message) error {
+	userId, err := dataBase.getID(strings.TrimPrefix(address, "@"))
+	if errors.Is(err, sql.ErrNoRows) {
+		return failure(FailurePermanent, err)
+	}
+	if err != nil {
+		return err
+	}
+	ans := tgbotapi.NewMessage(userId, newsText(msg))
+	// Low priority notifications are delivered silently.
+	ans.DisableNotification = msg.Priority == PriorityLow
+	if _, err = t.bot.Send(ans); err != nil {
+		return failure(sendFailureClass(err), err)
+	}
+	return nil
+}
+
+// sendFailureClass tells whether a failed Bot API request may succeed
+// later.
+func sendFailureClass(err error) FailureClass {
+	var apiErr *tgbotapi.Error
+	if errors.As(err, &apiErr) && (apiErr.Code == 400 || apiErr.Code == 403) {
+		// The chat is gone or the bot is blocked.
+		return FailurePermanent
+	}
+	return FailureDelivery
+}
+
+type mattermostNotifier struct {
+	client *model.Client4
+	user   *model.User
+	team   *model.Team
+}
+
+// connectMattermost logs in to the Mattermost server of cfg.
+func connectMattermost(cfg config) (*mattermostNotifier, error) {
+	client := model.NewAPIv4Client(cfg.server.String())
+	client.SetToken(cfg.token)
+	user, _, err := client.GetUser("me", "")
+	if err != nil {
+		return nil, fmt.Errorf("could not log in: %w", err)
+	}
+	team, _, err := client.GetTeamByName(cfg.teamName, "")
+	if err != nil {
+		return nil, fmt.Errorf("could not find team %s: %w", cfg.teamName, err)
+	}
+	return &mattermostNotifier{client: client, user: user, team: team}, nil
+}
+
+// notify posts msg to a direct channel. The address is either the id of
+// the direct channel of a Mattermost user or @username.
+func (m *mattermostNotifier) notify(address string, msg Message) error {
+	channel := address
+	if username, ok := strings.CutPrefix(address, "@"); ok {
+		user, _, err := m.client.GetUserByUsername(username, "")
+		if err != nil {
+			return failure(FailurePermanent, err)
+		}
+		direct, _, err := m.client.CreateDirectChannel(m.user.Id, user.Id)
+		if err != nil {
+			return failure(FailureDelivery, err)
+		}
+		channel = direct.Id
+	}
+	post := &model.Post{ChannelId: channel, Message: MmMessageToText(msg)}
+	if _, _, err := m.client.CreatePost(post); err != nil {
+		return failure(FailureDelivery, err)
+	}
+	return nil
+}
+
+const webhookTimeout = 10 * time.Second
+
+type webhookNotifier struct {
+	client *http.Client
+}
+
+// notify posts msg as JSON to the URL in address.
+func (w webhookNotifier) notify(address string, msg Message) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return failure(FailurePermanent, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, address, bytes.NewReader(body))
+	if err != nil {
+		return failure(FailurePermanent, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req)
+	if errors.Is(err, privateAddressError) {
+		return failure(FailurePermanent, err)
+	}
+	if err != nil {
+		return failure(FailureDelivery, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 300 {
+		return nil
+	}
+	err = fmt.Errorf("webhook responded with %s", resp.Status)
+	if resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+		return failure(FailurePermanent, err)
+	}
+	return failure(FailureDelivery, err)
+}
+
+// emailNotifier sends notifications over SMTP.
+type emailNotifier struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// newEmailNotifier configures email from the environment, nil if no
+// SMTP server is given.
+func newEmailNotifier() *emailNotifier {
+	addr := os.Getenv("TOPIC_KEEPER_SMTP_ADDR")
+	if addr == "" {
+		return nil
+	}
+	e := &emailNotifier{addr: addr, from: os.Getenv("TOPIC_KEEPER_SMTP_FROM")}
+	if user := os.Getenv("TOPIC_KEEPER_SMTP_USER"); user != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		e.auth = smtp.PlainAuth("", user, os.Getenv("TOPIC_KEEPER_SMTP_PASSWORD"), host)
+	}
+	if e.from == "" {
+		e.from = os.Getenv("TOPIC_KEEPER_SMTP_USER")
+	}
+	return e
+}
+
+func (e *emailNotifier) notify(address string, msg Message) error {
+	if err := smtp.SendMail(e.addr, e.auth, e.from, []string{address}, emailText(e.from, address, msg)); err != nil {
+		return failure(FailureDelivery, err)
+	}
+	return nil
+}
+
+// emailText renders msg as a plain text email.
+func emailText(from, to string, msg Message) []byte {
+	subject := fmt.Sprintf("[%s] %s", msg.Topic, msg.Channel)
+	if msg.Priority == PriorityHigh {
+		subject = highPriorityMark + subject
+	}
+	str := strings.Builder{}
+	str.WriteString("From: " + from + "\r\n")
+	str.WriteString("To: " + to + "\r\n")
+	str.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n")
+	str.WriteString("MIME-Version: 1.0\r\n")
+	str.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	str.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	str.WriteString(strings.ReplaceAll(newsText(msg), "\n", "\r\n"))
+	return []byte(str.String())
+}
+
+// registerNotifiers registers the notifiers which need no platform
+// client: webhooks and, if configured, email.
+func registerNotifiers() {
+	notifiers[DestinationWebhook] = webhookNotifier{client: publicClient(webhookTimeout)}
+	if email := newEmailNotifier(); email != nil {
+		notifiers[DestinationEmail] = email
+	}
+}
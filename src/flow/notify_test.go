@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withLookup makes host names resolve to the given addresses.
+func withLookup(t *testing.T, hosts map[string]string) {
+	saved := lookupIPAddr
+	lookupIPAddr = func(_ context.Context, host string) ([]net.IPAddr, error) {
+		addr, found := hosts[host]
+		if !found {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return []net.IPAddr{{IP: net.ParseIP(addr)}}, nil
+	}
+	t.Cleanup(func() { lookupIPAddr = saved })
+}
+
+func TestParseDestination(t *testing.T) {
+	withLookup(t, map[string]string{"ci.example.com": "93.184.216.34", "localhost": "127.0.0.1"})
+	for _, tt := range []struct {
+		in   string
+		home Application
+		want string
+		err  error
+	}{
+		{"home", Telegram, DestinationHome, nil},
+		{"tg", Telegram, DestinationHome, nil},
+		{"MM", MatterMost, DestinationHome, nil},
+		{"mm", Telegram, "", destinationAddressError},
+		{"mm:@ivanov", Telegram, "mm:@ivanov", nil},
+		{"tg:@petrov", MatterMost, "tg:@petrov", nil},
+		{"tg:petrov", MatterMost, "", wrongDestinationError},
+		{"slack", Slack, DestinationHome, nil},
+		{"slack:@ivanov", MatterMost, "slack:@ivanov", nil},
+		{"mx:@ivanov:matrix.org", Telegram, "mx:@ivanov:matrix.org", nil},
+		{"mx:@ivanov", Telegram, "", wrongDestinationError},
+		{"mx", Telegram, "", wrongDestinationError},
+		{"webhook:https://ci.example.com/hook?a=1", Telegram, "webhook:https://ci.example.com/hook?a=1", nil},
+		{"webhook:ftp://example.com", Telegram, "", wrongDestinationError},
+		{"webhook:http://localhost:8080/", Telegram, "", privateWebhookError},
+		{"webhook:http://169.254.169.254/latest/meta-data", Telegram, "", privateWebhookError},
+		{"webhook:http://10.0.0.5/hook", Telegram, "", privateWebhookError},
+		{"webhook:http://[::1]/hook", Telegram, "", privateWebhookError},
+		{"webhook:http://unknown.example.com/hook", Telegram, "", privateWebhookError},
+		{"email:Ivan <ivan@example.com>", Telegram, "email:ivan@example.com", nil},
+		{"email:nobody", Telegram, "", wrongDestinationError},
+		{"home:x", Telegram, "", wrongDestinationError},
+		{"sms:123", Telegram, "", wrongDestinationError},
+	} {
+		got, err := parseDestination(tt.in, tt.home)
+		if got != tt.want || err != tt.err {
+			t.Errorf("parseDestination(%q, %s) = %q, %v, want %q, %v", tt.in, tt.home, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestParseDestinations(t *testing.T) {
+	got, err := parseDestinations([]string{"home"}, Telegram)
+	if err != nil || got != nil {
+		t.Errorf("parseDestinations(home) = %v, %v, want nil", got, err)
+	}
+	got, err = parseDestinations([]string{"tg", "email:a@b.ru", "email:a@b.ru"}, Telegram)
+	want := []string{DestinationHome, "email:a@b.ru"}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("parseDestinations() = %v, %v, want %v", got, err, want)
+	}
+}
+
+func TestMergeDestinations(t *testing.T) {
+	merged := mergeDestinations(nil, "")
+	merged = mergeDestinations(merged, "email:a@b.ru webhook:http://h")
+	merged = mergeDestinations(merged, "email:a@b.ru")
+	want := []string{DestinationHome, "email:a@b.ru", "webhook:http://h"}
+	if !reflect.DeepEqual(merged, want) {
+		t.Errorf("mergeDestinations() = %v, want %v", merged, want)
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	var received Message
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	notifier := webhookNotifier{client: server.Client()}
+	msg := Message{User: "bob", Topic: "go", Link: "https://t.me/c/1/2", Application: Telegram}
+	if err := notifier.notify(server.URL, msg); err != nil {
+		t.Fatal(err)
+	}
+	if received.User != msg.User || received.Topic != msg.Topic || received.Link != msg.Link {
+		t.Errorf("webhook received %+v, want %+v", received, msg)
+	}
+
+	for code, class := range map[int]FailureClass{
+		http.StatusNotFound:            FailurePermanent,
+		http.StatusTooManyRequests:     FailureDelivery,
+		http.StatusInternalServerError: FailureDelivery,
+	} {
+		status = code
+		err := notifier.notify(server.URL, msg)
+		if err == nil || classify(err) != class {
+			t.Errorf("status %d: got %v, want a %s failure", code, err, class)
+		}
+	}
+}
+
+func TestWebhookNotifierPrivateAddress(t *testing.T) {
+	requested := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = true
+	}))
+	defer server.Close()
+
+	notifier := webhookNotifier{client: publicClient(webhookTimeout)}
+	err := notifier.notify(server.URL, Message{User: "bob"})
+	if err == nil || classify(err) != FailurePermanent || requested {
+		t.Errorf("notify to a loopback address = %v, requested %t, want a permanent failure", err, requested)
+	}
+}
+
+// confirmationStorage keeps the subscription and the confirmation
+// codes of one user.
+type confirmationStorage struct {
+	LocalStorage
+	codes        map[string]string
+	confirmed    []string
+	destinations []string
+}
+
+func (s *confirmationStorage) requestConfirmation(user, destination, code string, resendBefore time.Time) (bool, error) {
+	if _, sent := s.codes[destination]; sent || containsString(s.confirmed, destination) {
+		return false, nil
+	}
+	s.codes[destination] = code
+	return true, nil
+}
+
+func (s *confirmationStorage) confirmDestination(user, destination, code string) (bool, error) {
+	if s.codes[destination] != code {
+		return false, nil
+	}
+	s.confirmed = append(s.confirmed, destination)
+	return true, nil
+}
+
+func (s *confirmationStorage) getConfirmedDestinations(string) ([]string, error) {
+	return s.confirmed, nil
+}
+
+func (s *confirmationStorage) setDestinations(user, channel, topic string, application Application, destinations []string) error {
+	s.destinations = destinations
+	return nil
+}
+
+// recordingNotifier records the messages by address.
+type recordingNotifier map[string][]Message
+
+func (n recordingNotifier) notify(address string, msg Message) error {
+	n[address] = append(n[address], msg)
+	return nil
+}
+
+func TestChangeDestinationsConfirmation(t *testing.T) {
+	storage := &confirmationStorage{codes: map[string]string{}}
+	saved := dataBase
+	dataBase = storage
+	t.Cleanup(func() { dataBase = saved })
+	sent := recordingNotifier{}
+	savedNotifier := notifiers[DestinationEmail]
+	notifiers[DestinationEmail] = sent
+	t.Cleanup(func() { notifiers[DestinationEmail] = savedNotifier })
+
+	args := []string{"home", "email:ivan@example.com"}
+	for i := 0; i < 2; i++ {
+		if _, err := changeDestinations("ivan", Telegram, "news", "exam", Telegram, args); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if storage.destinations != nil || len(sent["ivan@example.com"]) != 1 {
+		t.Fatalf("destinations = %v, sent %+v, want one code and nothing stored", storage.destinations, sent)
+	}
+	code := storage.codes["email:ivan@example.com"]
+	if !strings.Contains(sent["ivan@example.com"][0].Summary, code) {
+		t.Errorf("confirmation %+v does not contain the code %s", sent["ivan@example.com"][0], code)
+	}
+
+	if _, err := confirmDestination("ivan", Telegram, "email:ivan@example.com", "wrong"); err != confirmationCodeError {
+		t.Errorf("confirmDestination with a wrong code error = %v", err)
+	}
+	if _, err := confirmDestination("ivan", Telegram, "email:Ivan <ivan@example.com>", code); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := changeDestinations("ivan", Telegram, "news", "exam", Telegram, args); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{DestinationHome, "email:ivan@example.com"}; !reflect.DeepEqual(storage.destinations, want) {
+		t.Errorf("destinations = %v, want %v", storage.destinations, want)
+	}
+}
+
+func TestEmailText(t *testing.T) {
+	text := string(emailText("bot@example.com", "ivan@example.com",
+		Message{Topic: "дедлайн", Channel: "course", Summary: "s", Link: "l", Priority: PriorityHigh}))
+	for _, want := range []string{"From: bot@example.com\r\n", "To: ivan@example.com\r\n",
+		"Subject: =?utf-8?q?", "charset=utf-8", "\r\n\r\n"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("emailText() = %q, want it to contain %q", text, want)
+		}
+	}
+}
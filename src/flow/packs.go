@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	packNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+	wrongPackNameError = errors.New(
+		"Название набора может состоять из латинских букв, цифр, '-' и '_' и быть не длиннее 64 символов")
+	packOwnedError    = errors.New("Набор с таким названием уже опубликован другим пользователем")
+	packNotFoundError = errors.New("Набор не найден")
+	packTopicsError   = errors.New("Среди ваших подписок нет таких топиков")
+)
+
+// parsePackName validates the name of a topic pack. Names are case
+// insensitive.
+func parsePackName(s string) (string, error) {
+	name := strings.ToLower(strings.TrimSpace(s))
+	if !packNameRegexp.MatchString(name) {
+		return "", wrongPackNameError
+	}
+	return name, nil
+}
+
+// parsePublish parses the arguments of the publish command: the name of
+// the pack and optionally the comma-separated topics to put into it, all
+// the topics of the owner if there are none.
+func parsePublish(s string) (string, []string, error) {
+	arg, rest, _ := strings.Cut(strings.TrimSpace(s), " ")
+	name, err := parsePackName(arg)
+	if err != nil {
+		return "", nil, err
+	}
+	var topics []string
+	for _, topic := range strings.Split(rest, ",") {
+		if topic = strings.TrimSpace(topic); topic != "" && !containsString(topics, topic) {
+			topics = append(topics, topic)
+		}
+	}
+	return name, topics, nil
+}
+
+// publishedReply tells the owner how others can subscribe to the pack.
+func publishedReply(name string, count int64, subscribeCommand string) string {
+	return fmt.Sprintf("Набор %s опубликован, топиков: %d. Подписаться на него: %s %s",
+		name, count, subscribeCommand, name)
+}
+
+// formatPacks renders the packs a user is subscribed to for the view
+// command.
+func formatPacks(packs []string) string {
+	if len(packs) == 0 {
+		return ""
+	}
+	str := strings.Builder{}
+	str.WriteString("Наборы:\n")
+	for _, pack := range packs {
+		str.WriteString(fmt.Sprintf("   - %s\n", pack))
+	}
+	return str.String()
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePackName(t *testing.T) {
+	for _, tc := range []struct {
+		given  string
+		answer string
+	}{
+		{"mkn-2-course-deadlines", "mkn-2-course-deadlines"},
+		{" MKN_2 ", "mkn_2"},
+		{"2024", "2024"},
+	} {
+		res, err := parsePackName(tc.given)
+		if err != nil {
+			t.Errorf("Error (%s) in parsing: %s", err.Error(), tc.given)
+		}
+		if res != tc.answer {
+			t.Errorf("Got %s but answer is %s", res, tc.answer)
+		}
+	}
+
+	for _, given := range []string{"", "-pack", "two words", "дедлайны", "pack!", string(make([]byte, 65))} {
+		if _, err := parsePackName(given); err == nil {
+			t.Errorf("No error in parsing: %q", given)
+		}
+	}
+}
+
+func TestParsePublish(t *testing.T) {
+	name, topics, err := parsePublish(" Deadlines exam, lab work,exam ")
+	if err != nil || name != "deadlines" || !reflect.DeepEqual(topics, []string{"exam", "lab work"}) {
+		t.Errorf("parsePublish() = %q, %q, %v", name, topics, err)
+	}
+	if _, topics, err := parsePublish("deadlines"); err != nil || topics != nil {
+		t.Errorf("parsePublish() without topics = %q, %v", topics, err)
+	}
+}
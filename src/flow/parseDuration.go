@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var wrongCooldownError = errors.New(
+	"Неправильная задержка. Используйте none, число минут (например, 15m) или day, то есть 24 часа")
+
+// parseDuration is time.ParseDuration which also accepts a number of
+// days, e.g. "1d".
+func parseDuration(s string) (time.Duration, error) {
+	if days, found := strings.CutSuffix(s, "d"); found {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// parseCooldown parses a subscription cooldown: "none", "day" or a
+// duration, where a bare number means minutes. A day is 24 hours since
+// the last notification, not a calendar day.
+func parseCooldown(s string) (time.Duration, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	switch s {
+	case "none":
+		return 0, nil
+	case "day":
+		return 24 * time.Hour, nil
+	}
+	if minutes, err := strconv.Atoi(s); err == nil {
+		s = fmt.Sprintf("%dm", minutes)
+	}
+	cooldown, err := parseDuration(s)
+	if err != nil || cooldown < 0 {
+		return 0, wrongCooldownError
+	}
+	return cooldown, nil
+}
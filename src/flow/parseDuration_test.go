@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCooldown(t *testing.T) {
+	for _, tc := range []struct {
+		given  string
+		answer time.Duration
+	}{
+		{"none", 0},
+		{"NONE", 0},
+		{"0", 0},
+		{"15", 15 * time.Minute},
+		{"15m", 15 * time.Minute},
+		{"2h", 2 * time.Hour},
+		{"day", 24 * time.Hour},
+		{"2d", 48 * time.Hour},
+	} {
+		res, err := parseCooldown(tc.given)
+		if err != nil {
+			t.Errorf("Error (%s) in parsing: %s", err.Error(), tc.given)
+		}
+		if res != tc.answer {
+			t.Errorf("Got %s but answer is %s", res, tc.answer)
+		}
+	}
+
+	for _, given := range []string{"", "-5", "-1h", "week", "d", "1.5d", "15x"} {
+		if _, err := parseCooldown(given); err == nil {
+			t.Errorf("No error in parsing: %q", given)
+		}
+	}
+}
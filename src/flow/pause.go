@@ -0,0 +1,91 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var wrongPauseError = errors.New(
+	"Неправильная длительность. Используйте, например, 30m, 2h, 1d или until ЧЧ:ММ")
+
+var channelNotMutedError = errors.New("Канал не заглушён")
+
+// parsePauseEnd parses the argument of the pause and mute commands: a
+// duration such as "2h" or "1d", or "until HH:MM" meaning the next such
+// wall clock time. An empty argument means no end and gives nil.
+func parsePauseEnd(s string, now time.Time) (*time.Time, error) {
+	fields := strings.Fields(strings.ToLower(s))
+	switch {
+	case len(fields) == 0:
+		return nil, nil
+	case len(fields) == 2 && (fields[0] == "until" || fields[0] == "до"):
+		hour, minute, err := parseClock(fields[1])
+		if err != nil {
+			return nil, wrongPauseError
+		}
+		end := DigestSchedule{Kind: DigestDaily, Hour: hour, Minute: minute}.next(now)
+		return &end, nil
+	case len(fields) == 1:
+		duration, err := parseDuration(fields[0])
+		if err != nil || duration <= 0 {
+			return nil, wrongPauseError
+		}
+		end := now.Add(duration)
+		return &end, nil
+	}
+	return nil, wrongPauseError
+}
+
+// pause pauses the user according to the command argument and returns
+// the reply.
+func pause(user, arg string) (string, error) {
+	settings, err := dataBase.getUserSettings(user)
+	if err != nil {
+		return "", err
+	}
+	until, err := parsePauseEnd(arg, time.Now().In(settings.location()))
+	if err != nil {
+		return "", err
+	}
+	if err := dataBase.pauseUser(user, until); err != nil {
+		return "", err
+	}
+	if until == nil {
+		return "Обновления поставлены на паузу!", nil
+	}
+	return "Обновления поставлены на паузу до " + until.Format(historyTimeFormat), nil
+}
+
+// changeMute mutes or unmutes the channel for the user according to the
+// command argument and returns the reply.
+func changeMute(user, channel string, application Application, arg string) (string, error) {
+	if strings.EqualFold(strings.TrimSpace(arg), "off") {
+		err := dataBase.unmuteChannel(user, channel, application)
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", channelNotMutedError
+		}
+		if err != nil {
+			return "", err
+		}
+		return "Канал снова присылает обновления", nil
+	}
+
+	settings, err := dataBase.getUserSettings(user)
+	if err != nil {
+		return "", err
+	}
+	until, err := parsePauseEnd(arg, time.Now().In(settings.location()))
+	if err != nil {
+		return "", err
+	}
+	if until == nil {
+		return "", wrongPauseError
+	}
+	if err := dataBase.muteChannel(user, channel, application, *until); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Канал заглушён до %s, обновления придут после", until.Format(historyTimeFormat)), nil
+}
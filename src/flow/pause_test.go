@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParsePauseEnd(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Moscow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 10, 14, 10, 20, 0, 0, loc)
+	for _, tc := range []struct {
+		given  string
+		answer time.Time
+	}{
+		{"2h", now.Add(2 * time.Hour)},
+		{"30m", now.Add(30 * time.Minute)},
+		{"1d", now.Add(24 * time.Hour)},
+		{"until 18:00", time.Date(2026, 10, 14, 18, 0, 0, 0, loc)},
+		{"Until 09:00", time.Date(2026, 10, 15, 9, 0, 0, 0, loc)},
+		{"до 10:20", time.Date(2026, 10, 15, 10, 20, 0, 0, loc)},
+	} {
+		res, err := parsePauseEnd(tc.given, now)
+		if err != nil {
+			t.Errorf("Error (%s) in parsing: %q", err.Error(), tc.given)
+			continue
+		}
+		if res == nil || !res.Equal(tc.answer) {
+			t.Errorf("%q: got %v but answer is %s", tc.given, res, tc.answer)
+		}
+	}
+
+	if res, err := parsePauseEnd("  ", now); res != nil || err != nil {
+		t.Errorf("Empty argument gives %v, %v", res, err)
+	}
+
+	for _, given := range []string{"0", "-1h", "2", "until", "until 25:00", "till 18:00", "2h 3h"} {
+		if _, err := parsePauseEnd(given, now); err == nil {
+			t.Errorf("No error in parsing: %q", given)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// pipeline turns the normalized events of every source into
+// notifications: it matches them against the subscriptions and either
+// sends the notifications or stores them according to the settings of
+// their users. Sources only produce workEvents, notifiers only deliver
+// Messages.
+type pipeline struct {
+	storage  LocalStorage
+	analyzer API
+	// openAIKey enables the OpenAI summarizer.
+	openAIKey string
+	// send hands a notification over for delivery.
+	send func(ctx context.Context, n notification)
+	// finish completes or retries the job of a notification.
+	finish func(job Job, err error)
+	// delivers reports whether this process delivers to a destination
+	// kind.
+	delivers func(kind DestinationKind) bool
+}
+
+const (
+	editedMark      = "(edited) "
+	forwardedFormat = "(forwarded from %s) "
+)
+
+// events is the pipeline of the running bot.
+var events *pipeline
+
+func newPipeline(storage LocalStorage, analyzer API, openAIKey string) *pipeline {
+	return &pipeline{storage: storage, analyzer: analyzer, openAIKey: openAIKey, send: queueNotification,
+		finish: finishJob, delivers: hasNotifier}
+}
+
+// worker handles the events of workChan until it is closed or ctx is
+// done.
+func worker(ctx context.Context, workChan chan workEvent) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case update, ok := <-workChan:
+			if !ok {
+				return
+			}
+			err := events.handle(ctx, update)
+			if update.job != nil {
+				finishJob(*update.job, err)
+			} else if err != nil {
+				retryEvent(update, err)
+			}
+		}
+	}
+}
+
+// retryEvent queues an event which has not come from the work queue for
+// a retry.
+func retryEvent(event workEvent, err error) {
+	payload, encodeErr := encodeEvent(event)
+	if encodeErr != nil {
+		log.Println(encodeErr.Error())
+		return
+	}
+	finishJob(Job{Kind: JobEvent, Payload: payload}, err)
+}
+
+// handle notifies the users subscribed to the topics found in the
+// event. Failed notifications are queued for a retry on their own; an
+// error means the event should be retried.
+func (p *pipeline) handle(ctx context.Context, event workEvent) error {
+	channel := event.key
+	application := event.application
+
+	if found, err := p.storage.containsChannel(channel, application); !found || err != nil {
+		return err
+	}
+	possibleTopics, err := p.storage.getTopics(channel, application)
+	if err != nil || len(possibleTopics) == 0 {
+		return err
+	}
+	foundTopics, err := p.analyzer.analyze(event.text, possibleTopics)
+	if err != nil || len(foundTopics) == 0 {
+		return failure(FailureAnalyzer, err)
+	}
+	summary := eventSummary(event, p.summarize(event.text))
+
+	// The notifications are queued in the transaction which marks the
+	// users notified, so a crash after it does not lose them.
+	var notifications []notification
+	err = p.storage.inTx(func(s LocalStorage) error {
+		var sendUsers map[string]Subscriber
+		var err error
+		if event.historyRequest != nil {
+			sendUsers = map[string]Subscriber{event.historyRequest.user: {Topics: foundTopics}}
+			sendUsers, err = skipNotified(s, event, sendUsers)
+		} else {
+			sendUsers, err = matchUsers(s, event, foundTopics)
+		}
+		if err != nil {
+			return err
+		}
+		notifications, err = p.enqueueNotifications(s, event, sendUsers, summary)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, n := range notifications {
+		if event.historyRequest != nil {
+			p.send(ctx, n)
+			continue
+		}
+		p.deliver(ctx, n)
+	}
+	return nil
+}
+
+// matchUsers returns the users to be notified about the event and marks
+// them notified. The users cooling down only have the match counted.
+func matchUsers(s LocalStorage, event workEvent, foundTopics []string) (map[string]Subscriber, error) {
+	channel := event.key
+	application := event.application
+	sendUsers, err := s.getUsers(channel, foundTopics, application)
+	if err != nil {
+		return nil, err
+	}
+	if sendUsers, err = skipForbidden(event, sendUsers); err != nil {
+		return nil, err
+	}
+	if sendUsers, err = skipNotified(s, event, sendUsers); err != nil {
+		return nil, err
+	}
+	// The users cooling down are marked as well, so a redelivered
+	// message is not counted twice.
+	cooling, err := s.getCoolingUsers(channel, foundTopics, application)
+	if err != nil {
+		return nil, err
+	}
+	if cooling, err = skipNotified(s, event, cooling); err != nil {
+		return nil, err
+	}
+	if err = s.suppress(channel, cooling, application); err != nil {
+		return nil, err
+	}
+	return sendUsers, s.setTimes(channel, sendUsers, application)
+}
+
+// enqueueNotifications stores a notification job for each user and
+// returns the ones this process delivers.
+func (p *pipeline) enqueueNotifications(s LocalStorage, event workEvent, users map[string]Subscriber,
+	summary string) ([]notification, error) {
+	notifications := make([]notification, 0, len(users))
+	for user, subscriber := range users {
+		message := Message{
+			Application:  event.application,
+			User:         user,
+			Link:         event.link,
+			Channel:      event.channel,
+			ChannelID:    event.key,
+			Topic:        strings.Join(subscriber.Topics, ", "),
+			Summary:      summary,
+			Suppressed:   subscriber.Suppressed,
+			Priority:     subscriber.Priority,
+			Destinations: subscriber.Destinations,
+		}
+		n, local, err := enqueueNotification(s, message, p.delivers)
+		if err != nil {
+			return nil, err
+		}
+		if local {
+			notifications = append(notifications, n)
+		}
+	}
+	return notifications, nil
+}
+
+// deliver sends the notification or stores it for later according to the
+// settings of its user. Its job is finished unless the sender does it.
+func (p *pipeline) deliver(ctx context.Context, n notification) {
+	queued := false
+	err := p.dispatch(n.message, func(m Message) {
+		queued = true
+		p.send(ctx, notification{message: m, job: n.job})
+	})
+	if err != nil || !queued {
+		p.finish(*n.job, err)
+	}
+}
+
+// summarize returns a short summary of text, made by OpenAI if it is
+// enabled and the text is long.
+func (p *pipeline) summarize(text string) string {
+	if p.openAIKey == "" || len(text) <= summaryLength {
+		return summarize(text)
+	}
+	summary, err := p.analyzer.summarize(text, p.openAIKey)
+	if err != nil {
+		log.Printf("error in OpenAI uisng with error: %s \n", err.Error())
+		return summarize(text)
+	}
+	return summary
+}
+
+// dispatch delivers message with send or stores it for later according
+// to the settings of its user.
+func (p *pipeline) dispatch(message Message, send func(Message)) error {
+	// Grouped messages, such as digests, have been released already.
+	if message.Priority == PriorityHigh || len(message.Grouped) > 0 {
+		send(message)
+		return nil
+	}
+	settings, err := p.storage.getUserSettings(message.User)
+	if err != nil {
+		return err
+	}
+	if message.Priority == PriorityLow {
+		return p.addLowPriority(message, settings)
+	}
+	muted, err := p.storage.isMuted(message.User, message.ChannelID, message.Application)
+	if err != nil {
+		return err
+	}
+	switch {
+	case settings.Paused || muted:
+		return p.storage.addDelayedMessage(message)
+	case settings.Digest != "":
+		return p.storage.addDigestMessage(message)
+	case settings.isQuiet(time.Now()):
+		return p.storage.addDelayedMessage(message)
+	}
+	send(message)
+	return nil
+}
+
+// addLowPriority adds message to the digest of its user, scheduling the
+// default digest if the user has not chosen one.
+func (p *pipeline) addLowPriority(message Message, settings UserSettings) error {
+	return p.storage.inTx(func(s LocalStorage) error {
+		if err := s.addDigestMessage(message); err != nil {
+			return err
+		}
+		if settings.Digest != "" {
+			return nil
+		}
+		return s.ensureDigestNext(message.User, defaultDigestSchedule.next(time.Now().In(settings.location())))
+	})
+}
+
+// skipForbidden removes from users everyone who may not read the channel
+// of the event, e.g. who has subscribed to a shared mailbox through a
+// pack or has been refused since.
+func skipForbidden(event workEvent, users map[string]Subscriber) (map[string]Subscriber, error) {
+	for user := range users {
+		err := checkAccess(user, event.application, event.key)
+		if errors.Is(err, channelAccessError) {
+			delete(users, user)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return users, nil
+}
+
+// skipNotified removes from users everyone who has already been
+// notified about the message of the event. The users notified before
+// about an edited message keep only the topics that are new to them.
+func skipNotified(s LocalStorage, event workEvent, users map[string]Subscriber) (map[string]Subscriber, error) {
+	if event.messageID == "" {
+		return users, nil
+	}
+	topics := make(map[string][]string, len(users))
+	for user, subscriber := range users {
+		topics[user] = subscriber.Topics
+	}
+	fresh, err := s.markNotified(event.application, event.channelID, event.messageID, topics)
+	if err != nil {
+		return nil, err
+	}
+	answer := make(map[string]Subscriber, len(fresh))
+	for user, topics := range fresh {
+		subscriber := users[user]
+		subscriber.Topics = topics
+		answer[user] = subscriber
+	}
+	return answer, nil
+}
+
+// eventSummary marks the summary of an edited or forwarded message.
+func eventSummary(event workEvent, summary string) string {
+	if event.forwardedFrom != "" {
+		summary = fmt.Sprintf(forwardedFormat, event.forwardedFrom) + summary
+	}
+	if event.edited {
+		summary = editedMark + summary
+	}
+	return summary
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeStorage keeps just enough state for the pipeline. The methods it
+// does not override panic through the nil LocalStorage.
+type fakeStorage struct {
+	LocalStorage
+	// subscriptions are by application and channel key, then user and
+	// topic.
+	subscriptions map[string]map[string]map[string]Priority
+	settings      map[string]UserSettings
+	notified      map[string]bool
+	// cooling users are cooling down on all their subscriptions, whose
+	// suppressed matches are counted by user.
+	cooling    map[string]bool
+	suppressed map[string]int
+	delayed    []Message
+	digested   []Message
+	// jobs are the enqueued notification jobs.
+	jobs []Job
+}
+
+func newFakeStorage() *fakeStorage {
+	return &fakeStorage{
+		subscriptions: map[string]map[string]map[string]Priority{},
+		settings:      map[string]UserSettings{},
+		notified:      map[string]bool{},
+		cooling:       map[string]bool{},
+		suppressed:    map[string]int{},
+	}
+}
+
+func (f *fakeStorage) subscribe(user, channel, topic string, application Application, priority Priority) {
+	key := application + "/" + channel
+	if f.subscriptions[key] == nil {
+		f.subscriptions[key] = map[string]map[string]Priority{}
+	}
+	if f.subscriptions[key][user] == nil {
+		f.subscriptions[key][user] = map[string]Priority{}
+	}
+	f.subscriptions[key][user][topic] = priority
+}
+
+func (f *fakeStorage) inTx(fn func(s LocalStorage) error) error {
+	return fn(f)
+}
+
+func (f *fakeStorage) containsChannel(channel string, application Application) (bool, error) {
+	return len(f.subscriptions[application+"/"+channel]) > 0, nil
+}
+
+func (f *fakeStorage) getTopics(channel string, application Application) ([]string, error) {
+	var topics []string
+	for _, userTopics := range f.subscriptions[application+"/"+channel] {
+		for topic := range userTopics {
+			if !containsString(topics, topic) {
+				topics = append(topics, topic)
+			}
+		}
+	}
+	return topics, nil
+}
+
+func (f *fakeStorage) getCoolingUsers(channel string, topics []string, application Application) (map[string]Subscriber, error) {
+	users := map[string]Subscriber{}
+	for user, userTopics := range f.subscriptions[application+"/"+channel] {
+		for _, topic := range topics {
+			if _, found := userTopics[topic]; found && f.cooling[user] {
+				subscriber := users[user]
+				subscriber.Topics = append(subscriber.Topics, topic)
+				users[user] = subscriber
+			}
+		}
+	}
+	return users, nil
+}
+
+func (f *fakeStorage) suppress(channel string, users map[string]Subscriber, application Application) error {
+	for user, subscriber := range users {
+		f.suppressed[user] += len(subscriber.Topics)
+	}
+	return nil
+}
+
+func (f *fakeStorage) getUsers(channel string, topics []string, application Application) (map[string]Subscriber, error) {
+	users := map[string]Subscriber{}
+	for user, userTopics := range f.subscriptions[application+"/"+channel] {
+		if f.cooling[user] {
+			continue
+		}
+		for _, topic := range topics {
+			priority, found := userTopics[topic]
+			if !found {
+				continue
+			}
+			subscriber, seen := users[user]
+			if seen {
+				priority = maxPriority(subscriber.Priority, priority)
+			}
+			subscriber.Topics = append(subscriber.Topics, topic)
+			subscriber.Priority = priority
+			subscriber.Destinations = mergeDestinations(subscriber.Destinations, "")
+			users[user] = subscriber
+		}
+	}
+	return users, nil
+}
+
+func (f *fakeStorage) setTimes(string, map[string]Subscriber, Application) error {
+	return nil
+}
+
+func (f *fakeStorage) markNotified(application Application, channelID, messageID string, topics map[string][]string) (map[string][]string, error) {
+	fresh := map[string][]string{}
+	for user, userTopics := range topics {
+		for _, topic := range userTopics {
+			key := strings.Join([]string{application, channelID, messageID, user, topic}, "/")
+			if !f.notified[key] {
+				f.notified[key] = true
+				fresh[user] = append(fresh[user], topic)
+			}
+		}
+	}
+	return fresh, nil
+}
+
+func (f *fakeStorage) getUserSettings(user string) (UserSettings, error) {
+	return f.settings[user], nil
+}
+
+func (f *fakeStorage) isMuted(string, string, Application) (bool, error) {
+	return false, nil
+}
+
+func (f *fakeStorage) addDelayedMessage(message Message) error {
+	f.delayed = append(f.delayed, message)
+	return nil
+}
+
+func (f *fakeStorage) addDigestMessage(message Message) error {
+	f.digested = append(f.digested, message)
+	return nil
+}
+
+func (f *fakeStorage) enqueueJob(job Job, at time.Time) (int64, error) {
+	job.ID = int64(len(f.jobs) + 1)
+	f.jobs = append(f.jobs, job)
+	return job.ID, nil
+}
+
+func (f *fakeStorage) getApplication(string) (Application, error) {
+	return Telegram, nil
+}
+
+func (f *fakeStorage) ensureDigestNext(string, time.Time) error {
+	return nil
+}
+
+// fakeAnalyzer finds the topics contained in the text.
+type fakeAnalyzer struct {
+	API
+	err error
+}
+
+func (a fakeAnalyzer) analyze(msg string, topics []string) ([]string, error) {
+	if a.err != nil {
+		return nil, a.err
+	}
+	var found []string
+	for _, topic := range topics {
+		if strings.Contains(strings.ToLower(msg), topic) {
+			found = append(found, topic)
+		}
+	}
+	return found, nil
+}
+
+// fakeSource produces events the way the listener of its platform does.
+type fakeSource struct {
+	application Application
+	channel     string
+	channelID   string
+	key         string
+}
+
+func (s fakeSource) event(id, text string) workEvent {
+	return workEvent{
+		application: s.application,
+		channel:     s.channel,
+		channelID:   s.channelID,
+		key:         s.key,
+		text:        text,
+		link:        s.application + "/" + s.channelID + "/" + id,
+		messageID:   id,
+	}
+}
+
+var (
+	telegramChannel   = fakeSource{application: Telegram, channel: "spbu_news", channelID: "-1001", key: "spbu_news"}
+	vkChannel         = fakeSource{application: VK, channel: "СПбГУ", channelID: "42", key: "42"}
+	mattermostChannel = fakeSource{application: MatterMost, channel: "town-square", channelID: "ch1", key: "ch1"}
+)
+
+func newTestPipeline(storage *fakeStorage, sent *[]Message) *pipeline {
+	p := newPipeline(storage, fakeAnalyzer{}, "")
+	p.send = func(_ context.Context, n notification) {
+		*sent = append(*sent, n.message)
+	}
+	p.finish = func(Job, error) {}
+	p.delivers = func(DestinationKind) bool { return true }
+	return p
+}
+
+func TestPipelineSources(t *testing.T) {
+	storage := newFakeStorage()
+	for _, source := range []fakeSource{telegramChannel, vkChannel, mattermostChannel} {
+		storage.subscribe("alice", source.key, "deadline", source.application, PriorityNormal)
+	}
+	var sent []Message
+	p := newTestPipeline(storage, &sent)
+
+	for _, source := range []fakeSource{telegramChannel, vkChannel, mattermostChannel} {
+		sent = nil
+		if err := p.handle(context.Background(), source.event("1", "The deadline is moved")); err != nil {
+			t.Fatal(err)
+		}
+		if len(sent) != 1 {
+			t.Fatalf("%s: sent %d messages, want 1", source.application, len(sent))
+		}
+		msg := sent[0]
+		if msg.User != "alice" || msg.Application != source.application || msg.Channel != source.channel ||
+			msg.ChannelID != source.key || msg.Topic != "deadline" || msg.Link != source.event("1", "").link {
+			t.Errorf("%s: sent %+v", source.application, msg)
+		}
+
+		sent = nil
+		if err := p.handle(context.Background(), source.event("2", "Nothing to see")); err != nil {
+			t.Fatal(err)
+		}
+		if len(sent) != 0 {
+			t.Errorf("%s: sent %d messages for an unmatched post", source.application, len(sent))
+		}
+	}
+}
+
+func TestPipelineSkipsUnknownAndNotified(t *testing.T) {
+	storage := newFakeStorage()
+	storage.subscribe("alice", telegramChannel.key, "exam", Telegram, PriorityNormal)
+	var sent []Message
+	p := newTestPipeline(storage, &sent)
+
+	event := telegramChannel.event("7", "exam tomorrow")
+	for i := 0; i < 2; i++ {
+		if err := p.handle(context.Background(), event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.handle(context.Background(), vkChannel.event("7", "exam tomorrow")); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 1 {
+		t.Errorf("sent %d messages, want 1", len(sent))
+	}
+}
+
+func TestPipelineSkipsForbidden(t *testing.T) {
+	mailboxes := newMailboxStorage()
+	mailboxes.states["math"] = Mailbox{Name: "math", Owner: "alice"}
+	withSources(t, map[string]Source{MailCode: &mailboxSource{storage: mailboxes}})
+	mailbox := fakeSource{application: Mail, channel: "math", channelID: "math", key: "math"}
+	storage := newFakeStorage()
+	for _, user := range []string{"alice", "eve"} {
+		storage.subscribe(user, mailbox.key, "exam", Mail, PriorityNormal)
+	}
+	var sent []Message
+	p := newTestPipeline(storage, &sent)
+
+	if err := p.handle(context.Background(), mailbox.event("1", "exam tomorrow")); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 1 || sent[0].User != "alice" {
+		t.Errorf("sent %+v, want a message to the owner only", sent)
+	}
+}
+
+func TestPipelineSuppressesOnce(t *testing.T) {
+	storage := newFakeStorage()
+	storage.subscribe("alice", telegramChannel.key, "exam", Telegram, PriorityNormal)
+	storage.subscribe("bob", telegramChannel.key, "exam", Telegram, PriorityNormal)
+	storage.cooling["bob"] = true
+	var sent []Message
+	p := newTestPipeline(storage, &sent)
+
+	event := telegramChannel.event("7", "exam tomorrow")
+	for i := 0; i < 2; i++ {
+		if err := p.handle(context.Background(), event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(sent) != 1 || sent[0].User != "alice" {
+		t.Errorf("sent %+v, want alice's only", sent)
+	}
+	if storage.suppressed["bob"] != 1 {
+		t.Errorf("suppressed %d matches of bob, want 1", storage.suppressed["bob"])
+	}
+}
+
+func TestPipelineEdits(t *testing.T) {
+	storage := newFakeStorage()
+	storage.subscribe("alice", telegramChannel.key, "exam", Telegram, PriorityNormal)
+	storage.subscribe("alice", telegramChannel.key, "deadline", Telegram, PriorityNormal)
+	storage.subscribe("bob", telegramChannel.key, "exam", Telegram, PriorityNormal)
+	var sent []Message
+	p := newTestPipeline(storage, &sent)
+
+	if err := p.handle(context.Background(), telegramChannel.event("7", "exam tomorrow")); err != nil {
+		t.Fatal(err)
+	}
+	sent = nil
+	edit := telegramChannel.event("7", "exam tomorrow, deadline today")
+	edit.edited = true
+	for i := 0; i < 2; i++ {
+		if err := p.handle(context.Background(), edit); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(sent) != 1 || sent[0].User != "alice" || sent[0].Topic != "deadline" {
+		t.Fatalf("sent %+v, want only the new topic of alice", sent)
+	}
+	if !strings.HasPrefix(sent[0].Summary, editedMark) {
+		t.Errorf("summary = %q, want the edited mark", sent[0].Summary)
+	}
+}
+
+func TestEventSummary(t *testing.T) {
+	event := telegramChannel.event("1", "exam")
+	event.forwardedFrom = "@dekanat"
+	if summary := eventSummary(event, "exam"); summary != "(forwarded from @dekanat) exam" {
+		t.Errorf("summary = %q", summary)
+	}
+	event.edited = true
+	if summary := eventSummary(event, "exam"); summary != "(edited) (forwarded from @dekanat) exam" {
+		t.Errorf("summary of an edit = %q", summary)
+	}
+}
+
+func TestPipelineDispatch(t *testing.T) {
+	storage := newFakeStorage()
+	storage.subscribe("paused", vkChannel.key, "exam", VK, PriorityNormal)
+	storage.subscribe("urgent", vkChannel.key, "exam", VK, PriorityHigh)
+	storage.subscribe("digest", vkChannel.key, "exam", VK, PriorityNormal)
+	storage.subscribe("low", vkChannel.key, "exam", VK, PriorityLow)
+	storage.settings["paused"] = UserSettings{Paused: true}
+	storage.settings["urgent"] = UserSettings{Paused: true}
+	storage.settings["digest"] = UserSettings{Digest: "hourly"}
+	var sent []Message
+	p := newTestPipeline(storage, &sent)
+
+	if err := p.handle(context.Background(), vkChannel.event("1", "exam")); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 1 || sent[0].User != "urgent" {
+		t.Errorf("sent %+v, want only the high priority one", sent)
+	}
+	if len(storage.delayed) != 1 || storage.delayed[0].User != "paused" {
+		t.Errorf("delayed %+v, want the paused user's", storage.delayed)
+	}
+	if len(storage.digested) != 2 {
+		t.Errorf("digested %+v, want the digest and the low priority user's", storage.digested)
+	}
+}
+
+func TestPipelineNotificationJobs(t *testing.T) {
+	storage := newFakeStorage()
+	storage.subscribe("paused", vkChannel.key, "exam", VK, PriorityNormal)
+	storage.subscribe("urgent", vkChannel.key, "exam", VK, PriorityHigh)
+	storage.settings["paused"] = UserSettings{Paused: true}
+	var sent []notification
+	var finished []Job
+	p := newPipeline(storage, fakeAnalyzer{}, "")
+	p.send = func(_ context.Context, n notification) { sent = append(sent, n) }
+	p.finish = func(job Job, _ error) { finished = append(finished, job) }
+	p.delivers = func(DestinationKind) bool { return true }
+
+	if err := p.handle(context.Background(), vkChannel.event("1", "exam")); err != nil {
+		t.Fatal(err)
+	}
+	if len(storage.jobs) != 2 {
+		t.Fatalf("enqueued %+v, want a job for each user", storage.jobs)
+	}
+	if len(sent) != 1 || sent[0].job == nil || sent[0].message.User != "urgent" {
+		t.Fatalf("sent %+v, want the urgent one with its job", sent)
+	}
+	if len(finished) != 1 || finished[0].ID == sent[0].job.ID {
+		t.Errorf("finished %+v, want the job of the delayed one", finished)
+	}
+}
+
+func TestPipelineHandsOverNotifications(t *testing.T) {
+	storage := newFakeStorage()
+	storage.subscribe("alice", vkChannel.key, "exam", VK, PriorityHigh)
+	var sent []Message
+	p := newTestPipeline(storage, &sent)
+	p.delivers = func(kind DestinationKind) bool { return kind != DestinationTelegram }
+
+	if err := p.handle(context.Background(), vkChannel.event("1", "exam")); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 0 {
+		t.Errorf("sent %+v without a notifier", sent)
+	}
+	if len(storage.jobs) != 1 || storage.jobs[0].Destination != DestinationTelegram {
+		t.Errorf("enqueued %+v, want a job for the Telegram process", storage.jobs)
+	}
+}
+
+func TestPipelineHistoryRequest(t *testing.T) {
+	storage := newFakeStorage()
+	storage.subscribe("alice", vkChannel.key, "exam", VK, PriorityNormal)
+	storage.settings["bob"] = UserSettings{Paused: true}
+	var sent []Message
+	p := newTestPipeline(storage, &sent)
+
+	event := vkChannel.event("3", "exam")
+	event.historyRequest = &historyRequest{user: "bob"}
+	if err := p.handle(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 1 || sent[0].User != "bob" {
+		t.Errorf("sent %+v, want the history to the requester", sent)
+	}
+}
+
+func TestPipelineAnalyzerFailure(t *testing.T) {
+	storage := newFakeStorage()
+	storage.subscribe("alice", mattermostChannel.key, "exam", MatterMost, PriorityNormal)
+	var sent []Message
+	p := newTestPipeline(storage, &sent)
+	p.analyzer = fakeAnalyzer{err: errors.New("analyzer is down")}
+
+	err := p.handle(context.Background(), mattermostChannel.event("1", "exam"))
+	if classify(err) != FailureAnalyzer {
+		t.Errorf("handle() = %v, want an analyzer failure", err)
+	}
+	if len(sent) != 0 {
+		t.Errorf("sent %+v after a failure", sent)
+	}
+}
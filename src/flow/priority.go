@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+type Priority = string
+
+const (
+	// PriorityHigh bypasses pauses, mutes, quiet hours and digests and is
+	// delivered with a notification sound.
+	PriorityHigh Priority = "high"
+	// PriorityNormal follows the settings of the user.
+	PriorityNormal Priority = "normal"
+	// PriorityLow only goes to the digest.
+	PriorityLow Priority = "low"
+
+	highPriorityMark = "❗ "
+)
+
+var wrongPriorityError = errors.New("Неправильный приоритет. Используйте high, normal или low")
+
+// defaultDigestSchedule delivers low priority matches of the users who
+// have not chosen a digest schedule.
+var defaultDigestSchedule = DigestSchedule{Kind: DigestDaily, Hour: 9}
+
+var priorityRanks = map[Priority]int{
+	PriorityLow:    0,
+	PriorityNormal: 1,
+	PriorityHigh:   2,
+}
+
+func parsePriority(s string) (Priority, error) {
+	priority := strings.ToLower(strings.TrimSpace(s))
+	if _, found := priorityRanks[priority]; !found {
+		return "", wrongPriorityError
+	}
+	return priority, nil
+}
+
+// maxPriority returns the highest of the priorities, an empty one is
+// normal.
+func maxPriority(a, b Priority) Priority {
+	if a == "" {
+		a = PriorityNormal
+	}
+	if b == "" {
+		b = PriorityNormal
+	}
+	if priorityRanks[b] > priorityRanks[a] {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParsePriority(t *testing.T) {
+	for given, answer := range map[string]Priority{
+		"high":    PriorityHigh,
+		" Normal": PriorityNormal,
+		"LOW":     PriorityLow,
+	} {
+		res, err := parsePriority(given)
+		if err != nil || res != answer {
+			t.Errorf("%q: got %q, %v but answer is %q", given, res, err, answer)
+		}
+	}
+	for _, given := range []string{"", "urgent", "1"} {
+		if _, err := parsePriority(given); err == nil {
+			t.Errorf("No error in parsing: %q", given)
+		}
+	}
+}
+
+func TestMaxPriority(t *testing.T) {
+	for _, tc := range []struct {
+		a, b, answer Priority
+	}{
+		{PriorityLow, PriorityHigh, PriorityHigh},
+		{PriorityHigh, PriorityNormal, PriorityHigh},
+		{PriorityLow, PriorityNormal, PriorityNormal},
+		{PriorityLow, PriorityLow, PriorityLow},
+		{"", PriorityLow, PriorityNormal},
+		{PriorityLow, "", PriorityNormal},
+	} {
+		if res := maxPriority(tc.a, tc.b); res != tc.answer {
+			t.Errorf("maxPriority(%q, %q) = %q but answer is %q", tc.a, tc.b, res, tc.answer)
+		}
+	}
+}
+
+func TestNewsTextPriority(t *testing.T) {
+	message := Message{Application: Telegram, Topic: "экзамен", Summary: "аудитория 405"}
+	if strings.HasPrefix(newsText(message), highPriorityMark) {
+		t.Errorf("Normal notification is marked: %s", newsText(message))
+	}
+	message.Priority = PriorityHigh
+	if !strings.HasPrefix(newsText(message), highPriorityMark) {
+		t.Errorf("High priority notification is not marked: %s", newsText(message))
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+var privateAddressError = errors.New("the address is not public")
+
+// lookupIPAddr resolves host names.
+var lookupIPAddr = net.DefaultResolver.LookupIPAddr
+
+// isPublicIP reports whether the bot may connect to ip on behalf of a
+// user: loopback, private, link-local and similar addresses reach the
+// services next to the bot.
+func isPublicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsMulticast() && !ip.IsUnspecified()
+}
+
+// checkPublicHost fails unless every address of host is public.
+func checkPublicHost(ctx context.Context, host string) error {
+	if ip := net.ParseIP(host); ip != nil {
+		if !isPublicIP(ip) {
+			return privateAddressError
+		}
+		return nil
+	}
+	addrs, err := lookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if !isPublicIP(addr.IP) {
+			return privateAddressError
+		}
+	}
+	return nil
+}
+
+// publicClient returns an HTTP client which connects to public addresses
+// only. The address is checked after it is resolved, so neither a
+// redirect nor a name resolving to another address reaches a private
+// one.
+func publicClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+				return privateAddressError
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// A proxy would be dialed instead of the address.
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
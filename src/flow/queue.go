@@ -0,0 +1,441 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type JobKind = string
+
+const (
+	// JobEvent is a workEvent to be handled by a worker.
+	JobEvent JobKind = "event"
+	// JobNotification is a Message to be dispatched to its user again
+	// after a failure.
+	JobNotification JobKind = "notification"
+)
+
+const (
+	// queueLease is for how long a claimed job is not claimed again. A job
+	// of a crashed process is retried after it.
+	queueLease = 10 * time.Minute
+	// queueBatch is the maximal number of jobs claimed at once.
+	queueBatch   = 2 * NWorkers
+	queuePeriod  = time.Second
+	maxJobErrLen = 1000
+)
+
+// Job is a unit of work stored in the work queue.
+type Job struct {
+	ID       int64
+	Kind     JobKind
+	Payload  []byte
+	Attempts int
+	// Destination is the kind of the destination of a notification job,
+	// which only the processes having its notifier claim. It is empty if
+	// any process may run the job.
+	Destination DestinationKind
+}
+
+// DeadLetter is a job which has failed for good.
+type DeadLetter struct {
+	ID       int64
+	Kind     JobKind
+	Payload  []byte
+	Attempts int
+	Class    FailureClass
+	Error    string
+	FailedAt time.Time
+}
+
+type FailureClass = string
+
+const (
+	FailureAnalyzer FailureClass = "analyzer"
+	FailureStorage  FailureClass = "storage"
+	FailureDelivery FailureClass = "delivery"
+	// FailurePermanent is not retried.
+	FailurePermanent FailureClass = "permanent"
+)
+
+// retryPolicy tells how many times a job is tried and how long to wait
+// before the next attempt. The delay doubles from base up to max.
+type retryPolicy struct {
+	attempts int
+	base     time.Duration
+	max      time.Duration
+}
+
+var retryPolicies = map[FailureClass]retryPolicy{
+	FailureAnalyzer:  {attempts: 10, base: 30 * time.Second, max: 30 * time.Minute},
+	FailureStorage:   {attempts: 20, base: 5 * time.Second, max: 5 * time.Minute},
+	FailureDelivery:  {attempts: 8, base: time.Minute, max: time.Hour},
+	FailurePermanent: {attempts: 1},
+}
+
+// backoff returns the delay before the attempt following the given
+// number of failed ones.
+func (p retryPolicy) backoff(failed int) time.Duration {
+	delay := p.base
+	for i := 1; i < failed && delay < p.max; i++ {
+		delay *= 2
+	}
+	if delay > p.max {
+		delay = p.max
+	}
+	return delay
+}
+
+// jobError is an error of a job with its failure class.
+type jobError struct {
+	class FailureClass
+	err   error
+}
+
+func (e *jobError) Error() string {
+	return fmt.Sprintf("%s: %s", e.class, e.err.Error())
+}
+
+func (e *jobError) Unwrap() error {
+	return e.err
+}
+
+// failure marks err with class; nil stays nil.
+func failure(class FailureClass, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &jobError{class: class, err: err}
+}
+
+// classify returns the failure class of err. Unmarked errors come from
+// the storage.
+func classify(err error) FailureClass {
+	var jobErr *jobError
+	if errors.As(err, &jobErr) {
+		return jobErr.class
+	}
+	return FailureStorage
+}
+
+// eventPayload is the stored form of a workEvent.
+type eventPayload struct {
+	Application Application `json:"application"`
+	Channel     string      `json:"channel"`
+	ChannelID   string      `json:"channel_id"`
+	Key         string      `json:"key,omitempty"`
+	Text        string      `json:"text"`
+	Link        string      `json:"link"`
+	MessageID   string      `json:"message_id"`
+	HistoryUser string      `json:"history_user,omitempty"`
+	Edited      bool        `json:"edited,omitempty"`
+	Forwarded   string      `json:"forwarded,omitempty"`
+}
+
+func encodeEvent(event workEvent) ([]byte, error) {
+	payload := eventPayload{
+		Application: event.application,
+		Channel:     event.channel,
+		ChannelID:   event.channelID,
+		Key:         event.key,
+		Text:        event.text,
+		Link:        event.link,
+		MessageID:   event.messageID,
+		Edited:      event.edited,
+		Forwarded:   event.forwardedFrom,
+	}
+	if event.historyRequest != nil {
+		payload.HistoryUser = event.historyRequest.user
+	}
+	return json.Marshal(payload)
+}
+
+func decodeEvent(data []byte) (workEvent, error) {
+	var payload eventPayload
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return workEvent{}, err
+	}
+	event := workEvent{
+		application:   payload.Application,
+		channel:       payload.Channel,
+		channelID:     payload.ChannelID,
+		key:           payload.Key,
+		text:          payload.Text,
+		link:          payload.Link,
+		messageID:     payload.MessageID,
+		edited:        payload.Edited,
+		forwardedFrom: payload.Forwarded,
+	}
+	if payload.HistoryUser != "" {
+		event.historyRequest = &historyRequest{user: payload.HistoryUser}
+	}
+	if event.key == "" {
+		// Stored before the events had keys.
+		event.key = event.channel
+		if event.application == VK {
+			event.key = event.channelID
+		}
+	}
+	return event, nil
+}
+
+// eventChan returns the work channel of the event. Events of one channel
+// always go to the same worker.
+func eventChan(event workEvent) chan workEvent {
+	return workChans[getHash(event.application+event.channelID)%NWorkers]
+}
+
+// queueWake wakes queuePoller up when a job is enqueued.
+var queueWake = make(chan struct{}, 1)
+
+// enqueueEvent stores the event in the work queue. If the queue is not
+// available, the event is passed to a worker directly.
+func enqueueEvent(event workEvent) {
+	payload, err := encodeEvent(event)
+	if err == nil {
+		_, err = dataBase.enqueueJob(Job{Kind: JobEvent, Payload: payload}, time.Now())
+	}
+	if err != nil {
+		log.Printf("can't enqueue an event, handling it without the queue: %s", err.Error())
+		eventChan(event) <- event
+		return
+	}
+	wakeQueue()
+}
+
+// wakeQueue makes queuePoller look for due jobs without waiting.
+func wakeQueue() {
+	select {
+	case queueWake <- struct{}{}:
+	default:
+	}
+}
+
+// queuePoller passes the due jobs of the work queue to the workers and
+// the sender until ctx is done.
+func queuePoller(ctx context.Context) {
+	ticker := time.NewTicker(queuePeriod)
+	defer ticker.Stop()
+	for ctx.Err() == nil {
+		jobs, err := dataBase.claimJobs(queueBatch, queueLease, notifierKinds())
+		if err != nil {
+			log.Println(err.Error())
+		}
+		for _, job := range jobs {
+			runJob(ctx, job)
+		}
+		if len(jobs) == queueBatch {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-queueWake:
+		}
+	}
+}
+
+func runJob(ctx context.Context, job Job) {
+	switch job.Kind {
+	case JobEvent:
+		event, err := decodeEvent(job.Payload)
+		if err != nil {
+			finishJob(job, failure(FailurePermanent, err))
+			return
+		}
+		event.job = &job
+		eventChan(event) <- event
+	case JobNotification:
+		var message Message
+		if err := json.Unmarshal(job.Payload, &message); err != nil {
+			finishJob(job, failure(FailurePermanent, err))
+			return
+		}
+		events.deliver(ctx, notification{message: message, job: &job})
+	default:
+		finishJob(job, failure(FailurePermanent, fmt.Errorf("unknown job kind %q", job.Kind)))
+	}
+}
+
+// finishJob removes a successful job from the queue. A failed one is
+// scheduled for a retry according to the policy of its failure class or
+// moved to the dead letters.
+func finishJob(job Job, err error) {
+	if err == nil {
+		if job.ID != 0 {
+			err = dataBase.completeJob(job.ID)
+		}
+		if err != nil {
+			log.Println(err.Error())
+		}
+		return
+	}
+
+	class := classify(err)
+	policy := retryPolicies[class]
+	job.Attempts++
+	text := err.Error()
+	if runes := []rune(text); len(runes) > maxJobErrLen {
+		text = string(runes[:maxJobErrLen])
+	}
+	log.Printf("%s job %d failed, attempt %d: %s", job.Kind, job.ID, job.Attempts, text)
+
+	switch {
+	case job.Attempts >= policy.attempts:
+		err = dataBase.buryJob(job, class, text)
+	case job.ID == 0:
+		_, err = dataBase.enqueueJob(job, time.Now().Add(policy.backoff(job.Attempts)))
+	default:
+		err = dataBase.retryJob(job.ID, job.Attempts, time.Now().Add(policy.backoff(job.Attempts)), text)
+	}
+	if err != nil {
+		log.Printf("%s job %d is lost: %s", job.Kind, job.ID, err.Error())
+	}
+}
+
+// retryNotification queues a failed delivery of message for a retry.
+func retryNotification(message Message, err error) {
+	job, jobErr := notificationJob(dataBase, message)
+	if jobErr != nil {
+		log.Println(jobErr.Error())
+		return
+	}
+	finishJob(job, err)
+}
+
+// handOverNotification queues message for a process which has the
+// notifier of its destination.
+func handOverNotification(message Message) {
+	job, err := notificationJob(dataBase, message)
+	if err == nil {
+		_, err = dataBase.enqueueJob(job, time.Now())
+	}
+	if err != nil {
+		log.Printf("notification for %s is lost: %s", message.User, err.Error())
+	}
+}
+
+// enqueueNotification stores the notification job of message. If the
+// process delivers to its destination, the job is leased to it and local
+// is true: the process delivers it right away, and if it crashes first,
+// another one runs the job when the lease is over. Otherwise the job is
+// due at once for the processes which have the notifier.
+func enqueueNotification(s LocalStorage, message Message,
+	delivers func(kind DestinationKind) bool) (n notification, local bool, err error) {
+	job, err := notificationJob(s, message)
+	if err != nil {
+		return notification{}, false, err
+	}
+	if !delivers(job.Destination) {
+		_, err = s.enqueueJob(job, time.Now())
+		return notification{}, false, err
+	}
+	if job.ID, err = s.enqueueJob(job, time.Now().Add(queueLease)); err != nil {
+		return notification{}, false, err
+	}
+	return notification{message: message, job: &job}, true, nil
+}
+
+// notificationJob returns the work queue job of message, routed to the
+// kind of its destination.
+func notificationJob(s LocalStorage, message Message) (Job, error) {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return Job{}, err
+	}
+	destination, err := messageDestination(s, message)
+	if err != nil {
+		return Job{}, err
+	}
+	return Job{Kind: JobNotification, Payload: payload, Destination: destination}, nil
+}
+
+// formatDeadLetters renders dead letters for the admin.
+func formatDeadLetters(letters []DeadLetter) string {
+	if len(letters) == 0 {
+		return "Неудавшихся задач нет"
+	}
+	str := strings.Builder{}
+	for _, letter := range letters {
+		str.WriteString(fmt.Sprintf("#%d %s, %s, попыток: %d, %s\n",
+			letter.ID, letter.Kind, letter.Class, letter.Attempts, letter.FailedAt.Local().Format(historyTimeFormat)))
+		switch letter.Kind {
+		case JobEvent:
+			if event, err := decodeEvent(letter.Payload); err == nil {
+				str.WriteString(fmt.Sprintf("%s %s %s\n", event.application, event.channel, event.link))
+			}
+		case JobNotification:
+			var message Message
+			if err := json.Unmarshal(letter.Payload, &message); err == nil {
+				str.WriteString(fmt.Sprintf("%s [%s] %s\n", message.User, message.Topic, message.Link))
+			}
+		}
+		str.WriteString(letter.Error + "\n\n")
+	}
+	return str.String()
+}
+
+var deadLetterNotFoundError = errors.New("Такой неудавшейся задачи нет")
+
+// adminsEnv lists the comma-separated users allowed to inspect and replay
+// dead letters.
+const adminsEnv = "TOPIC_KEEPER_ADMINS"
+
+func isAdmin(user string) bool {
+	for _, admin := range strings.Split(os.Getenv(adminsEnv), ",") {
+		if admin = strings.TrimSpace(admin); admin != "" && admin == user {
+			return true
+		}
+	}
+	return false
+}
+
+// showDeadLetters renders the latest dead letters, arg is their optional
+// number.
+func showDeadLetters(arg string) (string, error) {
+	limit, err := parseHistoryLimit(arg)
+	if err != nil {
+		return "", err
+	}
+	letters, err := dataBase.getDeadLetters(limit)
+	if err != nil {
+		return "", err
+	}
+	return formatDeadLetters(letters), nil
+}
+
+// replay moves the dead letter with the id given in arg, or every one for
+// "all", back to the work queue.
+func replay(arg string) (string, error) {
+	arg = strings.ToLower(strings.TrimSpace(arg))
+	var reply string
+	if arg == "all" {
+		n, err := dataBase.replayDeadLetters()
+		if err != nil {
+			return "", err
+		}
+		reply = fmt.Sprintf("Возвращено в очередь задач: %d", n)
+	} else {
+		id, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			return "", wrongFmtError
+		}
+		if err := dataBase.replayDeadLetter(id); errors.Is(err, sql.ErrNoRows) {
+			return "", deadLetterNotFoundError
+		} else if err != nil {
+			return "", err
+		}
+		reply = fmt.Sprintf("Задача #%d возвращена в очередь", id)
+	}
+	wakeQueue()
+	return reply, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	policy := retryPolicy{attempts: 10, base: time.Second, max: 10 * time.Second}
+	for failed, want := range map[int]time.Duration{
+		1:  time.Second,
+		2:  2 * time.Second,
+		3:  4 * time.Second,
+		4:  8 * time.Second,
+		5:  10 * time.Second,
+		30: 10 * time.Second,
+	} {
+		if got := policy.backoff(failed); got != want {
+			t.Errorf("backoff(%d) = %s, want %s", failed, got, want)
+		}
+	}
+}
+
+func TestClassify(t *testing.T) {
+	cause := errors.New("boom")
+	if failure(FailureAnalyzer, nil) != nil {
+		t.Error("failure(nil) is not nil")
+	}
+	if got := classify(cause); got != FailureStorage {
+		t.Errorf("classify(plain) = %s, want %s", got, FailureStorage)
+	}
+	marked := failure(FailureDelivery, cause)
+	if got := classify(marked); got != FailureDelivery {
+		t.Errorf("classify(marked) = %s, want %s", got, FailureDelivery)
+	}
+	if !errors.Is(marked, cause) {
+		t.Error("marked error does not wrap its cause")
+	}
+	if got := retryPolicies[FailurePermanent].attempts; got != 1 {
+		t.Errorf("permanent failures are tried %d times", got)
+	}
+}
+
+func TestEventPayloadRoundTrip(t *testing.T) {
+	for _, event := range []workEvent{
+		{application: Telegram, channel: "news", channelID: "-100", text: "hi", link: "l", messageID: "1"},
+		{application: Telegram, channel: "news", channelID: "-100", messageID: "2", edited: true, forwardedFrom: "@club"},
+		{application: VK, channel: "club", channelID: "42", messageID: "7", historyRequest: &historyRequest{user: "bob"}},
+	} {
+		payload, err := encodeEvent(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := decodeEvent(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.application != event.application || got.channel != event.channel ||
+			got.channelID != event.channelID || got.text != event.text || got.link != event.link ||
+			got.messageID != event.messageID || got.edited != event.edited || got.forwardedFrom != event.forwardedFrom {
+			t.Errorf("decodeEvent(encodeEvent(%+v)) = %+v", event, got)
+		}
+		if (got.historyRequest == nil) != (event.historyRequest == nil) ||
+			got.historyRequest != nil && got.historyRequest.user != event.historyRequest.user {
+			t.Errorf("history request of %+v is lost", event)
+		}
+	}
+}
+
+func TestFormatDeadLetters(t *testing.T) {
+	if got := formatDeadLetters(nil); got != "Неудавшихся задач нет" {
+		t.Errorf("formatDeadLetters(nil) = %q", got)
+	}
+	payload, _ := encodeEvent(workEvent{application: VK, channel: "club", link: "https://vk.com/wall-1_2"})
+	got := formatDeadLetters([]DeadLetter{
+		{ID: 3, Kind: JobEvent, Payload: payload, Attempts: 10, Class: FailureAnalyzer, Error: "timeout"},
+		{ID: 4, Kind: JobNotification, Payload: []byte(`{"user":"bob","topic":"go","link":"l"}`),
+			Attempts: 1, Class: FailurePermanent, Error: "blocked"},
+	})
+	for _, want := range []string{"#3 event, analyzer, попыток: 10", "https://vk.com/wall-1_2", "timeout",
+		"#4 notification, permanent", "bob [go] l", "blocked"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("formatDeadLetters() = %q, want it to contain %q", got, want)
+		}
+	}
+}
+
+func TestIsAdmin(t *testing.T) {
+	t.Setenv(adminsEnv, "alice, bob")
+	for user, want := range map[string]bool{"alice": true, "bob": true, "eve": false, "": false} {
+		if got := isAdmin(user); got != want {
+			t.Errorf("isAdmin(%q) = %t, want %t", user, got, want)
+		}
+	}
+}
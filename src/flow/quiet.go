@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	_ "time/tzdata"
+)
+
+var wrongQuietHoursError = errors.New(
+	"Неправильные тихие часы. Используйте off или ЧЧ:ММ-ЧЧ:ММ, например 23:00-08:00")
+
+var wrongTimezoneError = errors.New(
+	"Неизвестный часовой пояс. Используйте название из базы IANA, например Europe/Moscow")
+
+// QuietHours is a daily interval of the wall clock time during which
+// instant notifications are held. The interval may cross midnight.
+type QuietHours struct {
+	// Start and End are minutes since midnight.
+	Start int
+	End   int
+}
+
+// parseQuietHours parses an interval in the HH:MM-HH:MM format.
+func parseQuietHours(s string) (QuietHours, error) {
+	s = strings.ReplaceAll(strings.TrimSpace(s), "–", "-")
+	from, to, found := strings.Cut(s, "-")
+	if !found {
+		return QuietHours{}, wrongQuietHoursError
+	}
+	startHour, startMinute, err := parseClock(strings.TrimSpace(from))
+	if err != nil {
+		return QuietHours{}, wrongQuietHoursError
+	}
+	endHour, endMinute, err := parseClock(strings.TrimSpace(to))
+	if err != nil {
+		return QuietHours{}, wrongQuietHoursError
+	}
+	quiet := QuietHours{Start: startHour*60 + startMinute, End: endHour*60 + endMinute}
+	if quiet.Start == quiet.End {
+		return QuietHours{}, wrongQuietHoursError
+	}
+	return quiet, nil
+}
+
+func (q QuietHours) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", q.Start/60, q.Start%60, q.End/60, q.End%60)
+}
+
+// contains tells whether the wall clock time of t is inside the interval.
+func (q QuietHours) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	if q.Start < q.End {
+		return q.Start <= minute && minute < q.End
+	}
+	return minute >= q.Start || minute < q.End
+}
+
+// location returns the timezone of the user, the server one if it is not
+// set.
+func (s UserSettings) location() *time.Location {
+	if s.Timezone == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+// isQuiet tells whether now is inside the quiet hours of the user.
+func (s UserSettings) isQuiet(now time.Time) bool {
+	if s.QuietHours == "" {
+		return false
+	}
+	quiet, err := parseQuietHours(s.QuietHours)
+	if err != nil {
+		return false
+	}
+	return quiet.contains(now.In(s.location()))
+}
+
+// changeTimezone shows or changes the timezone of the user according to
+// the command argument and returns the reply. The next digest is moved
+// to the new timezone.
+func changeTimezone(user, arg string) (string, error) {
+	arg = strings.TrimSpace(arg)
+	settings, err := dataBase.getUserSettings(user)
+	if err != nil {
+		return "", err
+	}
+	if arg == "" {
+		if settings.Timezone == "" {
+			return "Часовой пояс не задан, используется " + time.Local.String(), nil
+		}
+		return "Часовой пояс: " + settings.Timezone, nil
+	}
+
+	// LoadLocation accepts "" and "Local" which are not IANA names.
+	loc, err := time.LoadLocation(arg)
+	if err != nil || arg == "Local" {
+		return "", wrongTimezoneError
+	}
+	err = dataBase.inTx(func(s LocalStorage) error {
+		if err := s.setTimezone(user, loc.String()); err != nil {
+			return err
+		}
+		if settings.Digest == "" {
+			return nil
+		}
+		schedule, err := parseDigestSchedule(settings.Digest)
+		if err != nil {
+			return err
+		}
+		next := schedule.next(time.Now().In(loc))
+		return s.setDigestNext(user, &next)
+	})
+	if err != nil {
+		return "", err
+	}
+	return "Часовой пояс: " + loc.String(), nil
+}
+
+// changeQuietHours shows or changes the quiet hours of the user
+// according to the command argument and returns the reply.
+func changeQuietHours(user, arg string) (string, error) {
+	arg = strings.TrimSpace(arg)
+	switch strings.ToLower(arg) {
+	case "":
+		settings, err := dataBase.getUserSettings(user)
+		if err != nil {
+			return "", err
+		}
+		if settings.QuietHours == "" {
+			return "Тихие часы не заданы", nil
+		}
+		return fmt.Sprintf("Тихие часы: %s (%s)", settings.QuietHours, settings.location()), nil
+	case "off":
+		if err := dataBase.setQuietHours(user, ""); err != nil {
+			return "", err
+		}
+		return "Тихие часы выключены", nil
+	}
+
+	quiet, err := parseQuietHours(arg)
+	if err != nil {
+		return "", err
+	}
+	if err := dataBase.setQuietHours(user, quiet.String()); err != nil {
+		return "", err
+	}
+	settings, err := dataBase.getUserSettings(user)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Тихие часы: %s (%s). Уведомления за это время придут после их окончания",
+		quiet, settings.location()), nil
+}
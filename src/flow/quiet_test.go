@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseQuietHours(t *testing.T) {
+	for _, tc := range []struct {
+		given  string
+		answer QuietHours
+	}{
+		{"23:00-08:00", QuietHours{Start: 23 * 60, End: 8 * 60}},
+		{"23:00–08:00", QuietHours{Start: 23 * 60, End: 8 * 60}},
+		{" 13:30 - 14:15 ", QuietHours{Start: 13*60 + 30, End: 14*60 + 15}},
+	} {
+		res, err := parseQuietHours(tc.given)
+		if err != nil {
+			t.Errorf("Error (%s) in parsing: %q", err.Error(), tc.given)
+		}
+		if res != tc.answer {
+			t.Errorf("Got %v but answer is %v", res, tc.answer)
+		}
+	}
+
+	for _, given := range []string{"", "23:00", "23:00-23:00", "25:00-08:00", "23:00-8", "night"} {
+		if _, err := parseQuietHours(given); err == nil {
+			t.Errorf("No error in parsing: %q", given)
+		}
+	}
+}
+
+func TestUserSettingsIsQuiet(t *testing.T) {
+	overnight := UserSettings{Timezone: "Europe/Berlin", QuietHours: "23:00-08:00"}
+	daytime := UserSettings{Timezone: "Europe/Berlin", QuietHours: "13:00-14:00"}
+	for _, tc := range []struct {
+		settings UserSettings
+		now      time.Time
+		answer   bool
+	}{
+		{UserSettings{}, time.Date(2026, 1, 1, 3, 0, 0, 0, time.UTC), false},
+		{daytime, time.Date(2026, 1, 1, 12, 30, 0, 0, time.UTC), true},
+		{daytime, time.Date(2026, 1, 1, 13, 0, 0, 0, time.UTC), false},
+		// 22:30 UTC is 23:30 CET.
+		{overnight, time.Date(2026, 1, 1, 22, 30, 0, 0, time.UTC), true},
+		{overnight, time.Date(2026, 1, 1, 21, 59, 0, 0, time.UTC), false},
+		// Clocks go forward on 2026-03-29 at 02:00 CET: 06:30 UTC is 07:30
+		// CET the day before and 08:30 CEST that day.
+		{overnight, time.Date(2026, 3, 28, 6, 30, 0, 0, time.UTC), true},
+		{overnight, time.Date(2026, 3, 29, 6, 30, 0, 0, time.UTC), false},
+		{overnight, time.Date(2026, 3, 29, 5, 59, 0, 0, time.UTC), true},
+		// Clocks go back on 2026-10-25 at 03:00 CEST: 06:30 UTC is 08:30
+		// CEST the day before and 07:30 CET that day.
+		{overnight, time.Date(2026, 10, 24, 6, 30, 0, 0, time.UTC), false},
+		{overnight, time.Date(2026, 10, 25, 6, 30, 0, 0, time.UTC), true},
+	} {
+		if res := tc.settings.isQuiet(tc.now); res != tc.answer {
+			t.Errorf("%v at %s: got %t but answer is %t", tc.settings, tc.now, res, tc.answer)
+		}
+	}
+}
+
+func TestDigestScheduleNextDST(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	daily := DigestSchedule{Kind: DigestDaily, Hour: 9}
+	hourly := DigestSchedule{Kind: DigestHourly}
+	for _, tc := range []struct {
+		schedule DigestSchedule
+		after    time.Time
+		answer   time.Time
+	}{
+		// The day before the change is 23 hours long in the spring and 25
+		// hours long in the autumn, the wall clock time stays the same.
+		{daily, time.Date(2026, 3, 28, 10, 0, 0, 0, loc), time.Date(2026, 3, 29, 7, 0, 0, 0, time.UTC)},
+		{daily, time.Date(2026, 10, 24, 10, 0, 0, 0, loc), time.Date(2026, 10, 25, 8, 0, 0, 0, time.UTC)},
+		// 01:30 CET is followed by 03:00 CEST.
+		{hourly, time.Date(2026, 3, 29, 1, 30, 0, 0, loc), time.Date(2026, 3, 29, 1, 0, 0, 0, time.UTC)},
+		// 02:30 CEST is followed by 02:00 CET.
+		{hourly, time.Date(2026, 10, 25, 0, 30, 0, 0, time.UTC), time.Date(2026, 10, 25, 1, 0, 0, 0, time.UTC)},
+	} {
+		if res := tc.schedule.next(tc.after); !res.Equal(tc.answer) {
+			t.Errorf("%s after %s: got %s but answer is %s", tc.schedule, tc.after, res.UTC(), tc.answer)
+		}
+	}
+}
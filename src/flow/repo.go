@@ -0,0 +1,520 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	GitCode     = "GIT"
+	githubHost  = "github.com"
+	githubAPI   = "https://api.github.com"
+	repoPeriod  = 5 * time.Minute
+	repoTimeout = 30 * time.Second
+	// repoPageSize is the number of items of a kind read in one poll.
+	repoPageSize = 100
+	// maxRepoResponse limits the size of an API response.
+	maxRepoResponse = 10 << 20
+)
+
+var (
+	wrongRepoError = errors.New(
+		"Неправильная ссылка на репозиторий. Используйте https://github.com/владелец/репозиторий или ссылку на проект GitLab")
+	repoNotFoundError = errors.New("Репозиторий не найден или закрыт")
+	gitlabHostError   = errors.New("Этот сервер GitLab не поддерживается")
+	privateRepoError  = errors.New("Репозиторий закрыт. Подписаться на него можно, только если его разрешил администратор")
+)
+
+// RepoState is what is known about a polled repository.
+type RepoState struct {
+	Repo string
+	// Since is the latest update of the items read so far.
+	Since time.Time
+	// ETags make the next requests of each kind of items conditional.
+	ETags map[string]string
+}
+
+// repoItem is an issue, a pull or merge request or a comment.
+type repoItem struct {
+	id      string
+	link    string
+	text    string
+	created time.Time
+	updated time.Time
+}
+
+// repoEndpoint lists one kind of items of a repository updated since a
+// time, the oldest first.
+type repoEndpoint struct {
+	kind  string
+	url   string
+	parse func(data []byte) ([]repoItem, error)
+}
+
+// repoSource polls the issues, pull requests and comments of the
+// subscribed GitHub and GitLab repositories. Repositories are
+// subscribed to as host/path, e.g. github.com/spbu/course; the hosts
+// but GitHub are the allowed GitLabs.
+type repoSource struct {
+	client  *http.Client
+	storage LocalStorage
+	// enqueue passes an event to the pipeline.
+	enqueue func(workEvent)
+
+	githubAPI   string
+	githubToken string
+	// gitlabTokens are the tokens of the allowed GitLab hosts, empty for
+	// a host read without one.
+	gitlabTokens map[string]string
+	// gitlabScheme is the scheme of the GitLab APIs.
+	gitlabScheme string
+	// privateRepos are the repositories which are not public but may be
+	// subscribed to.
+	privateRepos map[string]bool
+}
+
+// newRepoSource takes the GitHub token from TOPIC_KEEPER_GITHUB_TOKEN
+// and the allowed GitLab hosts, gitlab.com by default, from the
+// comma-separated TOPIC_KEEPER_GITLAB_HOSTS, each as host or host=token.
+// Public repositories are read without tokens, with a lower rate limit;
+// the rest have to be listed by an admin in TOPIC_KEEPER_PRIVATE_REPOS.
+func newRepoSource(storage LocalStorage) *repoSource {
+	gitlabHosts := os.Getenv("TOPIC_KEEPER_GITLAB_HOSTS")
+	if gitlabHosts == "" {
+		gitlabHosts = "gitlab.com"
+	}
+	gitlabTokens := make(map[string]string)
+	for _, entry := range strings.Split(gitlabHosts, ",") {
+		host, token, _ := strings.Cut(strings.TrimSpace(entry), "=")
+		if host != "" {
+			gitlabTokens[strings.ToLower(host)] = token
+		}
+	}
+	privateRepos := make(map[string]bool)
+	for _, repo := range strings.Split(os.Getenv("TOPIC_KEEPER_PRIVATE_REPOS"), ",") {
+		if host, path, err := parseRepo(strings.TrimSpace(repo)); err == nil {
+			privateRepos[host+"/"+path] = true
+		}
+	}
+	return &repoSource{
+		client:       &http.Client{Timeout: repoTimeout, CheckRedirect: dropTokens},
+		storage:      storage,
+		enqueue:      enqueueEvent,
+		githubAPI:    githubAPI,
+		githubToken:  os.Getenv("TOPIC_KEEPER_GITHUB_TOKEN"),
+		gitlabTokens: gitlabTokens,
+		gitlabScheme: "https",
+		privateRepos: privateRepos,
+	}
+}
+
+// dropTokens keeps the tokens from a redirect to another host: unlike
+// Authorization, PRIVATE-TOKEN is not dropped by the client itself.
+func dropTokens(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	if req.URL.Host != via[0].URL.Host {
+		req.Header.Del("Authorization")
+		req.Header.Del("PRIVATE-TOKEN")
+	}
+	return nil
+}
+
+// checkHost fails unless the repositories of host are read.
+func (s *repoSource) checkHost(host string) error {
+	if _, allowed := s.gitlabTokens[host]; host != githubHost && !allowed {
+		return gitlabHostError
+	}
+	return nil
+}
+
+// parseRepo returns the repository of a link as host/path.
+func parseRepo(link string) (host, path string, err error) {
+	if !strings.Contains(link, "://") {
+		link = "https://" + link
+	}
+	u, err := url.Parse(link)
+	if err != nil || u.Host == "" {
+		return "", "", wrongRepoError
+	}
+	host = strings.ToLower(strings.TrimPrefix(u.Host, "www."))
+	// GitLab pages of a project are under /-/.
+	path, _, _ = strings.Cut(strings.Trim(u.Path, "/"), "/-/")
+	path = strings.TrimSuffix(path, ".git")
+	parts := strings.Split(path, "/")
+	if host == githubHost && len(parts) > 2 {
+		// Issues, pulls and the like of a GitHub repository.
+		parts = parts[:2]
+	}
+	if len(parts) < 2 {
+		return "", "", wrongRepoError
+	}
+	for _, part := range parts {
+		if part == "" {
+			return "", "", wrongRepoError
+		}
+	}
+	return host, strings.Join(parts, "/"), nil
+}
+
+func (s *repoSource) handleUpdates(ctx context.Context) {
+	pollLoop(ctx, s.storage, Git, repoPeriod, s.poll)
+}
+
+// poll passes the items created since the last poll to the pipeline.
+// The items are read by their updates; if a kind has more updates than
+// fit in a poll, the next poll goes on from its last one.
+func (s *repoSource) poll(ctx context.Context, repo string) error {
+	state, err := s.storage.getRepo(repo)
+	if err != nil {
+		return err
+	}
+	host, path, err := parseRepo(repo)
+	if err != nil {
+		return err
+	}
+	if err := s.checkHost(host); err != nil {
+		return err
+	}
+	next := RepoState{Repo: repo, Since: state.Since, ETags: make(map[string]string)}
+	// The repository may have been closed since the last poll.
+	if next.ETags["project"], err = s.checkProject(ctx, host, path, state.ETags["project"]); err != nil {
+		return err
+	}
+	var limit time.Time
+	for _, endpoint := range s.endpoints(host, path, state.Since) {
+		items, etag, err := s.fetch(ctx, endpoint.url, state.ETags[endpoint.kind], endpoint.parse)
+		if err != nil {
+			return err
+		}
+		next.ETags[endpoint.kind] = etag
+		var last time.Time
+		for _, item := range items {
+			if item.created.After(state.Since) {
+				s.enqueue(repoEvent(repo, item))
+			}
+			if item.updated.After(last) {
+				last = item.updated
+			}
+		}
+		if last.After(next.Since) {
+			next.Since = last
+		}
+		if len(items) == repoPageSize && (limit.IsZero() || last.Before(limit)) {
+			limit = last
+		}
+	}
+	if !limit.IsZero() && next.Since.After(limit) {
+		next.Since = limit
+	}
+	return s.storage.saveRepo(next)
+}
+
+// fetch gets a list of items unless it has not changed since its etag,
+// in which case the items are nil. It returns the etag of the list.
+func (s *repoSource) fetch(ctx context.Context, u, etag string, parse func([]byte) ([]repoItem, error)) ([]repoItem, string, error) {
+	resp, err := s.get(ctx, u, etag)
+	if err != nil {
+		return nil, etag, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, etag, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, etag, fmt.Errorf("%s responded with %s", u, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxRepoResponse))
+	if err != nil {
+		return nil, etag, err
+	}
+	items, err := parse(data)
+	return items, resp.Header.Get("ETag"), err
+}
+
+func (s *repoSource) get(ctx context.Context, u, etag string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	// Each token is sent to its own host only.
+	if strings.HasPrefix(u, s.githubAPI+"/") {
+		req.Header.Set("Accept", "application/vnd.github+json")
+		if s.githubToken != "" {
+			req.Header.Set("Authorization", "Bearer "+s.githubToken)
+		}
+	} else if token := s.gitlabTokens[req.URL.Host]; token != "" && req.URL.Scheme == s.gitlabScheme {
+		req.Header.Set("PRIVATE-TOKEN", token)
+	}
+	return s.client.Do(req)
+}
+
+// checkProject fails unless the repository exists and either is public
+// or is allowed by an admin. It is not checked again until the project
+// changes since etag; the etag of the project is returned.
+func (s *repoSource) checkProject(ctx context.Context, host, path, etag string) (string, error) {
+	resp, err := s.get(ctx, s.projectURL(host, path), etag)
+	if err != nil {
+		return etag, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		return etag, nil
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusUnauthorized ||
+		resp.StatusCode == http.StatusForbidden:
+		return etag, repoNotFoundError
+	case resp.StatusCode != http.StatusOK:
+		return etag, fmt.Errorf("%s/%s responded with %s", host, path, resp.Status)
+	}
+	// GitHub marks a closed repository as private, GitLab tells
+	// internal and private projects by their visibility, which is
+	// omitted for an anonymous request of a public one.
+	var project struct {
+		Private    bool   `json:"private"`
+		Visibility string `json:"visibility"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxRepoResponse)).Decode(&project); err != nil {
+		return etag, err
+	}
+	public := !project.Private && (project.Visibility == "" || project.Visibility == "public")
+	if !public && !s.privateRepos[host+"/"+path] {
+		return etag, privateRepoError
+	}
+	return resp.Header.Get("ETag"), nil
+}
+
+// projectURL returns the API URL of the repository.
+func (s *repoSource) projectURL(host, path string) string {
+	if host == githubHost {
+		return s.githubAPI + "/repos/" + path
+	}
+	return fmt.Sprintf("%s://%s/api/v4/projects/%s", s.gitlabScheme, host, url.PathEscape(path))
+}
+
+// endpoints returns the lists of items of the repository updated since
+// a time.
+func (s *repoSource) endpoints(host, path string, since time.Time) []repoEndpoint {
+	project := s.projectURL(host, path)
+	if host == githubHost {
+		query := url.Values{
+			"since":     {since.UTC().Format(time.RFC3339)},
+			"sort":      {"updated"},
+			"direction": {"asc"},
+			"per_page":  {strconv.Itoa(repoPageSize)},
+		}
+		issues := url.Values{"state": {"all"}}
+		for key, value := range query {
+			issues[key] = value
+		}
+		return []repoEndpoint{
+			// Pull requests are listed as issues too.
+			{"issues", project + "/issues?" + issues.Encode(), parseGithubIssues},
+			{"comments", project + "/issues/comments?" + query.Encode(), parseGithubComments},
+			{"review_comments", project + "/pulls/comments?" + query.Encode(), parseGithubComments},
+		}
+	}
+	query := url.Values{
+		"updated_after": {since.UTC().Format(time.RFC3339)},
+		"order_by":      {"updated_at"},
+		"sort":          {"asc"},
+		"scope":         {"all"},
+		"per_page":      {strconv.Itoa(repoPageSize)},
+	}
+	// Events are filtered by day: after the day before since.
+	events := url.Values{
+		"action":   {"commented"},
+		"after":    {since.UTC().AddDate(0, 0, -1).Format("2006-01-02")},
+		"sort":     {"asc"},
+		"per_page": {strconv.Itoa(repoPageSize)},
+	}
+	web := fmt.Sprintf("%s://%s/%s", s.gitlabScheme, host, path)
+	return []repoEndpoint{
+		{"issues", project + "/issues?" + query.Encode(), parseGitlabIssues},
+		{"merge_requests", project + "/merge_requests?" + query.Encode(), parseGitlabIssues},
+		{"notes", project + "/events?" + events.Encode(), func(data []byte) ([]repoItem, error) {
+			return parseGitlabNotes(web, data)
+		}},
+	}
+}
+
+func parseGithubIssues(data []byte) ([]repoItem, error) {
+	var issues []struct {
+		ID      int64     `json:"id"`
+		HTMLURL string    `json:"html_url"`
+		Title   string    `json:"title"`
+		Body    string    `json:"body"`
+		Created time.Time `json:"created_at"`
+		Updated time.Time `json:"updated_at"`
+	}
+	if err := json.Unmarshal(data, &issues); err != nil {
+		return nil, err
+	}
+	items := make([]repoItem, 0, len(issues))
+	for _, issue := range issues {
+		items = append(items, repoItem{
+			id:      "issue/" + strconv.FormatInt(issue.ID, 10),
+			link:    issue.HTMLURL,
+			text:    strings.TrimSpace(issue.Title + "\n" + issue.Body),
+			created: issue.Created,
+			updated: issue.Updated,
+		})
+	}
+	return items, nil
+}
+
+// parseGithubComments parses issue and review comments, whose links are
+// their permalinks.
+func parseGithubComments(data []byte) ([]repoItem, error) {
+	var comments []struct {
+		ID      int64     `json:"id"`
+		HTMLURL string    `json:"html_url"`
+		Body    string    `json:"body"`
+		Created time.Time `json:"created_at"`
+		Updated time.Time `json:"updated_at"`
+	}
+	if err := json.Unmarshal(data, &comments); err != nil {
+		return nil, err
+	}
+	items := make([]repoItem, 0, len(comments))
+	for _, comment := range comments {
+		items = append(items, repoItem{
+			id:      "comment/" + strconv.FormatInt(comment.ID, 10),
+			link:    comment.HTMLURL,
+			text:    strings.TrimSpace(comment.Body),
+			created: comment.Created,
+			updated: comment.Updated,
+		})
+	}
+	return items, nil
+}
+
+// parseGitlabIssues parses issues or merge requests.
+func parseGitlabIssues(data []byte) ([]repoItem, error) {
+	var issues []struct {
+		ID          int64     `json:"id"`
+		WebURL      string    `json:"web_url"`
+		Title       string    `json:"title"`
+		Description string    `json:"description"`
+		Created     time.Time `json:"created_at"`
+		Updated     time.Time `json:"updated_at"`
+	}
+	if err := json.Unmarshal(data, &issues); err != nil {
+		return nil, err
+	}
+	items := make([]repoItem, 0, len(issues))
+	for _, issue := range issues {
+		items = append(items, repoItem{
+			id:      "issue/" + strconv.FormatInt(issue.ID, 10),
+			link:    issue.WebURL,
+			text:    strings.TrimSpace(issue.Title + "\n" + issue.Description),
+			created: issue.Created,
+			updated: issue.Updated,
+		})
+	}
+	return items, nil
+}
+
+// parseGitlabNotes parses the comment events of the project at web.
+// Notes have no links of their own, so they are built from the issue or
+// merge request they are on.
+func parseGitlabNotes(web string, data []byte) ([]repoItem, error) {
+	var events []struct {
+		Created time.Time `json:"created_at"`
+		Note    struct {
+			ID           int64  `json:"id"`
+			Body         string `json:"body"`
+			NoteableType string `json:"noteable_type"`
+			NoteableIID  int64  `json:"noteable_iid"`
+		} `json:"note"`
+	}
+	if err := json.Unmarshal(data, &events); err != nil {
+		return nil, err
+	}
+	items := make([]repoItem, 0, len(events))
+	for _, event := range events {
+		var kind string
+		switch event.Note.NoteableType {
+		case "Issue":
+			kind = "issues"
+		case "MergeRequest":
+			kind = "merge_requests"
+		default:
+			// Notes on commits and snippets are skipped.
+			continue
+		}
+		items = append(items, repoItem{
+			id:      "comment/" + strconv.FormatInt(event.Note.ID, 10),
+			link:    fmt.Sprintf("%s/-/%s/%d#note_%d", web, kind, event.Note.NoteableIID, event.Note.ID),
+			text:    strings.TrimSpace(event.Note.Body),
+			created: event.Created,
+			updated: event.Created,
+		})
+	}
+	return items, nil
+}
+
+func repoEvent(repo string, item repoItem) workEvent {
+	return workEvent{
+		application: Git,
+		channel:     repo,
+		channelID:   repo,
+		key:         repo,
+		text:        item.text,
+		link:        item.link,
+		messageID:   item.id,
+	}
+}
+
+func (*repoSource) application() Application {
+	return Git
+}
+
+// resolveChannel returns a repository as host/path. A new repository is
+// checked and only its later items are matched.
+func (s *repoSource) resolveChannel(link string) (string, error) {
+	host, path, err := parseRepo(link)
+	if err != nil {
+		return "", err
+	}
+	if err := s.checkHost(host); err != nil {
+		return "", err
+	}
+	repo := host + "/" + path
+	_, err = s.storage.getRepo(repo)
+	if !errors.Is(err, sql.ErrNoRows) {
+		return repo, err
+	}
+	if _, err := s.checkProject(context.Background(), host, path, ""); err != nil {
+		return "", err
+	}
+	return repo, s.storage.saveRepo(RepoState{Repo: repo, Since: time.Now().UTC()})
+}
+
+func (*repoSource) channelName(channel string) string {
+	return channel
+}
+
+// link returns the permalink of the item, which can't be built from its
+// id.
+func (*repoSource) link(event workEvent) string {
+	return event.link
+}
+
+func (*repoSource) history(user, channel string, count int) error {
+	return historyUnsupportedError
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// repoStorage keeps the repositories in memory.
+type repoStorage struct {
+	memoryStore[RepoState]
+}
+
+func (s *repoStorage) getRepo(repo string) (RepoState, error) {
+	return s.get(repo)
+}
+
+func (s *repoStorage) saveRepo(state RepoState) error {
+	return s.save(state.Repo, state)
+}
+
+var repoSince = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// repoServer fakes the activity of a GitHub repository under /github
+// and a GitLab which redirects. A list is not modified if its etag is
+// sent.
+func repoServer(t *testing.T) *httptest.Server {
+	lists := map[string]any{
+		"/github/repos/spbu/course/issues": []map[string]any{
+			{"id": 1, "html_url": "https://github.com/spbu/course/issues/1", "title": "Старый экзамен",
+				"created_at": repoSince.Add(-time.Hour), "updated_at": repoSince.Add(time.Minute)},
+			{"id": 2, "html_url": "https://github.com/spbu/course/pull/2", "title": "Дедлайн", "body": "проекта",
+				"created_at": repoSince.Add(2 * time.Minute), "updated_at": repoSince.Add(3 * time.Minute)},
+		},
+		"/github/repos/spbu/course/issues/comments": []map[string]any{
+			{"id": 10, "html_url": "https://github.com/spbu/course/issues/1#issuecomment-10", "body": "дедлайн завтра",
+				"created_at": repoSince.Add(5 * time.Minute), "updated_at": repoSince.Add(5 * time.Minute)},
+		},
+		"/github/repos/spbu/course/pulls/comments": []map[string]any{},
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.EscapedPath()
+		if strings.HasPrefix(path, "/github/") {
+			if r.Header.Get("Authorization") != "Bearer gh" {
+				t.Errorf("%s without the GitHub token", path)
+			}
+			if _, list := lists[path]; list && r.URL.Query().Get("since") == "" {
+				t.Errorf("%s without since", path)
+			}
+		} else if r.Header.Get("PRIVATE-TOKEN") != "gl" {
+			t.Errorf("%s without the GitLab token", path)
+		}
+		switch path {
+		case "/github/repos/spbu/course":
+			w.Write([]byte(`{}`))
+			return
+		case "/api/v4/projects/spbu%2Fmoved":
+			http.Redirect(w, r, r.URL.Query().Get("to"), http.StatusFound)
+			return
+		}
+		list, found := lists[path]
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		etag := `"` + path + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		json.NewEncoder(w).Encode(list)
+	}))
+}
+
+func newTestRepoSource(t *testing.T, repos ...string) (*repoSource, *repoStorage, *[]workEvent) {
+	server := repoServer(t)
+	t.Cleanup(server.Close)
+	storage := &repoStorage{newMemoryStore[RepoState]()}
+	for _, repo := range repos {
+		storage.states[repo] = RepoState{Repo: repo, Since: repoSince}
+	}
+	enqueue, events := recordEvents()
+	client := server.Client()
+	client.CheckRedirect = dropTokens
+	s := &repoSource{
+		client:       client,
+		storage:      storage,
+		enqueue:      enqueue,
+		githubAPI:    server.URL + "/github",
+		githubToken:  "gh",
+		gitlabTokens: map[string]string{strings.TrimPrefix(server.URL, "http://"): "gl"},
+		gitlabScheme: "http",
+		privateRepos: map[string]bool{},
+	}
+	return s, storage, events
+}
+
+func TestRepoPollGithub(t *testing.T) {
+	s, storage, events := newTestRepoSource(t, "github.com/spbu/course")
+	if err := s.poll(context.Background(), "github.com/spbu/course"); err != nil {
+		t.Fatal(err)
+	}
+	var links []string
+	for _, event := range *events {
+		if event.application != Git || event.channelID != "github.com/spbu/course" {
+			t.Errorf("event = %+v", event)
+		}
+		links = append(links, event.link)
+	}
+	want := []string{
+		"https://github.com/spbu/course/pull/2",
+		"https://github.com/spbu/course/issues/1#issuecomment-10",
+	}
+	if !reflect.DeepEqual(links, want) {
+		t.Errorf("links = %v, want %v", links, want)
+	}
+	if (*events)[0].text != "Дедлайн\nпроекта" {
+		t.Errorf("text = %q", (*events)[0].text)
+	}
+	state := storage.states["github.com/spbu/course"]
+	if !state.Since.Equal(repoSince.Add(5 * time.Minute)) {
+		t.Errorf("Since = %s", state.Since)
+	}
+	if state.ETags["issues"] != `"/github/repos/spbu/course/issues"` {
+		t.Errorf("ETags = %v", state.ETags)
+	}
+
+	*events = nil
+	if err := s.poll(context.Background(), "github.com/spbu/course"); err != nil || len(*events) != 0 {
+		t.Errorf("second poll = %v, events %+v", err, *events)
+	}
+}
+
+func TestRepoTokensStayOnTheirHosts(t *testing.T) {
+	requested := 0
+	outside := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested++
+		if r.Header.Get("PRIVATE-TOKEN") != "" || r.Header.Get("Authorization") != "" {
+			t.Errorf("%s got a token", r.URL)
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer outside.Close()
+	s, _, _ := newTestRepoSource(t)
+	outsideHost := strings.TrimPrefix(outside.URL, "http://")
+
+	if _, err := s.resolveChannel(outsideHost + "/spbu/course"); err != gitlabHostError || requested != 0 {
+		t.Errorf("resolveChannel on a host which is not allowed = %v, %d requests", err, requested)
+	}
+	s.gitlabTokens[outsideHost] = ""
+	if _, err := s.resolveChannel(outsideHost + "/spbu/course"); err != nil || requested != 1 {
+		t.Errorf("resolveChannel on an allowed host without a token = %v, %d requests", err, requested)
+	}
+
+	// An allowed GitLab redirects to another host.
+	var gitlab string
+	for host, token := range s.gitlabTokens {
+		if token != "" {
+			gitlab = host
+		}
+	}
+	u := "http://" + gitlab + "/api/v4/projects/spbu%2Fmoved?to=" + url.QueryEscape(outside.URL)
+	resp, err := s.get(context.Background(), u, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if requested != 2 {
+		t.Errorf("the redirect was not followed: %d requests", requested)
+	}
+}
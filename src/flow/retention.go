@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultRetentionDays = 30
+	retentionPeriod      = time.Hour
+)
+
+// loadRetention reads for how long delayed messages and delivery logs
+// are kept. Zero disables pruning.
+func loadRetention() time.Duration {
+	days := defaultRetentionDays
+	if raw := os.Getenv("TOPIC_KEEPER_RETENTION_DAYS"); raw != "" {
+		var err error
+		if days, err = strconv.Atoi(raw); err != nil || days < 0 {
+			log.Printf("wrong TOPIC_KEEPER_RETENTION_DAYS %q, using %d", raw, defaultRetentionDays)
+			days = defaultRetentionDays
+		}
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// retentionJob prunes the data older than retention every period until
+// ctx is done.
+func retentionJob(ctx context.Context, retention, period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		deleted, err := dataBase.prune(time.Now().Add(-retention))
+		if err != nil {
+			log.Println(err.Error())
+		} else if deleted > 0 {
+			log.Printf("retention: pruned %d rows", deleted)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoadRetention(t *testing.T) {
+	for _, tc := range []struct {
+		given  string
+		answer time.Duration
+	}{
+		{"", defaultRetentionDays * 24 * time.Hour},
+		{"7", 7 * 24 * time.Hour},
+		{"0", 0},
+		{"-3", defaultRetentionDays * 24 * time.Hour},
+		{"week", defaultRetentionDays * 24 * time.Hour},
+		{"1.5", defaultRetentionDays * 24 * time.Hour},
+	} {
+		t.Setenv("TOPIC_KEEPER_RETENTION_DAYS", tc.given)
+		if res := loadRetention(); res != tc.answer {
+			t.Errorf("TOPIC_KEEPER_RETENTION_DAYS=%q: got %s but answer is %s", tc.given, res, tc.answer)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+const schedulerPeriod = time.Minute
+
+// scheduler runs the time based deliveries to the users of application
+// every period until ctx is done. send delivers a text to one of them
+// and flush delivers their delayed messages.
+func scheduler(ctx context.Context, application Application, send func(user, text string) error, flush func(user string), period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			releaseDigests(ctx, application, send, now)
+			releasePauses(application, send, now)
+			releaseDelayed(application, flush, now)
+		}
+	}
+}
+
+// releasePauses ends the pauses and mutes which are over by now. Their
+// messages are then delivered by releaseDelayed.
+func releasePauses(application Application, send func(user, text string) error, now time.Time) {
+	users, err := dataBase.expirePauses(application, now)
+	if err != nil {
+		log.Println(err.Error())
+	}
+	for _, user := range users {
+		if err := send(user, "Пауза закончилась, обновления возобновлены!"); err != nil {
+			log.Println(err.Error())
+		}
+	}
+	if err := dataBase.expireMutes(now); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// releaseDelayed delivers the delayed messages of the users who are
+// neither paused nor in their quiet hours by now. Messages from muted
+// channels stay delayed.
+func releaseDelayed(application Application, flush func(user string), now time.Time) {
+	queued, err := dataBase.getQueuedUsers(application)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	for user, settings := range queued {
+		if !settings.isQuiet(now) {
+			flush(user)
+		}
+	}
+}
+
+// releaseDigests delivers the digests due by now and schedules the next
+// ones.
+func releaseDigests(ctx context.Context, application Application, send func(user, text string) error, now time.Time) {
+	due, err := dataBase.getDueDigests(application, now)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	for user, settings := range due {
+		if err := releaseDigest(ctx, user, send, queueNotification); err != nil {
+			log.Println(err.Error())
+			continue
+		}
+
+		var next *time.Time
+		if settings.Digest != "" {
+			schedule, err := parseDigestSchedule(settings.Digest)
+			if err != nil {
+				log.Println(err.Error())
+			} else {
+				at := schedule.next(now.In(settings.location()))
+				next = &at
+			}
+		}
+		if err := dataBase.setDigestNext(user, next); err != nil {
+			log.Println(err.Error())
+		}
+	}
+}
+
+// releaseDigest sends the digest of the user. Its messages are popped
+// and a notification job is enqueued for every part of it in one
+// transaction; the parts are queued for the sender after it commits, so
+// a failed part is retried on its own. The overview is sent with send
+// and is not retried.
+func releaseDigest(ctx context.Context, user string, send func(user, text string) error,
+	queue func(ctx context.Context, n notification)) error {
+	var messages []Message
+	var notifications []notification
+	err := dataBase.inTx(func(s LocalStorage) error {
+		var err error
+		messages, err = s.popDigestMessages(user)
+		if err != nil {
+			return err
+		}
+		for _, part := range splitDigest(messages) {
+			message := Message{User: user, Text: part.text, Grouped: part.messages}
+			n, local, err := enqueueNotification(s, message, hasNotifier)
+			if err != nil {
+				return err
+			}
+			if local {
+				notifications = append(notifications, n)
+			}
+		}
+		return nil
+	})
+	if err != nil || len(messages) == 0 {
+		return err
+	}
+
+	if overview := digestOverview(messages); overview != "" {
+		if err := send(user, overview); err != nil {
+			log.Println(err.Error())
+		}
+	}
+	for _, n := range notifications {
+		queue(ctx, n)
+	}
+	return nil
+}
+
+// sendGrouped sends the texts rendered from messages to the user and
+// logs the delivery of every message. It stops at the first failed
+// text and returns the failure unless it is permanent, in which case
+// the messages are logged as failed.
+func sendGrouped(s LocalStorage, user string, messages []Message, texts []string, send func(user, text string) error) error {
+	status := DeliverySent
+	for _, text := range texts {
+		if err := send(user, text); err != nil {
+			if classify(err) != FailurePermanent {
+				return err
+			}
+			log.Println(err.Error())
+			status = DeliveryFailed
+			break
+		}
+	}
+	for _, message := range messages {
+		if err := s.logDelivery(message, status); err != nil {
+			log.Println(err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+)
+
+// secretKeyEnv holds the base64 encoded 32 byte key the stored
+// credentials are encrypted with.
+const secretKeyEnv = "TOPIC_KEEPER_SECRET_KEY"
+
+var (
+	secretKeyError = errors.New("Хранение паролей не настроено, обратитесь к администратору бота")
+	sealedError    = errors.New("the secret can't be decrypted")
+)
+
+// secretCipher returns AES-GCM with the key of secretKeyEnv.
+func secretCipher() (cipher.AEAD, error) {
+	key, err := base64.StdEncoding.DecodeString(os.Getenv(secretKeyEnv))
+	if err != nil || len(key) != 32 {
+		return nil, secretKeyError
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealSecret encrypts secret, the random nonce goes first.
+func sealSecret(secret string) ([]byte, error) {
+	aead, err := secretCipher()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, []byte(secret), nil), nil
+}
+
+// openSecret decrypts a secret sealed by sealSecret.
+func openSecret(sealed []byte) (string, error) {
+	aead, err := secretCipher()
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", sealedError
+	}
+	nonce, data := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	secret, err := aead.Open(nil, nonce, data, nil)
+	if err != nil {
+		return "", sealedError
+	}
+	return string(secret), nil
+}
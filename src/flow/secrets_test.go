@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+)
+
+func TestSealSecret(t *testing.T) {
+	t.Setenv(secretKeyEnv, base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32)))
+	sealed, err := sealSecret("student\np\"w")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte("student")) {
+		t.Errorf("sealed secret %q holds the plain text", sealed)
+	}
+	if secret, err := openSecret(sealed); secret != "student\np\"w" || err != nil {
+		t.Errorf("openSecret = %q, %v", secret, err)
+	}
+
+	sealed[len(sealed)-1] ^= 1
+	if _, err := openSecret(sealed); err != sealedError {
+		t.Errorf("openSecret of a changed secret error = %v", err)
+	}
+	t.Setenv(secretKeyEnv, base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{8}, 32)))
+	sealed[len(sealed)-1] ^= 1
+	if _, err := openSecret(sealed); err != sealedError {
+		t.Errorf("openSecret with another key error = %v", err)
+	}
+
+	for _, key := range []string{"", "short", base64.StdEncoding.EncodeToString([]byte("16 bytes of key!"))} {
+		t.Setenv(secretKeyEnv, key)
+		if _, err := sealSecret("secret"); err != secretKeyError {
+			t.Errorf("sealSecret with the key %q error = %v", key, err)
+		}
+	}
+}
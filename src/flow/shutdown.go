@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// drainTimeout bounds the time spent on handling the events which are
+// in flight on shutdown.
+const drainTimeout = 30 * time.Second
+
+var workersDone sync.WaitGroup
+
+// withGracePeriod returns a context which is done the given period
+// after ctx is.
+func withGracePeriod(ctx context.Context, period time.Duration) (context.Context, context.CancelFunc) {
+	hard, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-hard.Done():
+			return
+		}
+		select {
+		case <-time.After(period):
+			cancel()
+		case <-hard.Done():
+		}
+	}()
+	return hard, cancel
+}
+
+// startWorkers starts a worker for every channel of workChans. They stop
+// when ctx is done or after stopWorkers.
+func startWorkers(ctx context.Context) {
+	workChans = make([]chan workEvent, NWorkers)
+	for i := 0; i < NWorkers; i++ {
+		workChans[i] = make(chan workEvent)
+		workersDone.Add(1)
+		go func(workChan chan workEvent) {
+			defer workersDone.Done()
+			worker(ctx, workChan)
+		}(workChans[i])
+	}
+}
+
+// stopWorkers closes workChans and waits for the workers to handle the
+// queued events. Nothing may be sent to workChans afterwards.
+func stopWorkers() {
+	for _, workChan := range workChans {
+		close(workChan)
+	}
+	workersDone.Wait()
+}
+
+// waitOrDone waits for fn to return or for ctx to be done and tells
+// whether fn has returned.
+func waitOrDone(ctx context.Context, fn func()) bool {
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// startSender starts the sender and returns a channel closed when it
+// stops.
+func startSender(ctx context.Context) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		sender(ctx)
+		close(done)
+	}()
+	return done
+}
+
+// drain stops the pipeline once ctx of the sources is done: every stage
+// is stopped after the ones feeding it, starting with stopSources. It
+// gives up when hardCtx is done and returns the exit code.
+func drain(hardCtx context.Context, senderDone <-chan struct{}, stopSources func()) int {
+	log.Println("shutting down, draining in-flight events")
+	drained := waitOrDone(hardCtx, func() {
+		stopSources()
+		stopWorkers()
+		close(sendChan)
+		<-senderDone
+	})
+	if !drained {
+		log.Println("drain timed out, in-flight events are dropped")
+		return 1
+	}
+	log.Println("all in-flight events are handled")
+	return 0
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWithGracePeriod(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	hard, cancel := withGracePeriod(ctx, 50*time.Millisecond)
+	defer cancel()
+
+	select {
+	case <-hard.Done():
+		t.Fatal("Hard context is done before the soft one")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	stop()
+	select {
+	case <-hard.Done():
+		t.Fatal("Hard context is done without the grace period")
+	case <-time.After(10 * time.Millisecond):
+	}
+	select {
+	case <-hard.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Hard context is not done after the grace period")
+	}
+}
+
+func TestWaitOrDone(t *testing.T) {
+	if !waitOrDone(context.Background(), func() {}) {
+		t.Errorf("Returned function is reported as not returned")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	block := make(chan struct{})
+	defer close(block)
+	if waitOrDone(ctx, func() { <-block }) {
+		t.Errorf("Blocked function is reported as returned")
+	}
+}
@@ -0,0 +1,621 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	SlackCode      = "SL"
+	slackAPI       = "https://slack.com/api"
+	slackTimeout   = 30 * time.Second
+	slackReconnect = 5 * time.Second
+	// maxSlackHistory limits the page of messages asked for.
+	maxSlackHistory = 200
+	// slackPageSize is the number of channels or users asked for at once.
+	slackPageSize = 200
+)
+
+var (
+	slackChannelError = errors.New(
+		"Канал Slack не найден. Используйте #канал или ссылку на канал рабочего пространства")
+	slackNotMemberError = errors.New("Бот не может войти в этот канал Slack. Пригласите его командой /invite")
+)
+
+var (
+	slackArchiveLink = regexp.MustCompile(`^(?:https?://)?[\w-]+\.slack\.com/archives/([CG][A-Z0-9]+)`)
+	slackChannelID   = regexp.MustCompile(`^[CG][A-Z0-9]{6,}$`)
+	// slackMarkup matches the links, mentions and channels in message
+	// text: <https://url|label>, <@U123> and <#C123|name>.
+	slackMarkup = regexp.MustCompile(`<([^<>|]*)(?:\|([^<>]*))?>`)
+)
+
+// slackClient calls the Slack Web API with the bot token. The app token
+// opens Socket Mode connections.
+type slackClient struct {
+	api      string
+	token    string
+	appToken string
+	client   *http.Client
+}
+
+// slackError is an error response of the Web API.
+type slackError struct {
+	Method string
+	Code   string
+}
+
+func (e *slackError) Error() string {
+	return fmt.Sprintf("slack: %s: %s", e.Method, e.Code)
+}
+
+// slackResponse is the envelope of every Web API response.
+type slackResponse struct {
+	OK       bool   `json:"ok"`
+	Error    string `json:"error"`
+	Metadata struct {
+		NextCursor string `json:"next_cursor"`
+	} `json:"response_metadata"`
+}
+
+// call calls the Web API method with the bot token and decodes the
+// response into v.
+func (c *slackClient) call(ctx context.Context, method string, params url.Values, v any) error {
+	return c.callWith(ctx, c.token, method, params, v)
+}
+
+func (c *slackClient) callWith(ctx context.Context, token, method string, params url.Values, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.api+"/"+method, strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return &slackError{Method: method, Code: "ratelimited"}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("slack %s responded with %s", method, resp.Status)
+	}
+	var raw json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return err
+	}
+	var status slackResponse
+	if err := json.Unmarshal(raw, &status); err != nil {
+		return err
+	}
+	if !status.OK {
+		return &slackError{Method: method, Code: status.Error}
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// postMessage posts text to a channel. A user id as the channel means
+// the direct channel with the user.
+func (c *slackClient) postMessage(ctx context.Context, channel, text string) error {
+	return c.call(ctx, "chat.postMessage", url.Values{"channel": {channel}, "text": {text}}, nil)
+}
+
+type slackChannel struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	IsMember bool   `json:"is_member"`
+}
+
+type slackMessage struct {
+	Type        string `json:"type"`
+	Subtype     string `json:"subtype"`
+	Channel     string `json:"channel"`
+	ChannelType string `json:"channel_type"`
+	User        string `json:"user"`
+	BotID       string `json:"bot_id"`
+	Text        string `json:"text"`
+	TS          string `json:"ts"`
+}
+
+// slackSource reads the channels of the workspace the bot is a member
+// of. Direct messages to the bot are commands.
+type slackSource struct {
+	c *slackClient
+	// userID is the user of the bot and teamURL the address of the
+	// workspace, which makes message links.
+	userID  string
+	teamURL string
+	// enqueue passes an event to the pipeline.
+	enqueue func(workEvent)
+	// command handles a direct message, nil if the commands are handled
+	// by another process.
+	command func(channel, text string)
+
+	mu       sync.Mutex
+	channels map[string]string
+}
+
+// connectSlack logs in to the workspace with the tokens of
+// SLACK_BOT_TOKEN and SLACK_APP_TOKEN. It returns nil if Slack is not
+// configured.
+func connectSlack() (*slackSource, error) {
+	token := os.Getenv("SLACK_BOT_TOKEN")
+	if token == "" {
+		return nil, nil
+	}
+	c := &slackClient{
+		api:      slackAPI,
+		token:    token,
+		appToken: os.Getenv("SLACK_APP_TOKEN"),
+		client:   &http.Client{Timeout: slackTimeout},
+	}
+	return newSlackSource(context.Background(), c)
+}
+
+func newSlackSource(ctx context.Context, c *slackClient) (*slackSource, error) {
+	var auth struct {
+		UserID string `json:"user_id"`
+		URL    string `json:"url"`
+	}
+	if err := c.call(ctx, "auth.test", url.Values{}, &auth); err != nil {
+		return nil, err
+	}
+	return &slackSource{
+		c:        c,
+		userID:   auth.UserID,
+		teamURL:  strings.TrimSuffix(auth.URL, "/"),
+		enqueue:  enqueueEvent,
+		channels: make(map[string]string),
+	}, nil
+}
+
+// registerSlack registers the Slack source and notifier if Slack is
+// configured and returns the source, nil otherwise.
+func registerSlack() *slackSource {
+	s, err := connectSlack()
+	if err != nil {
+		log.Printf("can't connect to slack: %s", err.Error())
+		return nil
+	}
+	if s == nil {
+		return nil
+	}
+	registerSource(SlackCode, s)
+	notifiers[DestinationSlack] = &slackNotifier{c: s.c}
+	return s
+}
+
+func (s *slackSource) handleUpdates(ctx context.Context) {
+	for {
+		err := s.listen(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("slack socket disconnected, reconnecting: %s", err.Error())
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(slackReconnect):
+		}
+	}
+}
+
+// listen handles the events of one Socket Mode connection until ctx is
+// done or the connection fails.
+func (s *slackSource) listen(ctx context.Context) error {
+	var open struct {
+		URL string `json:"url"`
+	}
+	if err := s.c.callWith(ctx, s.c.appToken, "apps.connections.open", url.Values{}, &open); err != nil {
+		return err
+	}
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, open.URL, nil)
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		// Closing the connection stops the reads below.
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	for {
+		var envelope struct {
+			EnvelopeID string `json:"envelope_id"`
+			Type       string `json:"type"`
+			Payload    struct {
+				Event slackMessage `json:"event"`
+			} `json:"payload"`
+		}
+		if err := conn.ReadJSON(&envelope); err != nil {
+			return err
+		}
+		// Unacknowledged events are delivered again.
+		if envelope.EnvelopeID != "" {
+			if err := conn.WriteJSON(map[string]string{"envelope_id": envelope.EnvelopeID}); err != nil {
+				return err
+			}
+		}
+		switch envelope.Type {
+		case "events_api":
+			s.dispatch(envelope.Payload.Event)
+		case "disconnect":
+			return errors.New("slack asked to reconnect")
+		}
+	}
+}
+
+// dispatch passes a channel message to the pipeline and a direct one to
+// the commands.
+func (s *slackSource) dispatch(message slackMessage) {
+	if message.Type != "message" || s.skip(message) {
+		return
+	}
+	if message.ChannelType == "im" {
+		if s.command != nil {
+			s.command(message.Channel, message.Text)
+		}
+		return
+	}
+	s.enqueue(s.event(message.Channel, message, nil))
+}
+
+// skip tells whether a message is not a new message of a person. Edits,
+// joins and the like have a subtype.
+func (s *slackSource) skip(message slackMessage) bool {
+	if message.Subtype != "" && message.Subtype != "thread_broadcast" && message.Subtype != "file_share" {
+		return true
+	}
+	return message.BotID != "" || message.User == s.userID || message.Text == ""
+}
+
+func (s *slackSource) event(channel string, message slackMessage, request *historyRequest) workEvent {
+	event := workEvent{
+		application:    Slack,
+		channel:        s.channelName(channel),
+		channelID:      channel,
+		key:            channel,
+		text:           slackText(message.Text),
+		messageID:      message.TS,
+		historyRequest: request,
+	}
+	event.link = s.link(event)
+	return event
+}
+
+// slackText returns the plain text of a message: the labels of links
+// and the names of channels instead of the markup.
+func slackText(text string) string {
+	text = slackMarkup.ReplaceAllStringFunc(text, func(markup string) string {
+		match := slackMarkup.FindStringSubmatch(markup)
+		target, label := match[1], match[2]
+		switch {
+		case strings.HasPrefix(target, "#") && label != "":
+			return "#" + label
+		case label != "":
+			return label
+		}
+		return target
+	})
+	return html.UnescapeString(text)
+}
+
+func (*slackSource) application() Application {
+	return Slack
+}
+
+// resolveChannel returns the id of a channel given by name, id or link
+// and joins it if the bot is not a member yet.
+func (s *slackSource) resolveChannel(link string) (string, error) {
+	ctx := context.Background()
+	name := strings.TrimPrefix(link, "#")
+	if match := slackArchiveLink.FindStringSubmatch(link); match != nil {
+		name = match[1]
+	}
+	var ch slackChannel
+	var err error
+	if slackChannelID.MatchString(name) {
+		ch, err = s.channelInfo(ctx, name)
+	} else {
+		ch, err = s.findChannel(ctx, name)
+	}
+	if err != nil {
+		return "", err
+	}
+	if !ch.IsMember {
+		err := s.c.call(ctx, "conversations.join", url.Values{"channel": {ch.ID}}, nil)
+		var e *slackError
+		if errors.As(err, &e) {
+			return "", slackNotMemberError
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return ch.ID, nil
+}
+
+// findChannel looks for the channel with the name among the channels of
+// the workspace.
+func (s *slackSource) findChannel(ctx context.Context, name string) (slackChannel, error) {
+	cursor := ""
+	for {
+		var page struct {
+			slackResponse
+			Channels []slackChannel `json:"channels"`
+		}
+		params := url.Values{
+			"types":            {"public_channel,private_channel"},
+			"exclude_archived": {"true"},
+			"limit":            {strconv.Itoa(slackPageSize)},
+		}
+		if cursor != "" {
+			params.Set("cursor", cursor)
+		}
+		if err := s.c.call(ctx, "conversations.list", params, &page); err != nil {
+			return slackChannel{}, err
+		}
+		for _, ch := range page.Channels {
+			s.remember(ch)
+			if ch.Name == name {
+				return ch, nil
+			}
+		}
+		if cursor = page.Metadata.NextCursor; cursor == "" {
+			return slackChannel{}, slackChannelError
+		}
+	}
+}
+
+// channelInfo returns the channel with the id.
+func (s *slackSource) channelInfo(ctx context.Context, id string) (slackChannel, error) {
+	var info struct {
+		Channel slackChannel `json:"channel"`
+	}
+	err := s.c.call(ctx, "conversations.info", url.Values{"channel": {id}}, &info)
+	var e *slackError
+	if errors.As(err, &e) && e.Code == "channel_not_found" {
+		return slackChannel{}, slackChannelError
+	}
+	if err != nil {
+		return slackChannel{}, err
+	}
+	s.remember(info.Channel)
+	return info.Channel, nil
+}
+
+func (s *slackSource) remember(ch slackChannel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.channels[ch.ID] = ch.Name
+}
+
+func (s *slackSource) channelName(channel string) string {
+	s.mu.Lock()
+	name, found := s.channels[channel]
+	s.mu.Unlock()
+	if !found {
+		if ch, err := s.channelInfo(context.Background(), channel); err == nil {
+			name = ch.Name
+		}
+	}
+	if name == "" {
+		return channel
+	}
+	return "#" + name
+}
+
+// link returns the permalink of a message: its ts without the dot.
+func (s *slackSource) link(event workEvent) string {
+	return fmt.Sprintf("%s/archives/%s/p%s", s.teamURL, event.channelID, strings.Replace(event.messageID, ".", "", 1))
+}
+
+func (s *slackSource) history(user, channel string, count int) error {
+	if count > maxSlackHistory {
+		count = maxSlackHistory
+	}
+	var resp struct {
+		Messages []slackMessage `json:"messages"`
+	}
+	params := url.Values{"channel": {channel}, "limit": {strconv.Itoa(count)}}
+	if err := s.c.call(context.Background(), "conversations.history", params, &resp); err != nil {
+		return err
+	}
+	// Slack returns the newest message first.
+	for i := len(resp.Messages) - 1; i >= 0; i-- {
+		if !s.skip(resp.Messages[i]) {
+			s.enqueue(s.event(channel, resp.Messages[i], &historyRequest{user}))
+		}
+	}
+	return nil
+}
+
+// slackNotifier sends notifications as direct messages of the bot.
+type slackNotifier struct {
+	c *slackClient
+}
+
+// notify sends msg to the direct channel of a Slack user given by the
+// address: the id of the channel or @username.
+func (n *slackNotifier) notify(address string, msg Message) error {
+	ctx := context.Background()
+	channel := address
+	if name, ok := strings.CutPrefix(address, "@"); ok {
+		user, err := n.findUser(ctx, name)
+		if err != nil {
+			return failure(slackFailureClass(err), err)
+		}
+		channel = user
+	}
+	if err := n.c.postMessage(ctx, channel, newsText(msg)); err != nil {
+		return failure(slackFailureClass(err), err)
+	}
+	return nil
+}
+
+// findUser returns the id of the user with the name or display name.
+func (n *slackNotifier) findUser(ctx context.Context, name string) (string, error) {
+	cursor := ""
+	for {
+		var page struct {
+			slackResponse
+			Members []struct {
+				ID      string `json:"id"`
+				Name    string `json:"name"`
+				Deleted bool   `json:"deleted"`
+				Profile struct {
+					DisplayName string `json:"display_name"`
+				} `json:"profile"`
+			} `json:"members"`
+		}
+		params := url.Values{"limit": {strconv.Itoa(slackPageSize)}}
+		if cursor != "" {
+			params.Set("cursor", cursor)
+		}
+		if err := n.c.call(ctx, "users.list", params, &page); err != nil {
+			return "", err
+		}
+		for _, member := range page.Members {
+			if !member.Deleted && (member.Name == name || member.Profile.DisplayName == name) {
+				return member.ID, nil
+			}
+		}
+		if cursor = page.Metadata.NextCursor; cursor == "" {
+			return "", &slackError{Method: "users.list", Code: "user_not_found"}
+		}
+	}
+}
+
+// slackFailureClass tells whether a failed request may succeed later.
+func slackFailureClass(err error) FailureClass {
+	var e *slackError
+	if errors.As(err, &e) && e.Code != "ratelimited" && e.Code != "internal_error" &&
+		e.Code != "fatal_error" && e.Code != "service_unavailable" {
+		return FailurePermanent
+	}
+	return FailureDelivery
+}
+
+// slackMain runs the Slack bot until ctx is done and then drains the
+// pipeline until hardCtx is.
+func slackMain(ctx, hardCtx context.Context) int {
+	source := registerSlack()
+	if source == nil {
+		log.Fatal("Could not connect to slack, check SLACK_BOT_TOKEN and SLACK_APP_TOKEN")
+	}
+	app := &slackApp{source: source}
+	source.command = app.handleCommand
+	log.Printf("Logged in to slack as %s", source.userID)
+
+	// Notifications may also go to the other platforms, and their
+	// channels may be subscribed to, if they are configured.
+	registerNotifiers()
+	registerRemoteSources()
+	if os.Getenv("MM_SERVER") != "" {
+		if mm, err := connectMattermost(loadConfig()); err != nil {
+			log.Printf("can't connect to mattermost: %s", err.Error())
+		} else {
+			notifiers[DestinationMattermost] = mm
+			registerSource(MattermostCode, mattermostSource{newApplication(loadConfig(), mm)})
+		}
+	}
+
+	ctx, stopSources := context.WithCancel(ctx)
+	defer stopSources()
+	go scheduler(ctx, Slack, app.sendMsg, func(id string) { flushDirectBacklog(app, id) }, schedulerPeriod)
+
+	var poller sync.WaitGroup
+	poller.Add(1)
+	go func() {
+		defer poller.Done()
+		queuePoller(ctx)
+	}()
+	senderDone := startSender(hardCtx)
+
+	source.handleUpdates(ctx)
+	stopSources()
+	return drain(hardCtx, senderDone, poller.Wait)
+}
+
+// slackApp handles the commands sent to the bot in direct messages, the
+// same as the Mattermost ones. Users are known by their direct channel.
+type slackApp struct {
+	source *slackSource
+}
+
+// handleCommand handles a command sent to the bot in a direct message.
+func (a *slackApp) handleCommand(id, text string) {
+	handleDirectCommand(a, directCommand{user: id, text: text})
+}
+
+func (*slackApp) code() string {
+	return SlackCode
+}
+
+func (*slackApp) application() Application {
+	return Slack
+}
+
+func (*slackApp) help() string {
+	return slackHelp
+}
+
+const slackHelp = "Мой набор команд включает в себя следующие опции:\n\n" +
+	"VIEW - для просмотра доступных каналов и связанных с ними тем.\n\n" +
+	"ADD <#канал> <слово> [VK/TG/MM/RSS/MAIL/DS/MX/HOOK/GIT] - добавляет указанное слово в список для поиска в конкретном канале, по умолчанию в Slack.\n\n" +
+	"REMOVE <#канал> <слово> [VK/TG/MM/RSS/MAIL/DS/MX/HOOK/GIT] - удаляет указанное слово из списка для поиска в конкретном канале.\n\n" +
+	"PAUSE [длительность/until ЧЧ:ММ] - приостанавливает обновления в боте, например PAUSE 2h или PAUSE until 18:00.\n\n" +
+	"MUTE <#канал> <длительность/until ЧЧ:ММ/off> - приостанавливает обновления из одного канала Slack, например MUTE #general 1d.\n\n" +
+	"CONTINUE - возобновляет поток обновлений в боте после приостановки. Если накопилось много уведомлений, присылает их сводку.\n\n" +
+	"BACKLOG [номер/ALL/DISCARD] - показывает страницу сводки накопившихся уведомлений, все уведомления сразу или удаляет их.\n\n" +
+	"HISTORY [N] - показывает последние N отправленных уведомлений.\n\n" +
+	"POSTS <#канал> [VK/TG/MM/RSS/MAIL/DS/MX/HOOK/GIT] <N> - ищет слова в последних N постах канала, если платформа это позволяет.\n\n" +
+	"COOLDOWN <#канал> <слово> <none/минуты/day> - задаёт минимальный интервал между уведомлениями по слову, day - 24 часа с последнего уведомления.\n\n" +
+	"PRIORITY <#канал> <слово> <high/normal/low> - задаёт приоритет слова: high приходит всегда, даже на паузе и в тихие часы, normal следует вашим настройкам, low приходит только в дайджесте.\n\n" +
+	"NOTIFY <#канал> <слово> [VK/TG/MM/RSS/MAIL/DS/MX/HOOK/GIT] <куда> [куда...] - задаёт, куда присылать уведомления по слову: home (сюда), tg:@имя в Telegram, mm:@имя в Mattermost, mx:@имя:сервер в Matrix, webhook:<url> или email:<адрес>. Каждый адрес, кроме home, нужно сначала подтвердить.\n\n" +
+	"CONFIRM <куда> <код> - подтверждает адрес доставки кодом, который бот отправил туда.\n\n" +
+	"DIGEST [off/hourly/daily ЧЧ:ММ/weekly <mon-sun> ЧЧ:ММ] - собирает уведомления в дайджест по расписанию.\n\n" +
+	"TIMEZONE [часовой пояс] - задаёт часовой пояс для расписаний, например Europe/Moscow.\n\n" +
+	"QUIET [off/ЧЧ:ММ-ЧЧ:ММ] - задаёт тихие часы, уведомления за это время придут после их окончания.\n\n" +
+	"PUBLISH <набор> [топик, ...] - публикует ваши подписки на перечисленные топики, или все, как набор, на который могут подписаться другие.\n\n" +
+	"UNPUBLISH <набор> - удаляет опубликованный набор.\n\n" +
+	"SUBSCRIBE <набор> - подписывает на набор топиков.\n\n" +
+	"UNSUBSCRIBE <набор> - отписывает от набора топиков.\n\n" +
+	"FORGET_ME - удаляет все данные о вас.\n\n" +
+	"Бот видит только каналы, в которых состоит. В открытые каналы он входит сам при ADD."
+
+func (a *slackApp) sendMsg(id, text string) error {
+	if text == "" {
+		return nil
+	}
+	err := a.source.c.postMessage(context.Background(), id, text)
+	if err != nil {
+		log.Printf("can't send a slack message to %s: %s", id, err.Error())
+		return failure(slackFailureClass(err), err)
+	}
+	return nil
+}
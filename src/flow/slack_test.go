@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// slackServer fakes the Web API and a Socket Mode connection of Slack
+// with the channel #general, which the bot has not joined. The socket
+// sends a message of a bot, a direct message and a channel message, and
+// passes the acknowledged envelopes to acks.
+func slackServer(t *testing.T, acks chan string) *slackSource {
+	upgrader := websocket.Upgrader{}
+	general := slackChannel{ID: "C0GENERAL1", Name: "general"}
+	var server *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/", func(w http.ResponseWriter, r *http.Request) {
+		resp := map[string]any{"ok": true}
+		switch strings.TrimPrefix(r.URL.Path, "/api/") {
+		case "auth.test":
+			resp["user_id"], resp["url"] = "UBOT", "https://spbu.slack.com/"
+		case "apps.connections.open":
+			resp["url"] = "ws" + strings.TrimPrefix(server.URL, "http") + "/socket"
+		case "conversations.list":
+			resp["channels"] = []slackChannel{general}
+		case "conversations.info":
+			resp["channel"] = general
+		case "conversations.join":
+			general.IsMember = true
+		default:
+			resp = map[string]any{"ok": false, "error": "unknown_method"}
+		}
+		json.NewEncoder(w).Encode(resp)
+	})
+	mux.HandleFunc("/socket", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		conn.WriteJSON(map[string]any{"type": "hello"})
+		for i, event := range []slackMessage{
+			{Type: "message", ChannelType: "channel", Channel: "C0GENERAL1", BotID: "B1", Text: "экзамен от бота", TS: "1.1"},
+			{Type: "message", ChannelType: "im", Channel: "D0IVAN", User: "U1", Text: "help", TS: "1.2"},
+			{Type: "message", ChannelType: "channel", Channel: "C0GENERAL1", User: "U1", Text: "экзамен", TS: "1700000000.000100"},
+		} {
+			conn.WriteJSON(map[string]any{"envelope_id": "e" + strconv.Itoa(i), "type": "events_api",
+				"payload": map[string]any{"event": event}})
+		}
+		for {
+			var ack struct {
+				EnvelopeID string `json:"envelope_id"`
+			}
+			if err := conn.ReadJSON(&ack); err != nil {
+				return
+			}
+			acks <- ack.EnvelopeID
+		}
+	})
+	server = httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	c := &slackClient{api: server.URL + "/api", token: "xoxb-secret", appToken: "xapp-secret", client: server.Client()}
+	s, err := newSlackSource(context.Background(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSlackSocket(t *testing.T) {
+	acks := make(chan string, 3)
+	s := slackServer(t, acks)
+	events := make(chan workEvent, 3)
+	commands := make(chan string, 1)
+	s.enqueue = func(event workEvent) { events <- event }
+	s.command = func(channel, text string) { commands <- channel + " " + text }
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.listen(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-acks:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d envelopes acknowledged, want 3", i)
+		}
+	}
+	if command := <-commands; command != "D0IVAN help" {
+		t.Errorf("command = %q", command)
+	}
+	if event := <-events; event.link != "https://spbu.slack.com/archives/C0GENERAL1/p1700000000000100" ||
+		len(events) != 0 {
+		t.Errorf("event = %+v, want only the channel message", event)
+	}
+}
+
+func TestSlackResolveChannel(t *testing.T) {
+	s := slackServer(t, nil)
+	if channel, err := s.resolveChannel("#general"); channel != "C0GENERAL1" || err != nil {
+		t.Errorf("resolveChannel(#general) = %q, %v", channel, err)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Source is a platform whose posts are matched against the
+// subscriptions. Sources are registered by the code users type in
+// commands, e.g. TG in /add @channel exam TG.
+type Source interface {
+	// handleUpdates turns the posts of the platform into workEvents for
+	// the pipeline until ctx is done.
+	UpdatesListener
+	// application is the platform as stored in the subscriptions.
+	application() Application
+	// resolveChannel turns a channel name or link given by a user into
+	// the channel as stored in the subscriptions.
+	resolveChannel(link string) (string, error)
+	// channelName returns the name to show for a subscribed channel.
+	channelName(channel string) string
+	// link returns the link to the post of the event.
+	link(event workEvent) string
+	// history passes the latest count posts of the channel to the
+	// pipeline as a history request of the user.
+	history(user, channel string, count int) error
+}
+
+const (
+	TelegramCode   = "TG"
+	VKCode         = "VK"
+	MattermostCode = "MM"
+)
+
+// restrictedSource is a Source whose channels only some users may read.
+type restrictedSource interface {
+	// checkAccess fails with channelAccessError unless the user may read
+	// the channel.
+	checkAccess(user, channel string) error
+}
+
+// sources are the registered sources by code.
+var sources = map[string]Source{}
+
+var (
+	unsupportedPlatformError = errors.New("Неподдерживаемая платформа")
+	historyUnsupportedError  = errors.New("Для этой платформы история недоступна")
+	channelAccessError       = errors.New("Нет доступа к каналу")
+)
+
+// isChannelError tells whether err of resolveChannel is meant for the
+// user rather than the log.
+func isChannelError(err error) bool {
+	for _, target := range []error{
+		unsupportedPlatformError,
+		channelAccessError,
+		wrongFeedError,
+		notFeedError,
+		privateFeedError,
+		mailboxNotFoundError,
+		discordLinkError,
+		discordChannelError,
+		matrixRoomError,
+		matrixForbiddenError,
+		slackChannelError,
+		slackNotMemberError,
+		hookChannelError,
+		wrongRepoError,
+		repoNotFoundError,
+		gitlabHostError,
+		privateRepoError,
+	} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// registerRemoteSources registers the sources the Telegram bot listens
+// to, for another bot to subscribe to their channels, and the Telegram
+// notifier if its token is given.
+func registerRemoteSources() {
+	if token := os.Getenv("TOPIC_KEEPER_TOKEN"); token != "" {
+		var err error
+		if bot, err = tgbotapi.NewBotAPI(token); err != nil {
+			log.Printf("can't log in to telegram: %s", err.Error())
+		} else {
+			notifiers[DestinationTelegram] = telegramNotifier{bot: bot}
+			registerSource(TelegramCode, telegramSource{})
+		}
+	}
+	vkToken = os.Getenv("TOPIC_KEEPER_VK_TOKEN")
+	registerSource(VKCode, vkSource{&vkListener})
+	registerSource(FeedCode, newFeedSource(dataBase))
+	registerSource(MailCode, newMailboxSource(dataBase))
+	registerSource(GitCode, newRepoSource(dataBase))
+	if token := os.Getenv("TOPIC_KEEPER_DISCORD_TOKEN"); token != "" {
+		registerSource(DiscordCode, newDiscordSource(token))
+	}
+	registerMatrix()
+	if hook := newHookSource(); hook != nil {
+		registerSource(HookCode, hook)
+	}
+}
+
+func registerSource(code string, source Source) {
+	sources[code] = source
+}
+
+// sourceCodes returns the codes of the registered sources in order.
+func sourceCodes() []string {
+	codes := make([]string, 0, len(sources))
+	for code := range sources {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+func getSource(code string) (Source, error) {
+	source, found := sources[strings.ToUpper(code)]
+	if !found {
+		return nil, fmt.Errorf("%w. Используйте %s", unsupportedPlatformError, strings.Join(sourceCodes(), ", "))
+	}
+	return source, nil
+}
+
+// resolveChannel turns a channel name or link on platform into the
+// channel identifier stored in subscriptions.
+func resolveChannel(platform, link string) (string, Application, error) {
+	source, err := getSource(platform)
+	if err != nil {
+		return "", "", err
+	}
+	channel, err := source.resolveChannel(link)
+	return channel, source.application(), err
+}
+
+// checkAccess fails with channelAccessError if the channel of the
+// application is restricted and the user may not read it.
+func checkAccess(user string, application Application, channel string) error {
+	for _, source := range sources {
+		if restricted, ok := source.(restrictedSource); ok && source.application() == application {
+			return restricted.checkAccess(user, channel)
+		}
+	}
+	return nil
+}
+
+// channelName returns the name to show for a subscribed channel, the
+// channel itself if its source is not registered.
+func channelName(application Application, channel string) string {
+	for _, source := range sources {
+		if source.application() == application {
+			return source.channelName(channel)
+		}
+	}
+	return channel
+}
+
+// pollLoop polls the subscribed channels of the application every
+// period until ctx is done.
+func pollLoop(ctx context.Context, storage LocalStorage, application Application, period time.Duration,
+	poll func(ctx context.Context, channel string) error) {
+	for {
+		pollSubscribed(ctx, storage, application, poll)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(period):
+		}
+	}
+}
+
+// pollSubscribed polls each subscribed channel of the application once.
+// A channel which fails is logged and the rest are polled still.
+func pollSubscribed(ctx context.Context, storage LocalStorage, application Application,
+	poll func(ctx context.Context, channel string) error) {
+	channels, err := storage.getSubscribedChannels(application)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	for _, channel := range channels {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := poll(ctx, channel); err != nil {
+			log.Printf("can't poll %s channel %s: %s", application, channel, err.Error())
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// memoryStore keeps the states of polled channels in memory. The
+// subscribed channels are the ones with a state.
+type memoryStore[T any] struct {
+	LocalStorage
+	states map[string]T
+	// missing is the error for a channel without a state.
+	missing error
+}
+
+func newMemoryStore[T any]() memoryStore[T] {
+	return memoryStore[T]{states: map[string]T{}, missing: sql.ErrNoRows}
+}
+
+func (s *memoryStore[T]) get(channel string) (T, error) {
+	state, found := s.states[channel]
+	if !found {
+		return state, s.missing
+	}
+	return state, nil
+}
+
+func (s *memoryStore[T]) save(channel string, state T) error {
+	s.states[channel] = state
+	return nil
+}
+
+func (s *memoryStore[T]) getSubscribedChannels(application Application) ([]string, error) {
+	channels := make([]string, 0, len(s.states))
+	for channel := range s.states {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+	return channels, nil
+}
+
+// recordEvents returns an enqueue which records the events passed to
+// the pipeline.
+func recordEvents() (func(workEvent), *[]workEvent) {
+	var events []workEvent
+	return func(event workEvent) { events = append(events, event) }, &events
+}
+
+// stubSource is a source resolving channel names by upper-casing them.
+type stubSource struct {
+	app Application
+}
+
+func (stubSource) handleUpdates(ctx context.Context) {}
+
+func (s stubSource) application() Application {
+	return s.app
+}
+
+func (stubSource) resolveChannel(link string) (string, error) {
+	if link == "" {
+		return "", wrongFmtError
+	}
+	return strings.ToUpper(link), nil
+}
+
+func (stubSource) channelName(channel string) string {
+	return "#" + channel
+}
+
+func (stubSource) link(event workEvent) string {
+	return "stub/" + event.messageID
+}
+
+func (stubSource) history(user, channel string, count int) error {
+	return historyUnsupportedError
+}
+
+// withSources replaces the registered sources for the test.
+func withSources(t *testing.T, registered map[string]Source) {
+	saved := sources
+	sources = registered
+	t.Cleanup(func() { sources = saved })
+}
+
+func TestSourceRegistry(t *testing.T) {
+	withSources(t, map[string]Source{})
+	registerSource("ZZ", stubSource{app: "zz"})
+	registerSource("AA", stubSource{app: "aa"})
+
+	if got, want := sourceCodes(), []string{"AA", "ZZ"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sourceCodes() = %v, want %v", got, want)
+	}
+	if _, err := getSource("aa"); err != nil {
+		t.Errorf("getSource(aa): %v", err)
+	}
+	_, err := getSource("XX")
+	if !errors.Is(err, unsupportedPlatformError) || !strings.Contains(err.Error(), "AA, ZZ") {
+		t.Errorf("getSource(XX) error = %v", err)
+	}
+}
+
+func TestResolveChannel(t *testing.T) {
+	withSources(t, map[string]Source{"AA": stubSource{app: "aa"}})
+
+	channel, application, err := resolveChannel("AA", "news")
+	if channel != "NEWS" || application != "aa" || err != nil {
+		t.Errorf("resolveChannel = %q, %q, %v", channel, application, err)
+	}
+	if _, _, err := resolveChannel("AA", ""); err != wrongFmtError {
+		t.Errorf("resolveChannel of empty link error = %v", err)
+	}
+	if _, _, err := resolveChannel("BB", "news"); !errors.Is(err, unsupportedPlatformError) {
+		t.Errorf("resolveChannel on unknown platform error = %v", err)
+	}
+	if got := channelName("aa", "NEWS"); got != "#NEWS" {
+		t.Errorf("channelName = %q", got)
+	}
+	if got := channelName("bb", "NEWS"); got != "NEWS" {
+		t.Errorf("channelName of unregistered source = %q", got)
+	}
+}
+
+func TestTelegramLink(t *testing.T) {
+	for _, tt := range []struct {
+		event workEvent
+		want  string
+	}{
+		{workEvent{channel: "spbu_news", channelID: "-1001234", messageID: "7"}, "https://t.me/spbu_news/7"},
+		{workEvent{channel: "Кафедра", channelID: "1234", messageID: "7"}, "https://t.me/c/1234/7"},
+	} {
+		if got := (telegramSource{}).link(tt.event); got != tt.want {
+			t.Errorf("link(%+v) = %q, want %q", tt.event, got, tt.want)
+		}
+	}
+}
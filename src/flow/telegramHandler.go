@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"strconv"
@@ -17,6 +18,8 @@ const (
 type TelegramHandler struct {
 	keyBoard tgbotapi.ReplyKeyboardMarkup
 	updates  tgbotapi.UpdatesChannel
+	// enqueue passes an event to the pipeline.
+	enqueue func(workEvent)
 }
 
 func newTelegramHandler(b *tgbotapi.BotAPI) *TelegramHandler {
@@ -32,117 +35,241 @@ func newTelegramHandler(b *tgbotapi.BotAPI) *TelegramHandler {
 			tgbotapi.NewKeyboardButton("/help"),
 		),
 	)
-	return &TelegramHandler{keyBoard, updates}
-}
-
-func (t *TelegramHandler) handleUpdates() {
-	for update := range t.updates {
-		switch {
-		case update.ChannelPost != nil:
-			if update.ChannelPost.Chat.UserName != "" {
-				hsh := getHash(update.ChannelPost.Chat.UserName)
-				w := workEvent{
-					application:    Telegram,
-					channel:        update.ChannelPost.Chat.UserName,
-					channelID:      strconv.FormatInt(update.ChannelPost.Chat.ID, 10),
-					text:           update.ChannelPost.Text,
-					messageID:      strconv.Itoa(update.ChannelPost.MessageID),
-					historyRequest: nil,
-				}
-				w.link = createPublicLink(w)
-				workChans[hsh%NWorkers] <- w
-			} else {
-				hsh := getHash(update.ChannelPost.Chat.Title)
-				w := workEvent{
-					application:    Telegram,
-					channel:        update.ChannelPost.Chat.Title,
-					channelID:      getPrivateID(update.ChannelPost.Chat.ID),
-					text:           update.ChannelPost.Text,
-					messageID:      strconv.Itoa(update.ChannelPost.MessageID),
-					historyRequest: nil,
-				}
-				w.link = createPrivateLink(w)
-				workChans[hsh%NWorkers] <- w
-			}
-		case update.Message != nil:
-			if update.Message.Chat.IsSuperGroup() {
-				if update.Message.Chat.UserName != "" {
-					hsh := getHash(update.Message.Chat.UserName)
-					w := workEvent{
-						application:    Telegram,
-						channel:        update.Message.Chat.UserName,
-						channelID:      strconv.FormatInt(update.Message.Chat.ID, 10),
-						text:           update.Message.Text,
-						messageID:      update.Message.Text,
-						historyRequest: nil,
-					}
-					w.link = createPublicLink(w)
-					workChans[hsh%NWorkers] <- w
-				} else {
-					hsh := getHash(update.Message.Chat.Title)
-					w := workEvent{
-						application:    Telegram,
-						channel:        update.Message.Chat.Title,
-						channelID:      getPrivateID(update.Message.Chat.ID),
-						text:           update.Message.Text,
-						messageID:      update.Message.Text,
-						historyRequest: nil,
-					}
-					w.link = createPrivateLink(w)
-					workChans[hsh%NWorkers] <- w
-				}
+	return &TelegramHandler{keyBoard: keyBoard, updates: updates, enqueue: enqueueEvent}
+}
+
+func (t *TelegramHandler) handleUpdates(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			bot.StopReceivingUpdates()
+			return
+		case update, ok := <-t.updates:
+			if !ok {
 				return
 			}
+			t.handleUpdate(update)
+		}
+	}
+}
 
-			msg := tgbotapi.NewMessage(update.Message.Chat.ID, "")
-			msg.ReplyMarkup = t.keyBoard
-			_, err := bot.Send(msg)
-			if err != nil {
-				log.Println(err.Error())
-			}
+func (t *TelegramHandler) handleUpdate(update tgbotapi.Update) {
+	switch {
+	case update.CallbackQuery != nil:
+		handleBacklogCallback(update.CallbackQuery)
+	case update.ChannelPost != nil:
+		t.handlePost(update.ChannelPost, false)
+	case update.EditedChannelPost != nil:
+		t.handlePost(update.EditedChannelPost, true)
+	case update.EditedMessage != nil:
+		if update.EditedMessage.Chat.IsSuperGroup() {
+			t.handlePost(update.EditedMessage, true)
+		}
+	case update.Message != nil:
+		if update.Message.Chat.IsSuperGroup() {
+			t.handlePost(update.Message, false)
+			return
+		}
 
-			updText := strings.Trim(update.Message.Text, "\n ")
-			uname := update.Message.Chat.UserName
-			err = dataBase.addUser(uname, update.Message.Chat.ID)
-			if err != nil {
-				log.Println(err.Error())
-				return
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID, "")
+		msg.ReplyMarkup = t.keyBoard
+		_, err := bot.Send(msg)
+		if err != nil {
+			log.Println(err.Error())
+		}
+
+		updText := strings.Trim(update.Message.Text, "\n ")
+		uname := update.Message.Chat.UserName
+		err = dataBase.addUser(uname, update.Message.Chat.ID, Telegram)
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+
+		if update.Message.Document != nil {
+			if strings.HasPrefix(update.Message.Caption, "/import") {
+				handleImport(uname, update.Message.Document)
+			} else {
+				handleUnknownCommand(uname)
 			}
+			return
+		}
 
-			switch updText {
-			case "/start":
-				handleStart(uname)
-			case "/view":
-				handleView(uname)
-			case "/help":
-				handleHelp(uname)
-			case "/pause":
-				handlePause(uname)
-			case "/continue":
-				handleContinue(uname)
-			default:
-				if strings.HasPrefix(updText, "/add") {
-					handleAdd(uname, updText)
-				} else if strings.HasPrefix(updText, "/removeChannel") {
-					handleRemoveChannel(uname, updText)
-				} else if strings.HasPrefix(updText, "/historyVK") {
-					HandlegetHistoryVK(uname, updText)
-				} else if strings.HasPrefix(updText, "/remove") {
-					handleRemoveTopic(uname, updText)
-				} else {
-					handleUnknownCommand(uname)
+		switch updText {
+		case "/start":
+			handleStart(uname)
+		case "/view":
+			handleView(uname)
+		case "/help":
+			handleHelp(uname)
+		case "/continue":
+			handleContinue(uname)
+		case "/export_my_data":
+			handleExportMyData(uname)
+		case "/import":
+			handleImport(uname, nil)
+		default:
+			if strings.HasPrefix(updText, "/add") {
+				handleAdd(uname, updText)
+			} else if strings.HasPrefix(updText, "/notify") {
+				handleNotify(uname, updText)
+			} else if strings.HasPrefix(updText, "/confirm") {
+				handleConfirm(uname, updText)
+			} else if strings.HasPrefix(updText, "/priority") {
+				handlePriority(uname, updText)
+			} else if strings.HasPrefix(updText, "/pause") {
+				handlePause(uname, updText)
+			} else if strings.HasPrefix(updText, "/mute") {
+				handleMute(uname, updText)
+			} else if strings.HasPrefix(updText, "/digest") {
+				handleDigest(uname, updText)
+			} else if strings.HasPrefix(updText, "/timezone") {
+				handleTimezone(uname, updText)
+			} else if strings.HasPrefix(updText, "/quiet") {
+				handleQuiet(uname, updText)
+			} else if strings.HasPrefix(updText, "/publish") {
+				handlePublish(uname, updText)
+			} else if strings.HasPrefix(updText, "/unpublish") {
+				handleUnpublish(uname, updText)
+			} else if strings.HasPrefix(updText, "/subscribe") {
+				handleSubscribe(uname, updText)
+			} else if strings.HasPrefix(updText, "/unsubscribe") {
+				handleUnsubscribe(uname, updText)
+			} else if strings.HasPrefix(updText, "/export") {
+				handleExport(uname, updText)
+			} else if strings.HasPrefix(updText, "/forget_me") {
+				handleForgetMe(uname, updText)
+			} else if strings.HasPrefix(updText, "/cooldown") {
+				handleCooldown(uname, updText)
+			} else if strings.HasPrefix(updText, "/removeChannel") {
+				handleRemoveChannel(uname, updText)
+			} else if strings.HasPrefix(updText, "/mailbox") {
+				handleMailbox(uname, updText)
+				// The command holds the password of the mailbox.
+				if _, err := bot.Request(tgbotapi.NewDeleteMessage(update.Message.Chat.ID, update.Message.MessageID)); err != nil {
+					log.Println(err.Error())
 				}
+			} else if strings.HasPrefix(updText, "/share") {
+				handleShareMailbox(uname, updText, true)
+			} else if strings.HasPrefix(updText, "/unshare") {
+				handleShareMailbox(uname, updText, false)
+			} else if strings.HasPrefix(updText, "/posts") {
+				handlePosts(uname, updText)
+			} else if strings.HasPrefix(updText, "/historyVK") {
+				HandlegetHistoryVK(uname, updText)
+			} else if strings.HasPrefix(updText, "/deadletters") {
+				handleDeadLetters(uname, updText)
+			} else if strings.HasPrefix(updText, "/replay") {
+				handleReplay(uname, updText)
+			} else if strings.HasPrefix(updText, "/history") {
+				handleHistory(uname, updText)
+			} else if strings.HasPrefix(updText, "/remove") {
+				handleRemoveTopic(uname, updText)
+			} else {
+				handleUnknownCommand(uname)
 			}
 		}
 	}
 }
 
+// handlePost passes a post of a channel or a supergroup to the pipeline.
+// Posts without text, e.g. stickers, are skipped.
+func (t *TelegramHandler) handlePost(post *tgbotapi.Message, edited bool) {
+	w := postEvent(post, edited)
+	if w.text == "" {
+		return
+	}
+	t.enqueue(w)
+}
+
+// postEvent makes the event of a post. Public chats are keyed by their
+// name, private ones by their title.
+func postEvent(post *tgbotapi.Message, edited bool) workEvent {
+	w := workEvent{
+		application:   Telegram,
+		channel:       post.Chat.UserName,
+		key:           post.Chat.UserName,
+		channelID:     strconv.FormatInt(post.Chat.ID, 10),
+		text:          postText(post),
+		messageID:     strconv.Itoa(post.MessageID),
+		edited:        edited,
+		forwardedFrom: forwardOrigin(post),
+	}
+	if post.Chat.UserName == "" {
+		w.channel = post.Chat.Title
+		w.key = post.Chat.Title
+		w.channelID = getPrivateID(post.Chat.ID)
+	}
+	w.link = telegramSource{}.link(w)
+	return w
+}
+
+// postText returns the text of a post, which is the caption for a
+// photo, a video or a document.
+func postText(post *tgbotapi.Message) string {
+	if post.Text != "" {
+		return post.Text
+	}
+	return post.Caption
+}
+
+// forwardOrigin returns where a forwarded post comes from, empty if it
+// is not forwarded.
+func forwardOrigin(post *tgbotapi.Message) string {
+	switch {
+	case post.ForwardFromChat != nil && post.ForwardFromChat.UserName != "":
+		return "@" + post.ForwardFromChat.UserName
+	case post.ForwardFromChat != nil:
+		return post.ForwardFromChat.Title
+	case post.ForwardFrom != nil && post.ForwardFrom.UserName != "":
+		return "@" + post.ForwardFrom.UserName
+	case post.ForwardFrom != nil:
+		return strings.TrimSpace(post.ForwardFrom.FirstName + " " + post.ForwardFrom.LastName)
+	}
+	return post.ForwardSenderName
+}
+
 func getPrivateID(id int64) string {
 	ID := strconv.FormatInt(id, 10)
 	s, _ := strings.CutPrefix(ID, "-100")
 	return s
 }
 
+// telegramSource reads the channels and supergroups the bot is added to.
+type telegramSource struct {
+	handler *TelegramHandler
+}
+
+func (s telegramSource) handleUpdates(ctx context.Context) {
+	s.handler.handleUpdates(ctx)
+}
+
+func (telegramSource) application() Application {
+	return Telegram
+}
+
+func (telegramSource) resolveChannel(link string) (string, error) {
+	return parseChannelName(link)
+}
+
+func (telegramSource) channelName(channel string) string {
+	return channel
+}
+
+// link returns the link to the post by the name of a public chat, whose
+// full id starts with a minus, or by the short id of a private one.
+func (telegramSource) link(event workEvent) string {
+	if strings.HasPrefix(event.channelID, "-") {
+		return createPublicLink(event)
+	}
+	return createPrivateLink(event)
+}
+
+// history is not available: bots can't read the history of a chat.
+func (telegramSource) history(user, channel string, count int) error {
+	return historyUnsupportedError
+}
+
 func createPrivateLink(w workEvent) string {
 	return fmt.Sprintf(privateLinkTelegram, w.channelID, w.messageID)
 }
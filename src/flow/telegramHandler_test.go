@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// telegramUpdates are updates as the Bot API sends them.
+var telegramUpdates = map[string]string{
+	"channel post": `{"update_id": 1, "channel_post": {"message_id": 10, "date": 1709294400,
+		"chat": {"id": -1001234567890, "title": "Новости СПбГУ", "username": "spbu_news", "type": "channel"},
+		"text": "Экзамен перенесён"}}`,
+	"photo caption": `{"update_id": 2, "channel_post": {"message_id": 11, "date": 1709294400,
+		"chat": {"id": -1001234567890, "title": "Новости СПбГУ", "username": "spbu_news", "type": "channel"},
+		"photo": [{"file_id": "AgAD", "file_unique_id": "AQAD", "width": 90, "height": 90}],
+		"caption": "Расписание экзаменов"}}`,
+	"document caption in a private supergroup": `{"update_id": 3, "message": {"message_id": 12, "date": 1709294400,
+		"from": {"id": 5, "is_bot": false, "first_name": "Анна"},
+		"chat": {"id": -1009876543210, "title": "Матмех 3 курс", "type": "supergroup"},
+		"document": {"file_id": "BQAD", "file_unique_id": "AgAD", "file_name": "deadlines.pdf"},
+		"caption": "Дедлайны"}}`,
+	"edited channel post": `{"update_id": 4, "edited_channel_post": {"message_id": 10, "date": 1709294400,
+		"edit_date": 1709294500,
+		"chat": {"id": -1001234567890, "title": "Новости СПбГУ", "username": "spbu_news", "type": "channel"},
+		"text": "Экзамен перенесён, дедлайн тоже"}}`,
+	"edited supergroup message": `{"update_id": 5, "edited_message": {"message_id": 12, "date": 1709294400,
+		"edit_date": 1709294500, "from": {"id": 5, "is_bot": false, "first_name": "Анна"},
+		"chat": {"id": -1009876543210, "title": "Матмех 3 курс", "type": "supergroup"},
+		"text": "Дедлайны сдвинуты"}}`,
+	"forwarded from a channel": `{"update_id": 6, "channel_post": {"message_id": 13, "date": 1709294400,
+		"chat": {"id": -1001234567890, "title": "Новости СПбГУ", "username": "spbu_news", "type": "channel"},
+		"forward_from_chat": {"id": -1001111111111, "title": "Деканат", "username": "dekanat", "type": "channel"},
+		"forward_date": 1709290000, "text": "Сессия"}}`,
+	"forwarded from a hidden user": `{"update_id": 7, "channel_post": {"message_id": 14, "date": 1709294400,
+		"chat": {"id": -1001234567890, "title": "Новости СПбГУ", "username": "spbu_news", "type": "channel"},
+		"forward_sender_name": "Иван Петров", "forward_date": 1709290000, "text": "Сессия"}}`,
+	"sticker": `{"update_id": 8, "channel_post": {"message_id": 15, "date": 1709294400,
+		"chat": {"id": -1001234567890, "title": "Новости СПбГУ", "username": "spbu_news", "type": "channel"},
+		"sticker": {"file_id": "CAAD", "file_unique_id": "AgAD", "width": 512, "height": 512,
+			"is_animated": false, "is_video": false, "type": "regular"}}}`,
+}
+
+func handleTelegramUpdate(t *testing.T, name string) []workEvent {
+	t.Helper()
+	var update tgbotapi.Update
+	if err := json.Unmarshal([]byte(telegramUpdates[name]), &update); err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	var events []workEvent
+	handler := &TelegramHandler{enqueue: func(event workEvent) { events = append(events, event) }}
+	handler.handleUpdate(update)
+	return events
+}
+
+func TestTelegramHandlerPosts(t *testing.T) {
+	for _, tt := range []struct {
+		update string
+		want   workEvent
+	}{
+		{"channel post", workEvent{channel: "spbu_news", key: "spbu_news", channelID: "-1001234567890",
+			text: "Экзамен перенесён", link: "https://t.me/spbu_news/10", messageID: "10"}},
+		{"photo caption", workEvent{channel: "spbu_news", key: "spbu_news", channelID: "-1001234567890",
+			text: "Расписание экзаменов", link: "https://t.me/spbu_news/11", messageID: "11"}},
+		{"document caption in a private supergroup", workEvent{channel: "Матмех 3 курс", key: "Матмех 3 курс",
+			channelID: "9876543210", text: "Дедлайны", link: "https://t.me/c/9876543210/12", messageID: "12"}},
+		{"edited channel post", workEvent{channel: "spbu_news", key: "spbu_news", channelID: "-1001234567890",
+			text: "Экзамен перенесён, дедлайн тоже", link: "https://t.me/spbu_news/10", messageID: "10", edited: true}},
+		{"edited supergroup message", workEvent{channel: "Матмех 3 курс", key: "Матмех 3 курс",
+			channelID: "9876543210", text: "Дедлайны сдвинуты", link: "https://t.me/c/9876543210/12", messageID: "12", edited: true}},
+		{"forwarded from a channel", workEvent{channel: "spbu_news", key: "spbu_news", channelID: "-1001234567890",
+			text: "Сессия", link: "https://t.me/spbu_news/13", messageID: "13", forwardedFrom: "@dekanat"}},
+		{"forwarded from a hidden user", workEvent{channel: "spbu_news", key: "spbu_news", channelID: "-1001234567890",
+			text: "Сессия", link: "https://t.me/spbu_news/14", messageID: "14", forwardedFrom: "Иван Петров"}},
+	} {
+		events := handleTelegramUpdate(t, tt.update)
+		tt.want.application = Telegram
+		if len(events) != 1 || events[0] != tt.want {
+			t.Errorf("%s: events = %+v, want %+v", tt.update, events, tt.want)
+		}
+	}
+}
+
+func TestTelegramHandlerSkipsPostsWithoutText(t *testing.T) {
+	if events := handleTelegramUpdate(t, "sticker"); len(events) != 0 {
+		t.Errorf("events = %+v, want none", events)
+	}
+}
@@ -1,37 +1,86 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
+	"sync"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
 
-func tgMain() int {
+// tgMain runs the Telegram bot until ctx is done and then drains the
+// pipeline until hardCtx is.
+func tgMain(ctx, hardCtx context.Context) int {
 	var err error
 	token := os.Getenv("TOPIC_KEEPER_TOKEN")
-	openAIkey = os.Getenv("TOPIC_KEEPER_OPENAI_TOKEN")
 	vkToken = os.Getenv("TOPIC_KEEPER_VK_TOKEN")
 
 	bot, err = tgbotapi.NewBotAPI(token)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
-	if openAIkey != "" {
-		log.Printf("using openAI summarizer with key: %s", openAIkey)
-	}
 	setBotCommands(bot)
+
+	// Notifications may also go to Mattermost, and its channels may be
+	// subscribed to, if it is configured.
+	notifiers[DestinationTelegram] = telegramNotifier{bot: bot}
+	registerNotifiers()
+	if os.Getenv("MM_SERVER") != "" {
+		if mm, err := connectMattermost(loadConfig()); err != nil {
+			log.Printf("can't connect to mattermost: %s", err.Error())
+		} else {
+			notifiers[DestinationMattermost] = mm
+			registerSource(MattermostCode, mattermostSource{newApplication(loadConfig(), mm)})
+		}
+	}
 	bot.Debug = true
 	log.Printf("Authorized on account: %s\n", bot.Self.UserName)
 
-	api = basicAPI{}
+	vkListener = VKHandler{accessToken: vkToken}
+	registerSource(TelegramCode, telegramSource{newTelegramHandler(bot)})
+	registerSource(VKCode, vkSource{&vkListener})
+	registerSource(FeedCode, newFeedSource(dataBase))
+	registerSource(MailCode, newMailboxSource(dataBase))
+	registerSource(GitCode, newRepoSource(dataBase))
+	listened := []string{TelegramCode, VKCode, FeedCode, MailCode, GitCode}
+	if token := os.Getenv("TOPIC_KEEPER_DISCORD_TOKEN"); token != "" {
+		registerSource(DiscordCode, newDiscordSource(token))
+		listened = append(listened, DiscordCode)
+	}
+	if registerMatrix() != nil {
+		listened = append(listened, MatrixCode)
+	}
+	if hook := newHookSource(); hook != nil {
+		registerSource(HookCode, hook)
+		listened = append(listened, HookCode)
+	}
+	registerSlack()
 
-	telegramListener = newTelegramHandler(bot)
-	go telegramListener.handleUpdates()
+	// Mattermost and Slack are listened to by their own processes.
+	var listeners sync.WaitGroup
+	for _, code := range listened {
+		source := sources[code]
+		listeners.Add(1)
+		go func() {
+			defer listeners.Done()
+			source.handleUpdates(ctx)
+		}()
+	}
 
-	vkListener = VKHandler{accessToken: vkToken}
-	go vkListener.handleUpdates()
+	listeners.Add(1)
+	go func() {
+		defer listeners.Done()
+		queuePoller(ctx)
+	}()
+
+	go scheduler(ctx, Telegram, sendText, flushBacklog, schedulerPeriod)
+
+	senderDone := startSender(hardCtx)
 
-	sender()
-	return 0
+	<-ctx.Done()
+	return drain(hardCtx, senderDone, func() {
+		listeners.Wait()
+		vkListener.stop()
+	})
 }
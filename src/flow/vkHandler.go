@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,7 +10,9 @@ import (
 	"net/http"
 	"reflect"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -57,51 +60,81 @@ type UserHistory struct {
 type VKHandler struct {
 	accessToken       string
 	groupSegmentation map[int][]string
+	// running tracks the goroutines started by handleUpdates.
+	running sync.WaitGroup
 }
 
-func (vk *VKHandler) handleUpdates() {
-	groups, err := dataBase.getVKPublic()
-	if err != nil {
-		log.Println(err.Error())
-	}
-
-	for _, group := range groups {
-		vk.initLastPostID(group, vk.accessToken)
-	}
-
+// handleUpdates starts polling the VK publics until ctx is done. It does
+// not block; stop waits for the started goroutines.
+func (vk *VKHandler) handleUpdates(ctx context.Context) {
 	VKChans = make([]chan []string, VKNWorkers)
 	for i := 0; i < VKNWorkers; i++ {
-		VKChans[i] = make(chan []string)
-		go vkWorker(VKChans[i])
+		groups := make(chan []string)
+		VKChans[i] = groups
+		vk.run(func() { vkWorker(ctx, groups) })
 	}
 
 	VKHistoryChans = make([]chan UserHistory, VKNHistoryWorkers)
 	for i := 0; i < VKNHistoryWorkers; i++ {
-		VKHistoryChans[i] = make(chan UserHistory)
-		go vkHistoryWorker(VKHistoryChans[i])
+		requests := make(chan UserHistory)
+		VKHistoryChans[i] = requests
+		vk.run(func() { vkHistoryWorker(requests) })
 	}
 
 	segmentation := make(map[int][]string)
 
 	vk.groupSegmentation = segmentation
 
-	go vk.refreshGroups(time.Second * 60)
+	vk.run(func() {
+		groups, err := dataBase.getVKPublic()
+		if err != nil {
+			log.Println(err.Error())
+		}
+
+		for _, group := range groups {
+			vk.initLastPostID(group, vk.accessToken)
+		}
+
+		vk.refreshGroups(ctx, time.Second*60)
+	})
+}
+
+func (vk *VKHandler) run(fn func()) {
+	vk.running.Add(1)
+	go func() {
+		defer vk.running.Done()
+		fn()
+	}()
 }
 
-func vkWorker(groups chan []string) {
+// stop closes VKHistoryChans and waits for the goroutines started by
+// handleUpdates. The context passed to it must be done and nothing may
+// be sent to VKHistoryChans afterwards.
+func (vk *VKHandler) stop() {
+	for _, historyChan := range VKHistoryChans {
+		close(historyChan)
+	}
+	vk.running.Wait()
+}
+
+func vkWorker(ctx context.Context, groups chan []string) {
 	curGroups := make([]string, 0)
 	for {
 		select {
 		case curGroups = <-groups:
+		case <-ctx.Done():
+			return
 		default:
 		}
 
 		for _, group := range curGroups {
+			if ctx.Err() != nil {
+				return
+			}
 			posts := fetchPosts(group)
 			if posts == nil {
 				continue
 			}
-			hsh := getHash(group) % NWorkers
 			for _, post := range posts {
 				groupName, err := dataBase.getVKPublicNameByID(group)
 				if err != nil {
@@ -112,48 +145,116 @@ func vkWorker(groups chan []string) {
 					application:    VK,
 					channel:        groupName,
 					channelID:      group,
+					key:            group,
 					text:           post.Text,
 					link:           post.URL,
-					messageID:      string(rune(post.ID)),
+					messageID:      strconv.Itoa(post.ID),
 					historyRequest: nil,
 				}
-				workChans[hsh] <- msg
+				enqueueEvent(msg)
 			}
 		}
 
-		time.Sleep(time.Second * 60)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second * 60):
+		}
 	}
 }
 
 func vkHistoryWorker(historyRequestChan chan UserHistory) {
 	for request := range historyRequestChan {
-
-		count := fmt.Sprintf("%d", request.postsCount)
-
-		posts, err := getLatestPosts(request.publicID, count)
-		if err != nil {
+		if err := fetchVKHistory(request); err != nil {
 			log.Println(err.Error())
-			continue
 		}
+	}
+}
 
-		hsh := getHash(request.publicName) % NWorkers
-
-		for _, post := range posts {
-			workChans[hsh] <- workEvent{
-				application:    VK,
-				channel:        request.publicName,
-				channelID:      request.publicID,
-				text:           post.Text,
-				link:           fmt.Sprintf(VKPostLink, request.publicID, post.ID),
-				messageID:      fmt.Sprintf("%d", post.ID),
-				historyRequest: &historyRequest{request.user},
-			}
+// fetchVKHistory passes the latest posts of the public of request to the
+// pipeline.
+func fetchVKHistory(request UserHistory) error {
+	count := fmt.Sprintf("%d", request.postsCount)
 
-		}
+	posts, err := getLatestPosts(request.publicID, count)
+	if err != nil {
+		return err
+	}
+
+	for _, post := range posts {
+		enqueueEvent(workEvent{
+			application:    VK,
+			channel:        request.publicName,
+			channelID:      request.publicID,
+			key:            request.publicID,
+			text:           post.Text,
+			link:           fmt.Sprintf(VKPostLink, request.publicID, post.ID),
+			messageID:      fmt.Sprintf("%d", post.ID),
+			historyRequest: &historyRequest{request.user},
+		})
+	}
+	return nil
+}
+
+// vkSource reads the walls of the subscribed VK publics.
+type vkSource struct {
+	handler *VKHandler
+}
+
+// handleUpdates polls the publics until ctx is done. The goroutines of
+// the handler are waited for by its stop.
+func (s vkSource) handleUpdates(ctx context.Context) {
+	s.handler.handleUpdates(ctx)
+	<-ctx.Done()
+}
+
+func (vkSource) application() Application {
+	return VK
+}
+
+// resolveChannel returns the id of the public of link and remembers its
+// name, which the listener needs for every subscribed public.
+func (vkSource) resolveChannel(link string) (string, error) {
+	name, objectType, id, err := getVKInfo(link, vkToken)
+	if err != nil {
+		return "", err
+	}
+	if objectType != "group" {
+		return "", errors.New("Resolved object is not a group")
+	}
+	groupID := fmt.Sprintf("%d", id)
+	return groupID, dataBase.addVKPublic(name, groupID, 0)
+}
+
+func (vkSource) channelName(channel string) string {
+	if name, err := dataBase.getVKPublicNameByID(channel); err == nil {
+		return name
+	}
+	return channel
+}
+
+func (vkSource) link(event workEvent) string {
+	id, _ := strconv.Atoi(event.messageID)
+	return fmt.Sprintf(VKPostLink, event.channelID, id)
+}
+
+// history fetches the posts by the history workers if the listener runs
+// and right away otherwise.
+func (s vkSource) history(user, channel string, count int) error {
+	request := UserHistory{
+		user:       user,
+		publicID:   channel,
+		postsCount: count,
+		publicName: s.channelName(channel),
 	}
+	if len(VKHistoryChans) == 0 {
+		return fetchVKHistory(request)
+	}
+	VKHistoryChans[getHash(request.publicName)%VKNHistoryWorkers] <- request
+	return nil
 }
 
-func (vk *VKHandler) refreshGroups(period time.Duration) {
+func (vk *VKHandler) refreshGroups(ctx context.Context, period time.Duration) {
 	curGroups, err := dataBase.getVKPublic()
 	log.Println(curGroups)
 	if err != nil {
@@ -173,11 +274,18 @@ func (vk *VKHandler) refreshGroups(period time.Duration) {
 		was := vk.groupSegmentation[i]
 		sort.Strings(was)
 		if !reflect.DeepEqual(was, cur) {
-			VKChans[i] <- cur
+			select {
+			case VKChans[i] <- cur:
+			case <-ctx.Done():
+				return
+			}
 		}
 	}
 
-	time.Sleep(period)
+	select {
+	case <-ctx.Done():
+	case <-time.After(period):
+	}
 }
 
 func (vk *VKHandler) initLastPostID(groupID, accessToken string) {